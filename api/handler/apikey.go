@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyHandler struct {
+	service service.APIKeyService
+	policy  *authz.Policy
+	logger  *logger.Logger
+}
+
+func NewAPIKeyHandler(service service.APIKeyService, policy *authz.Policy, logger *logger.Logger) *APIKeyHandler {
+	return &APIKeyHandler{
+		service: service,
+		policy:  policy,
+		logger:  logger,
+	}
+}
+
+// CreateAPIKey creates a key and returns it in full. This is the only time
+// the secret part of the key is shown.
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var input model.APIKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userRole, identity, ok := caller(c)
+	if !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	createdBy := identity
+	if createdBy == "" {
+		createdBy = string(userRole)
+	}
+
+	key, err := h.service.CreateAPIKey(c.Request.Context(), input, middleware.Grants(c, h.policy), createdBy)
+	if err != nil {
+		var validationErr *service.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+		h.logger.Error("Failed to create API key", "error", err, "name", input.Name)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, key)
+}
+
+func (h *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	keys, err := h.service.ListAPIKeys(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to list API keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := h.service.RevokeAPIKey(c.Request.Context(), id); err != nil {
+		if errors.Is(err, service.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		h.logger.Error("Failed to revoke API key", "error", err, "id", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
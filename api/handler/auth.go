@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuthHandler struct {
+	config      *config.Config
+	keys        *jwtkeys.KeySet
+	service     service.MailboxService
+	authService service.AuthService
+	policy      *authz.Policy
+	logger      *logger.Logger
+}
+
+func NewAuthHandler(cfg *config.Config, keys *jwtkeys.KeySet, service service.MailboxService, authService service.AuthService, policy *authz.Policy, logger *logger.Logger) *AuthHandler {
+	return &AuthHandler{
+		config:      cfg,
+		keys:        keys,
+		service:     service,
+		authService: authService,
+		policy:      policy,
+		logger:      logger,
+	}
+}
+
+// Login exchanges a username and password for an access token and a refresh
+// token.
+func (h *AuthHandler) Login(c *gin.Context) {
+	var request model.LoginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	credential, err := h.authService.Authenticate(c.Request.Context(), request.Username, request.Password)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+			return
+		}
+		h.logger.Error("Failed to authenticate", "error", err, "username", request.Username)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	refreshToken, err := h.authService.IssueRefreshToken(c.Request.Context(), credential.Username)
+	if err != nil {
+		h.logger.Error("Failed to issue refresh token", "error", err, "username", credential.Username)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	h.respondWithTokens(c, credential, refreshToken)
+}
+
+// Refresh exchanges a refresh token for a new token pair. The presented
+// refresh token is revoked.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var request model.RefreshRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	credential, refreshToken, err := h.authService.RotateRefreshToken(c.Request.Context(), request.RefreshToken)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidRefreshToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+			return
+		}
+		h.logger.Error("Failed to refresh token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	h.respondWithTokens(c, credential, refreshToken)
+}
+
+// Logout revokes the access token used for the request and, if one is given
+// in the body, the refresh token.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	value, _ := c.Get(middleware.ContextClaims)
+	claims, ok := value.(*middleware.Claims)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only token sessions can log out"})
+		return
+	}
+
+	var request model.RefreshRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	// Tokens from an external provider without a jti cannot be revoked here
+	if claims.ID != "" {
+		if err := h.authService.RevokeAccessToken(c.Request.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+			h.logger.Error("Failed to revoke access token", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+
+	if request.RefreshToken != "" {
+		if err := h.authService.RevokeRefreshToken(c.Request.Context(), request.RefreshToken); err != nil {
+			h.logger.Error("Failed to revoke refresh token", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// CreateCredential stores a login for a role defined by the policy,
+// optionally bound to a mailbox.
+func (h *AuthHandler) CreateCredential(c *gin.Context) {
+	var input model.CredentialInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !h.policy.HasRole(authz.Role(input.Role)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	credential, err := h.authService.CreateCredential(c.Request.Context(), input)
+	if err != nil {
+		var validationErr *service.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+		case errors.Is(err, service.ErrCredentialExists):
+			c.JSON(http.StatusConflict, gin.H{"error": "Credential already exists"})
+		default:
+			h.logger.Error("Failed to create credential", "error", err, "username", input.Username)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create credential"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, credential)
+}
+
+func (h *AuthHandler) respondWithTokens(c *gin.Context, credential *model.Credential, refreshToken string) {
+	accessToken, err := middleware.GenerateToken(h.config, h.keys, authz.Role(credential.Role), credential.MailboxIdentifier)
+	if err != nil {
+		h.logger.Error("Failed to generate token", "error", err, "username", credential.Username)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    h.config.Auth.TokenExpiry * 60,
+	})
+}
+
+// IssueToken mints a token for the role in the path without checking any
+// credentials. It is only routed in development mode. The token is bound to
+// the mailbox given in the "mailbox" query parameter or, if that is missing,
+// to the first mailbox whose job title matches the role name. Only roles that
+// can read every mailbox may have a token without a mailbox.
+func (h *AuthHandler) IssueToken(c *gin.Context) {
+	role := authz.Role(c.Param("role"))
+	if !h.policy.HasRole(role) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	identifier := c.Query("mailbox")
+
+	if identifier == "" {
+		mailbox, err := h.service.GetMailboxByJobTitle(c.Request.Context(), string(role))
+		if err != nil {
+			h.logger.Error("Failed to find mailbox for role", "error", err, "role", role)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		if mailbox != nil {
+			identifier = mailbox.Identifier
+		}
+	}
+
+	if identifier == "" && !h.policy.Can(role, authz.PermMailboxReadAll) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mailbox query parameter is required"})
+		return
+	}
+
+	token, err := middleware.GenerateToken(h.config, h.keys, role, identifier)
+	if err != nil {
+		h.logger.Error("Failed to generate token", "error", err, "role", role)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+// JWKS publishes the public keys that verify access tokens. Retired keys stay
+// in the set until they are removed from the key directory.
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
+
+// Me returns the caller's role, the mailbox their token is bound to and the
+// scope that applies to the mailbox endpoints.
+func (h *AuthHandler) Me(c *gin.Context) {
+	userRole, identity, ok := caller(c)
+	if !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	grants := middleware.Grants(c, h.policy)
+	response := model.Identity{
+		Role:              string(userRole),
+		Permissions:       []string{},
+		MailboxIdentifier: identity,
+		Scope:             grants.ReadScope(identity),
+	}
+
+	for _, permission := range grants.List() {
+		response.Permissions = append(response.Permissions, string(permission))
+	}
+
+	if identity != "" {
+		mailbox, err := h.service.GetMailboxByIdentifier(c.Request.Context(), identity)
+		if err != nil {
+			h.logger.Error("Failed to get mailbox", "error", err, "identifier", identity)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get mailbox"})
+			return
+		}
+		response.Mailbox = mailbox
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DepartmentHandler struct {
+	service service.DepartmentService
+	logger  *logger.Logger
+}
+
+func NewDepartmentHandler(service service.DepartmentService, logger *logger.Logger) *DepartmentHandler {
+	return &DepartmentHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+func (h *DepartmentHandler) GetDepartments(c *gin.Context) {
+	departments, err := h.service.GetDepartments(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to get departments", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get departments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, departments)
+}
+
+func (h *DepartmentHandler) GetDepartment(c *gin.Context) {
+	id, ok := departmentID(c)
+	if !ok {
+		return
+	}
+
+	department, err := h.service.GetDepartment(c.Request.Context(), id)
+	if err != nil {
+		h.logger.Error("Failed to get department", "error", err, "id", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get department"})
+		return
+	}
+
+	if department == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Department not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, department)
+}
+
+func (h *DepartmentHandler) CreateDepartment(c *gin.Context) {
+	var input model.DepartmentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	department, err := h.service.CreateDepartment(c.Request.Context(), input)
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to create department", input.ID)
+		return
+	}
+
+	c.JSON(http.StatusCreated, department)
+}
+
+func (h *DepartmentHandler) PatchDepartment(c *gin.Context) {
+	id, ok := departmentID(c)
+	if !ok {
+		return
+	}
+
+	var patch model.DepartmentPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	department, err := h.service.PatchDepartment(c.Request.Context(), id, patch)
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to update department", id)
+		return
+	}
+
+	c.JSON(http.StatusOK, department)
+}
+
+func (h *DepartmentHandler) DeleteDepartment(c *gin.Context) {
+	id, ok := departmentID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.DeleteDepartment(c.Request.Context(), id); err != nil {
+		h.handleWriteError(c, err, "Failed to delete department", id)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *DepartmentHandler) handleWriteError(c *gin.Context, err error, message string, id int) {
+	var validationErr *service.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+	case errors.Is(err, service.ErrDepartmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Department not found"})
+	case errors.Is(err, service.ErrDepartmentExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Department already exists"})
+	case errors.Is(err, service.ErrDepartmentHasMembers):
+		c.JSON(http.StatusConflict, gin.H{"error": "Department still has members"})
+	case errors.Is(err, service.ErrDepartmentHasSubDepartments):
+		c.JSON(http.StatusConflict, gin.H{"error": "Department still has sub-departments"})
+	default:
+		h.logger.Error(message, "error", err, "id", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// departmentID parses the department ID from the path, writing a 400
+// response if it is not a number.
+func departmentID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid department ID"})
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"net/http"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/export"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportHandler serves directory exports. The department service may be nil
+// if the department export is not routed. LDIF entries are named below
+// baseDN.
+type ExportHandler struct {
+	mailboxes   service.MailboxService
+	departments service.DepartmentService
+	policy      *authz.Policy
+	baseDN      string
+	logger      *logger.Logger
+}
+
+func NewExportHandler(mailboxes service.MailboxService, departments service.DepartmentService, policy *authz.Policy, baseDN string, logger *logger.Logger) *ExportHandler {
+	return &ExportHandler{
+		mailboxes:   mailboxes,
+		departments: departments,
+		policy:      policy,
+		baseDN:      baseDN,
+		logger:      logger,
+	}
+}
+
+// ExportMailboxes streams every mailbox in the caller's scope that matches
+// the filter.
+func (h *ExportHandler) ExportMailboxes(c *gin.Context) {
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+
+	filter, err := parseMailboxFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	streamMailboxes(c, h.mailboxes, h.policy, h.logger, format, "mailboxes."+format, export.Options{Fields: filter.Fields, BaseDN: h.baseDN}, filter)
+}
+
+// ExportDepartments streams every department.
+func (h *ExportHandler) ExportDepartments(c *gin.Context) {
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+
+	departments, err := h.departments.GetDepartments(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to get departments", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export departments"})
+		return
+	}
+
+	out := &exportResponse{c: c, contentType: export.ContentType(format), filename: "departments." + format}
+	w, err := export.NewDepartmentWriter(out, format, export.Options{BaseDN: h.baseDN})
+	if err != nil {
+		h.logger.Error("Failed to start department export", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export departments"})
+		return
+	}
+
+	for _, department := range departments {
+		if err := w.Write(department.Department); err != nil {
+			h.logger.Error("Failed to write department export", "error", err)
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		h.logger.Error("Failed to write department export", "error", err)
+		return
+	}
+	out.start()
+}
+
+// exportFormat takes the format from the format query parameter, or else
+// from the Accept header, and defaults to CSV.
+func exportFormat(c *gin.Context) (string, bool) {
+	format := c.Query("format")
+	if format == "" {
+		format = export.Negotiate(c.GetHeader("Accept"))
+	}
+	if format == "" {
+		format = export.FormatCSV
+	}
+
+	if !export.IsFormat(format) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of csv, json, ndjson or ldif"})
+		return "", false
+	}
+	return format, true
+}
+
+// exportResponse writes an export to the response. The export headers and
+// the status are only set when the first bytes are written, so an error
+// before that still gets a JSON error response. If filename is set, the
+// export is sent as an attachment of that name.
+type exportResponse struct {
+	c           *gin.Context
+	contentType string
+	filename    string
+}
+
+func (r *exportResponse) Write(p []byte) (int, error) {
+	r.start()
+	return r.c.Writer.Write(p)
+}
+
+// start sets the export headers and the status unless the response has
+// started already.
+func (r *exportResponse) start() {
+	if r.c.Writer.Written() {
+		return
+	}
+	if r.filename != "" {
+		r.c.Header("Content-Disposition", `attachment; filename="`+r.filename+`"`)
+	}
+	r.c.Header("Content-Type", r.contentType)
+	r.c.Status(http.StatusOK)
+	r.c.Writer.WriteHeaderNow()
+}
+
+// streamMailboxes writes the mailboxes in the caller's scope that match the
+// filter as they are read from the database, as an attachment if filename is
+// set. Errors before the first record still get an error response; later
+// ones can only end the response early.
+func streamMailboxes(c *gin.Context, mailboxes service.MailboxService, policy *authz.Policy, logger *logger.Logger, format string, filename string, options export.Options, filter model.MailboxFilter) {
+	_, identity, ok := caller(c)
+	if !ok {
+		logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	scope := middleware.Grants(c, policy).ReadScope(identity)
+	if scope == model.ScopeNone {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	out := &exportResponse{c: c, contentType: export.ContentType(format), filename: filename}
+	w, err := export.NewMailboxWriter(out, format, options)
+	if err != nil {
+		logger.Error("Failed to start mailbox export", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export mailboxes"})
+		return
+	}
+
+	switch scope {
+	case model.ScopeAll:
+		err = mailboxes.StreamMailboxes(c.Request.Context(), "", filter, w.Write)
+	case model.ScopeSubOrg:
+		err = mailboxes.StreamMailboxes(c.Request.Context(), identity, filter, w.Write)
+	case model.ScopeSelf:
+		var mailbox *model.Mailbox
+		mailbox, err = mailboxes.GetMailboxByIdentifier(c.Request.Context(), identity)
+		if err == nil && mailbox != nil {
+			err = w.Write(*mailbox)
+		}
+	}
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err != nil {
+		logger.Error("Failed to export mailboxes", "error", err)
+		if !c.Writer.Written() {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export mailboxes"})
+		}
+		return
+	}
+	out.start()
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImportSize is the largest file accepted by the import endpoints.
+const maxImportSize = 10 << 20
+
+// ImportHandler serves the bulk imports. The sync service may be nil if the
+// sync endpoints are not routed.
+type ImportHandler struct {
+	service service.MailboxService
+	sync    service.SyncService
+	logger  *logger.Logger
+}
+
+func NewImportHandler(service service.MailboxService, sync service.SyncService, logger *logger.Logger) *ImportHandler {
+	return &ImportHandler{
+		service: service,
+		sync:    sync,
+		logger:  logger,
+	}
+}
+
+// ImportMailboxes imports the mailboxes of the uploaded file in one
+// transaction. The format query parameter selects CSV (the default), a JSON
+// array, NDJSON, a nested org tree or LDIF. With dry_run=true the file is only
+// validated.
+func (h *ImportHandler) ImportMailboxes(c *gin.Context) {
+	importers := map[string]importFunc{
+		"csv":    h.service.ImportMailboxesFromCSV,
+		"json":   h.service.ImportMailboxesFromJSON,
+		"ndjson": h.service.ImportMailboxesFromNDJSON,
+		"tree":   h.service.ImportMailboxesFromTree,
+		"ldif":   h.service.ImportMailboxesFromLDIF,
+	}
+
+	run, ok := importers[c.DefaultQuery("format", "csv")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of csv, json, ndjson, tree or ldif"})
+		return
+	}
+
+	h.importFile(c, "mailboxes", run)
+}
+
+// ImportDepartments imports the departments of the uploaded CSV file in one
+// transaction. With dry_run=true the file is only validated.
+func (h *ImportHandler) ImportDepartments(c *gin.Context) {
+	h.importFile(c, "departments", h.service.ImportDepartmentsFromCSV)
+}
+
+// SyncMailboxes compares the uploaded roster with the directory and stores
+// the plan of changes for review. With dry_run=true the plan is only
+// returned.
+func (h *ImportHandler) SyncMailboxes(c *gin.Context) {
+	userRole, identity, ok := caller(c)
+	if !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	createdBy := identity
+	if createdBy == "" {
+		createdBy = string(userRole)
+	}
+
+	h.importFile(c, "mailbox roster", func(ctx context.Context, csvData string, dryRun bool) (*model.ImportResult, error) {
+		return h.sync.SyncMailboxesFromCSV(ctx, csvData, dryRun, createdBy)
+	})
+}
+
+func (h *ImportHandler) ListPlans(c *gin.Context) {
+	plans, err := h.sync.ListPlans(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to list import plans", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list import plans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, plans)
+}
+
+func (h *ImportHandler) GetPlan(c *gin.Context) {
+	plan, err := h.sync.GetPlan(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		h.handlePlanError(c, err, "Failed to get import plan")
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// ApplyPlan applies a pending plan in one transaction.
+func (h *ImportHandler) ApplyPlan(c *gin.Context) {
+	plan, err := h.sync.ApplyPlan(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		h.handlePlanError(c, err, "Failed to apply import plan")
+		return
+	}
+
+	h.logger.Info("Applied import plan", "id", plan.ID, "add", plan.Summary.Add, "update", plan.Summary.Update,
+		"move", plan.Summary.Move, "deactivate", plan.Summary.Deactivate)
+	c.JSON(http.StatusOK, plan)
+}
+
+func (h *ImportHandler) handlePlanError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrPlanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import plan not found"})
+	case errors.Is(err, service.ErrPlanNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Import plan is not pending"})
+	case errors.Is(err, service.ErrPlanStale):
+		c.JSON(http.StatusConflict, gin.H{"error": "Directory changed since the plan was created, sync again"})
+	default:
+		h.logger.Error(message, "error", err, "id", c.Param("id"))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+type importFunc func(ctx context.Context, data string, dryRun bool) (*model.ImportResult, error)
+
+// importFile reads the file from the "file" field of a multipart upload and
+// runs the import. A file with invalid rows is answered with 422 and the
+// per-row errors; nothing is written in that case.
+func (h *ImportHandler) importFile(c *gin.Context, kind string, run importFunc) {
+	dryRun := false
+	if value := c.Query("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run parameter"})
+			return
+		}
+		dryRun = parsed
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required in the file field"})
+		return
+	}
+	if header.Size > maxImportSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		h.logger.Error("Failed to open uploaded file", "error", err, "kind", kind)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		h.logger.Error("Failed to read uploaded file", "error", err, "kind", kind)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	result, err := run(c.Request.Context(), string(data), dryRun)
+	if err != nil {
+		var validationErr *service.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+			return
+		}
+		h.logger.Error("Failed to import "+kind, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import " + kind})
+		return
+	}
+
+	if len(result.Errors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	h.logger.Info("Imported "+kind, "rows", result.Rows, "imported", result.Imported, "dry_run", dryRun)
+	c.JSON(http.StatusOK, result)
+}
@@ -1,11 +1,15 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/dto"
+	"mailbox-api/export"
 	"mailbox-api/logger"
 	"mailbox-api/model"
 	"mailbox-api/service"
@@ -15,16 +19,21 @@ import (
 
 type MailboxHandler struct {
 	service service.MailboxService
+	policy  *authz.Policy
 	logger  *logger.Logger
 }
 
-func NewMailboxHandler(service service.MailboxService, logger *logger.Logger) *MailboxHandler {
+func NewMailboxHandler(service service.MailboxService, policy *authz.Policy, logger *logger.Logger) *MailboxHandler {
 	return &MailboxHandler{
 		service: service,
+		policy:  policy,
 		logger:  logger,
 	}
 }
 
+// GetMailboxes lists a page of mailboxes as JSON. Clients that accept CSV or
+// NDJSON instead get every matching mailbox streamed in that format, as from
+// the export endpoint.
 func (h *MailboxHandler) GetMailboxes(c *gin.Context) {
 	filter, err := parseMailboxFilter(c)
 	if err != nil {
@@ -33,21 +42,27 @@ func (h *MailboxHandler) GetMailboxes(c *gin.Context) {
 		return
 	}
 
-	var response interface{}
-	role, _ := c.Get("role")
-	userRole, ok := role.(middleware.Role)
+	if format := export.Negotiate(c.GetHeader("Accept")); format == export.FormatCSV || format == export.FormatNDJSON {
+		streamMailboxes(c, h.service, h.policy, h.logger, format, "", export.Options{Fields: filter.Fields}, filter)
+		return
+	}
 
+	var response interface{}
+	_, identity, ok := caller(c)
 	if !ok {
 		h.logger.Error("Failed to get user role")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	if userRole == middleware.RoleCEO {
+	switch middleware.Grants(c, h.policy).ReadScope(identity) {
+	case model.ScopeAll:
 		response, err = h.service.GetMailboxes(c.Request.Context(), filter)
-	} else if userRole == middleware.RoleCTO {
-		response, err = h.service.GetMailboxesInSubOrg(c.Request.Context(), string(userRole), filter)
-	} else {
+	case model.ScopeSubOrg:
+		response, err = h.service.GetMailboxesInSubOrg(c.Request.Context(), identity, filter)
+	case model.ScopeSelf:
+		response, err = h.ownMailbox(c, identity)
+	default:
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
 	}
@@ -76,39 +91,314 @@ func (h *MailboxHandler) GetMailbox(c *gin.Context) {
 		return
 	}
 
-	role, _ := c.Get("role")
-	userRole, ok := role.(middleware.Role)
-	if !ok {
-		h.logger.Error("Failed to get user role")
+	allowed, err := h.canView(c, identifier)
+	if err != nil {
+		h.logger.Error("Failed to check if mailbox is in caller's sub-org", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	if userRole == middleware.RoleCEO {
-		c.JSON(http.StatusOK, mailbox)
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 		return
 	}
 
-	if userRole == middleware.RoleCTO {
-		ctoIdentifier := "david.brown@falafel.org"
+	c.JSON(http.StatusOK, mailbox)
+}
+
+// GetReportingChain lists the managers above a mailbox, nearest first.
+func (h *MailboxHandler) GetReportingChain(c *gin.Context) {
+	h.listRelated(c, func(identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+		return h.service.GetReportingChain(c.Request.Context(), identifier, subOrgOf, filter)
+	})
+}
 
-		isUnderCTO, err := h.service.IsMailboxInSubOrg(c.Request.Context(), ctoIdentifier, identifier)
+// GetReports lists the direct reports of a mailbox, or its whole sub-org with
+// recursive=true.
+func (h *MailboxHandler) GetReports(c *gin.Context) {
+	recursive := false
+	if recursiveStr := c.Query("recursive"); recursiveStr != "" {
+		parsed, err := strconv.ParseBool(recursiveStr)
 		if err != nil {
-			h.logger.Error("Failed to check if mailbox is in CTO's sub-org", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "recursive must be true or false"})
 			return
 		}
+		recursive = parsed
+	}
 
-		if !isUnderCTO && identifier != ctoIdentifier {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-			return
-		}
+	h.listRelated(c, func(identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+		return h.service.GetReports(c.Request.Context(), identifier, recursive, subOrgOf, filter)
+	})
+}
+
+// GetPeers lists the mailboxes that share a manager with a mailbox.
+func (h *MailboxHandler) GetPeers(c *gin.Context) {
+	h.listRelated(c, func(identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+		return h.service.GetPeers(c.Request.Context(), identifier, subOrgOf, filter)
+	})
+}
+
+// listRelated serves the mailboxes related to the one in the path with the
+// list endpoint's filters and pagination. The mailbox must be within the
+// caller's scope, and so must the results: callers scoped to their sub-org
+// only see mailboxes inside it, callers scoped to themselves see none.
+func (h *MailboxHandler) listRelated(c *gin.Context, list func(identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error)) {
+	identifier := c.Param("id")
+
+	filter, err := parseMailboxFilter(c)
+	if err != nil {
+		h.logger.Error("Failed to parse mailbox filter", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, identity, ok := caller(c)
+	if !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	allowed, err := h.canView(c, identifier)
+	if err != nil {
+		h.logger.Error("Failed to check if mailbox is in caller's sub-org", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	var response *model.MailboxResponse
+	switch middleware.Grants(c, h.policy).ReadScope(identity) {
+	case model.ScopeAll:
+		response, err = list(identifier, "", filter)
+	case model.ScopeSubOrg:
+		response, err = list(identifier, identity, filter)
+	default:
+		response = dto.NewMailboxResponse([]model.Mailbox{}, &model.Pagination{Page: 1, TotalPages: 1})
+	}
+
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to get mailboxes", identifier)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *MailboxHandler) CreateMailbox(c *gin.Context) {
+	var input model.MailboxInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !h.authorizeWrite(c, "", &input.ManagerIdentifier) {
+		return
+	}
+
+	mailbox, err := h.service.CreateMailbox(c.Request.Context(), input)
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to create mailbox", input.Identifier)
+		return
+	}
+
+	c.JSON(http.StatusCreated, mailbox)
+}
+
+func (h *MailboxHandler) ReplaceMailbox(c *gin.Context) {
+	identifier := c.Param("id")
+
+	var input model.MailboxInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !h.authorizeWrite(c, identifier, &input.ManagerIdentifier) {
+		return
+	}
+
+	mailbox, err := h.service.ReplaceMailbox(c.Request.Context(), identifier, input)
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to update mailbox", identifier)
+		return
+	}
+
+	c.JSON(http.StatusOK, mailbox)
+}
+
+func (h *MailboxHandler) PatchMailbox(c *gin.Context) {
+	identifier := c.Param("id")
+
+	var patch model.MailboxPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !h.authorizeWrite(c, identifier, patch.ManagerIdentifier) {
+		return
+	}
+
+	mailbox, err := h.service.PatchMailbox(c.Request.Context(), identifier, patch)
+	if err != nil {
+		h.handleWriteError(c, err, "Failed to update mailbox", identifier)
+		return
+	}
+
+	c.JSON(http.StatusOK, mailbox)
+}
+
+func (h *MailboxHandler) DeleteMailbox(c *gin.Context) {
+	identifier := c.Param("id")
 
-		c.JSON(http.StatusOK, mailbox)
+	if !h.authorizeWrite(c, identifier, nil) {
 		return
 	}
 
-	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	if err := h.service.DeleteMailbox(c.Request.Context(), identifier); err != nil {
+		h.handleWriteError(c, err, "Failed to delete mailbox", identifier)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeWrite checks that the caller may modify the target mailbox and
+// attach it to the given manager, as canWriteMailbox decides. It writes the
+// error response itself and reports whether the request may proceed.
+func (h *MailboxHandler) authorizeWrite(c *gin.Context, target string, manager *string) bool {
+	if _, _, ok := caller(c); !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false
+	}
+
+	allowed, err := canWriteMailbox(c, h.policy, h.service, target, manager)
+	if err != nil {
+		h.logger.Error("Failed to check if mailbox is in caller's sub-org", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false
+	}
+
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+
+	return true
+}
+
+// canView reports whether the mailbox is inside the caller's read scope.
+func (h *MailboxHandler) canView(c *gin.Context, identifier string) (bool, error) {
+	return canViewMailbox(c, h.policy, h.service, identifier)
+}
+
+// canWriteMailbox reports whether the caller may modify the target mailbox
+// and attach it to the given manager. It requires the write permission; a
+// caller who can read all mailboxes may then change any of them, a caller
+// scoped to a sub-org only mailboxes inside it, excluding their own mailbox.
+// An empty target is not checked. A nil manager means the request leaves the
+// manager as is; otherwise a sub-org scoped caller must name themselves or a
+// mailbox inside their sub-org, so that they can neither create mailboxes
+// outside it nor move reports out of it by clearing the manager.
+func canWriteMailbox(c *gin.Context, policy *authz.Policy, mailboxes service.MailboxService, target string, manager *string) (bool, error) {
+	_, identity, _ := caller(c)
+
+	grants := middleware.Grants(c, policy)
+	if !grants.Can(authz.PermMailboxWrite) {
+		return false, nil
+	}
+
+	scope := grants.ReadScope(identity)
+	if scope == model.ScopeAll {
+		return true, nil
+	}
+
+	if scope != model.ScopeSubOrg || target == identity {
+		return false, nil
+	}
+
+	identifiers := []string{}
+	if target != "" {
+		identifiers = append(identifiers, target)
+	}
+	if manager != nil {
+		if strings.TrimSpace(*manager) == "" {
+			return false, nil
+		}
+		identifiers = append(identifiers, strings.TrimSpace(*manager))
+	}
+
+	for _, identifier := range identifiers {
+		inSubOrg, err := canViewMailbox(c, policy, mailboxes, identifier)
+		if err != nil || !inSubOrg {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// canViewMailbox reports whether the mailbox is inside the caller's read
+// scope.
+func canViewMailbox(c *gin.Context, policy *authz.Policy, mailboxes service.MailboxService, identifier string) (bool, error) {
+	_, identity, _ := caller(c)
+
+	switch middleware.Grants(c, policy).ReadScope(identity) {
+	case model.ScopeAll:
+		return true, nil
+	case model.ScopeSubOrg:
+		return mailboxes.IsMailboxInSubOrg(c.Request.Context(), identity, identifier)
+	case model.ScopeSelf:
+		return identifier == identity, nil
+	default:
+		return false, nil
+	}
+}
+
+// ownMailbox lists only the caller's own mailbox, for callers whose scope is
+// limited to themselves.
+func (h *MailboxHandler) ownMailbox(c *gin.Context, identity string) (*model.MailboxResponse, error) {
+	mailbox, err := h.service.GetMailboxByIdentifier(c.Request.Context(), identity)
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes := []model.Mailbox{}
+	if mailbox != nil {
+		mailboxes = append(mailboxes, *mailbox)
+	}
+
+	pagination := &model.Pagination{
+		Page:       1,
+		PageSize:   len(mailboxes),
+		TotalItems: len(mailboxes),
+		TotalPages: 1,
+	}
+
+	return dto.NewMailboxResponse(mailboxes, pagination), nil
+}
+
+func (h *MailboxHandler) handleWriteError(c *gin.Context, err error, message string, identifier string) {
+	var validationErr *service.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+	case errors.Is(err, service.ErrMailboxNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mailbox not found"})
+	case errors.Is(err, service.ErrMailboxExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Mailbox already exists"})
+	case errors.Is(err, service.ErrMailboxHasReports):
+		c.JSON(http.StatusConflict, gin.H{"error": "Mailbox has direct reports"})
+	default:
+		h.logger.Error(message, "error", err, "identifier", identifier)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
 }
 
 func (h *MailboxHandler) CalculateOrgMetrics(c *gin.Context) {
@@ -135,6 +425,14 @@ func parseMailboxFilter(c *gin.Context) (model.MailboxFilter, error) {
 		filter.Department = department
 	}
 
+	if includeStr := c.Query("include_sub_departments"); includeStr != "" {
+		include, err := strconv.ParseBool(includeStr)
+		if err != nil {
+			return filter, err
+		}
+		filter.IncludeSubDepartments = include
+	}
+
 	if orgDepthStr := c.Query("org_depth_exact"); orgDepthStr != "" {
 		orgDepth, err := strconv.Atoi(orgDepthStr)
 		if err != nil {
@@ -175,6 +473,14 @@ func parseMailboxFilter(c *gin.Context) (model.MailboxFilter, error) {
 		filter.SubOrgSizeMax = &subOrgSizeMax
 	}
 
+	if activeStr := c.Query("active"); activeStr != "" {
+		active, err := strconv.ParseBool(activeStr)
+		if err != nil {
+			return filter, err
+		}
+		filter.Active = &active
+	}
+
 	if sortBy := c.QueryArray("sort_by"); len(sortBy) > 0 {
 		filter.SortBy = sortBy
 
@@ -213,3 +519,11 @@ func parseMailboxFilter(c *gin.Context) (model.MailboxFilter, error) {
 
 	return filter, nil
 }
+
+// caller returns the role and mailbox identifier that AuthMiddleware stored
+// on the request.
+func caller(c *gin.Context) (authz.Role, string, bool) {
+	role, _ := c.Get(middleware.ContextRole)
+	userRole, ok := role.(authz.Role)
+	return userRole, c.GetString(middleware.ContextIdentity), ok
+}
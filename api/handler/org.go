@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/logger"
+	"mailbox-api/orgchart"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OrgHandler struct {
+	service service.OrgService
+	policy  *authz.Policy
+	logger  *logger.Logger
+}
+
+func NewOrgHandler(service service.OrgService, policy *authz.Policy, logger *logger.Logger) *OrgHandler {
+	return &OrgHandler{
+		service: service,
+		policy:  policy,
+		logger:  logger,
+	}
+}
+
+func (h *OrgHandler) GetIntegrity(c *gin.Context) {
+	report, err := h.service.CheckIntegrity(c.Request.Context())
+	if err != nil {
+		h.logger.Error("Failed to check org integrity", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check org integrity"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetTree returns the org chart as nested nodes. The query parameters are
+// root (a mailbox identifier), depth (levels below the root, unlimited if
+// omitted) and fields.
+func (h *OrgHandler) GetTree(c *gin.Context) {
+	depth, ok := treeDepth(c)
+	if !ok {
+		return
+	}
+
+	var fields []string
+	if fieldsStr := c.Query("fields"); fieldsStr != "" {
+		fields = strings.Split(fieldsStr, ",")
+	}
+
+	scope, identity, ok := h.callerScope(c)
+	if !ok {
+		return
+	}
+
+	tree, err := h.service.GetTree(c.Request.Context(), scope, identity, c.Query("root"), depth, fields)
+	if err != nil {
+		h.handleError(c, err, "Failed to get org tree")
+		return
+	}
+
+	c.JSON(http.StatusOK, tree)
+}
+
+// ExportTree renders the tree of GetTree as Graphviz DOT, Mermaid or GraphML,
+// chosen by the format query parameter. cluster=department groups mailboxes
+// by department.
+func (h *OrgHandler) ExportTree(c *gin.Context) {
+	depth, ok := treeDepth(c)
+	if !ok {
+		return
+	}
+
+	options := orgchart.ExportOptions{Format: c.DefaultQuery("format", orgchart.FormatDOT)}
+	switch cluster := c.Query("cluster"); cluster {
+	case "":
+	case "department":
+		options.ClusterByDepartment = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cluster must be department"})
+		return
+	}
+
+	scope, identity, ok := h.callerScope(c)
+	if !ok {
+		return
+	}
+
+	chart, err := h.service.ExportTree(c.Request.Context(), scope, identity, c.Query("root"), depth, options)
+	if err != nil {
+		h.handleError(c, err, "Failed to export org chart")
+		return
+	}
+
+	c.Data(http.StatusOK, orgchart.ContentType(options.Format), chart)
+}
+
+// GetLayout returns coordinates for drawing the tree of GetTree, or with
+// format=svg the drawing itself. node_width, node_height, sibling_spacing,
+// level_spacing, orientation and collapse_above override the defaults of
+// orgchart.DefaultLayoutOptions.
+func (h *OrgHandler) GetLayout(c *gin.Context) {
+	depth, ok := treeDepth(c)
+	if !ok {
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "svg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or svg"})
+		return
+	}
+
+	options := orgchart.DefaultLayoutOptions()
+	options.Orientation = c.DefaultQuery("orientation", options.Orientation)
+	for name, value := range map[string]*float64{
+		"node_width":      &options.NodeWidth,
+		"node_height":     &options.NodeHeight,
+		"sibling_spacing": &options.SiblingSpacing,
+		"level_spacing":   &options.LevelSpacing,
+	} {
+		if str := c.Query(name); str != "" {
+			parsed, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a number"})
+				return
+			}
+			*value = parsed
+		}
+	}
+	if str := c.Query("collapse_above"); str != "" {
+		parsed, err := strconv.Atoi(str)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "collapse_above must be an integer"})
+			return
+		}
+		options.CollapseAbove = parsed
+	}
+
+	scope, identity, ok := h.callerScope(c)
+	if !ok {
+		return
+	}
+
+	layout, err := h.service.LayoutTree(c.Request.Context(), scope, identity, c.Query("root"), depth, options)
+	if err != nil {
+		h.handleError(c, err, "Failed to lay out org chart")
+		return
+	}
+
+	if format == "svg" {
+		var b bytes.Buffer
+		if err := orgchart.WriteSVG(&b, layout); err != nil {
+			h.handleError(c, err, "Failed to draw org chart")
+			return
+		}
+		c.Data(http.StatusOK, "image/svg+xml; charset=utf-8", b.Bytes())
+		return
+	}
+
+	c.JSON(http.StatusOK, layout)
+}
+
+// GetRelationship describes how the mailboxes given by the a and b query
+// parameters are connected.
+func (h *OrgHandler) GetRelationship(c *gin.Context) {
+	a, b := c.Query("a"), c.Query("b")
+	if a == "" || b == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a and b are required"})
+		return
+	}
+
+	scope, identity, ok := h.callerScope(c)
+	if !ok {
+		return
+	}
+
+	relationship, err := h.service.GetRelationship(c.Request.Context(), scope, identity, a, b)
+	if err != nil {
+		h.handleError(c, err, "Failed to get org relationship")
+		return
+	}
+
+	c.JSON(http.StatusOK, relationship)
+}
+
+// callerScope returns the caller's read scope and mailbox, writing an error
+// response if the request carries no role.
+func (h *OrgHandler) callerScope(c *gin.Context) (string, string, bool) {
+	_, identity, ok := caller(c)
+	if !ok {
+		h.logger.Error("Failed to get user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return "", "", false
+	}
+	return middleware.Grants(c, h.policy).ReadScope(identity), identity, true
+}
+
+// treeDepth parses the depth query parameter, -1 if it is absent, writing a
+// 400 response if it is invalid.
+func treeDepth(c *gin.Context) (int, bool) {
+	depthStr := c.Query("depth")
+	if depthStr == "" {
+		return -1, true
+	}
+
+	depth, err := strconv.Atoi(depthStr)
+	if err != nil || depth < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "depth must be a non-negative integer"})
+		return 0, false
+	}
+	return depth, true
+}
+
+func (h *OrgHandler) handleError(c *gin.Context, err error, message string) {
+	var validationErr *service.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErr.Error()})
+	case errors.Is(err, service.ErrMailboxNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mailbox not found"})
+	case errors.Is(err, service.ErrOutOfScope):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	default:
+		h.logger.Error(message, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
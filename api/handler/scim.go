@@ -0,0 +1,918 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/scim"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SCIMBasePath is the root of the SCIM endpoints.
+const SCIMBasePath = "/scim/v2"
+
+// scimAttributes names the SCIM attributes of the fields validation errors
+// report.
+var scimAttributes = map[string]string{
+	"mailbox_identifier":         "userName",
+	"user_full_name":             "displayName",
+	"job_title":                  "title",
+	"department_id":              scim.SchemaEnterpriseUser + ":department",
+	"manager_mailbox_identifier": scim.SchemaEnterpriseUser + ":manager",
+	"department_name":            "displayName",
+	"members":                    "members",
+}
+
+// SCIMHandler serves SCIM 2.0 Users, which are mailboxes, and Groups, which
+// are departments, so that identity providers can provision joiners, movers
+// and leavers. Users are read and written within the caller's scope, as on
+// the mailbox endpoints.
+type SCIMHandler struct {
+	mailboxes   service.MailboxService
+	departments service.DepartmentService
+	policy      *authz.Policy
+	logger      *logger.Logger
+}
+
+func NewSCIMHandler(mailboxes service.MailboxService, departments service.DepartmentService, policy *authz.Policy, logger *logger.Logger) *SCIMHandler {
+	return &SCIMHandler{
+		mailboxes:   mailboxes,
+		departments: departments,
+		policy:      policy,
+		logger:      logger,
+	}
+}
+
+func (h *SCIMHandler) ServiceProviderConfig(c *gin.Context) {
+	writeSCIM(c, http.StatusOK, scim.NewServiceProviderConfig(scimBaseURL(c)))
+}
+
+func (h *SCIMHandler) ResourceTypes(c *gin.Context) {
+	resourceTypes := scim.NewResourceTypes(scimBaseURL(c))
+	if id := c.Param("id"); id != "" {
+		for _, resourceType := range resourceTypes {
+			if resourceType.ID == id {
+				writeSCIM(c, http.StatusOK, resourceType)
+				return
+			}
+		}
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Resource type not found"))
+		return
+	}
+
+	resources := make([]interface{}, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		resources = append(resources, resourceType)
+	}
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(len(resources), 1, resources))
+}
+
+func (h *SCIMHandler) Schemas(c *gin.Context) {
+	schemas := scim.NewSchemas(scimBaseURL(c))
+	if id := c.Param("id"); id != "" {
+		for _, schema := range schemas {
+			if schema.ID == id {
+				writeSCIM(c, http.StatusOK, schema)
+				return
+			}
+		}
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Schema not found"))
+		return
+	}
+
+	resources := make([]interface{}, 0, len(schemas))
+	for _, schema := range schemas {
+		resources = append(resources, schema)
+	}
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(len(resources), 1, resources))
+}
+
+// ListUsers lists the mailboxes in the caller's read scope that match the
+// filter. A filter on userName or id is first narrowed to a lookup of that
+// mailbox, as identity providers send before creating a user; other filters
+// are evaluated on every mailbox in scope.
+func (h *SCIMHandler) ListUsers(c *gin.Context) {
+	query, ok := parseSCIMQuery(c)
+	if !ok {
+		return
+	}
+
+	base := scimBaseURL(c)
+	page := newSCIMPage(query)
+	visit := func(mailbox model.Mailbox) error {
+		resource, err := scim.ToMap(scim.NewUser(mailbox, base))
+		if err != nil {
+			return err
+		}
+		page.add(resource)
+		return nil
+	}
+
+	identifier := ""
+	if query.filter != nil {
+		for _, attribute := range []string{"userName", "id"} {
+			if value, ok := query.filter.Equality(attribute); ok {
+				identifier = value
+			}
+		}
+	}
+
+	var err error
+	if identifier != "" {
+		// Identifiers are stored as given but filters compare case
+		// insensitively, so the lookup ignores case as well
+		filter := model.MailboxFilter{Identifier: identifier}
+		err = h.mailboxes.StreamMailboxes(c.Request.Context(), "", filter, func(mailbox model.Mailbox) error {
+			visible, err := canViewMailbox(c, h.policy, h.mailboxes, mailbox.Identifier)
+			if err != nil || !visible {
+				return err
+			}
+			return visit(mailbox)
+		})
+	} else {
+		err = h.visitMailboxes(c, model.MailboxFilter{}, visit)
+	}
+	if err != nil {
+		h.fail(c, err, "Failed to list users")
+		return
+	}
+
+	writeSCIM(c, http.StatusOK, page.response())
+}
+
+func (h *SCIMHandler) GetUser(c *gin.Context) {
+	mailbox, ok := h.visibleMailbox(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	resource, err := scim.ToMap(scim.NewUser(*mailbox, scimBaseURL(c)))
+	if err != nil {
+		h.fail(c, err, "Failed to get user")
+		return
+	}
+	writeSCIM(c, http.StatusOK, scim.Project(resource, splitList(c.Query("attributes")), splitList(c.Query("excludedAttributes"))))
+}
+
+// CreateUser creates a mailbox for a joiner. The enterprise department names
+// the department, and the manager is given by their id.
+func (h *SCIMHandler) CreateUser(c *gin.Context) {
+	var user scim.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	input, err := h.mailboxInput(c.Request.Context(), user, nil)
+	if err != nil {
+		h.fail(c, err, "Failed to create user")
+		return
+	}
+
+	if !h.authorizeWrite(c, "", &input.ManagerIdentifier) {
+		return
+	}
+
+	if user.Active != nil {
+		active := bool(*user.Active)
+		input.Active = &active
+	}
+
+	mailbox, err := h.mailboxes.CreateMailbox(c.Request.Context(), input)
+	if err != nil {
+		h.fail(c, err, "Failed to create user")
+		return
+	}
+
+	created := scim.NewUser(*mailbox, scimBaseURL(c))
+	c.Header("Location", created.Meta.Location)
+	writeSCIM(c, http.StatusCreated, created)
+}
+
+// ReplaceUser replaces a mailbox's attributes. The active flag is left as is
+// if it is not given.
+func (h *SCIMHandler) ReplaceUser(c *gin.Context) {
+	current, ok := h.visibleMailbox(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var user scim.User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	h.updateUser(c, current, user)
+}
+
+// PatchUser applies PATCH operations to the User resource of a mailbox and
+// stores the result as ReplaceUser would, so movers and leavers can be sent
+// as partial updates such as replacing active or the manager.
+func (h *SCIMHandler) PatchUser(c *gin.Context) {
+	current, ok := h.visibleMailbox(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var patch scim.PatchOp
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	resource, err := scim.ToMap(scim.NewUser(*current, scimBaseURL(c)))
+	if err == nil {
+		err = patch.Apply(resource)
+	}
+	var user scim.User
+	if err == nil {
+		err = scim.FromMap(resource, &user)
+	}
+	if err != nil {
+		h.fail(c, err, "Failed to update user")
+		return
+	}
+
+	h.updateUser(c, current, user)
+}
+
+func (h *SCIMHandler) updateUser(c *gin.Context, current *model.Mailbox, user scim.User) {
+	input, err := h.mailboxInput(c.Request.Context(), user, current)
+	if err != nil {
+		h.fail(c, err, "Failed to update user")
+		return
+	}
+
+	// A user sent without a manager is moved to the top of the org, which
+	// callers scoped to a sub-org may not do
+	var manager *string
+	if input.ManagerIdentifier != current.ManagerIdentifier {
+		manager = &input.ManagerIdentifier
+	}
+	if !h.authorizeWrite(c, current.Identifier, manager) {
+		return
+	}
+
+	mailbox, err := h.mailboxes.ReplaceMailbox(c.Request.Context(), current.Identifier, input)
+	if err != nil {
+		h.fail(c, err, "Failed to update user")
+		return
+	}
+
+	if user.Active != nil && bool(*user.Active) != mailbox.Active {
+		mailbox, err = h.mailboxes.SetMailboxActive(c.Request.Context(), mailbox.Identifier, bool(*user.Active))
+		if err != nil {
+			h.fail(c, err, "Failed to update user")
+			return
+		}
+	}
+
+	writeSCIM(c, http.StatusOK, scim.NewUser(*mailbox, scimBaseURL(c)))
+}
+
+// DeleteUser deletes a leaver's mailbox. Mailboxes with direct reports are
+// kept until the reports have moved; deactivating is the alternative.
+func (h *SCIMHandler) DeleteUser(c *gin.Context) {
+	identifier := c.Param("id")
+	if !h.authorizeWrite(c, identifier, nil) {
+		return
+	}
+
+	if err := h.mailboxes.DeleteMailbox(c.Request.Context(), identifier); err != nil {
+		h.fail(c, err, "Failed to delete user")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListGroups lists the departments that match the filter. Members are the
+// mailboxes in the caller's read scope.
+func (h *SCIMHandler) ListGroups(c *gin.Context) {
+	query, ok := parseSCIMQuery(c)
+	if !ok {
+		return
+	}
+
+	departments, err := h.departments.GetDepartments(c.Request.Context())
+	if err != nil {
+		h.fail(c, err, "Failed to list groups")
+		return
+	}
+
+	members := map[int][]model.Mailbox{}
+	if query.wants("members") {
+		err := h.visitMailboxes(c, model.MailboxFilter{}, func(mailbox model.Mailbox) error {
+			members[mailbox.DepartmentID] = append(members[mailbox.DepartmentID], mailbox)
+			return nil
+		})
+		if err != nil {
+			h.fail(c, err, "Failed to list groups")
+			return
+		}
+	}
+
+	base := scimBaseURL(c)
+	page := newSCIMPage(query)
+	for _, department := range departments {
+		resource, err := scim.ToMap(scim.NewGroup(department.Department, members[department.ID], base))
+		if err != nil {
+			h.fail(c, err, "Failed to list groups")
+			return
+		}
+		page.add(resource)
+	}
+
+	writeSCIM(c, http.StatusOK, page.response())
+}
+
+func (h *SCIMHandler) GetGroup(c *gin.Context) {
+	department, ok := h.department(c)
+	if !ok {
+		return
+	}
+
+	members := []model.Mailbox{}
+	err := h.visitMailboxes(c, model.MailboxFilter{Department: department.ID}, func(mailbox model.Mailbox) error {
+		if mailbox.DepartmentID == department.ID {
+			members = append(members, mailbox)
+		}
+		return nil
+	})
+	if err != nil {
+		h.fail(c, err, "Failed to get group")
+		return
+	}
+
+	resource, err := scim.ToMap(scim.NewGroup(*department, members, scimBaseURL(c)))
+	if err != nil {
+		h.fail(c, err, "Failed to get group")
+		return
+	}
+	writeSCIM(c, http.StatusOK, scim.Project(resource, splitList(c.Query("attributes")), splitList(c.Query("excludedAttributes"))))
+}
+
+// CreateGroup creates a top-level department with the members moved into
+// it. Every member is checked first, and the department is created and the
+// members moved in one transaction.
+func (h *SCIMHandler) CreateGroup(c *gin.Context) {
+	var group scim.Group
+	if err := c.ShouldBindJSON(&group); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	members, err := h.checkMembers(c, group.Members)
+	if err != nil {
+		h.fail(c, err, "Failed to create group")
+		return
+	}
+
+	summary, err := h.departments.CreateDepartment(c.Request.Context(), model.DepartmentInput{Name: group.DisplayName, Members: members})
+	if err != nil {
+		h.fail(c, err, "Failed to create group")
+		return
+	}
+
+	department := summary.Department
+	created := h.group(c, department)
+	if created == nil {
+		return
+	}
+	c.Header("Location", created.Meta.Location)
+	writeSCIM(c, http.StatusCreated, created)
+}
+
+// ReplaceGroup renames a department and, if members are given, moves the
+// new members into it.
+func (h *SCIMHandler) ReplaceGroup(c *gin.Context) {
+	department, ok := h.department(c)
+	if !ok {
+		return
+	}
+
+	var group scim.Group
+	if err := c.ShouldBindJSON(&group); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	h.updateGroup(c, department, group, group.Members != nil)
+}
+
+// PatchGroup applies PATCH operations to the Group resource of a department,
+// such as adding members or replacing displayName.
+func (h *SCIMHandler) PatchGroup(c *gin.Context) {
+	department, ok := h.department(c)
+	if !ok {
+		return
+	}
+
+	var patch scim.PatchOp
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, "Invalid request body: %v", err))
+		return
+	}
+
+	// The patch applies to every member, including those outside the
+	// caller's scope, so that only the members it names change
+	members, err := h.members(c.Request.Context(), department.ID)
+	if err != nil {
+		h.fail(c, err, "Failed to update group")
+		return
+	}
+
+	resource, err := scim.ToMap(scim.NewGroup(*department, members, scimBaseURL(c)))
+	if err == nil {
+		err = patch.Apply(resource)
+	}
+	var group scim.Group
+	if err == nil {
+		err = scim.FromMap(resource, &group)
+	}
+	if err != nil {
+		h.fail(c, err, "Failed to update group")
+		return
+	}
+
+	h.updateGroup(c, department, group, true)
+}
+
+func (h *SCIMHandler) updateGroup(c *gin.Context, department *model.Department, group scim.Group, replaceMembers bool) {
+	if group.DisplayName != department.Name {
+		summary, err := h.departments.PatchDepartment(c.Request.Context(), department.ID, model.DepartmentPatch{Name: &group.DisplayName})
+		if err != nil {
+			h.fail(c, err, "Failed to update group")
+			return
+		}
+		department = &summary.Department
+	}
+
+	if replaceMembers {
+		current, err := h.members(c.Request.Context(), department.ID)
+		if err == nil {
+			err = h.setMembers(c, *department, group.Members, current)
+		}
+		if err != nil {
+			h.fail(c, err, "Failed to update group")
+			return
+		}
+	}
+
+	if updated := h.group(c, *department); updated != nil {
+		writeSCIM(c, http.StatusOK, updated)
+	}
+}
+
+// DeleteGroup deletes a department that has no members or sub-departments.
+func (h *SCIMHandler) DeleteGroup(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Group not found"))
+		return
+	}
+
+	if err := h.departments.DeleteDepartment(c.Request.Context(), id); err != nil {
+		h.fail(c, err, "Failed to delete group")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// setMembers moves the members that are not in the department yet into it,
+// after checking all of them. A mailbox always belongs to a department, so
+// members cannot be removed; they leave a group by being added to another.
+func (h *SCIMHandler) setMembers(c *gin.Context, department model.Department, members []scim.Reference, current []model.Mailbox) error {
+	wanted := map[string]bool{}
+	for _, member := range members {
+		wanted[member.Value] = true
+	}
+
+	for _, mailbox := range current {
+		if !wanted[mailbox.Identifier] {
+			return scim.NewError(http.StatusBadRequest, scim.ErrMutability, "%s cannot leave %s; add it to the group of its new department instead", mailbox.Identifier, department.Name)
+		}
+		delete(wanted, mailbox.Identifier)
+	}
+
+	joiners := []scim.Reference{}
+	for _, member := range members {
+		if wanted[member.Value] {
+			joiners = append(joiners, member)
+		}
+	}
+
+	identifiers, err := h.checkMembers(c, joiners)
+	if err != nil {
+		return err
+	}
+
+	for _, identifier := range identifiers {
+		if _, err := h.mailboxes.PatchMailbox(c.Request.Context(), identifier, model.MailboxPatch{DepartmentID: &department.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMembers checks that every member is a mailbox the caller may modify,
+// so that no member is moved unless all of them can be, and returns their
+// identifiers without duplicates.
+func (h *SCIMHandler) checkMembers(c *gin.Context, members []scim.Reference) ([]string, error) {
+	identifiers := []string{}
+	seen := map[string]bool{}
+	for _, member := range members {
+		if seen[member.Value] {
+			continue
+		}
+		seen[member.Value] = true
+
+		allowed, err := canWriteMailbox(c, h.policy, h.mailboxes, member.Value, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, scim.NewError(http.StatusForbidden, "", "Access denied to %s", member.Value)
+		}
+
+		mailbox, err := h.mailboxes.GetMailboxByIdentifier(c.Request.Context(), member.Value)
+		if err != nil {
+			return nil, err
+		}
+		if mailbox == nil {
+			return nil, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "member %s is not a user", member.Value)
+		}
+		identifiers = append(identifiers, mailbox.Identifier)
+	}
+	return identifiers, nil
+}
+
+// members returns every mailbox in the department.
+func (h *SCIMHandler) members(ctx context.Context, departmentID int) ([]model.Mailbox, error) {
+	members := []model.Mailbox{}
+	err := h.mailboxes.StreamMailboxes(ctx, "", model.MailboxFilter{Department: departmentID}, func(mailbox model.Mailbox) error {
+		if mailbox.DepartmentID == departmentID {
+			members = append(members, mailbox)
+		}
+		return nil
+	})
+	return members, err
+}
+
+// group returns the Group resource of the department with the members in
+// the caller's scope, or writes the error response and returns nil.
+func (h *SCIMHandler) group(c *gin.Context, department model.Department) *scim.Group {
+	members := []model.Mailbox{}
+	err := h.visitMailboxes(c, model.MailboxFilter{Department: department.ID}, func(mailbox model.Mailbox) error {
+		if mailbox.DepartmentID == department.ID {
+			members = append(members, mailbox)
+		}
+		return nil
+	})
+	if err != nil {
+		h.fail(c, err, "Failed to get group")
+		return nil
+	}
+
+	group := scim.NewGroup(department, members, scimBaseURL(c))
+	return &group
+}
+
+// department returns the department named by the path, or writes a 404 and
+// returns false.
+func (h *SCIMHandler) department(c *gin.Context) (*model.Department, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Group not found"))
+		return nil, false
+	}
+
+	summary, err := h.departments.GetDepartment(c.Request.Context(), id)
+	if err != nil {
+		h.fail(c, err, "Failed to get group")
+		return nil, false
+	}
+	if summary == nil {
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Group not found"))
+		return nil, false
+	}
+	return &summary.Department, true
+}
+
+// visitMailboxes calls fn for the mailboxes in the caller's read scope that
+// match the filter, as GET /api/mailboxes lists them.
+func (h *SCIMHandler) visitMailboxes(c *gin.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	_, identity, _ := caller(c)
+
+	switch middleware.Grants(c, h.policy).ReadScope(identity) {
+	case model.ScopeAll:
+		return h.mailboxes.StreamMailboxes(c.Request.Context(), "", filter, fn)
+	case model.ScopeSubOrg:
+		return h.mailboxes.StreamMailboxes(c.Request.Context(), identity, filter, fn)
+	case model.ScopeSelf:
+		return h.visitMailbox(c, identity, fn)
+	default:
+		return nil
+	}
+}
+
+// visitMailbox calls fn for the mailbox if it exists and is in the caller's
+// read scope.
+func (h *SCIMHandler) visitMailbox(c *gin.Context, identifier string, fn func(model.Mailbox) error) error {
+	visible, err := canViewMailbox(c, h.policy, h.mailboxes, identifier)
+	if err != nil || !visible {
+		return err
+	}
+
+	mailbox, err := h.mailboxes.GetMailboxByIdentifier(c.Request.Context(), identifier)
+	if err != nil || mailbox == nil {
+		return err
+	}
+	return fn(*mailbox)
+}
+
+// visibleMailbox returns the mailbox if it exists and is in the caller's
+// read scope, or writes a 404 and returns false.
+func (h *SCIMHandler) visibleMailbox(c *gin.Context, identifier string) (*model.Mailbox, bool) {
+	var found *model.Mailbox
+	err := h.visitMailbox(c, identifier, func(mailbox model.Mailbox) error {
+		found = &mailbox
+		return nil
+	})
+	if err != nil {
+		h.fail(c, err, "Failed to get user")
+		return nil, false
+	}
+	if found == nil {
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "User not found"))
+		return nil, false
+	}
+	return found, true
+}
+
+// authorizeWrite checks that the caller may modify the target mailbox and
+// attach it to the manager, as canWriteMailbox decides, writing a 403 if
+// not.
+func (h *SCIMHandler) authorizeWrite(c *gin.Context, target string, manager *string) bool {
+	allowed, err := canWriteMailbox(c, h.policy, h.mailboxes, target, manager)
+	if err != nil {
+		h.fail(c, err, "Failed to check access")
+		return false
+	}
+	if !allowed {
+		writeSCIMError(c, scim.NewError(http.StatusForbidden, "", "Access denied"))
+		return false
+	}
+	return true
+}
+
+// mailboxInput converts a User resource into the fields of a mailbox. The
+// full name is displayName, else the name; the department is the enterprise
+// department, by name or ID.
+func (h *SCIMHandler) mailboxInput(ctx context.Context, user scim.User, current *model.Mailbox) (model.MailboxInput, error) {
+	input := model.MailboxInput{
+		Identifier:   strings.TrimSpace(user.UserName),
+		UserFullName: user.DisplayName,
+		JobTitle:     user.Title,
+	}
+	if input.Identifier == "" {
+		return input, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "userName is required")
+	}
+
+	if strings.TrimSpace(input.UserFullName) == "" && user.Name != nil {
+		input.UserFullName = user.Name.Formatted
+		if strings.TrimSpace(input.UserFullName) == "" {
+			input.UserFullName = strings.TrimSpace(user.Name.GivenName + " " + user.Name.FamilyName)
+		}
+	}
+
+	department := ""
+	if user.Enterprise != nil {
+		department = user.Enterprise.Department
+		if user.Enterprise.Manager != nil {
+			input.ManagerIdentifier = strings.TrimSpace(user.Enterprise.Manager.Value)
+		}
+	}
+
+	departmentID, err := h.departmentID(ctx, department, current)
+	if err != nil {
+		return input, err
+	}
+	input.DepartmentID = departmentID
+
+	return input, nil
+}
+
+// departmentID resolves the enterprise department, which identity providers
+// hold as a name, to a department ID. A department ID is accepted as well.
+func (h *SCIMHandler) departmentID(ctx context.Context, department string, current *model.Mailbox) (int, error) {
+	department = strings.TrimSpace(department)
+	if department == "" {
+		return 0, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "%s:department is required", scim.SchemaEnterpriseUser)
+	}
+	if current != nil && strings.EqualFold(department, current.Department) {
+		return current.DepartmentID, nil
+	}
+
+	departments, err := h.departments.GetDepartments(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	matches := []int{}
+	for _, candidate := range departments {
+		if strings.EqualFold(candidate.Name, department) {
+			matches = append(matches, candidate.ID)
+		}
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		if id, err := strconv.Atoi(department); err == nil {
+			for _, candidate := range departments {
+				if candidate.ID == id {
+					return id, nil
+				}
+			}
+		}
+		return 0, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "department %q does not exist", department)
+	default:
+		return 0, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "department name %q is ambiguous; use the department ID", department)
+	}
+}
+
+// fail writes the SCIM error response for an error of the services or of
+// the scim package.
+func (h *SCIMHandler) fail(c *gin.Context, err error, message string) {
+	var scimErr *scim.Error
+	var validationErr *service.ValidationError
+
+	switch {
+	case errors.As(err, &scimErr):
+		writeSCIMError(c, scimErr)
+	case errors.As(err, &validationErr):
+		attribute, ok := scimAttributes[validationErr.Field]
+		if !ok {
+			attribute = validationErr.Field
+		}
+		scimType := scim.ErrInvalidValue
+		if strings.HasPrefix(validationErr.Message, "cannot be changed") {
+			scimType = scim.ErrMutability
+		}
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scimType, "invalid %s: %s", attribute, validationErr.Message))
+	case errors.Is(err, service.ErrMailboxNotFound):
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "User not found"))
+	case errors.Is(err, service.ErrMailboxExists):
+		writeSCIMError(c, scim.NewError(http.StatusConflict, scim.ErrUniqueness, "User already exists"))
+	case errors.Is(err, service.ErrMailboxHasReports):
+		writeSCIMError(c, scim.NewError(http.StatusConflict, "", "User has direct reports; move them or deactivate the user instead"))
+	case errors.Is(err, service.ErrDepartmentNotFound):
+		writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Group not found"))
+	case errors.Is(err, service.ErrDepartmentHasMembers):
+		writeSCIMError(c, scim.NewError(http.StatusConflict, "", "Group still has members"))
+	case errors.Is(err, service.ErrDepartmentHasSubDepartments):
+		writeSCIMError(c, scim.NewError(http.StatusConflict, "", "Group still has sub-departments"))
+	default:
+		h.logger.Error(message, "error", err)
+		writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", message))
+	}
+}
+
+// scimQuery holds the query parameters of a list request.
+type scimQuery struct {
+	filter     *scim.Filter
+	startIndex int
+	count      int
+	attributes []string
+	excluded   []string
+}
+
+// wants reports whether the response includes the attribute.
+func (q scimQuery) wants(attribute string) bool {
+	for _, excluded := range q.excluded {
+		if strings.EqualFold(excluded, attribute) {
+			return false
+		}
+	}
+	if len(q.attributes) == 0 {
+		return true
+	}
+	for _, requested := range q.attributes {
+		if strings.EqualFold(requested, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSCIMQuery reads filter, startIndex, count, attributes and
+// excludedAttributes. startIndex is 1-based; count defaults to
+// scim.DefaultCount and is capped at scim.MaxResults.
+func parseSCIMQuery(c *gin.Context) (scimQuery, bool) {
+	query := scimQuery{
+		startIndex: 1,
+		count:      scim.DefaultCount,
+		attributes: splitList(c.Query("attributes")),
+		excluded:   splitList(c.Query("excludedAttributes")),
+	}
+
+	if filter := c.Query("filter"); filter != "" {
+		parsed, err := scim.ParseFilter(filter)
+		if err != nil {
+			writeSCIMError(c, err.(*scim.Error))
+			return query, false
+		}
+		query.filter = parsed
+	}
+
+	for name, target := range map[string]*int{"startIndex": &query.startIndex, "count": &query.count} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "%s must be a number", name))
+			return query, false
+		}
+		*target = n
+	}
+
+	if query.startIndex < 1 {
+		query.startIndex = 1
+	}
+	if query.count < 0 {
+		query.count = 0
+	}
+	if query.count > scim.MaxResults {
+		query.count = scim.MaxResults
+	}
+	return query, true
+}
+
+// scimPage collects the page of resources that match the query's filter,
+// counting every match.
+type scimPage struct {
+	query     scimQuery
+	total     int
+	resources []interface{}
+}
+
+func newSCIMPage(query scimQuery) *scimPage {
+	return &scimPage{query: query, resources: []interface{}{}}
+}
+
+func (p *scimPage) add(resource map[string]interface{}) {
+	if p.query.filter != nil && !p.query.filter.Match(resource) {
+		return
+	}
+	p.total++
+	if p.total >= p.query.startIndex && len(p.resources) < p.query.count {
+		p.resources = append(p.resources, scim.Project(resource, p.query.attributes, p.query.excluded))
+	}
+}
+
+func (p *scimPage) response() scim.ListResponse {
+	return scim.NewListResponse(p.total, p.query.startIndex, p.resources)
+}
+
+// scimBaseURL returns the absolute URL of the SCIM root, from which resource
+// locations are built.
+func scimBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + SCIMBasePath
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func writeSCIM(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", scim.ContentType)
+	c.JSON(status, body)
+}
+
+func writeSCIMError(c *gin.Context, err *scim.Error) {
+	writeSCIM(c, err.StatusCode(), err)
+}
@@ -1,32 +1,82 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"net/http"
 	"strings"
 	"time"
 
+	"mailbox-api/authz"
 	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
 	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/oidc"
+	"mailbox-api/service"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 )
 
-type Role string
-
+// Context keys set by AuthMiddleware.
 const (
-	RoleCEO Role = "ceo"
-	RoleCTO Role = "cto"
+	ContextRole     = "role"
+	ContextIdentity = "mailbox_identifier"
+	ContextClaims   = "claims"
+	ContextGrants   = "grants"
 )
 
+// APIKeyRole is the role reported for callers that authenticate with an API
+// key. Their permissions are the key's scopes, not those of a policy role.
+const APIKeyRole authz.Role = "api_key"
+
+// APIKeyHeader carries an API key; "Authorization: ApiKey <key>" works too.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator looks up an API key. It returns nil if the key is
+// unknown, revoked or expired.
+type APIKeyAuthenticator interface {
+	AuthenticateAPIKey(ctx context.Context, key string) (*model.APIKey, error)
+}
+
+// RevocationList reports whether an access token has been revoked, by its
+// jti claim.
+type RevocationList interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// Claims carries the caller's role; the registered subject claim holds the
+// identifier of the caller's own mailbox.
 type Claims struct {
-	Role Role `json:"role"`
+	Role authz.Role `json:"role"`
 	jwt.RegisteredClaims
 }
 
-func AuthMiddleware(cfg *config.Config, logger *logger.Logger) gin.HandlerFunc {
+// AuthSources are the optional collaborators of AuthMiddleware; nil fields
+// are skipped.
+type AuthSources struct {
+	Revocations RevocationList
+	// OIDC validates tokens whose iss claim names the external provider.
+	OIDC    *oidc.Verifier
+	APIKeys APIKeyAuthenticator
+}
+
+// AuthMiddleware authenticates the caller with an API key or a bearer token.
+// It validates the bearer token and rejects tokens on the revocation list.
+// Tokens issued by this service must carry the configured issuer and
+// audience and a jti; the token's kid header selects the verification key.
+// Tokens from the configured OIDC provider are validated against its keys
+// instead and their claims mapped to a role and mailbox.
+func AuthMiddleware(cfg *config.Config, keys *jwtkeys.KeySet, logger *logger.Logger, sources AuthSources) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := apiKeyFrom(c); apiKey != "" {
+			authenticateAPIKey(c, sources.APIKeys, logger, apiKey)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
@@ -43,13 +93,13 @@ func AuthMiddleware(cfg *config.Config, logger *logger.Logger) gin.HandlerFunc {
 
 		tokenString := parts[1]
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(cfg.Auth.JWTSecret), nil
-		})
+		var claims *Claims
+		var err error
+		if sources.OIDC != nil && issuerOf(tokenString) == sources.OIDC.Issuer() {
+			claims, err = externalClaims(c.Request.Context(), sources.OIDC, tokenString)
+		} else {
+			claims, err = localClaims(cfg, keys, tokenString)
+		}
 
 		if err != nil {
 			logger.Error("Failed to parse token", "error", err)
@@ -58,52 +108,199 @@ func AuthMiddleware(cfg *config.Config, logger *logger.Logger) gin.HandlerFunc {
 			return
 		}
 
-		if !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
+		if sources.Revocations != nil && claims.ID != "" {
+			revoked, err := sources.Revocations.IsRevoked(c.Request.Context(), claims.ID)
+			if err != nil {
+				logger.Error("Failed to check token revocation", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				c.Abort()
+				return
+			}
+			if revoked {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+				c.Abort()
+				return
+			}
 		}
 
-		c.Set("role", claims.Role)
+		c.Set(ContextRole, claims.Role)
+		c.Set(ContextIdentity, claims.Subject)
+		c.Set(ContextClaims, claims)
 		c.Next()
 	}
 }
 
-func RoleMiddleware(roles ...Role) gin.HandlerFunc {
+// apiKeyFrom returns the API key the request carries, if any. Besides the
+// API key header and scheme, keys are accepted as bearer tokens, since
+// provisioning clients such as SCIM identity providers can only send those;
+// the key prefix tells them apart from JWTs.
+func apiKeyFrom(c *gin.Context) string {
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		return key
+	}
+	authorization := c.GetHeader("Authorization")
+	if key, ok := strings.CutPrefix(authorization, "ApiKey "); ok {
+		return key
+	}
+	if key, ok := strings.CutPrefix(authorization, "Bearer "); ok && strings.HasPrefix(key, service.APIKeyPrefix) {
+		return key
+	}
+	return ""
+}
+
+func authenticateAPIKey(c *gin.Context, apiKeys APIKeyAuthenticator, logger *logger.Logger, apiKey string) {
+	if apiKeys == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "API keys are not accepted"})
+		c.Abort()
+		return
+	}
+
+	key, err := apiKeys.AuthenticateAPIKey(c.Request.Context(), apiKey)
+	if err != nil {
+		logger.Error("Failed to authenticate API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		c.Abort()
+		return
+	}
+	if key == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+		c.Abort()
+		return
+	}
+
+	scopes := make([]authz.Permission, 0, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		scopes = append(scopes, authz.Permission(scope))
+	}
+
+	c.Set(ContextRole, APIKeyRole)
+	c.Set(ContextIdentity, key.MailboxIdentifier)
+	c.Set(ContextGrants, authz.NewGrants(scopes))
+	c.Next()
+}
+
+// Grants returns the caller's permissions: the scopes of their API key or,
+// for a token, the permissions of their role under the policy.
+func Grants(c *gin.Context, policy *authz.Policy) authz.Grants {
+	if grants, ok := c.Get(ContextGrants); ok {
+		return grants.(authz.Grants)
+	}
+	role, _ := c.Get(ContextRole)
+	userRole, _ := role.(authz.Role)
+	return policy.Grants(userRole)
+}
+
+func localClaims(cfg *config.Config, keys *jwtkeys.KeySet, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid ||
+		!claims.VerifyIssuer(cfg.Auth.Issuer, true) ||
+		!claims.VerifyAudience(cfg.Auth.Audience, true) ||
+		claims.ID == "" {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+// externalClaims converts a token from the OIDC provider into the claims of
+// a locally issued token, so handlers need not tell them apart.
+func externalClaims(ctx context.Context, verifier *oidc.Verifier, tokenString string) (*Claims, error) {
+	identity, err := verifier.Verify(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Claims{
+		Role: identity.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        identity.ID,
+			Issuer:    verifier.Issuer(),
+			Subject:   identity.MailboxIdentifier,
+			ExpiresAt: jwt.NewNumericDate(identity.ExpiresAt),
+		},
+	}, nil
+}
+
+// issuerOf reads the iss claim without verifying the token, only to decide
+// which verifier applies.
+func issuerOf(tokenString string) string {
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+// RequirePermission lets the request through if the caller holds at least
+// one of the permissions.
+func RequirePermission(policy *authz.Policy, permissions ...authz.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		role, exists := c.Get("role")
-		if !exists {
+		if _, exists := c.Get(ContextRole); !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
-		userRole := role.(Role)
-		for _, r := range roles {
-			if userRole == r {
-				c.Next()
-				return
-			}
+		if !Grants(c, policy).CanAny(permissions...) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			c.Abort()
+			return
 		}
 
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		c.Abort()
+		c.Next()
 	}
 }
 
-func GenerateToken(cfg *config.Config, role Role) (string, error) {
+// keyFunc looks up the verification key by the token's kid and only accepts
+// the algorithm that key was loaded for, so a token cannot switch a public
+// key into an HMAC secret.
+func keyFunc(keys *jwtkeys.KeySet) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keys.Get(kid)
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.VerificationKey(), nil
+	}
+}
+
+// GenerateToken signs a token for the given role, bound to the mailbox
+// identified by subject, with the key set's active key.
+func GenerateToken(cfg *config.Config, keys *jwtkeys.KeySet, role authz.Role, subject string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
 		Role: role,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			Issuer:    cfg.Auth.Issuer,
+			Audience:  jwt.ClaimStrings{cfg.Auth.Audience},
+			Subject:   subject,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * time.Duration(cfg.Auth.TokenExpiry))),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	key := keys.Active()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
 
-	tokenString, err := token.SignedString([]byte(cfg.Auth.JWTSecret))
+	tokenString, err := token.SignedString(key.SigningKey())
 	if err != nil {
 		return "", err
 	}
@@ -6,8 +6,11 @@ import (
 
 	"mailbox-api/api/handler"
 	"mailbox-api/api/middleware"
+	"mailbox-api/authz"
 	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
 	"mailbox-api/logger"
+	"mailbox-api/oidc"
 	"mailbox-api/service"
 
 	"github.com/gin-gonic/gin"
@@ -23,7 +26,25 @@ func (r *Router) GetEngine() *gin.Engine {
 	return r.engine
 }
 
-func SetupRouter(cfg *config.Config, logger *logger.Logger, mailboxService service.MailboxService) *Router {
+// Services are the application services the routes are wired to. Only
+// Mailbox and Org are required:
+//   - a nil Department service leaves out the department and SCIM routes
+//   - a nil Auth service disables the login endpoints and the token
+//     revocation check
+//   - a nil APIKey service disables API keys
+//   - a nil Sync service leaves out the sync import endpoints
+//   - a nil OIDC verifier disables tokens from an external identity provider
+type Services struct {
+	Mailbox    service.MailboxService
+	Org        service.OrgService
+	Department service.DepartmentService
+	Auth       service.AuthService
+	APIKey     service.APIKeyService
+	Sync       service.SyncService
+	OIDC       *oidc.Verifier
+}
+
+func SetupRouter(cfg *config.Config, logger *logger.Logger, policy *authz.Policy, keys *jwtkeys.KeySet, services Services) *Router {
 	router := &Router{
 		engine: gin.New(),
 		config: cfg,
@@ -33,49 +54,185 @@ func SetupRouter(cfg *config.Config, logger *logger.Logger, mailboxService servi
 	router.engine.Use(gin.Recovery())
 	router.engine.Use(middleware.LoggerMiddleware(logger))
 
-	mailboxHandler := handler.NewMailboxHandler(mailboxService, logger)
+	mailboxHandler := handler.NewMailboxHandler(services.Mailbox, policy, logger)
+	orgHandler := handler.NewOrgHandler(services.Org, policy, logger)
+	authHandler := handler.NewAuthHandler(cfg, keys, services.Mailbox, services.Auth, policy, logger)
+	authMiddleware := middleware.AuthMiddleware(cfg, keys, logger, middleware.AuthSources{
+		Revocations: services.Auth,
+		OIDC:        services.OIDC,
+		APIKeys:     services.APIKey,
+	})
 
 	router.engine.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	router.engine.GET("/.well-known/jwks.json", authHandler.JWKS)
+
 	api := router.engine.Group("/api")
 	{
-		api.GET("/token/ceo", func(c *gin.Context) {
-			token, err := middleware.GenerateToken(cfg, middleware.RoleCEO)
-			if err != nil {
-				logger.Error("Failed to generate CEO token", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-				return
+		// Unauthenticated token minting, for local development only
+		if cfg.Auth.DevMode {
+			api.GET("/token/:role", authHandler.IssueToken)
+		}
+
+		if services.Auth != nil {
+			auth := api.Group("/auth")
+			{
+				auth.POST("/login", authHandler.Login)
+				auth.POST("/refresh", authHandler.Refresh)
+				auth.POST("/logout", authMiddleware, authHandler.Logout)
 			}
-			c.JSON(http.StatusOK, gin.H{"token": token})
-		})
-
-		api.GET("/token/cto", func(c *gin.Context) {
-			token, err := middleware.GenerateToken(cfg, middleware.RoleCTO)
-			if err != nil {
-				logger.Error("Failed to generate CTO token", "error", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-				return
+
+			credentials := api.Group("/credentials")
+			credentials.Use(authMiddleware)
+			credentials.Use(middleware.RequirePermission(policy, authz.PermCredentialsManage))
+			{
+				credentials.POST("", authHandler.CreateCredential)
 			}
-			c.JSON(http.StatusOK, gin.H{"token": token})
-		})
+		}
 
-		// Protected routes for both CEO and CTO (with role-based filtering)
+		if services.APIKey != nil {
+			apiKeyHandler := handler.NewAPIKeyHandler(services.APIKey, policy, logger)
+
+			apiKeys := api.Group("/api-keys")
+			apiKeys.Use(authMiddleware)
+			apiKeys.Use(middleware.RequirePermission(policy, authz.PermAPIKeysManage))
+			{
+				apiKeys.POST("", apiKeyHandler.CreateAPIKey)
+				apiKeys.GET("", apiKeyHandler.ListAPIKeys)
+				apiKeys.DELETE("/:id", apiKeyHandler.RevokeAPIKey)
+			}
+		}
+
+		me := api.Group("/me")
+		me.Use(authMiddleware)
+		{
+			me.GET("", authHandler.Me)
+		}
+
+		// Protected routes for every role that can read mailboxes (with scope-based filtering)
 		mailboxes := api.Group("/mailboxes")
-		mailboxes.Use(middleware.AuthMiddleware(cfg, logger))
-		mailboxes.Use(middleware.RoleMiddleware(middleware.RoleCEO, middleware.RoleCTO))
+		mailboxes.Use(authMiddleware)
+		mailboxes.Use(middleware.RequirePermission(policy, authz.ReadPermissions...))
 		{
 			mailboxes.GET("", mailboxHandler.GetMailboxes)
 			mailboxes.GET("/:id", mailboxHandler.GetMailbox)
+			mailboxes.GET("/:id/chain", mailboxHandler.GetReportingChain)
+			mailboxes.GET("/:id/reports", mailboxHandler.GetReports)
+			mailboxes.GET("/:id/peers", mailboxHandler.GetPeers)
+			mailboxes.POST("", mailboxHandler.CreateMailbox)
+			mailboxes.PUT("/:id", mailboxHandler.ReplaceMailbox)
+			mailboxes.PATCH("/:id", mailboxHandler.PatchMailbox)
+			mailboxes.DELETE("/:id", mailboxHandler.DeleteMailbox)
 
-			// Only CEO can recalculate metrics
 			calcMetrics := mailboxes.Group("/calculate-metrics")
-			calcMetrics.Use(middleware.RoleMiddleware(middleware.RoleCEO))
+			calcMetrics.Use(middleware.RequirePermission(policy, authz.PermMetricsRecalculate))
 			{
 				calcMetrics.POST("", mailboxHandler.CalculateOrgMetrics)
 			}
 		}
+
+		if services.Department != nil {
+			departmentHandler := handler.NewDepartmentHandler(services.Department, logger)
+			requireWrite := middleware.RequirePermission(policy, authz.PermDepartmentWrite)
+
+			departments := api.Group("/departments")
+			departments.Use(authMiddleware)
+			departments.Use(middleware.RequirePermission(policy, authz.PermDepartmentRead, authz.PermDepartmentWrite))
+			{
+				departments.GET("", departmentHandler.GetDepartments)
+				departments.GET("/:id", departmentHandler.GetDepartment)
+				departments.POST("", requireWrite, departmentHandler.CreateDepartment)
+				departments.PATCH("/:id", requireWrite, departmentHandler.PatchDepartment)
+				departments.DELETE("/:id", requireWrite, departmentHandler.DeleteDepartment)
+			}
+		}
+
+		exportHandler := handler.NewExportHandler(services.Mailbox, services.Department, policy, cfg.LDAP.BaseDN, logger)
+
+		exports := api.Group("/export")
+		exports.Use(authMiddleware)
+		{
+			exports.GET("/mailboxes", middleware.RequirePermission(policy, authz.ReadPermissions...), exportHandler.ExportMailboxes)
+
+			if services.Department != nil {
+				exports.GET("/departments", middleware.RequirePermission(policy, authz.PermDepartmentRead, authz.PermDepartmentWrite), exportHandler.ExportDepartments)
+			}
+		}
+
+		importHandler := handler.NewImportHandler(services.Mailbox, services.Sync, logger)
+
+		imports := api.Group("/import")
+		imports.Use(authMiddleware)
+		imports.Use(middleware.RequirePermission(policy, authz.PermDirectoryImport))
+		{
+			imports.POST("/mailboxes", importHandler.ImportMailboxes)
+			imports.POST("/departments", importHandler.ImportDepartments)
+
+			if services.Sync != nil {
+				imports.POST("/mailboxes/sync", importHandler.SyncMailboxes)
+				imports.GET("/plans", importHandler.ListPlans)
+				imports.GET("/plans/:id", importHandler.GetPlan)
+				imports.POST("/plans/:id/apply", importHandler.ApplyPlan)
+			}
+		}
+
+		org := api.Group("/org")
+		org.Use(authMiddleware)
+		org.Use(middleware.RequirePermission(policy, authz.ReadPermissions...))
+		{
+			org.GET("/tree", orgHandler.GetTree)
+			org.GET("/relationship", orgHandler.GetRelationship)
+			org.GET("/export", orgHandler.ExportTree)
+			org.GET("/layout", orgHandler.GetLayout)
+
+			integrity := org.Group("/integrity")
+			integrity.Use(middleware.RequirePermission(policy, authz.PermOrgIntegrity))
+			{
+				integrity.GET("", orgHandler.GetIntegrity)
+			}
+		}
+	}
+
+	// SCIM 2.0 provisioning for identity providers: Users are mailboxes,
+	// Groups are departments
+	if services.Department != nil {
+		scimHandler := handler.NewSCIMHandler(services.Mailbox, services.Department, policy, logger)
+		requireRead := middleware.RequirePermission(policy, authz.ReadPermissions...)
+		requireWrite := middleware.RequirePermission(policy, authz.PermDepartmentWrite)
+
+		scim := router.engine.Group(handler.SCIMBasePath)
+		scim.Use(authMiddleware)
+		{
+			scim.GET("/ServiceProviderConfig", scimHandler.ServiceProviderConfig)
+			scim.GET("/ResourceTypes", scimHandler.ResourceTypes)
+			scim.GET("/ResourceTypes/:id", scimHandler.ResourceTypes)
+			scim.GET("/Schemas", scimHandler.Schemas)
+			scim.GET("/Schemas/:id", scimHandler.Schemas)
+
+			users := scim.Group("/Users")
+			users.Use(requireRead)
+			{
+				users.GET("", scimHandler.ListUsers)
+				users.GET("/:id", scimHandler.GetUser)
+				users.POST("", scimHandler.CreateUser)
+				users.PUT("/:id", scimHandler.ReplaceUser)
+				users.PATCH("/:id", scimHandler.PatchUser)
+				users.DELETE("/:id", scimHandler.DeleteUser)
+			}
+
+			groups := scim.Group("/Groups")
+			groups.Use(middleware.RequirePermission(policy, authz.PermDepartmentRead, authz.PermDepartmentWrite))
+			{
+				groups.GET("", scimHandler.ListGroups)
+				groups.GET("/:id", scimHandler.GetGroup)
+				groups.POST("", requireWrite, scimHandler.CreateGroup)
+				groups.PUT("/:id", requireWrite, scimHandler.ReplaceGroup)
+				groups.PATCH("/:id", requireWrite, scimHandler.PatchGroup)
+				groups.DELETE("/:id", requireWrite, scimHandler.DeleteGroup)
+			}
+		}
 	}
 
 	return router
@@ -0,0 +1,227 @@
+// Package authz maps roles to the permissions that guard the API. Handlers
+// and routes check permissions; which role holds which permission is data,
+// loaded from a policy file or taken from DefaultPolicy.
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"mailbox-api/model"
+)
+
+type Role string
+
+type Permission string
+
+const (
+	PermMailboxReadAll     Permission = "mailbox:read:all"
+	PermMailboxReadSubOrg  Permission = "mailbox:read:suborg"
+	PermMailboxReadSelf    Permission = "mailbox:read:self"
+	PermMailboxWrite       Permission = "mailbox:write"
+	PermMetricsRecalculate Permission = "metrics:recalculate"
+	PermOrgIntegrity       Permission = "org:integrity"
+	PermDepartmentRead     Permission = "department:read"
+	PermDepartmentWrite    Permission = "department:write"
+	PermCredentialsManage  Permission = "credentials:manage"
+	PermAPIKeysManage      Permission = "api_keys:manage"
+	PermDirectoryImport    Permission = "directory:import"
+
+	// PermAll grants every permission.
+	PermAll Permission = "*"
+)
+
+// Roles of the built-in policy.
+const (
+	RoleAdmin   Role = "admin"
+	RoleCEO     Role = "ceo"
+	RoleCTO     Role = "cto"
+	RoleHR      Role = "hr"
+	RoleManager Role = "manager"
+	RoleAuditor Role = "auditor"
+	RoleSelf    Role = "self"
+)
+
+// ReadPermissions are the permissions that grant access to at least some
+// mailboxes.
+var ReadPermissions = []Permission{PermMailboxReadAll, PermMailboxReadSubOrg, PermMailboxReadSelf}
+
+// KnownPermissions lists every permission the API checks, excluding PermAll.
+var KnownPermissions = []Permission{
+	PermMailboxReadAll,
+	PermMailboxReadSubOrg,
+	PermMailboxReadSelf,
+	PermMailboxWrite,
+	PermMetricsRecalculate,
+	PermOrgIntegrity,
+	PermDepartmentRead,
+	PermDepartmentWrite,
+	PermCredentialsManage,
+	PermAPIKeysManage,
+	PermDirectoryImport,
+}
+
+// IsKnown reports whether the permission is checked anywhere in the API.
+func IsKnown(permission Permission) bool {
+	for _, known := range KnownPermissions {
+		if known == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type Policy struct {
+	roles map[Role]Grants
+}
+
+// policyFile is the on-disk format of a policy:
+//
+//	{"roles": {"hr": ["mailbox:read:all", "mailbox:write"]}}
+type policyFile struct {
+	Roles map[Role][]Permission `json:"roles"`
+}
+
+func NewPolicy(roles map[Role][]Permission) *Policy {
+	p := &Policy{roles: make(map[Role]Grants, len(roles))}
+	for role, permissions := range roles {
+		p.roles[role] = NewGrants(permissions)
+	}
+	return p
+}
+
+func DefaultPolicy() *Policy {
+	return NewPolicy(map[Role][]Permission{
+		RoleAdmin:   {PermAll},
+		RoleCEO:     {PermMailboxReadAll, PermMailboxWrite, PermMetricsRecalculate, PermOrgIntegrity, PermDepartmentRead, PermDepartmentWrite, PermDirectoryImport},
+		RoleCTO:     {PermMailboxReadSubOrg, PermMailboxWrite, PermDepartmentRead},
+		RoleHR:      {PermMailboxReadAll, PermMailboxWrite, PermDepartmentRead, PermDepartmentWrite, PermDirectoryImport},
+		RoleManager: {PermMailboxReadSubOrg, PermMailboxWrite, PermDepartmentRead},
+		RoleAuditor: {PermMailboxReadAll, PermOrgIntegrity, PermDepartmentRead},
+		RoleSelf:    {PermMailboxReadSelf},
+	})
+}
+
+// LoadPolicy reads a JSON policy file. An empty path returns DefaultPolicy.
+// Permissions other than PermAll and KnownPermissions are rejected, so that a
+// misspelt permission fails at startup instead of silently granting nothing.
+func LoadPolicy(path string) (*Policy, error) {
+	if path == "" {
+		return DefaultPolicy(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var file policyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %w", err)
+	}
+
+	if len(file.Roles) == 0 {
+		return nil, fmt.Errorf("policy file %s defines no roles", path)
+	}
+
+	roles := make([]string, 0, len(file.Roles))
+	for role := range file.Roles {
+		roles = append(roles, string(role))
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		for _, permission := range file.Roles[Role(role)] {
+			if permission != PermAll && !IsKnown(permission) {
+				return nil, fmt.Errorf("policy file %s grants role %s the unknown permission %q", path, role, permission)
+			}
+		}
+	}
+
+	return NewPolicy(file.Roles), nil
+}
+
+// HasRole reports whether the policy defines the role.
+func (p *Policy) HasRole(role Role) bool {
+	_, ok := p.roles[role]
+	return ok
+}
+
+// Grants returns the permissions the role holds. Unknown roles hold none.
+func (p *Policy) Grants(role Role) Grants {
+	if grants, ok := p.roles[role]; ok {
+		return grants
+	}
+	return Grants{}
+}
+
+// Can reports whether the role holds the permission.
+func (p *Policy) Can(role Role, permission Permission) bool {
+	return p.Grants(role).Can(permission)
+}
+
+// CanAny reports whether the role holds at least one of the permissions.
+func (p *Policy) CanAny(role Role, permissions ...Permission) bool {
+	return p.Grants(role).CanAny(permissions...)
+}
+
+// Permissions returns the role's permissions in sorted order.
+func (p *Policy) Permissions(role Role) []Permission {
+	return p.Grants(role).List()
+}
+
+// Grants is a set of permissions, either those of a role or the scopes of an
+// API key.
+type Grants map[Permission]bool
+
+func NewGrants(permissions []Permission) Grants {
+	grants := make(Grants, len(permissions))
+	for _, permission := range permissions {
+		grants[permission] = true
+	}
+	return grants
+}
+
+// Can reports whether the set holds the permission.
+func (g Grants) Can(permission Permission) bool {
+	return g[PermAll] || g[permission]
+}
+
+// CanAny reports whether the set holds at least one of the permissions.
+func (g Grants) CanAny(permissions ...Permission) bool {
+	for _, permission := range permissions {
+		if g.Can(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadScope returns which part of the directory the holder can read, taking
+// the broadest read permission they hold. Scopes below "all" are relative to
+// the mailbox the token or API key is bound to, so they need an identity.
+func (g Grants) ReadScope(identity string) string {
+	switch {
+	case g.Can(PermMailboxReadAll):
+		return model.ScopeAll
+	case identity == "":
+		return model.ScopeNone
+	case g.Can(PermMailboxReadSubOrg):
+		return model.ScopeSubOrg
+	case g.Can(PermMailboxReadSelf):
+		return model.ScopeSelf
+	default:
+		return model.ScopeNone
+	}
+}
+
+// List returns the permissions in sorted order.
+func (g Grants) List() []Permission {
+	permissions := []Permission{}
+	for permission := range g {
+		permissions = append(permissions, permission)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i] < permissions[j] })
+	return permissions
+}
@@ -12,6 +12,8 @@ type Config struct {
 	Server   ServerConfig
 	Database DatabaseConfig
 	Auth     AuthConfig
+	OIDC     OIDCConfig
+	LDAP     LDAPConfig
 }
 
 type ServerConfig struct {
@@ -28,8 +30,45 @@ type DatabaseConfig struct {
 }
 
 type AuthConfig struct {
-	JWTSecret   string
-	TokenExpiry int
+	JWTSecret string
+	// JWTKeysDir holds one PEM file per signing key, named <kid>.pem. When
+	// set, tokens are signed with RS256 or ES256 instead of JWTSecret.
+	JWTKeysDir         string
+	JWTSigningKeyID    string
+	TokenExpiry        int
+	RefreshTokenExpiry int
+	Issuer             string
+	Audience           string
+	PolicyFile         string
+	// DevMode enables the unauthenticated /api/token/:role endpoint.
+	DevMode           bool
+	BootstrapUsername string
+	BootstrapPassword string
+}
+
+// OIDCConfig enables tokens from an external identity provider. It is
+// disabled unless Issuer is set.
+type OIDCConfig struct {
+	Issuer   string
+	Audience string
+	JWKSURL  string
+	JWKSFile string
+	// MailboxClaim and GroupsClaim name the claims, possibly as dotted paths,
+	// that hold the mailbox identifier and the caller's groups.
+	MailboxClaim string
+	GroupsClaim  string
+	// RoleMappings is a comma-separated list of group=role pairs, checked in
+	// order.
+	RoleMappings string
+	DefaultRole  string
+}
+
+// LDAPConfig names the LDAP directory the mailboxes are exported to and
+// imported from. ListenAddr, if set, serves the directory read-only over
+// LDAP.
+type LDAPConfig struct {
+	BaseDN     string
+	ListenAddr string
 }
 
 func Load() (*Config, error) {
@@ -46,11 +85,21 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("invalid SERVER_PORT: %w", err)
 	}
 
-	tokenExpiry, err := strconv.Atoi(getEnv("TOKEN_EXPIRY", "60"))
+	tokenExpiry, err := strconv.Atoi(getEnv("TOKEN_EXPIRY", "15"))
 	if err != nil {
 		return nil, fmt.Errorf("invalid TOKEN_EXPIRY: %w", err)
 	}
 
+	refreshTokenExpiry, err := strconv.Atoi(getEnv("REFRESH_TOKEN_EXPIRY", "10080"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REFRESH_TOKEN_EXPIRY: %w", err)
+	}
+
+	devMode, err := strconv.ParseBool(getEnv("AUTH_DEV_MODE", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTH_DEV_MODE: %w", err)
+	}
+
 	return &Config{
 		Server: ServerConfig{
 			Port: serverPort,
@@ -64,8 +113,31 @@ func Load() (*Config, error) {
 			SSLMode:  getEnv("DB_SSLMODE", "disable"),
 		},
 		Auth: AuthConfig{
-			JWTSecret:   getEnv("JWT_SECRET", "secure-jwt-secret-key-should-be-long-and-complex"),
-			TokenExpiry: tokenExpiry,
+			JWTSecret:          getEnv("JWT_SECRET", "secure-jwt-secret-key-should-be-long-and-complex"),
+			JWTKeysDir:         getEnv("JWT_KEYS_DIR", ""),
+			JWTSigningKeyID:    getEnv("JWT_SIGNING_KEY_ID", ""),
+			TokenExpiry:        tokenExpiry,
+			RefreshTokenExpiry: refreshTokenExpiry,
+			Issuer:             getEnv("JWT_ISSUER", "mailbox-api"),
+			Audience:           getEnv("JWT_AUDIENCE", "mailbox-api"),
+			PolicyFile:         getEnv("RBAC_POLICY_FILE", ""),
+			DevMode:            devMode,
+			BootstrapUsername:  getEnv("AUTH_BOOTSTRAP_USERNAME", ""),
+			BootstrapPassword:  getEnv("AUTH_BOOTSTRAP_PASSWORD", ""),
+		},
+		OIDC: OIDCConfig{
+			Issuer:       getEnv("OIDC_ISSUER", ""),
+			Audience:     getEnv("OIDC_AUDIENCE", ""),
+			JWKSURL:      getEnv("OIDC_JWKS_URL", ""),
+			JWKSFile:     getEnv("OIDC_JWKS_FILE", ""),
+			MailboxClaim: getEnv("OIDC_MAILBOX_CLAIM", "email"),
+			GroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+			RoleMappings: getEnv("OIDC_ROLE_MAPPINGS", ""),
+			DefaultRole:  getEnv("OIDC_DEFAULT_ROLE", ""),
+		},
+		LDAP: LDAPConfig{
+			BaseDN:     getEnv("LDAP_BASE_DN", "dc=example,dc=com"),
+			ListenAddr: getEnv("LDAP_LISTEN_ADDR", ""),
 		},
 	}, nil
 }
@@ -17,31 +17,53 @@ func FilterMailboxFields(mailboxes []model.Mailbox, fields []string) []map[strin
 	result := make([]map[string]interface{}, len(mailboxes))
 
 	for i, mailbox := range mailboxes {
-		m := make(map[string]interface{})
-
-		for _, field := range fields {
-			switch field {
-			case "mailbox_identifier":
-				m["mailbox_identifier"] = mailbox.Identifier
-			case "user_full_name":
-				m["user_full_name"] = mailbox.UserFullName
-			case "job_title":
-				m["job_title"] = mailbox.JobTitle
-			case "department_id":
-				m["department_id"] = mailbox.DepartmentID
-			case "department":
-				m["department"] = mailbox.Department
-			case "org_depth":
-				m["org_depth"] = mailbox.OrgDepth
-			case "sub_org_size":
-				m["sub_org_size"] = mailbox.SubOrgSize
-			case "manager_mailbox_identifier":
-				m["manager_mailbox_identifier"] = mailbox.ManagerIdentifier
-			}
-		}
-
-		result[i] = m
+		result[i] = MailboxFields(mailbox, fields)
 	}
 
 	return result
 }
+
+// FilterOrgTreeFields projects every node of the tree onto the given fields.
+// The reports of each node are always included.
+func FilterOrgTreeFields(node *model.OrgTreeNode, fields []string) map[string]interface{} {
+	m := MailboxFields(node.Mailbox, fields)
+
+	reports := make([]map[string]interface{}, len(node.Reports))
+	for i, report := range node.Reports {
+		reports[i] = FilterOrgTreeFields(report, fields)
+	}
+	m["reports"] = reports
+
+	return m
+}
+
+// MailboxFields projects a mailbox onto the given fields; unknown fields
+// are ignored.
+func MailboxFields(mailbox model.Mailbox, fields []string) map[string]interface{} {
+	m := make(map[string]interface{})
+
+	for _, field := range fields {
+		switch field {
+		case "mailbox_identifier":
+			m["mailbox_identifier"] = mailbox.Identifier
+		case "user_full_name":
+			m["user_full_name"] = mailbox.UserFullName
+		case "job_title":
+			m["job_title"] = mailbox.JobTitle
+		case "department_id":
+			m["department_id"] = mailbox.DepartmentID
+		case "department":
+			m["department"] = mailbox.Department
+		case "org_depth":
+			m["org_depth"] = mailbox.OrgDepth
+		case "sub_org_size":
+			m["sub_org_size"] = mailbox.SubOrgSize
+		case "manager_mailbox_identifier":
+			m["manager_mailbox_identifier"] = mailbox.ManagerIdentifier
+		case "active":
+			m["active"] = mailbox.Active
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,330 @@
+// Package export writes mailboxes and departments record by record in the
+// formats the directory can be exported in, so that exports of any size are
+// streamed instead of being built in memory.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mailbox-api/dto"
+	"mailbox-api/ldif"
+	"mailbox-api/model"
+)
+
+// Export formats.
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatLDIF   = "ldif"
+)
+
+// Formats lists the supported export formats.
+var Formats = []string{FormatCSV, FormatJSON, FormatNDJSON, FormatLDIF}
+
+// MailboxColumns are the CSV columns of a mailbox export, in the layout of
+// data/mailboxes.csv.
+var MailboxColumns = []string{"mailbox_identifier", "user_full_name", "job_title", "department_id", "manager_mailbox_identifier"}
+
+// DepartmentColumns are the CSV columns of a department export: the layout of
+// data/departments.csv followed by the optional hierarchy columns.
+var DepartmentColumns = []string{"department_id", "department_name", "parent_department_id", "cost_center"}
+
+var mediaTypes = map[string]string{
+	"text/csv":             FormatCSV,
+	"application/json":     FormatJSON,
+	"application/x-ndjson": FormatNDJSON,
+	"application/ndjson":   FormatNDJSON,
+	"text/x-ldif":          FormatLDIF,
+}
+
+// Options configure an export. Fields limit mailbox exports to the given
+// fields, except in LDIF, whose entries are named below BaseDN.
+type Options struct {
+	Fields []string
+	BaseDN string
+}
+
+// IsFormat reports whether the format can be exported.
+func IsFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the media type of an exported format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatLDIF:
+		return "text/x-ldif; charset=utf-8"
+	default:
+		return "application/json; charset=utf-8"
+	}
+}
+
+// Negotiate picks the format the Accept header prefers most, by quality and
+// then by order. It returns "" if the header names none of the formats
+// explicitly; wildcards are left for the caller's default.
+func Negotiate(accept string) string {
+	type candidate struct {
+		format  string
+		quality float64
+	}
+	candidates := []candidate{}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := mediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if quality > 0 {
+			candidates = append(candidates, candidate{format: format, quality: quality})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+	return candidates[0].format
+}
+
+// writer writes records as CSV rows, as the elements of a JSON array, as
+// JSON lines, or as LDIF entries. The CSV header, the opening bracket of the
+// array, or the LDIF version and container entry, is written with the first
+// record or on Close, so an empty export is still valid.
+type writer struct {
+	format    string
+	out       io.Writer
+	csv       *csv.Writer
+	json      *json.Encoder
+	columns   []string
+	container ldif.Entry
+	started   bool
+}
+
+func newWriter(w io.Writer, format string, columns []string, container ldif.Entry) (*writer, error) {
+	if !IsFormat(format) {
+		return nil, fmt.Errorf("unsupported export format %q", format)
+	}
+
+	wr := &writer{format: format, out: w, columns: columns, container: container}
+	switch format {
+	case FormatCSV:
+		wr.csv = csv.NewWriter(w)
+	default:
+		wr.json = json.NewEncoder(w)
+		wr.json.SetEscapeHTML(false)
+	}
+	return wr, nil
+}
+
+func (w *writer) write(row []string, value interface{}, entry ldif.Entry) error {
+	first := !w.started
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	switch w.format {
+	case FormatCSV:
+		return w.csv.Write(row)
+	case FormatJSON:
+		if !first {
+			if _, err := io.WriteString(w.out, ","); err != nil {
+				return err
+			}
+		}
+		return w.json.Encode(value)
+	case FormatLDIF:
+		return ldif.WriteEntry(w.out, entry)
+	default:
+		return w.json.Encode(value)
+	}
+}
+
+func (w *writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	switch w.format {
+	case FormatCSV:
+		return w.csv.Write(w.columns)
+	case FormatJSON:
+		_, err := io.WriteString(w.out, "[\n")
+		return err
+	case FormatLDIF:
+		if _, err := io.WriteString(w.out, ldif.Header+"\n"); err != nil {
+			return err
+		}
+		return ldif.WriteEntry(w.out, w.container)
+	}
+	return nil
+}
+
+// Close ends the export and flushes any buffered output.
+func (w *writer) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	switch w.format {
+	case FormatCSV:
+		w.csv.Flush()
+		return w.csv.Error()
+	case FormatJSON:
+		_, err := io.WriteString(w.out, "]\n")
+		return err
+	}
+	return nil
+}
+
+// MailboxWriter exports mailboxes. By default a CSV row has the columns of
+// data/mailboxes.csv and a JSON record every field of the mailbox; with
+// fields, both are limited to the given fields in the given order. LDIF
+// exports are inetOrgPerson entries under ou=people.
+type MailboxWriter struct {
+	*writer
+	fields    []string
+	directory ldif.Directory
+}
+
+func NewMailboxWriter(w io.Writer, format string, options Options) (*MailboxWriter, error) {
+	columns := MailboxColumns
+	if len(options.Fields) > 0 {
+		columns = []string{}
+		for _, field := range options.Fields {
+			if _, ok := mailboxCell(model.Mailbox{}, field); ok {
+				columns = append(columns, field)
+			}
+		}
+	}
+
+	directory := ldif.Directory{BaseDN: options.BaseDN}
+	wr, err := newWriter(w, format, columns, directory.PeopleEntry())
+	if err != nil {
+		return nil, err
+	}
+	return &MailboxWriter{writer: wr, fields: options.Fields, directory: directory}, nil
+}
+
+func (w *MailboxWriter) Write(mailbox model.Mailbox) error {
+	var row []string
+	var value interface{} = mailbox
+	var entry ldif.Entry
+
+	switch {
+	case w.format == FormatCSV:
+		row = make([]string, len(w.columns))
+		for i, column := range w.columns {
+			row[i], _ = mailboxCell(mailbox, column)
+		}
+	case w.format == FormatLDIF:
+		entry = w.directory.MailboxEntry(mailbox)
+	case len(w.fields) > 0:
+		value = dto.MailboxFields(mailbox, w.fields)
+	}
+
+	return w.write(row, value, entry)
+}
+
+// mailboxCell formats a field of the mailbox for CSV. A missing manager is
+// written as "null", as in data/mailboxes.csv.
+func mailboxCell(mailbox model.Mailbox, field string) (string, bool) {
+	switch field {
+	case "mailbox_identifier":
+		return mailbox.Identifier, true
+	case "user_full_name":
+		return mailbox.UserFullName, true
+	case "job_title":
+		return mailbox.JobTitle, true
+	case "department_id":
+		return strconv.Itoa(mailbox.DepartmentID), true
+	case "department":
+		return mailbox.Department, true
+	case "manager_mailbox_identifier":
+		if mailbox.ManagerIdentifier == "" {
+			return "null", true
+		}
+		return mailbox.ManagerIdentifier, true
+	case "org_depth":
+		return strconv.Itoa(mailbox.OrgDepth), true
+	case "sub_org_size":
+		return strconv.Itoa(mailbox.SubOrgSize), true
+	case "active":
+		return strconv.FormatBool(mailbox.Active), true
+	default:
+		return "", false
+	}
+}
+
+// DepartmentWriter exports departments. A top-level department has an empty
+// parent_department_id in CSV. LDIF exports are organizationalUnit entries
+// under ou=departments, nested as the department tree; since a department
+// can only be written after its parent, they are written on Close.
+type DepartmentWriter struct {
+	*writer
+	directory ldif.Directory
+	pending   []model.Department
+}
+
+func NewDepartmentWriter(w io.Writer, format string, options Options) (*DepartmentWriter, error) {
+	directory := ldif.Directory{BaseDN: options.BaseDN}
+	wr, err := newWriter(w, format, DepartmentColumns, directory.DepartmentsEntry())
+	if err != nil {
+		return nil, err
+	}
+	return &DepartmentWriter{writer: wr, directory: directory}, nil
+}
+
+func (w *DepartmentWriter) Write(department model.Department) error {
+	if w.format == FormatLDIF {
+		w.pending = append(w.pending, department)
+		return nil
+	}
+
+	parent := ""
+	if department.ParentID != 0 {
+		parent = strconv.Itoa(department.ParentID)
+	}
+
+	row := []string{strconv.Itoa(department.ID), department.Name, parent, department.CostCenter}
+	return w.write(row, department, ldif.Entry{})
+}
+
+// Close writes any pending LDIF entries and ends the export.
+func (w *DepartmentWriter) Close() error {
+	for _, entry := range w.directory.DepartmentEntries(w.pending) {
+		if err := w.write(nil, nil, entry); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return w.writer.Close()
+}
@@ -0,0 +1,343 @@
+// Package jwtkeys holds the keys used to sign and verify access tokens. A key
+// set is either a single shared HS256 secret or a directory of PEM files, one
+// per key, named after the key's kid. Asymmetric public keys are published as
+// a JWKS document so other services can verify tokens without the signing key,
+// and ParseJWKS reads such a document from an external identity provider.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+)
+
+// Key is a single signing or verification key. Keys loaded from a public key
+// file have no signing key and are only used for verification, which lets a
+// retired key keep verifying tokens until they expire.
+type Key struct {
+	ID        string
+	Algorithm string
+	signing   interface{}
+	verifying interface{}
+}
+
+// SigningKey returns the key to pass to jwt.Token.SignedString, or nil for a
+// verification-only key.
+func (k *Key) SigningKey() interface{} {
+	return k.signing
+}
+
+// VerificationKey returns the key to return from a jwt.Keyfunc.
+func (k *Key) VerificationKey() interface{} {
+	return k.verifying
+}
+
+// KeySet is safe for concurrent use; Reload swaps the keys atomically so that
+// keys can be rotated while the server is running.
+type KeySet struct {
+	mu       sync.RWMutex
+	dir      string
+	activeID string
+	keys     map[string]*Key
+	active   *Key
+}
+
+// NewHMAC returns a key set with a single HS256 secret and an empty kid.
+func NewHMAC(secret string) *KeySet {
+	key := &Key{Algorithm: AlgorithmHS256, signing: []byte(secret), verifying: []byte(secret)}
+	return &KeySet{keys: map[string]*Key{"": key}, active: key}
+}
+
+// Load reads every *.pem file in dir. The file name without extension is the
+// key's kid. RSA keys sign with RS256 and P-256 keys with ES256. Tokens are
+// signed with the key named activeID or, if activeID is empty, with the
+// private key whose kid sorts last, so that kids named by date rotate on
+// their own.
+func Load(dir string, activeID string) (*KeySet, error) {
+	s := &KeySet{dir: dir, activeID: activeID}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the key directory. On error the current keys stay in use.
+func (s *KeySet) Reload() error {
+	if s.dir == "" {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.pem"))
+	if err != nil {
+		return fmt.Errorf("failed to list key files: %w", err)
+	}
+
+	keys := make(map[string]*Key, len(paths))
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+	}
+
+	active, err := selectActive(keys, s.activeID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.active = active
+
+	return nil
+}
+
+// Active returns the key that signs new tokens.
+func (s *KeySet) Active() *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// Get returns the key with the given kid.
+func (s *KeySet) Get(kid string) (*Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// JWK is the public part of an asymmetric key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set in kid order. HMAC secrets are
+// never published.
+func (s *KeySet) JWKS() JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, kid := range sortedIDs(s.keys) {
+		key := s.keys[kid]
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+
+		switch public := key.verifying.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(public.N)
+			jwk.E = encode(big.NewInt(int64(public.E)))
+		case *ecdsa.PublicKey:
+			jwk.KeyType = "EC"
+			jwk.Curve = public.Curve.Params().Name
+			jwk.X = encodeFixed(public.X, 32)
+			jwk.Y = encodeFixed(public.Y, 32)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key file %s contains no PEM block", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key file %s has unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.signing = signer
+		parsed = signer.Public()
+	}
+
+	switch public := parsed.(type) {
+	case *rsa.PublicKey:
+		key.Algorithm = AlgorithmRS256
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key file %s: only P-256 EC keys are supported", path)
+		}
+		key.Algorithm = AlgorithmES256
+	default:
+		return nil, fmt.Errorf("key file %s: unsupported key type %T", path, parsed)
+	}
+	key.verifying = parsed
+
+	return key, nil
+}
+
+func selectActive(keys map[string]*Key, activeID string) (*Key, error) {
+	if activeID != "" {
+		key, ok := keys[activeID]
+		if !ok {
+			return nil, fmt.Errorf("signing key %s not found", activeID)
+		}
+		if key.signing == nil {
+			return nil, fmt.Errorf("signing key %s has no private key", activeID)
+		}
+		return key, nil
+	}
+
+	ids := sortedIDs(keys)
+	for i := len(ids) - 1; i >= 0; i-- {
+		if keys[ids[i]].signing != nil {
+			return keys[ids[i]], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no private key found")
+}
+
+func sortedIDs(keys map[string]*Key) []string {
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func encode(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// encodeFixed pads EC coordinates to the curve size as RFC 7518 requires.
+func encodeFixed(n *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+}
+
+// ParseJWKS builds a verification-only key set from a JWKS document, such as
+// the one published by an external identity provider. Keys that are not
+// signing keys or whose type is not supported are skipped.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var jwks JWKS
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*Key, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys[key.ID] = key
+		}
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+func parseJWK(jwk JWK) (*Key, error) {
+	key := &Key{ID: jwk.KeyID}
+
+	switch {
+	case jwk.KeyType == "RSA" && (jwk.Algorithm == "" || jwk.Algorithm == AlgorithmRS256):
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus in key %s: %w", jwk.KeyID, err)
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent in key %s", jwk.KeyID)
+		}
+		key.Algorithm = AlgorithmRS256
+		key.verifying = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case jwk.KeyType == "EC" && jwk.Curve == "P-256" && (jwk.Algorithm == "" || jwk.Algorithm == AlgorithmES256):
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate in key %s: %w", jwk.KeyID, err)
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate in key %s: %w", jwk.KeyID, err)
+		}
+		if x.BitLen() > 256 || y.BitLen() > 256 {
+			return nil, fmt.Errorf("key %s is not on curve P-256", jwk.KeyID)
+		}
+		point := append([]byte{4}, append(x.FillBytes(make([]byte, 32)), y.FillBytes(make([]byte, 32))...)...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("key %s is not on curve P-256", jwk.KeyID)
+		}
+		key.Algorithm = AlgorithmES256
+		key.verifying = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return nil, nil
+	}
+
+	return key, nil
+}
+
+func decode(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,228 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER classes and universal tags used by LDAP.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10
+	tagSet         = 0x11
+)
+
+// maxDepth limits the nesting of a message, which bounds the recursion of
+// decoding and of filter evaluation.
+const maxDepth = 64
+
+var errMessageTooLarge = errors.New("message too large")
+
+// packet is a BER element. Primitive elements carry their content in value,
+// constructed ones their elements in children.
+type packet struct {
+	class       byte
+	constructed bool
+	tag         int
+	value       []byte
+	children    []*packet
+}
+
+// readPacket reads one element of at most maxSize bytes of content. Only
+// the definite length forms LDAP requires are supported.
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	identifier, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxSize {
+		return nil, errMessageTooLarge
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return decodeContent(identifier, content, 0)
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first < 0x80 {
+		return int(first), nil
+	}
+
+	n := int(first & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("unsupported length encoding")
+	}
+	length := 0
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	return length, nil
+}
+
+func decodeContent(identifier byte, content []byte, depth int) (*packet, error) {
+	if identifier&0x1f == 0x1f {
+		return nil, fmt.Errorf("high tag numbers are not supported")
+	}
+	if depth > maxDepth {
+		return nil, fmt.Errorf("message nested too deeply")
+	}
+
+	p := &packet{
+		class:       identifier & 0xc0,
+		constructed: identifier&0x20 != 0,
+		tag:         int(identifier & 0x1f),
+	}
+	if !p.constructed {
+		p.value = content
+		return p, nil
+	}
+
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, fmt.Errorf("truncated element")
+		}
+		child := content[0]
+		r := &sliceReader{data: content[1:]}
+		length, err := readLength(r)
+		if err != nil {
+			return nil, fmt.Errorf("truncated element")
+		}
+		if length > len(r.data) {
+			return nil, fmt.Errorf("truncated element")
+		}
+
+		decoded, err := decodeContent(child, r.data[:length], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, decoded)
+		content = r.data[length:]
+	}
+	return p, nil
+}
+
+type sliceReader struct {
+	data []byte
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+// is reports whether the element has the class and tag.
+func (p *packet) is(class byte, tag int) bool {
+	return p.class == class && p.tag == tag
+}
+
+func (p *packet) string() string {
+	return string(p.value)
+}
+
+func (p *packet) int() (int, error) {
+	if p.constructed || len(p.value) == 0 || len(p.value) > 4 {
+		return 0, fmt.Errorf("invalid integer")
+	}
+	n := int(int8(p.value[0]))
+	for _, b := range p.value[1:] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+func (p *packet) bool() bool {
+	return len(p.value) > 0 && p.value[0] != 0
+}
+
+// encode returns the BER encoding of the element.
+func (p *packet) encode() []byte {
+	content := p.value
+	if p.constructed {
+		content = nil
+		for _, child := range p.children {
+			content = append(content, child.encode()...)
+		}
+	}
+
+	identifier := p.class | byte(p.tag)
+	if p.constructed {
+		identifier |= 0x20
+	}
+
+	out := []byte{identifier}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func constructed(class byte, tag int, children ...*packet) *packet {
+	return &packet{class: class, constructed: true, tag: tag, children: children}
+}
+
+func primitive(class byte, tag int, value []byte) *packet {
+	return &packet{class: class, tag: tag, value: value}
+}
+
+func sequence(children ...*packet) *packet {
+	return constructed(classUniversal, tagSequence, children...)
+}
+
+func octetString(s string) *packet {
+	return primitive(classUniversal, tagOctetString, []byte(s))
+}
+
+func integer(n int) *packet {
+	return primitive(classUniversal, tagInteger, encodeInt(n))
+}
+
+func enumerated(n int) *packet {
+	return primitive(classUniversal, tagEnumerated, encodeInt(n))
+}
+
+// encodeInt returns the shortest two's complement encoding of n.
+func encodeInt(n int) []byte {
+	out := []byte{byte(n)}
+	for v := n >> 8; ; v >>= 8 {
+		last := out[0]
+		if (v == 0 && last&0x80 == 0) || (v == -1 && last&0x80 != 0) {
+			return out
+		}
+		out = append([]byte{byte(v)}, out...)
+	}
+}
@@ -0,0 +1,226 @@
+package ldap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mailbox-api/ldif"
+	"mailbox-api/model"
+)
+
+// Filter choices (RFC 4511, section 4.5.1).
+const (
+	filterAnd            = 0
+	filterOr             = 1
+	filterNot            = 2
+	filterEquality       = 3
+	filterSubstrings     = 4
+	filterGreaterOrEqual = 5
+	filterLessOrEqual    = 6
+	filterPresent        = 7
+	filterApprox         = 8
+	filterExtensible     = 9
+)
+
+// filter is a decoded search filter.
+type filter struct {
+	op       int
+	attr     string
+	value    string
+	initial  string
+	any      []string
+	final    string
+	children []*filter
+}
+
+func parseFilter(p *packet) (*filter, error) {
+	if p.class != classContext {
+		return nil, fmt.Errorf("invalid filter")
+	}
+	f := &filter{op: p.tag}
+
+	switch p.tag {
+	case filterAnd, filterOr, filterNot:
+		if !p.constructed || (p.tag == filterNot && len(p.children) != 1) {
+			return nil, fmt.Errorf("invalid filter")
+		}
+		for _, child := range p.children {
+			parsed, err := parseFilter(child)
+			if err != nil {
+				return nil, err
+			}
+			f.children = append(f.children, parsed)
+		}
+	case filterEquality, filterGreaterOrEqual, filterLessOrEqual, filterApprox:
+		if len(p.children) != 2 {
+			return nil, fmt.Errorf("invalid attribute value assertion")
+		}
+		f.attr, f.value = p.children[0].string(), p.children[1].string()
+	case filterSubstrings:
+		if len(p.children) != 2 {
+			return nil, fmt.Errorf("invalid substring filter")
+		}
+		f.attr = p.children[0].string()
+		for _, part := range p.children[1].children {
+			switch part.tag {
+			case 0:
+				f.initial = part.string()
+			case 1:
+				f.any = append(f.any, part.string())
+			case 2:
+				f.final = part.string()
+			}
+		}
+	case filterPresent:
+		f.attr = p.string()
+	case filterExtensible:
+		// Matching rules are not supported; the filter matches nothing
+	default:
+		return nil, fmt.Errorf("invalid filter")
+	}
+	return f, nil
+}
+
+// match evaluates the filter against an entry. Values are compared case
+// insensitively, and ordering compares numbers as numbers.
+func (f *filter) match(entry ldif.Entry) bool {
+	switch f.op {
+	case filterAnd:
+		for _, child := range f.children {
+			if !child.match(entry) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range f.children {
+			if child.match(entry) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !f.children[0].match(entry)
+	case filterPresent:
+		return len(entry.Get(attributeType(f.attr))) > 0
+	case filterEquality, filterApprox:
+		return f.anyValue(entry, func(value string) bool { return strings.EqualFold(value, f.value) })
+	case filterGreaterOrEqual:
+		return f.anyValue(entry, func(value string) bool { return compare(value, f.value) >= 0 })
+	case filterLessOrEqual:
+		return f.anyValue(entry, func(value string) bool { return compare(value, f.value) <= 0 })
+	case filterSubstrings:
+		return f.anyValue(entry, f.matchSubstrings)
+	default:
+		return false
+	}
+}
+
+func (f *filter) anyValue(entry ldif.Entry, match func(value string) bool) bool {
+	for _, value := range entry.Get(attributeType(f.attr)) {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) matchSubstrings(value string) bool {
+	value = strings.ToLower(value)
+
+	initial := strings.ToLower(f.initial)
+	if !strings.HasPrefix(value, initial) {
+		return false
+	}
+	value = value[len(initial):]
+
+	final := strings.ToLower(f.final)
+	if !strings.HasSuffix(value, final) {
+		return false
+	}
+	value = value[:len(value)-len(final)]
+
+	for _, part := range f.any {
+		i := strings.Index(value, strings.ToLower(part))
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return true
+}
+
+func compare(a string, b string) int {
+	if x, err := strconv.Atoi(a); err == nil {
+		if y, err := strconv.Atoi(b); err == nil {
+			return x - y
+		}
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// attributeType drops the options of an attribute description, such as the
+// ;binary in userCertificate;binary.
+func attributeType(description string) string {
+	attrType, _, _ := strings.Cut(description, ";")
+	return attrType
+}
+
+// mailboxFilter translates the conditions of the filter that every matching
+// mailbox must meet into a MailboxFilter, so that the repository query
+// returns as few mailboxes as possible. The result is a superset of the
+// matches; the filter itself still decides. An equality on mail becomes a
+// lookup of that identifier, ignoring case as the filter does.
+func (f *filter) mailboxFilter() model.MailboxFilter {
+	var mailboxFilter model.MailboxFilter
+
+	terms := []*filter{f}
+	if f.op == filterAnd {
+		terms = f.children
+	}
+
+	for _, term := range terms {
+		attrType := strings.ToLower(attributeType(term.attr))
+
+		switch term.op {
+		case filterEquality:
+			switch attrType {
+			case "mail":
+				mailboxFilter.Identifier = term.value
+			case "departmentnumber":
+				if id, err := strconv.Atoi(term.value); err == nil {
+					mailboxFilter.Department = id
+				}
+			case "cn", "title", "ou":
+				if mailboxFilter.SearchTerm == "" {
+					mailboxFilter.SearchTerm = term.value
+				}
+			}
+		case filterSubstrings:
+			// The search term matches the name, title or department name
+			// anywhere, and sn and givenName are parts of the name
+			switch attrType {
+			case "cn", "sn", "givenname", "title", "ou":
+				if mailboxFilter.SearchTerm == "" {
+					mailboxFilter.SearchTerm = term.longestSubstring()
+				}
+			}
+		}
+	}
+
+	return mailboxFilter
+}
+
+func (f *filter) longestSubstring() string {
+	longest := f.initial
+	for _, part := range f.any {
+		if len(part) > len(longest) {
+			longest = part
+		}
+	}
+	if len(f.final) > len(longest) {
+		longest = f.final
+	}
+	return longest
+}
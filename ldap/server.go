@@ -0,0 +1,605 @@
+// Package ldap serves the directory over a read-only subset of LDAPv3, so
+// that mail clients and other LDAP tools can look up mailboxes. Simple bind,
+// search, unbind and abandon are supported; mailboxes are the inetOrgPerson
+// entries of the LDIF export, and a search returns only the mailboxes the
+// bound caller could read over the HTTP API.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"mailbox-api/authz"
+	"mailbox-api/ldif"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+)
+
+// Protocol operations (RFC 4511, section 4.2 onwards).
+const (
+	opBindRequest       = 0
+	opBindResponse      = 1
+	opUnbindRequest     = 2
+	opSearchRequest     = 3
+	opSearchResultEntry = 4
+	opSearchResultDone  = 5
+	opModifyRequest     = 6
+	opAddRequest        = 8
+	opDelRequest        = 10
+	opModifyDNRequest   = 12
+	opCompareRequest    = 14
+	opAbandonRequest    = 16
+	opExtendedRequest   = 23
+	opExtendedResponse  = 24
+)
+
+// Result codes.
+const (
+	resultSuccess                  = 0
+	resultOperationsError          = 1
+	resultProtocolError            = 2
+	resultSizeLimitExceeded        = 4
+	resultAuthMethodNotSupported   = 7
+	resultNoSuchObject             = 32
+	resultInvalidDNSyntax          = 34
+	resultInvalidCredentials       = 49
+	resultInsufficientAccessRights = 50
+	resultUnwillingToPerform       = 53
+)
+
+// Search scopes.
+const (
+	scopeBaseObject   = 0
+	scopeSingleLevel  = 1
+	scopeWholeSubtree = 2
+)
+
+const (
+	// maxMessageSize bounds the requests a client can send.
+	maxMessageSize = 1 << 20
+	// idleTimeout closes connections that send no request for this long.
+	idleTimeout = 5 * time.Minute
+	// searchTimeout bounds the repository queries of a search.
+	searchTimeout = time.Minute
+)
+
+var errSizeLimitExceeded = errors.New("size limit exceeded")
+
+// Services are the application services the listener answers from. Only
+// Mailbox is required; a nil Auth service disables binding with a username
+// and password, and a nil APIKey service binding with an API key.
+type Services struct {
+	Mailbox service.MailboxService
+	Auth    service.AuthService
+	APIKey  service.APIKeyService
+}
+
+type Server struct {
+	directory ldif.Directory
+	policy    *authz.Policy
+	services  Services
+	logger    *logger.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+func NewServer(baseDN string, policy *authz.Policy, services Services, logger *logger.Logger) *Server {
+	return &Server{
+		directory: ldif.Directory{BaseDN: baseDN},
+		policy:    policy,
+		services:  services,
+		logger:    logger,
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// Start listens on addr and serves connections in the background.
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s.logger.Info("Starting LDAP listener", "addr", listener.Addr().String(), "base_dn", s.directory.BaseDN)
+	go func() {
+		if err := s.Serve(listener); err != nil {
+			s.logger.Error("LDAP listener stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Serve accepts connections on the listener until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listener and closes the open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// session is the state of a connection: who bound, and what they can read.
+// Anonymous sessions hold no grants.
+type session struct {
+	grants   authz.Grants
+	identity string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		message, err := readPacket(r, maxMessageSize)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Debug("Closing LDAP connection", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+
+		id, op, err := parseMessage(message)
+		if err != nil {
+			s.logger.Debug("Closing LDAP connection", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+
+		keep := s.handle(w, sess, id, op)
+		if err := w.Flush(); err != nil || !keep {
+			return
+		}
+	}
+}
+
+// parseMessage returns the message ID and protocol operation of an
+// LDAPMessage. Controls are ignored; none are critical to a read-only
+// directory.
+func parseMessage(message *packet) (int, *packet, error) {
+	if !message.is(classUniversal, tagSequence) || len(message.children) < 2 {
+		return 0, nil, fmt.Errorf("invalid LDAP message")
+	}
+	id, err := message.children[0].int()
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid message ID: %w", err)
+	}
+	op := message.children[1]
+	if op.class != classApplication {
+		return 0, nil, fmt.Errorf("invalid protocol operation")
+	}
+	return id, op, nil
+}
+
+// handle answers one request. It returns false if the connection is to be
+// closed.
+func (s *Server) handle(w *bufio.Writer, sess *session, id int, op *packet) bool {
+	switch op.tag {
+	case opBindRequest:
+		s.bind(w, sess, id, op)
+	case opUnbindRequest:
+		return false
+	case opSearchRequest:
+		s.search(w, sess, id, op)
+	case opAbandonRequest:
+		// Requests are answered in order, so there is never one to abandon
+	case opModifyRequest, opAddRequest, opDelRequest, opModifyDNRequest, opCompareRequest:
+		writeResult(w, id, op.tag+1, resultUnwillingToPerform, "the directory is read-only")
+	case opExtendedRequest:
+		writeResult(w, id, opExtendedResponse, resultProtocolError, "extended operations are not supported")
+	default:
+		return false
+	}
+	return true
+}
+
+func writeMessage(w io.Writer, id int, op *packet) error {
+	_, err := w.Write(sequence(integer(id), op).encode())
+	return err
+}
+
+// writeResult writes an LDAPResult response. The matched DN is left empty.
+func writeResult(w io.Writer, id int, tag int, code int, message string) error {
+	return writeMessage(w, id, constructed(classApplication, tag, enumerated(code), octetString(""), octetString(message)))
+}
+
+// bind authenticates the session with a simple bind. The password is either
+// an API key, or the password of the credential named by the first RDN value
+// of the bind DN, or by the bind name itself if it is not a DN. An empty name
+// and password bind anonymously.
+func (s *Server) bind(w *bufio.Writer, sess *session, id int, op *packet) {
+	if len(op.children) != 3 {
+		writeResult(w, id, opBindResponse, resultProtocolError, "invalid bind request")
+		return
+	}
+	if version, err := op.children[0].int(); err != nil || version != 3 {
+		writeResult(w, id, opBindResponse, resultProtocolError, "only LDAPv3 is supported")
+		return
+	}
+	auth := op.children[2]
+	if !auth.is(classContext, 0) {
+		writeResult(w, id, opBindResponse, resultAuthMethodNotSupported, "only simple bind is supported")
+		return
+	}
+
+	// A bind, even a failed one, drops the previous authentication
+	*sess = session{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	name, password := op.children[1].string(), auth.string()
+	bound, code, message := s.authenticate(ctx, name, password)
+	if code == resultSuccess {
+		*sess = bound
+	}
+	writeResult(w, id, opBindResponse, code, message)
+}
+
+func (s *Server) authenticate(ctx context.Context, name string, password string) (session, int, string) {
+	switch {
+	case name == "" && password == "":
+		return session{}, resultSuccess, ""
+	case password == "":
+		return session{}, resultUnwillingToPerform, "unauthenticated bind is not allowed"
+	case strings.HasPrefix(password, service.APIKeyPrefix) && s.services.APIKey != nil:
+		key, err := s.services.APIKey.AuthenticateAPIKey(ctx, password)
+		if err != nil {
+			s.logger.Error("Failed to authenticate API key", "error", err)
+			return session{}, resultOperationsError, "internal error"
+		}
+		if key == nil {
+			return session{}, resultInvalidCredentials, "invalid or expired API key"
+		}
+
+		scopes := make([]authz.Permission, 0, len(key.Scopes))
+		for _, scope := range key.Scopes {
+			scopes = append(scopes, authz.Permission(scope))
+		}
+		return session{grants: authz.NewGrants(scopes), identity: key.MailboxIdentifier}, resultSuccess, ""
+	case s.services.Auth != nil:
+		credential, err := s.services.Auth.Authenticate(ctx, bindUsername(name), password)
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			return session{}, resultInvalidCredentials, "invalid username or password"
+		}
+		if err != nil {
+			s.logger.Error("Failed to authenticate", "error", err)
+			return session{}, resultOperationsError, "internal error"
+		}
+		return session{grants: s.policy.Grants(authz.Role(credential.Role)), identity: credential.MailboxIdentifier}, resultSuccess, ""
+	default:
+		return session{}, resultInvalidCredentials, "invalid credentials"
+	}
+}
+
+// bindUsername returns the username of a bind name: the value of the first
+// RDN of a DN such as uid=admin,dc=example,dc=com, or the name as is.
+func bindUsername(name string) string {
+	if rdns, err := ldif.ParseDN(name); err == nil && len(rdns) > 0 {
+		return rdns[0].Value
+	}
+	return name
+}
+
+// searchRequest is a decoded SearchRequest.
+type searchRequest struct {
+	base       string
+	scope      int
+	sizeLimit  int
+	typesOnly  bool
+	filter     *filter
+	attributes []string
+}
+
+func parseSearchRequest(op *packet) (searchRequest, error) {
+	if len(op.children) != 8 {
+		return searchRequest{}, fmt.Errorf("invalid search request")
+	}
+
+	scope, err := op.children[1].int()
+	if err != nil || scope < scopeBaseObject || scope > scopeWholeSubtree {
+		return searchRequest{}, fmt.Errorf("invalid search scope")
+	}
+	sizeLimit, err := op.children[3].int()
+	if err != nil || sizeLimit < 0 {
+		return searchRequest{}, fmt.Errorf("invalid size limit")
+	}
+	f, err := parseFilter(op.children[6])
+	if err != nil {
+		return searchRequest{}, err
+	}
+
+	attributes := make([]string, 0, len(op.children[7].children))
+	for _, attribute := range op.children[7].children {
+		attributes = append(attributes, attribute.string())
+	}
+
+	return searchRequest{
+		base:       op.children[0].string(),
+		scope:      scope,
+		sizeLimit:  sizeLimit,
+		typesOnly:  op.children[5].bool(),
+		filter:     f,
+		attributes: attributes,
+	}, nil
+}
+
+func (s *Server) search(w *bufio.Writer, sess *session, id int, op *packet) {
+	req, err := parseSearchRequest(op)
+	if err != nil {
+		writeResult(w, id, opSearchResultDone, resultProtocolError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	results := &resultWriter{w: w, id: id, req: req}
+	code, message := s.runSearch(ctx, sess, req, results)
+	writeResult(w, id, opSearchResultDone, code, message)
+}
+
+// runSearch sends the entries in the scope of the search that match its
+// filter. The root DSE can be read anonymously; everything else needs a
+// bind whose grants can read mailboxes.
+func (s *Server) runSearch(ctx context.Context, sess *session, req searchRequest, results *resultWriter) (int, string) {
+	if req.base == "" && req.scope == scopeBaseObject {
+		return s.finish(results.send(req.filter, s.rootDSE()))
+	}
+
+	readScope := sess.grants.ReadScope(sess.identity)
+	if readScope == model.ScopeNone {
+		return resultInsufficientAccessRights, "bind as a caller who can read mailboxes"
+	}
+
+	base, err := ldif.NormalizeDN(req.base)
+	if err != nil {
+		return resultInvalidDNSyntax, err.Error()
+	}
+	root, _ := ldif.NormalizeDN(s.directory.BaseDN)
+	people, _ := ldif.NormalizeDN(s.directory.PeopleDN())
+
+	// A search based at a mailbox reads only that mailbox
+	if parentDN(base) == people {
+		rdns, _ := ldif.ParseDN(req.base)
+		if !strings.EqualFold(rdns[0].Type, "mail") {
+			return resultNoSuchObject, "no such object"
+		}
+		mailbox, err := s.visibleMailbox(ctx, readScope, sess.identity, rdns[0].Value)
+		if err != nil {
+			s.logger.Error("Failed to get mailbox", "error", err)
+			return resultOperationsError, "internal error"
+		}
+		if mailbox == nil {
+			return resultNoSuchObject, "no such object"
+		}
+		if req.scope == scopeSingleLevel {
+			return resultSuccess, ""
+		}
+		return s.finish(results.send(req.filter, s.directory.MailboxEntry(*mailbox)))
+	}
+
+	if base != "" && base != root && base != people && !strings.HasSuffix(root, ","+base) {
+		return resultNoSuchObject, "no such object"
+	}
+
+	if inScope(people, base, req.scope) {
+		if err := results.send(req.filter, s.directory.PeopleEntry()); err != nil {
+			return s.finish(err)
+		}
+	}
+	if inScope("mail=,"+people, base, req.scope) {
+		return s.finish(s.searchMailboxes(ctx, readScope, sess.identity, req.filter, results))
+	}
+	return resultSuccess, ""
+}
+
+// searchMailboxes sends the mailboxes in the read scope that match the
+// filter. The filter narrows the repository query where it can, and an
+// equality on mail becomes a lookup of that mailbox.
+func (s *Server) searchMailboxes(ctx context.Context, readScope string, identity string, f *filter, results *resultWriter) error {
+	mailboxFilter := f.mailboxFilter()
+	send := func(mailbox model.Mailbox) error {
+		return results.send(f, s.directory.MailboxEntry(mailbox))
+	}
+
+	if readScope == model.ScopeSelf {
+		mailbox, err := s.visibleMailbox(ctx, readScope, identity, identity)
+		if err != nil || mailbox == nil {
+			return err
+		}
+		return send(*mailbox)
+	}
+
+	// The lookup may match mailboxes outside a sub-org, and the caller's
+	// own mailbox, which the sub-org query leaves out, so each match is
+	// checked against the read scope instead
+	if mailboxFilter.Identifier != "" {
+		return s.services.Mailbox.StreamMailboxes(ctx, "", mailboxFilter, func(mailbox model.Mailbox) error {
+			visible, err := s.canRead(ctx, readScope, identity, mailbox.Identifier)
+			if err != nil || !visible {
+				return err
+			}
+			return send(mailbox)
+		})
+	}
+
+	subOrgOf := ""
+	if readScope == model.ScopeSubOrg {
+		subOrgOf = identity
+	}
+	return s.services.Mailbox.StreamMailboxes(ctx, subOrgOf, mailboxFilter, send)
+}
+
+// visibleMailbox returns the mailbox if it exists and is in the read scope,
+// as a GET of the mailbox over the HTTP API would.
+func (s *Server) visibleMailbox(ctx context.Context, readScope string, identity string, identifier string) (*model.Mailbox, error) {
+	visible, err := s.canRead(ctx, readScope, identity, identifier)
+	if err != nil || !visible {
+		return nil, err
+	}
+	return s.services.Mailbox.GetMailboxByIdentifier(ctx, identifier)
+}
+
+// canRead reports whether the mailbox is in the read scope.
+func (s *Server) canRead(ctx context.Context, readScope string, identity string, identifier string) (bool, error) {
+	switch readScope {
+	case model.ScopeAll:
+		return true, nil
+	case model.ScopeSubOrg:
+		return s.services.Mailbox.IsMailboxInSubOrg(ctx, identity, identifier)
+	case model.ScopeSelf:
+		return identifier == identity, nil
+	default:
+		return false, nil
+	}
+}
+
+// finish maps the error that ended a search to its result.
+func (s *Server) finish(err error) (int, string) {
+	switch {
+	case err == nil:
+		return resultSuccess, ""
+	case errors.Is(err, errSizeLimitExceeded):
+		return resultSizeLimitExceeded, "size limit exceeded"
+	default:
+		s.logger.Error("Failed to search mailboxes", "error", err)
+		return resultOperationsError, "internal error"
+	}
+}
+
+// rootDSE describes the server to clients that discover the naming context.
+func (s *Server) rootDSE() ldif.Entry {
+	entry := ldif.Entry{}
+	entry.Add("objectClass", "top")
+	entry.Add("namingContexts", s.directory.BaseDN)
+	entry.Add("supportedLDAPVersion", "3")
+	entry.Add("vendorName", "mailbox-api")
+	return entry
+}
+
+// inScope reports whether the entry named by the normalized DN is in the
+// scope of a search based at the normalized base.
+func inScope(dn string, base string, scope int) bool {
+	switch scope {
+	case scopeBaseObject:
+		return dn == base
+	case scopeSingleLevel:
+		return parentDN(dn) == base
+	default:
+		return dn == base || base == "" || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+// parentDN drops the first RDN of a normalized DN, whose separators are the
+// unescaped commas.
+func parentDN(dn string) string {
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			return dn[i+1:]
+		}
+	}
+	return ""
+}
+
+// resultWriter writes the entries of a search that match its filter, with
+// the requested attributes, up to the size limit.
+type resultWriter struct {
+	w    io.Writer
+	id   int
+	req  searchRequest
+	sent int
+}
+
+func (r *resultWriter) send(f *filter, entry ldif.Entry) error {
+	if !f.match(entry) {
+		return nil
+	}
+	if r.req.sizeLimit > 0 && r.sent >= r.req.sizeLimit {
+		return errSizeLimitExceeded
+	}
+
+	all := len(r.req.attributes) == 0
+	requested := map[string]bool{}
+	for _, attribute := range r.req.attributes {
+		if attribute == "*" {
+			all = true
+		}
+		requested[strings.ToLower(attributeType(attribute))] = true
+	}
+
+	attributes := []*packet{}
+	for _, attribute := range entry.Attributes {
+		if !all && !requested[strings.ToLower(attribute.Type)] {
+			continue
+		}
+		values := []*packet{}
+		if !r.req.typesOnly {
+			for _, value := range attribute.Values {
+				values = append(values, octetString(value))
+			}
+		}
+		attributes = append(attributes, sequence(octetString(attribute.Type), constructed(classUniversal, tagSet, values...)))
+	}
+
+	r.sent++
+	return writeMessage(r.w, r.id, constructed(classApplication, opSearchResultEntry, octetString(entry.DN), sequence(attributes...)))
+}
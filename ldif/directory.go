@@ -0,0 +1,120 @@
+package ldif
+
+import (
+	"strconv"
+	"strings"
+
+	"mailbox-api/model"
+)
+
+// Directory maps the mailbox directory to LDAP entries below a base DN.
+// Mailboxes are inetOrgPerson entries named by their mail address under
+// ou=people; departments are organizationalUnit entries under
+// ou=departments, nested as the department tree.
+type Directory struct {
+	BaseDN string
+}
+
+func (d Directory) PeopleDN() string {
+	return "ou=people," + d.BaseDN
+}
+
+func (d Directory) DepartmentsDN() string {
+	return "ou=departments," + d.BaseDN
+}
+
+// MailboxDN returns the DN of a mailbox.
+func (d Directory) MailboxDN(identifier string) string {
+	return "mail=" + EscapeValue(identifier) + "," + d.PeopleDN()
+}
+
+// PeopleEntry returns the organizational unit that holds the mailboxes.
+func (d Directory) PeopleEntry() Entry {
+	return containerEntry(d.PeopleDN(), "people")
+}
+
+// DepartmentsEntry returns the organizational unit that holds the
+// departments.
+func (d Directory) DepartmentsEntry() Entry {
+	return containerEntry(d.DepartmentsDN(), "departments")
+}
+
+func containerEntry(dn string, name string) Entry {
+	entry := Entry{DN: dn}
+	entry.Add("objectClass", "top", "organizationalUnit")
+	entry.Add("ou", name)
+	return entry
+}
+
+// MailboxEntry returns the inetOrgPerson entry of a mailbox. The surname is
+// the last word of the full name, and the manager is written as a DN.
+func (d Directory) MailboxEntry(mailbox model.Mailbox) Entry {
+	entry := Entry{DN: d.MailboxDN(mailbox.Identifier)}
+	entry.Add("objectClass", "top", "person", "organizationalPerson", "inetOrgPerson")
+	entry.Add("mail", mailbox.Identifier)
+
+	// cn and sn are required by person
+	name := mailbox.UserFullName
+	if name == "" {
+		name = mailbox.Identifier
+	}
+	words := strings.Fields(name)
+	entry.Add("cn", name)
+	if len(words) > 1 {
+		entry.Add("givenName", strings.Join(words[:len(words)-1], " "))
+		entry.Add("sn", words[len(words)-1])
+	} else {
+		entry.Add("sn", name)
+	}
+
+	entry.Add("title", mailbox.JobTitle)
+	entry.Add("departmentNumber", strconv.Itoa(mailbox.DepartmentID))
+	entry.Add("ou", mailbox.Department)
+	if mailbox.ManagerIdentifier != "" {
+		entry.Add("manager", d.MailboxDN(mailbox.ManagerIdentifier))
+	}
+	return entry
+}
+
+// DepartmentEntries returns the organizationalUnit entries of the
+// departments, each below its parent and after it. The department ID is
+// written as businessCategory and the cost center as description. A
+// department whose parent is not among the departments is placed directly
+// under ou=departments.
+func (d Directory) DepartmentEntries(departments []model.Department) []Entry {
+	byID := make(map[int]model.Department, len(departments))
+	for _, department := range departments {
+		byID[department.ID] = department
+	}
+
+	entries := make([]Entry, 0, len(departments))
+	dns := make(map[int]string, len(departments))
+
+	var place func(department model.Department, visiting map[int]bool) string
+	place = func(department model.Department, visiting map[int]bool) string {
+		if dn, ok := dns[department.ID]; ok {
+			return dn
+		}
+
+		parentDN := d.DepartmentsDN()
+		if parent, ok := byID[department.ParentID]; ok && !visiting[parent.ID] {
+			visiting[department.ID] = true
+			parentDN = place(parent, visiting)
+		}
+
+		entry := Entry{DN: "ou=" + EscapeValue(department.Name) + "," + parentDN}
+		entry.Add("objectClass", "top", "organizationalUnit")
+		entry.Add("ou", department.Name)
+		entry.Add("businessCategory", strconv.Itoa(department.ID))
+		entry.Add("description", department.CostCenter)
+
+		entries = append(entries, entry)
+		dns[department.ID] = entry.DN
+		return entry.DN
+	}
+
+	for _, department := range departments {
+		place(department, map[int]bool{})
+	}
+	return entries
+}
@@ -0,0 +1,118 @@
+package ldif
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RDN is an attribute type and value naming an entry within its parent.
+type RDN struct {
+	Type  string
+	Value string
+}
+
+// EscapeValue escapes an attribute value for use in a DN (RFC 4514).
+func EscapeValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '#' && i == 0, c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ParseDN splits a DN into its RDNs, starting with the entry's own, and
+// unescapes the values. Multi-valued RDNs are not supported.
+func ParseDN(dn string) ([]RDN, error) {
+	rdns := []RDN{}
+	if strings.TrimSpace(dn) == "" {
+		return rdns, nil
+	}
+
+	var value strings.Builder
+	attrType := ""
+	inValue := false
+	// Unescaped spaces around a value are not part of it
+	trailing := 0
+
+	end := func() error {
+		if !inValue || strings.TrimSpace(attrType) == "" {
+			return fmt.Errorf("invalid DN %q", dn)
+		}
+		v := value.String()
+		rdns = append(rdns, RDN{Type: strings.TrimSpace(attrType), Value: v[:len(v)-trailing]})
+		attrType, inValue, trailing = "", false, 0
+		value.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(dn); i++ {
+		c := dn[i]
+		switch {
+		case !inValue && c == '=':
+			inValue = true
+		case !inValue:
+			attrType += string(c)
+		case c == '\\':
+			if i+1 >= len(dn) {
+				return nil, fmt.Errorf("invalid DN %q", dn)
+			}
+			if i+2 < len(dn) {
+				if b, err := strconv.ParseUint(dn[i+1:i+3], 16, 8); err == nil {
+					value.WriteByte(byte(b))
+					i += 2
+					trailing = 0
+					continue
+				}
+			}
+			value.WriteByte(dn[i+1])
+			i++
+			trailing = 0
+		case c == ',' || c == ';':
+			if err := end(); err != nil {
+				return nil, err
+			}
+		case c == '+':
+			return nil, fmt.Errorf("multi-valued RDNs are not supported: %q", dn)
+		case c == ' ' && value.Len() == 0:
+		case c == ' ':
+			value.WriteByte(c)
+			trailing++
+		default:
+			value.WriteByte(c)
+			trailing = 0
+		}
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+
+	return rdns, nil
+}
+
+// NormalizeDN returns the DN in a canonical form for comparison: types and
+// values in lower case and no spaces around separators.
+func NormalizeDN(dn string) (string, error) {
+	rdns, err := ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, len(rdns))
+	for i, rdn := range rdns {
+		parts[i] = strings.ToLower(rdn.Type) + "=" + EscapeValue(strings.ToLower(rdn.Value))
+	}
+	return strings.Join(parts, ","), nil
+}
@@ -0,0 +1,257 @@
+// Package ldif reads and writes LDAP Data Interchange Format (RFC 2849)
+// content records, and maps mailboxes and departments to LDAP entries.
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Header starts an LDIF file.
+const Header = "version: 1\n"
+
+// maxLineLength is the length after which lines are folded.
+const maxLineLength = 76
+
+// Attribute is an attribute of an entry and its values.
+type Attribute struct {
+	Type   string
+	Values []string
+}
+
+// Entry is an LDAP entry. Line is the line of the dn when the entry was
+// parsed.
+type Entry struct {
+	DN         string
+	Attributes []Attribute
+	Line       int
+}
+
+// Add appends the non-empty values to the attribute.
+func (e *Entry) Add(attrType string, values ...string) {
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		i := e.index(attrType)
+		if i < 0 {
+			e.Attributes = append(e.Attributes, Attribute{Type: attrType})
+			i = len(e.Attributes) - 1
+		}
+		e.Attributes[i].Values = append(e.Attributes[i].Values, value)
+	}
+}
+
+// Get returns the values of the attribute. Attribute types are case
+// insensitive.
+func (e Entry) Get(attrType string) []string {
+	if i := e.index(attrType); i >= 0 {
+		return e.Attributes[i].Values
+	}
+	return nil
+}
+
+// First returns the first value of the attribute, or "".
+func (e Entry) First(attrType string) string {
+	if values := e.Get(attrType); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// HasObjectClass reports whether the entry is of the object class.
+func (e Entry) HasObjectClass(class string) bool {
+	for _, value := range e.Get("objectClass") {
+		if strings.EqualFold(value, class) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Entry) index(attrType string) int {
+	for i, attribute := range e.Attributes {
+		if strings.EqualFold(attribute.Type, attrType) {
+			return i
+		}
+	}
+	return -1
+}
+
+// WriteEntry writes the entry as a content record followed by a blank line.
+// Values that are not safe strings are base64 encoded, and long lines are
+// folded.
+func WriteEntry(w io.Writer, e Entry) error {
+	var b strings.Builder
+	writeLine(&b, "dn", e.DN)
+	for _, attribute := range e.Attributes {
+		for _, value := range attribute.Values {
+			writeLine(&b, attribute.Type, value)
+		}
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeLine(b *strings.Builder, attrType string, value string) {
+	line := attrType + ": " + value
+	if !isSafe(value) {
+		line = attrType + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	// Unsafe values are base64 encoded, so every line is ASCII and can be
+	// folded at any byte. Continuation lines start with a space.
+	width := maxLineLength
+	for len(line) > width {
+		b.WriteString(line[:width])
+		b.WriteString("\n ")
+		line = line[width:]
+		width = maxLineLength - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\n")
+}
+
+// isSafe reports whether the value can be written as is: a SAFE-STRING of
+// RFC 2849 without trailing spaces.
+func isSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads the content records of an LDIF file. Records with a changetype
+// other than add, and values given by URL, are rejected.
+func Parse(r io.Reader) ([]Entry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10<<20)
+
+	entries := []Entry{}
+	var entry *Entry
+	var line string
+	lineNumber, start := 0, 0
+	comment := false
+
+	// flush adds the logical line that ends here to the current entry
+	flush := func() error {
+		if line == "" {
+			return nil
+		}
+		defer func() { line = "" }()
+
+		attrType, value, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", start, err)
+		}
+
+		switch {
+		case entry == nil && strings.EqualFold(attrType, "version") && len(entries) == 0:
+			if value != "1" {
+				return fmt.Errorf("line %d: unsupported LDIF version %s", start, value)
+			}
+		case entry == nil:
+			if !strings.EqualFold(attrType, "dn") {
+				return fmt.Errorf("line %d: a record must start with dn", start)
+			}
+			entry = &Entry{DN: value, Line: start}
+		case strings.EqualFold(attrType, "changetype"):
+			if !strings.EqualFold(value, "add") {
+				return fmt.Errorf("line %d: changetype %s is not supported", start, value)
+			}
+		default:
+			entry.Add(attrType, value)
+		}
+		return nil
+	}
+
+	endRecord := func() {
+		if entry != nil {
+			entries = append(entries, *entry)
+			entry = nil
+		}
+	}
+
+	for scanner.Scan() {
+		lineNumber++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case strings.HasPrefix(text, " "):
+			// A folded line continues the previous one
+			if !comment {
+				if line == "" {
+					return nil, fmt.Errorf("line %d: continuation without a line to continue", lineNumber)
+				}
+				line += text[1:]
+			}
+			continue
+		case text == "":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			endRecord()
+			comment = false
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		comment = strings.HasPrefix(text, "#")
+		if !comment {
+			line, start = text, lineNumber
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read LDIF: %w", err)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	endRecord()
+
+	return entries, nil
+}
+
+// parseLine splits an unfolded line into the attribute type and the decoded
+// value.
+func parseLine(line string) (string, string, error) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return "", "", fmt.Errorf("expected attribute: value")
+	}
+	attrType, rest := line[:i], line[i+1:]
+
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value of %s", attrType)
+		}
+		return attrType, string(value), nil
+	case strings.HasPrefix(rest, "<"):
+		return "", "", fmt.Errorf("values given by URL are not supported")
+	default:
+		return attrType, strings.TrimLeft(rest, " "), nil
+	}
+}
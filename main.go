@@ -8,9 +8,14 @@ import (
 	"time"
 
 	"mailbox-api/api/router"
+	"mailbox-api/authz"
 	"mailbox-api/config"
 	"mailbox-api/db"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/ldap"
 	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/oidc"
 	"mailbox-api/repository"
 	"mailbox-api/service"
 )
@@ -30,15 +35,116 @@ func main() {
 	}
 	defer dbConn.Close()
 
+	policy, err := authz.LoadPolicy(cfg.Auth.PolicyFile)
+	if err != nil {
+		l.Fatal("Failed to load RBAC policy", "error", err)
+	}
+
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	if cfg.Auth.JWTKeysDir != "" {
+		keys, err = jwtkeys.Load(cfg.Auth.JWTKeysDir, cfg.Auth.JWTSigningKeyID)
+		if err != nil {
+			l.Fatal("Failed to load JWT signing keys", "error", err)
+		}
+		l.Info("Loaded JWT signing keys", "active_kid", keys.Active().ID)
+
+		// Reload the key directory on SIGHUP to rotate keys without a restart
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := keys.Reload(); err != nil {
+					l.Error("Failed to reload JWT signing keys", "error", err)
+					continue
+				}
+				l.Info("Reloaded JWT signing keys", "active_kid", keys.Active().ID)
+			}
+		}()
+	}
+
+	var oidcVerifier *oidc.Verifier
+	if cfg.OIDC.Issuer != "" {
+		if cfg.OIDC.Audience == "" {
+			l.Fatal("OIDC_AUDIENCE is required with OIDC_ISSUER")
+		}
+
+		roles, err := oidc.ParseRoleMappings(cfg.OIDC.RoleMappings)
+		if err != nil {
+			l.Fatal("Invalid OIDC role mappings", "error", err)
+		}
+		for _, mapping := range roles {
+			if !policy.HasRole(mapping.Role) {
+				l.Fatal("OIDC role mapping names a role missing from the policy", "group", mapping.Group, "role", mapping.Role)
+			}
+		}
+		if cfg.OIDC.DefaultRole != "" && !policy.HasRole(authz.Role(cfg.OIDC.DefaultRole)) {
+			l.Fatal("OIDC default role is missing from the policy", "role", cfg.OIDC.DefaultRole)
+		}
+
+		oidcVerifier, err = oidc.NewVerifier(context.Background(), cfg.OIDC.Issuer, cfg.OIDC.Audience, cfg.OIDC.JWKSURL, cfg.OIDC.JWKSFile, oidc.ClaimMapping{
+			MailboxClaim: cfg.OIDC.MailboxClaim,
+			GroupsClaim:  cfg.OIDC.GroupsClaim,
+			Roles:        roles,
+			DefaultRole:  authz.Role(cfg.OIDC.DefaultRole),
+		})
+		if err != nil {
+			l.Fatal("Failed to set up OIDC verifier", "error", err)
+		}
+		l.Info("Accepting tokens from OIDC issuer", "issuer", cfg.OIDC.Issuer)
+	}
+
 	mailboxRepo := repository.NewMailboxRepository(dbConn)
 	departmentRepo := repository.NewDepartmentRepository(dbConn)
+	authRepo := repository.NewAuthRepository(dbConn)
+	apiKeyRepo := repository.NewAPIKeyRepository(dbConn)
+	importPlanRepo := repository.NewImportPlanRepository(dbConn)
 
 	mailboxService := service.NewMailboxService(mailboxRepo, departmentRepo)
+	orgService := service.NewOrgService(mailboxRepo)
+	departmentService := service.NewDepartmentService(departmentRepo)
+	authService := service.NewAuthService(authRepo, mailboxRepo, time.Minute*time.Duration(cfg.Auth.RefreshTokenExpiry))
+	apiKeyService := service.NewAPIKeyService(apiKeyRepo, mailboxRepo)
+	syncService := service.NewSyncService(mailboxRepo, departmentRepo, importPlanRepo)
+
+	if cfg.Auth.BootstrapUsername != "" {
+		err := authService.EnsureCredential(context.Background(), model.CredentialInput{
+			Username: cfg.Auth.BootstrapUsername,
+			Password: cfg.Auth.BootstrapPassword,
+			Role:     string(authz.RoleAdmin),
+		})
+		if err != nil {
+			l.Fatal("Failed to create bootstrap credential", "error", err)
+		}
+	}
+
+	if cfg.Auth.DevMode {
+		l.Warn("Development mode is enabled, /api/token/:role issues tokens without credentials")
+	}
 
-	r := router.SetupRouter(cfg, l, mailboxService)
+	r := router.SetupRouter(cfg, l, policy, keys, router.Services{
+		Mailbox:    mailboxService,
+		Org:        orgService,
+		Department: departmentService,
+		Auth:       authService,
+		APIKey:     apiKeyService,
+		Sync:       syncService,
+		OIDC:       oidcVerifier,
+	})
 
 	srv := r.Start(cfg.Server.Port)
 
+	var ldapServer *ldap.Server
+	if cfg.LDAP.ListenAddr != "" {
+		ldapServer = ldap.NewServer(cfg.LDAP.BaseDN, policy, ldap.Services{
+			Mailbox: mailboxService,
+			Auth:    authService,
+			APIKey:  apiKeyService,
+		}, l)
+		if err := ldapServer.Start(cfg.LDAP.ListenAddr); err != nil {
+			l.Fatal("Failed to start LDAP listener", "error", err)
+		}
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -51,6 +157,9 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		l.Error("Server forced to shutdown", "error", err)
 	}
+	if ldapServer != nil {
+		ldapServer.Close()
+	}
 
 	l.Info("Server exiting")
 }
@@ -0,0 +1,29 @@
+-- Create closure table holding one row per (ancestor, descendant) pair in the
+-- reporting hierarchy, including a depth 0 row for every mailbox itself
+CREATE TABLE IF NOT EXISTS mailbox_closure (
+    ancestor_identifier VARCHAR(100) NOT NULL,
+    descendant_identifier VARCHAR(100) NOT NULL,
+    depth INT NOT NULL,
+    PRIMARY KEY (ancestor_identifier, descendant_identifier),
+    FOREIGN KEY (ancestor_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE,
+    FOREIGN KEY (descendant_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE
+);
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_mailbox_closure_descendant ON mailbox_closure(descendant_identifier, depth);
+
+-- Backfill from existing mailboxes; the depth bound stops the walk on a cycle
+WITH RECURSIVE paths AS (
+    SELECT mailbox_identifier AS ancestor_identifier, mailbox_identifier AS descendant_identifier, 0 AS depth
+    FROM mailboxes
+    UNION ALL
+    SELECT p.ancestor_identifier, m.mailbox_identifier, p.depth + 1
+    FROM paths p
+    JOIN mailboxes m ON m.manager_mailbox_identifier = p.descendant_identifier
+    WHERE p.depth < (SELECT COUNT(*) FROM mailboxes)
+)
+INSERT INTO mailbox_closure (ancestor_identifier, descendant_identifier, depth)
+SELECT ancestor_identifier, descendant_identifier, MIN(depth)
+FROM paths
+GROUP BY ancestor_identifier, descendant_identifier
+ON CONFLICT DO NOTHING;
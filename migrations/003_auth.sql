@@ -0,0 +1,29 @@
+-- Create credentials table; password_hash holds a bcrypt hash
+CREATE TABLE IF NOT EXISTS credentials (
+    username VARCHAR(100) PRIMARY KEY,
+    password_hash VARCHAR(100) NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    mailbox_identifier VARCHAR(100),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (mailbox_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE SET NULL
+);
+
+-- Create refresh tokens table; only the SHA-256 hash of each token is stored
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    username VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (username) REFERENCES credentials(username) ON DELETE CASCADE
+);
+
+-- Create revocation list of access tokens by jti, kept until they expire
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
@@ -0,0 +1,15 @@
+-- Create API keys table for service accounts; only the SHA-256 hash of each
+-- key is stored, the id is the public part of the key used for lookup
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(32) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    mailbox_identifier VARCHAR(100),
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY (mailbox_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE SET NULL
+);
@@ -0,0 +1,7 @@
+-- Departments form a tree of divisions, departments and teams; a department
+-- without a parent is a top-level division
+ALTER TABLE departments ADD COLUMN IF NOT EXISTS parent_department_id INT REFERENCES departments(department_id);
+ALTER TABLE departments ADD COLUMN IF NOT EXISTS cost_center VARCHAR(50) NOT NULL DEFAULT '';
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_departments_parent_id ON departments(parent_department_id);
@@ -0,0 +1,18 @@
+-- Mailboxes that left the organization are deactivated instead of deleted,
+-- so their history and reporting line are kept
+ALTER TABLE mailboxes ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Create import plans table; a plan lists the changes a sync import would
+-- make and is applied at most once
+CREATE TABLE IF NOT EXISTS import_plans (
+    id VARCHAR(32) PRIMARY KEY,
+    status VARCHAR(20) NOT NULL,
+    summary JSONB NOT NULL,
+    changes JSONB NOT NULL,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    applied_at TIMESTAMPTZ
+);
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_import_plans_created_at ON import_plans(created_at);
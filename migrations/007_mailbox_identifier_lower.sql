@@ -0,0 +1,3 @@
+-- Identity providers and directory clients match user names regardless of
+-- case, so identifiers are also looked up by their lower-case form
+CREATE INDEX IF NOT EXISTS idx_mailboxes_identifier_lower ON mailboxes(lower(mailbox_identifier));
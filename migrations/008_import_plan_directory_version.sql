@@ -0,0 +1,3 @@
+-- A plan is only applied to the directory it was computed against; plans
+-- stored before the version was recorded are refused as stale
+ALTER TABLE import_plans ADD COLUMN IF NOT EXISTS directory_version VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// APIKey is a service-account credential. Its scopes are the permissions it
+// grants; the secret part of the key is only returned once, on creation.
+type APIKey struct {
+	ID                string     `json:"id" db:"id"`
+	Name              string     `json:"name" db:"name"`
+	KeyHash           string     `json:"-" db:"key_hash"`
+	Scopes            []string   `json:"scopes" db:"scopes"`
+	MailboxIdentifier string     `json:"mailbox_identifier,omitempty" db:"mailbox_identifier"`
+	CreatedBy         string     `json:"created_by" db:"created_by"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt        *time.Time `json:"last_used_at" db:"last_used_at"`
+	RevokedAt         *time.Time `json:"revoked_at" db:"revoked_at"`
+}
+
+type APIKeyInput struct {
+	Name              string     `json:"name"`
+	Scopes            []string   `json:"scopes"`
+	MailboxIdentifier string     `json:"mailbox_identifier"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+}
+
+// CreatedAPIKey is returned when a key is created and carries the full key.
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+type Credential struct {
+	Username          string    `json:"username" db:"username"`
+	PasswordHash      string    `json:"-" db:"password_hash"`
+	Role              string    `json:"role" db:"role"`
+	MailboxIdentifier string    `json:"mailbox_identifier" db:"mailbox_identifier"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+}
+
+type CredentialInput struct {
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	Role              string `json:"role"`
+	MailboxIdentifier string `json:"mailbox_identifier"`
+}
+
+type RefreshToken struct {
+	TokenHash string     `db:"token_hash"`
+	Username  string     `db:"username"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
@@ -1,6 +1,40 @@
 package model
 
+// Department is a node in the department tree. ParentID is 0 for a top-level
+// division.
 type Department struct {
-	ID   int    `json:"department_id" db:"department_id"`
-	Name string `json:"department_name" db:"department_name"`
+	ID         int    `json:"department_id" db:"department_id"`
+	Name       string `json:"department_name" db:"department_name"`
+	ParentID   int    `json:"parent_department_id" db:"parent_department_id"`
+	CostCenter string `json:"cost_center" db:"cost_center"`
+}
+
+// DepartmentSummary is a department with statistics about its members.
+// Managers are members with at least one direct report. TotalHeadcount adds
+// the headcount of every department below this one.
+type DepartmentSummary struct {
+	Department
+	Headcount       int     `json:"headcount" db:"headcount"`
+	TotalHeadcount  int     `json:"total_headcount"`
+	ManagerCount    int     `json:"manager_count" db:"manager_count"`
+	AverageOrgDepth float64 `json:"average_org_depth" db:"average_org_depth"`
+}
+
+// DepartmentInput creates a department. A zero ID picks the next free one.
+// Members are mailboxes moved into the department as it is created; SCIM
+// sets them from a new group's members.
+type DepartmentInput struct {
+	ID         int      `json:"department_id"`
+	Name       string   `json:"department_name"`
+	ParentID   int      `json:"parent_department_id"`
+	CostCenter string   `json:"cost_center"`
+	Members    []string `json:"-"`
+}
+
+// DepartmentPatch changes only the fields that are set. A ParentID of 0
+// makes the department top-level.
+type DepartmentPatch struct {
+	Name       *string `json:"department_name"`
+	ParentID   *int    `json:"parent_department_id"`
+	CostCenter *string `json:"cost_center"`
 }
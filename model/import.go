@@ -0,0 +1,21 @@
+package model
+
+// ImportResult reports the outcome of a bulk import. If any row has errors
+// nothing is written, and Imported is 0. A sync import returns the plan it
+// computed instead of writing.
+type ImportResult struct {
+	DryRun   bool             `json:"dry_run"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Errors   []ImportRowError `json:"errors"`
+	Plan     *ImportPlan      `json:"plan,omitempty"`
+}
+
+// ImportRowError is a validation error of one row. Rows are numbered as in a
+// spreadsheet: the CSV header is row 1 and the first record row 2.
+type ImportRowError struct {
+	Row        int    `json:"row"`
+	Identifier string `json:"identifier,omitempty"`
+	Field      string `json:"field,omitempty"`
+	Message    string `json:"message"`
+}
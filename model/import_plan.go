@@ -0,0 +1,54 @@
+package model
+
+import "time"
+
+// Import plan statuses.
+const (
+	PlanPending = "pending"
+	PlanApplied = "applied"
+)
+
+// Sync change actions.
+const (
+	ChangeAdd        = "add"
+	ChangeUpdate     = "update"
+	ChangeMove       = "move"
+	ChangeDeactivate = "deactivate"
+)
+
+// ImportPlan is the set of changes a sync import makes to bring the directory
+// in line with a full roster. It is stored for review and applied at most
+// once, and only to the directory it was computed against, identified by
+// DirectoryVersion.
+type ImportPlan struct {
+	ID               string       `json:"id" db:"id"`
+	Status           string       `json:"status" db:"status"`
+	Summary          PlanSummary  `json:"summary" db:"summary"`
+	Changes          []PlanChange `json:"changes,omitempty" db:"changes"`
+	DirectoryVersion string       `json:"-" db:"directory_version"`
+	CreatedBy        string       `json:"created_by" db:"created_by"`
+	CreatedAt        time.Time    `json:"created_at" db:"created_at"`
+	AppliedAt        *time.Time   `json:"applied_at" db:"applied_at"`
+}
+
+// PlanSummary counts the changes of a plan by action. Unchanged counts the
+// roster rows that already match the directory.
+type PlanSummary struct {
+	Add        int `json:"add"`
+	Update     int `json:"update"`
+	Move       int `json:"move"`
+	Deactivate int `json:"deactivate"`
+	Unchanged  int `json:"unchanged"`
+}
+
+// PlanChange is the change of one mailbox. A move is a change of manager and
+// may change other fields as well; Fields lists every field that changes.
+// Before is the stored mailbox the plan was computed against and is nil for
+// additions; After is nil for deactivations.
+type PlanChange struct {
+	Action     string   `json:"action"`
+	Identifier string   `json:"mailbox_identifier"`
+	Fields     []string `json:"fields,omitempty"`
+	Before     *Mailbox `json:"before,omitempty"`
+	After      *Mailbox `json:"after,omitempty"`
+}
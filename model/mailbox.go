@@ -9,21 +9,58 @@ type Mailbox struct {
 	ManagerIdentifier string `json:"manager_mailbox_identifier" db:"manager_mailbox_identifier"`
 	OrgDepth          int    `json:"org_depth" db:"org_depth"`
 	SubOrgSize        int    `json:"sub_org_size" db:"sub_org_size"`
+	Active            bool   `json:"active" db:"active"`
+}
+
+// MailboxInput creates or replaces a mailbox. Active is only read on create,
+// where false creates the mailbox deactivated; SCIM sets it, as identity
+// providers may provision a user before their start date.
+type MailboxInput struct {
+	Identifier        string `json:"mailbox_identifier"`
+	UserFullName      string `json:"user_full_name"`
+	JobTitle          string `json:"job_title"`
+	DepartmentID      int    `json:"department_id"`
+	ManagerIdentifier string `json:"manager_mailbox_identifier"`
+	Active            *bool  `json:"-"`
+}
+
+// MailboxPatch holds a partial update; nil fields are left unchanged.
+type MailboxPatch struct {
+	UserFullName      *string `json:"user_full_name"`
+	JobTitle          *string `json:"job_title"`
+	DepartmentID      *int    `json:"department_id"`
+	ManagerIdentifier *string `json:"manager_mailbox_identifier"`
 }
 
 type MailboxFilter struct {
-	SearchTerm     string   `form:"search"`
-	Department     int      `form:"department"`
-	OrgDepthExact  *int     `form:"org_depth_exact"`
-	OrgDepthGt     *int     `form:"org_depth_gt"`
-	OrgDepthLt     *int     `form:"org_depth_lt"`
-	SubOrgSizeMin  *int     `form:"sub_org_size_min"`
-	SubOrgSizeMax  *int     `form:"sub_org_size_max"`
-	SortBy         []string `form:"sort_by"`
-	SortDirections []string `form:"sort_dir"`
-	Fields         []string `form:"fields"`
-	Page           int      `form:"page"`
-	PageSize       int      `form:"page_size"`
+	// SubOrgOf limits results to the sub-org of the given mailbox. It is set
+	// by the service from the caller's scope, never from the query string.
+	SubOrgOf string `form:"-"`
+	// AncestorsOf, ReportsTo and PeersOf limit results to the management
+	// chain above, the direct reports of, or the mailboxes sharing a manager
+	// with the given mailbox. Like SubOrgOf they are set by the service.
+	AncestorsOf string `form:"-"`
+	ReportsTo   string `form:"-"`
+	PeersOf     string `form:"-"`
+	// Identifier limits results to the mailbox with the identifier, compared
+	// case-insensitively, as SCIM and LDAP lookups compare user names.
+	Identifier string `form:"-"`
+	SearchTerm string `form:"search"`
+	Department int    `form:"department"`
+	// IncludeSubDepartments extends the department filter to every
+	// department below it.
+	IncludeSubDepartments bool     `form:"include_sub_departments"`
+	OrgDepthExact         *int     `form:"org_depth_exact"`
+	OrgDepthGt            *int     `form:"org_depth_gt"`
+	OrgDepthLt            *int     `form:"org_depth_lt"`
+	SubOrgSizeMin         *int     `form:"sub_org_size_min"`
+	SubOrgSizeMax         *int     `form:"sub_org_size_max"`
+	Active                *bool    `form:"active"`
+	SortBy                []string `form:"sort_by"`
+	SortDirections        []string `form:"sort_dir"`
+	Fields                []string `form:"fields"`
+	Page                  int      `form:"page"`
+	PageSize              int      `form:"page_size"`
 }
 
 type MailboxResponse struct {
@@ -0,0 +1,60 @@
+package model
+
+// Identity describes the authenticated caller and the part of the directory
+// they can see.
+type Identity struct {
+	Role              string   `json:"role"`
+	Permissions       []string `json:"permissions"`
+	MailboxIdentifier string   `json:"mailbox_identifier"`
+	Mailbox           *Mailbox `json:"mailbox"`
+	Scope             string   `json:"scope"`
+}
+
+const (
+	ScopeAll    = "all"
+	ScopeSubOrg = "sub_org"
+	ScopeSelf   = "self"
+	ScopeNone   = "none"
+)
+
+// OrgTreeNode is a mailbox with its reports nested below it.
+type OrgTreeNode struct {
+	Mailbox
+	Reports []*OrgTreeNode `json:"reports"`
+}
+
+// OrgRelationship describes how two mailboxes are connected through the
+// reporting lines. Path runs from A up to the lowest common manager and down
+// to B. Mailboxes in separate trees have no common manager and a nil
+// distance.
+type OrgRelationship struct {
+	A                   string    `json:"a"`
+	B                   string    `json:"b"`
+	LowestCommonManager *Mailbox  `json:"lowest_common_manager"`
+	Path                []Mailbox `json:"path"`
+	Distance            *int      `json:"distance"`
+	AInSubOrgOfB        bool      `json:"a_in_sub_org_of_b"`
+	BInSubOrgOfA        bool      `json:"b_in_sub_org_of_a"`
+}
+
+type OrgIntegrityReport struct {
+	Healthy          bool                `json:"healthy"`
+	TotalMailboxes   int                 `json:"total_mailboxes"`
+	Cycles           [][]string          `json:"cycles"`
+	DanglingManagers []DanglingManager   `json:"dangling_managers"`
+	OrphanedRoots    []string            `json:"orphaned_roots"`
+	MetricMismatches []OrgMetricMismatch `json:"metric_mismatches"`
+}
+
+type DanglingManager struct {
+	Identifier        string `json:"mailbox_identifier"`
+	ManagerIdentifier string `json:"manager_mailbox_identifier"`
+}
+
+type OrgMetricMismatch struct {
+	Identifier         string `json:"mailbox_identifier"`
+	StoredOrgDepth     int    `json:"stored_org_depth"`
+	ExpectedOrgDepth   int    `json:"expected_org_depth"`
+	StoredSubOrgSize   int    `json:"stored_sub_org_size"`
+	ExpectedSubOrgSize int    `json:"expected_sub_org_size"`
+}
@@ -0,0 +1,293 @@
+// Package oidc validates access tokens issued by an external OpenID Connect
+// provider and maps their claims onto a role and a mailbox identity.
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mailbox-api/authz"
+	"mailbox-api/jwtkeys"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// minRefreshInterval limits how often an unknown kid triggers a JWKS fetch.
+const minRefreshInterval = time.Minute
+
+var ErrNoRole = errors.New("token does not map to any role")
+
+// RoleMapping grants Role to callers whose groups claim contains Group.
+type RoleMapping struct {
+	Group string
+	Role  authz.Role
+}
+
+// ClaimMapping describes how external claims become a role and a mailbox.
+// Claim names may be dotted paths into nested objects, e.g.
+// "realm_access.roles".
+type ClaimMapping struct {
+	MailboxClaim string
+	GroupsClaim  string
+	// Roles are checked in order; the first group the caller belongs to
+	// decides the role.
+	Roles []RoleMapping
+	// DefaultRole applies when no group matches. If it is empty such tokens
+	// are rejected.
+	DefaultRole authz.Role
+}
+
+// Identity is what a validated external token maps to.
+type Identity struct {
+	Role              authz.Role
+	MailboxIdentifier string
+	ID                string
+	ExpiresAt         time.Time
+}
+
+type Verifier struct {
+	issuer   string
+	audience string
+	mapping  ClaimMapping
+
+	jwksURL  string
+	jwksFile string
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        *jwtkeys.KeySet
+	lastFetched time.Time
+}
+
+// NewVerifier loads the provider's JWKS from jwksURL or, for offline
+// testing, from jwksFile.
+func NewVerifier(ctx context.Context, issuer string, audience string, jwksURL string, jwksFile string, mapping ClaimMapping) (*Verifier, error) {
+	if issuer == "" {
+		return nil, errors.New("OIDC issuer is required")
+	}
+	// Without an audience, tokens the provider issued to any other client
+	// would be accepted
+	if audience == "" {
+		return nil, errors.New("OIDC audience is required")
+	}
+	if jwksURL == "" && jwksFile == "" {
+		return nil, errors.New("either a JWKS URL or a JWKS file is required")
+	}
+
+	v := &Verifier{
+		issuer:   issuer,
+		audience: audience,
+		mapping:  mapping,
+		jwksURL:  jwksURL,
+		jwksFile: jwksFile,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Issuer returns the iss claim that identifies tokens for this verifier.
+func (v *Verifier) Issuer() string {
+	return v.issuer
+}
+
+// Verify checks the token's signature, issuer, audience and lifetime and maps
+// its claims to an identity.
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.VerificationKey(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return nil, errors.New("unexpected issuer")
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return nil, errors.New("unexpected audience")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("token has no expiry")
+	}
+
+	role, err := v.role(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Role: role}
+	identity.MailboxIdentifier, _ = lookup(claims, v.mapping.MailboxClaim).(string)
+	identity.MailboxIdentifier = strings.ToLower(strings.TrimSpace(identity.MailboxIdentifier))
+	identity.ID, _ = claims["jti"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		identity.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+
+	return identity, nil
+}
+
+func (v *Verifier) role(claims jwt.MapClaims) (authz.Role, error) {
+	groups := map[string]bool{}
+	switch value := lookup(claims, v.mapping.GroupsClaim).(type) {
+	case string:
+		groups[value] = true
+	case []interface{}:
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups[name] = true
+			}
+		}
+	}
+
+	for _, mapping := range v.mapping.Roles {
+		if groups[mapping.Group] {
+			return mapping.Role, nil
+		}
+	}
+
+	if v.mapping.DefaultRole != "" {
+		return v.mapping.DefaultRole, nil
+	}
+
+	return "", ErrNoRole
+}
+
+// key returns the verification key for kid, fetching the JWKS again if the
+// kid is unknown, so that keys rotated by the provider are picked up.
+func (v *Verifier) key(ctx context.Context, kid string) (*jwtkeys.Key, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys.Get(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(v.lastFetched) >= minRefreshInterval {
+		if err := v.fetch(ctx); err != nil {
+			return nil, err
+		}
+		if key, ok := v.keys.Get(kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("unknown signing key")
+}
+
+func (v *Verifier) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fetch(ctx)
+}
+
+// fetch loads the JWKS; callers must hold mu.
+func (v *Verifier) fetch(ctx context.Context) error {
+	v.lastFetched = time.Now()
+
+	var data []byte
+	var err error
+	if v.jwksFile != "" {
+		data, err = os.ReadFile(v.jwksFile)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+	} else {
+		data, err = v.download(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := jwtkeys.ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+
+	return nil
+}
+
+func (v *Verifier) download(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %w", err)
+	}
+
+	return data, nil
+}
+
+// ParseRoleMappings parses "group=role" pairs separated by commas, keeping
+// their order.
+func ParseRoleMappings(value string) ([]RoleMapping, error) {
+	mappings := []RoleMapping{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(group) == "" || strings.TrimSpace(role) == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, expected group=role", pair)
+		}
+
+		mappings = append(mappings, RoleMapping{
+			Group: strings.TrimSpace(group),
+			Role:  authz.Role(strings.TrimSpace(role)),
+		})
+	}
+	return mappings, nil
+}
+
+// lookup follows a dotted claim path through nested objects.
+func lookup(claims map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+
+	var value interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
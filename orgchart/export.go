@@ -0,0 +1,331 @@
+// Package orgchart renders an org tree for use outside the API: as Graphviz
+// DOT, Mermaid or GraphML text, or as a tidy-tree layout with coordinates
+// for front-ends and an SVG drawing of it.
+package orgchart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"mailbox-api/model"
+)
+
+// Export formats.
+const (
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+	FormatGraphML = "graphml"
+)
+
+// Formats lists the supported export formats.
+var Formats = []string{FormatDOT, FormatMermaid, FormatGraphML}
+
+// ExportOptions control how the tree is rendered.
+type ExportOptions struct {
+	Format string
+	// ClusterByDepartment groups the mailboxes of each department into a
+	// subgraph.
+	ClusterByDepartment bool
+}
+
+// ContentType returns the media type of a rendered format.
+func ContentType(format string) string {
+	switch format {
+	case FormatDOT:
+		return "text/vnd.graphviz; charset=utf-8"
+	case FormatGraphML:
+		return "application/graphml+xml; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// IsFormat reports whether the format can be exported.
+func IsFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Export writes the tree in the requested format.
+func Export(w io.Writer, tree *model.OrgTreeNode, options ExportOptions) error {
+	nodes := flatten(tree)
+
+	switch options.Format {
+	case FormatDOT:
+		return writeDOT(w, nodes, options)
+	case FormatMermaid:
+		return writeMermaid(w, nodes, options)
+	case FormatGraphML:
+		return writeGraphML(w, nodes, options)
+	default:
+		return fmt.Errorf("unsupported export format %q", options.Format)
+	}
+}
+
+// node is a mailbox of the tree with its manager, if the manager is part of
+// the tree.
+type node struct {
+	mailbox model.Mailbox
+	manager string
+}
+
+// flatten lists the tree in pre-order, so managers come before their reports.
+func flatten(tree *model.OrgTreeNode) []node {
+	nodes := []node{}
+
+	var walk func(n *model.OrgTreeNode, manager string)
+	walk = func(n *model.OrgTreeNode, manager string) {
+		nodes = append(nodes, node{mailbox: n.Mailbox, manager: manager})
+		for _, report := range n.Reports {
+			walk(report, n.Identifier)
+		}
+	}
+	walk(tree, "")
+
+	return nodes
+}
+
+// department is a group of nodes for clustering, in order of first
+// appearance.
+type department struct {
+	id    int
+	name  string
+	nodes []node
+}
+
+func groupByDepartment(nodes []node) []*department {
+	departments := []*department{}
+	byID := map[int]*department{}
+
+	for _, n := range nodes {
+		d, ok := byID[n.mailbox.DepartmentID]
+		if !ok {
+			d = &department{id: n.mailbox.DepartmentID, name: n.mailbox.Department}
+			byID[d.id] = d
+			departments = append(departments, d)
+		}
+		d.nodes = append(d.nodes, n)
+	}
+
+	return departments
+}
+
+func labelLines(mailbox model.Mailbox) []string {
+	lines := []string{mailbox.UserFullName}
+	if mailbox.UserFullName == "" {
+		lines[0] = mailbox.Identifier
+	}
+	if mailbox.JobTitle != "" {
+		lines = append(lines, mailbox.JobTitle)
+	}
+	if mailbox.Department != "" {
+		lines = append(lines, mailbox.Department)
+	}
+	return lines
+}
+
+func writeDOT(w io.Writer, nodes []node, options ExportOptions) error {
+	var b bytes.Buffer
+
+	b.WriteString("digraph org {\n")
+	b.WriteString("  rankdir=TB;\n")
+	b.WriteString("  node [shape=box];\n")
+
+	writeNode := func(indent string, n node) {
+		lines := labelLines(n.mailbox)
+		for i, line := range lines {
+			lines[i] = dotEscape(line)
+		}
+		fmt.Fprintf(&b, "%s\"%s\" [label=\"%s\"];\n", indent, dotEscape(n.mailbox.Identifier), strings.Join(lines, `\n`))
+	}
+
+	if options.ClusterByDepartment {
+		for _, d := range groupByDepartment(nodes) {
+			fmt.Fprintf(&b, "  subgraph \"cluster_%d\" {\n", d.id)
+			fmt.Fprintf(&b, "    label=\"%s\";\n", dotEscape(d.name))
+			for _, n := range d.nodes {
+				writeNode("    ", n)
+			}
+			b.WriteString("  }\n")
+		}
+	} else {
+		for _, n := range nodes {
+			writeNode("  ", n)
+		}
+	}
+
+	for _, n := range nodes {
+		if n.manager != "" {
+			fmt.Fprintf(&b, "  \"%s\" -> \"%s\";\n", dotEscape(n.manager), dotEscape(n.mailbox.Identifier))
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMermaid writes a flowchart. Mermaid IDs cannot contain the characters
+// of an email address, so nodes are numbered and the identifier is only used
+// as a fallback label.
+func writeMermaid(w io.Writer, nodes []node, options ExportOptions) error {
+	var b bytes.Buffer
+
+	ids := make(map[string]string, len(nodes))
+	for i, n := range nodes {
+		ids[n.mailbox.Identifier] = fmt.Sprintf("n%d", i)
+	}
+
+	b.WriteString("flowchart TB\n")
+
+	writeNode := func(indent string, n node) {
+		lines := labelLines(n.mailbox)
+		for i, line := range lines {
+			lines[i] = mermaidEscape(line)
+		}
+		fmt.Fprintf(&b, "%s%s[\"%s\"]\n", indent, ids[n.mailbox.Identifier], strings.Join(lines, "<br/>"))
+	}
+
+	if options.ClusterByDepartment {
+		for _, d := range groupByDepartment(nodes) {
+			fmt.Fprintf(&b, "  subgraph d%d[\"%s\"]\n", d.id, mermaidEscape(d.name))
+			for _, n := range d.nodes {
+				writeNode("    ", n)
+			}
+			b.WriteString("  end\n")
+		}
+	} else {
+		for _, n := range nodes {
+			writeNode("  ", n)
+		}
+	}
+
+	for _, n := range nodes {
+		if n.manager != "" {
+			fmt.Fprintf(&b, "  %s --> %s\n", ids[n.manager], ids[n.mailbox.Identifier])
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;", "\n", " ").Replace(s)
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID    string        `xml:"id,attr"`
+	Data  []graphMLData `xml:"data"`
+	Graph *graphMLGraph `xml:"graph,omitempty"`
+}
+
+type graphMLEdge struct {
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeGraphML writes the tree with the name, title and department of each
+// mailbox as node data. Clusters become department nodes with a nested graph
+// holding their members; edges stay in the top-level graph.
+func writeGraphML(w io.Writer, nodes []node, options ExportOptions) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "name", For: "node", Name: "user_full_name", Type: "string"},
+			{ID: "title", For: "node", Name: "job_title", Type: "string"},
+			{ID: "department_id", For: "node", Name: "department_id", Type: "int"},
+			{ID: "department", For: "node", Name: "department", Type: "string"},
+		},
+		Graph: graphMLGraph{ID: "org", EdgeDefault: "directed"},
+	}
+
+	toNode := func(n node) graphMLNode {
+		return graphMLNode{
+			ID: n.mailbox.Identifier,
+			Data: []graphMLData{
+				{Key: "name", Value: n.mailbox.UserFullName},
+				{Key: "title", Value: n.mailbox.JobTitle},
+				{Key: "department_id", Value: fmt.Sprint(n.mailbox.DepartmentID)},
+				{Key: "department", Value: n.mailbox.Department},
+			},
+		}
+	}
+
+	if options.ClusterByDepartment {
+		for _, d := range groupByDepartment(nodes) {
+			id := fmt.Sprintf("department:%d", d.id)
+			cluster := graphMLNode{
+				ID: id,
+				Data: []graphMLData{
+					{Key: "department_id", Value: fmt.Sprint(d.id)},
+					{Key: "department", Value: d.name},
+				},
+				Graph: &graphMLGraph{ID: id + ":", EdgeDefault: "directed"},
+			}
+			for _, n := range d.nodes {
+				cluster.Graph.Nodes = append(cluster.Graph.Nodes, toNode(n))
+			}
+			doc.Graph.Nodes = append(doc.Graph.Nodes, cluster)
+		}
+	} else {
+		for _, n := range nodes {
+			doc.Graph.Nodes = append(doc.Graph.Nodes, toNode(n))
+		}
+	}
+
+	for _, n := range nodes {
+		if n.manager != "" {
+			doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{Source: n.manager, Target: n.mailbox.Identifier})
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,261 @@
+package orgchart
+
+import (
+	"math"
+
+	"mailbox-api/model"
+)
+
+// Layout orientations.
+const (
+	OrientationVertical   = "vertical"
+	OrientationHorizontal = "horizontal"
+)
+
+// LayoutOptions control the size and spacing of the laid out nodes. In the
+// vertical orientation managers are above their reports, in the horizontal
+// one to their left.
+type LayoutOptions struct {
+	NodeWidth      float64
+	NodeHeight     float64
+	SiblingSpacing float64
+	LevelSpacing   float64
+	Orientation    string
+	// CollapseAbove hides the reports of mailboxes with more than this many
+	// direct reports; 0 never collapses.
+	CollapseAbove int
+}
+
+// DefaultLayoutOptions returns the options used for parameters a caller
+// leaves out.
+func DefaultLayoutOptions() LayoutOptions {
+	return LayoutOptions{
+		NodeWidth:      160,
+		NodeHeight:     60,
+		SiblingSpacing: 20,
+		LevelSpacing:   60,
+		Orientation:    OrientationVertical,
+	}
+}
+
+// Point is a position in the layout. The origin is the top-left corner.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// LayoutNode is a laid out mailbox. X and Y are the centre of the node;
+// SubtreeWidth is the extent of the node and everything below it across the
+// reporting lines (horizontally in the vertical orientation).
+type LayoutNode struct {
+	Identifier    string  `json:"mailbox_identifier"`
+	UserFullName  string  `json:"user_full_name"`
+	JobTitle      string  `json:"job_title"`
+	Department    string  `json:"department"`
+	Depth         int     `json:"depth"`
+	X             float64 `json:"x"`
+	Y             float64 `json:"y"`
+	Width         float64 `json:"width"`
+	Height        float64 `json:"height"`
+	SubtreeWidth  float64 `json:"subtree_width"`
+	Collapsed     bool    `json:"collapsed"`
+	HiddenReports int     `json:"hidden_reports"`
+}
+
+// LayoutEdge is the route of a reporting line from the manager's node to
+// the report's, as a polyline with right-angled bends.
+type LayoutEdge struct {
+	Source string  `json:"source"`
+	Target string  `json:"target"`
+	Points []Point `json:"points"`
+}
+
+// Layout is a tidy drawing of an org tree.
+type Layout struct {
+	Orientation string       `json:"orientation"`
+	Width       float64      `json:"width"`
+	Height      float64      `json:"height"`
+	Nodes       []LayoutNode `json:"nodes"`
+	Edges       []LayoutEdge `json:"edges"`
+}
+
+// placed is a subtree laid out relative to its root. offsets are the
+// positions of the children relative to the root across the reporting lines;
+// left and right are the outer edges of the subtree on each level below and
+// including the root.
+type placed struct {
+	node      *model.OrgTreeNode
+	children  []*placed
+	offsets   []float64
+	left      []float64
+	right     []float64
+	collapsed bool
+	hidden    int
+}
+
+// NewLayout lays out the tree in the style of Reingold and Tilford: each
+// subtree is laid out on its own, siblings are pushed apart just far enough
+// that their contours keep the sibling spacing on every level, and each
+// manager is centred over their first and last report. Subtrees are never
+// interleaved, and identical subtrees are drawn identically.
+func NewLayout(tree *model.OrgTreeNode, options LayoutOptions) *Layout {
+	breadth, length := options.NodeWidth, options.NodeHeight
+	if options.Orientation == OrientationHorizontal {
+		breadth, length = options.NodeHeight, options.NodeWidth
+	}
+
+	root := place(tree, breadth, options)
+
+	layout := &Layout{
+		Orientation: options.Orientation,
+		Nodes:       []LayoutNode{},
+		Edges:       []LayoutEdge{},
+	}
+
+	// Shift the tree so that its leftmost edge is at 0
+	minLeft := 0.0
+	for _, left := range root.left {
+		minLeft = math.Min(minLeft, left)
+	}
+
+	position := func(across float64, depth int) Point {
+		along := float64(depth)*(length+options.LevelSpacing) + length/2
+		if options.Orientation == OrientationHorizontal {
+			return Point{X: along, Y: across}
+		}
+		return Point{X: across, Y: along}
+	}
+
+	var walk func(p *placed, across float64, depth int)
+	walk = func(p *placed, across float64, depth int) {
+		centre := position(across, depth)
+		layout.Nodes = append(layout.Nodes, LayoutNode{
+			Identifier:    p.node.Identifier,
+			UserFullName:  p.node.UserFullName,
+			JobTitle:      p.node.JobTitle,
+			Department:    p.node.Department,
+			Depth:         depth,
+			X:             centre.X,
+			Y:             centre.Y,
+			Width:         options.NodeWidth,
+			Height:        options.NodeHeight,
+			SubtreeWidth:  extent(p),
+			Collapsed:     p.collapsed,
+			HiddenReports: p.hidden,
+		})
+
+		for i, child := range p.children {
+			childAcross := across + p.offsets[i]
+			layout.Edges = append(layout.Edges, LayoutEdge{
+				Source: p.node.Identifier,
+				Target: child.node.Identifier,
+				Points: route(centre, position(childAcross, depth+1), options),
+			})
+			walk(child, childAcross, depth+1)
+		}
+	}
+	walk(root, -minLeft, 0)
+
+	totalAcross := extent(root)
+	totalAlong := float64(len(root.left))*(length+options.LevelSpacing) - options.LevelSpacing
+	if options.Orientation == OrientationHorizontal {
+		layout.Width, layout.Height = totalAlong, totalAcross
+	} else {
+		layout.Width, layout.Height = totalAcross, totalAlong
+	}
+
+	return layout
+}
+
+func place(node *model.OrgTreeNode, breadth float64, options LayoutOptions) *placed {
+	p := &placed{
+		node:  node,
+		left:  []float64{-breadth / 2},
+		right: []float64{breadth / 2},
+	}
+
+	if options.CollapseAbove > 0 && len(node.Reports) > options.CollapseAbove {
+		p.collapsed = true
+		p.hidden = countReports(node)
+		return p
+	}
+	if len(node.Reports) == 0 {
+		return p
+	}
+
+	positions := make([]float64, len(node.Reports))
+	var accLeft, accRight []float64
+
+	for i, report := range node.Reports {
+		child := place(report, breadth, options)
+		p.children = append(p.children, child)
+
+		if i == 0 {
+			accLeft = append(accLeft, child.left...)
+			accRight = append(accRight, child.right...)
+			continue
+		}
+
+		shift := math.Inf(-1)
+		for level := 0; level < len(accRight) && level < len(child.left); level++ {
+			shift = math.Max(shift, accRight[level]-child.left[level]+options.SiblingSpacing)
+		}
+		positions[i] = shift
+
+		for level := range child.left {
+			if level < len(accRight) {
+				accRight[level] = child.right[level] + shift
+			} else {
+				accLeft = append(accLeft, child.left[level]+shift)
+				accRight = append(accRight, child.right[level]+shift)
+			}
+		}
+	}
+
+	mid := (positions[0] + positions[len(positions)-1]) / 2
+	p.offsets = make([]float64, len(positions))
+	for i, position := range positions {
+		p.offsets[i] = position - mid
+	}
+	for level := range accLeft {
+		p.left = append(p.left, accLeft[level]-mid)
+		p.right = append(p.right, accRight[level]-mid)
+	}
+
+	return p
+}
+
+// extent is the width of the subtree across the reporting lines.
+func extent(p *placed) float64 {
+	minLeft, maxRight := math.Inf(1), math.Inf(-1)
+	for level := range p.left {
+		minLeft = math.Min(minLeft, p.left[level])
+		maxRight = math.Max(maxRight, p.right[level])
+	}
+	return maxRight - minLeft
+}
+
+func countReports(node *model.OrgTreeNode) int {
+	count := 0
+	for _, report := range node.Reports {
+		count += 1 + countReports(report)
+	}
+	return count
+}
+
+// route leaves the manager's node in the middle of its far side, bends
+// halfway between the two levels and enters the report's node in the middle
+// of its near side.
+func route(from Point, to Point, options LayoutOptions) []Point {
+	if options.Orientation == OrientationHorizontal {
+		start := Point{X: from.X + options.NodeWidth/2, Y: from.Y}
+		end := Point{X: to.X - options.NodeWidth/2, Y: to.Y}
+		bend := (start.X + end.X) / 2
+		return []Point{start, {X: bend, Y: start.Y}, {X: bend, Y: end.Y}, end}
+	}
+
+	start := Point{X: from.X, Y: from.Y + options.NodeHeight/2}
+	end := Point{X: to.X, Y: to.Y - options.NodeHeight/2}
+	bend := (start.Y + end.Y) / 2
+	return []Point{start, {X: start.X, Y: bend}, {X: end.X, Y: bend}, end}
+}
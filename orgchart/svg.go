@@ -0,0 +1,87 @@
+package orgchart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"mailbox-api/model"
+)
+
+// svgMargin keeps strokes at the edge of the layout inside the image.
+const svgMargin = 10
+
+// WriteSVG draws the layout as an SVG image: a box per mailbox with its name,
+// title and department, and the edge routes as polylines. Collapsed nodes
+// show how many reports they hide.
+func WriteSVG(w io.Writer, layout *Layout) error {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="%s %s %s %s" font-family="sans-serif" font-size="12">`+"\n",
+		number(layout.Width+2*svgMargin), number(layout.Height+2*svgMargin),
+		number(-svgMargin), number(-svgMargin), number(layout.Width+2*svgMargin), number(layout.Height+2*svgMargin))
+
+	b.WriteString(`  <g fill="none" stroke="#888">` + "\n")
+	for _, edge := range layout.Edges {
+		points := make([]string, len(edge.Points))
+		for i, p := range edge.Points {
+			points[i] = number(p.X) + "," + number(p.Y)
+		}
+		fmt.Fprintf(&b, `    <polyline points="%s"/>`+"\n", strings.Join(points, " "))
+	}
+	b.WriteString("  </g>\n")
+
+	for _, node := range layout.Nodes {
+		x, y := node.X-node.Width/2, node.Y-node.Height/2
+		fmt.Fprintf(&b, `  <g id="%s">`+"\n", escapeXML(node.Identifier))
+		fmt.Fprintf(&b, `    <rect x="%s" y="%s" width="%s" height="%s" rx="4" fill="#fff" stroke="#333"/>`+"\n",
+			number(x), number(y), number(node.Width), number(node.Height))
+
+		lines := labelLines(model.Mailbox{
+			Identifier:   node.Identifier,
+			UserFullName: node.UserFullName,
+			JobTitle:     node.JobTitle,
+			Department:   node.Department,
+		})
+		if node.Collapsed {
+			lines = append(lines, fmt.Sprintf("+%d more", node.HiddenReports))
+		}
+
+		fmt.Fprintf(&b, `    <text x="%s" y="%s" text-anchor="middle">`, number(node.X), number(node.Y))
+		offset := -float64(len(lines)-1) / 2
+		for i, line := range lines {
+			fmt.Fprintf(&b, `<tspan x="%s" dy="%sem">%s</tspan>`, number(node.X), number(dy(i, offset)), escapeXML(line))
+		}
+		b.WriteString("</text>\n")
+		b.WriteString("  </g>\n")
+	}
+
+	b.WriteString("</svg>\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// dy is the vertical offset of a text line in ems: the first line is moved
+// up so that the block is centred, the others follow one line apart.
+func dy(line int, firstOffset float64) float64 {
+	if line == 0 {
+		return firstOffset*1.2 + 0.35
+	}
+	return 1.2
+}
+
+// number formats a coordinate with at most two decimals.
+func number(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
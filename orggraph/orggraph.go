@@ -0,0 +1,300 @@
+// Package orggraph indexes a flat list of mailboxes by reporting line so that
+// hierarchy questions can be answered without rescanning the whole list.
+package orggraph
+
+import (
+	"mailbox-api/model"
+)
+
+// Graph is a parent-to-children index over a set of mailboxes. Mailboxes
+// without a manager, or whose manager is not part of the set, are roots.
+type Graph struct {
+	mailboxes []model.Mailbox
+	index     map[string]int
+	children  map[string][]string
+	roots     []string
+}
+
+// New builds the graph in a single pass. Children keep the order in which
+// they appear in mailboxes.
+func New(mailboxes []model.Mailbox) *Graph {
+	g := &Graph{
+		mailboxes: mailboxes,
+		index:     make(map[string]int, len(mailboxes)),
+		children:  make(map[string][]string),
+	}
+
+	for i := range mailboxes {
+		g.index[mailboxes[i].Identifier] = i
+	}
+
+	for _, mailbox := range mailboxes {
+		manager := mailbox.ManagerIdentifier
+		if _, ok := g.index[manager]; manager == "" || !ok {
+			g.roots = append(g.roots, mailbox.Identifier)
+			continue
+		}
+		g.children[manager] = append(g.children[manager], mailbox.Identifier)
+	}
+
+	return g
+}
+
+// Len returns the number of mailboxes in the graph.
+func (g *Graph) Len() int {
+	return len(g.mailboxes)
+}
+
+// Get returns the mailbox with the given identifier.
+func (g *Graph) Get(identifier string) (*model.Mailbox, bool) {
+	i, ok := g.index[identifier]
+	if !ok {
+		return nil, false
+	}
+	return &g.mailboxes[i], true
+}
+
+// Roots returns the identifiers of mailboxes that have no known manager.
+func (g *Graph) Roots() []string {
+	return g.roots
+}
+
+// Children returns the identifiers of the direct reports of a mailbox.
+func (g *Graph) Children(identifier string) []string {
+	return g.children[identifier]
+}
+
+// Subtree returns every direct and indirect report of a mailbox in
+// breadth-first order, excluding the mailbox itself.
+func (g *Graph) Subtree(identifier string) []model.Mailbox {
+	result := []model.Mailbox{}
+	visited := map[string]bool{identifier: true}
+	queue := []string{identifier}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, child := range g.children[current] {
+			if visited[child] {
+				continue
+			}
+			visited[child] = true
+			result = append(result, g.mailboxes[g.index[child]])
+			queue = append(queue, child)
+		}
+	}
+
+	return result
+}
+
+// Ancestors returns the management chain above a mailbox, nearest manager
+// first. The walk stops at a root or when it would revisit a mailbox.
+func (g *Graph) Ancestors(identifier string) []string {
+	ancestors := []string{}
+	visited := map[string]bool{identifier: true}
+
+	i, ok := g.index[identifier]
+	for ok {
+		manager := g.mailboxes[i].ManagerIdentifier
+		if visited[manager] {
+			break
+		}
+		i, ok = g.index[manager]
+		if !ok {
+			break
+		}
+		visited[manager] = true
+		ancestors = append(ancestors, manager)
+	}
+
+	return ancestors
+}
+
+// Tree returns the mailbox with its reports nested below it, down to depth
+// levels; a negative depth means no limit. Reports keep the order of
+// Children, and a mailbox already placed in the tree is not repeated.
+func (g *Graph) Tree(identifier string, depth int) (*model.OrgTreeNode, bool) {
+	i, ok := g.index[identifier]
+	if !ok {
+		return nil, false
+	}
+
+	visited := map[string]bool{identifier: true}
+	root := &model.OrgTreeNode{Mailbox: g.mailboxes[i], Reports: []*model.OrgTreeNode{}}
+
+	var grow func(node *model.OrgTreeNode, level int)
+	grow = func(node *model.OrgTreeNode, level int) {
+		if depth >= 0 && level >= depth {
+			return
+		}
+		for _, child := range g.children[node.Identifier] {
+			if visited[child] {
+				continue
+			}
+			visited[child] = true
+			report := &model.OrgTreeNode{Mailbox: g.mailboxes[g.index[child]], Reports: []*model.OrgTreeNode{}}
+			node.Reports = append(node.Reports, report)
+			grow(report, level+1)
+		}
+	}
+	grow(root, 0)
+
+	return root, true
+}
+
+// IsInSubOrg reports whether the mailbox reports, directly or indirectly, to
+// the manager. It only walks the mailbox's own management chain.
+func (g *Graph) IsInSubOrg(managerIdentifier string, identifier string) bool {
+	for _, ancestor := range g.Ancestors(identifier) {
+		if ancestor == managerIdentifier {
+			return true
+		}
+	}
+	return false
+}
+
+// DanglingManagers returns the mailboxes that name a manager which is not part
+// of the graph.
+func (g *Graph) DanglingManagers() []model.Mailbox {
+	result := []model.Mailbox{}
+	for _, mailbox := range g.mailboxes {
+		if mailbox.ManagerIdentifier == "" {
+			continue
+		}
+		if _, ok := g.index[mailbox.ManagerIdentifier]; !ok {
+			result = append(result, mailbox)
+		}
+	}
+	return result
+}
+
+// Cycles returns every reporting cycle as the list of its members, starting
+// from the member that appears first in the input. Since each mailbox has at
+// most one manager, every mailbox belongs to at most one cycle and a single
+// pass over the manager references finds them all.
+func (g *Graph) Cycles() [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+
+	state := make(map[string]int, len(g.mailboxes))
+	cycles := [][]string{}
+
+	for _, mailbox := range g.mailboxes {
+		path := []string{}
+		current := mailbox.Identifier
+
+		for {
+			if _, ok := g.index[current]; !ok || state[current] == done {
+				break
+			}
+			if state[current] == inProgress {
+				for i, identifier := range path {
+					if identifier == current {
+						cycles = append(cycles, append([]string{}, path[i:]...))
+						break
+					}
+				}
+				break
+			}
+
+			state[current] = inProgress
+			path = append(path, current)
+			current = g.mailboxes[g.index[current]].ManagerIdentifier
+		}
+
+		for _, identifier := range path {
+			state[identifier] = done
+		}
+	}
+
+	return cycles
+}
+
+// TopologicalOrder returns the identifiers of all mailboxes so that every
+// manager comes before its reports. Mailboxes in a cycle are appended last,
+// in input order.
+func (g *Graph) TopologicalOrder() []string {
+	order := make([]string, 0, len(g.mailboxes))
+	visited := make(map[string]bool, len(g.mailboxes))
+
+	queue := append([]string{}, g.roots...)
+	for _, root := range g.roots {
+		visited[root] = true
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		order = append(order, current)
+
+		for _, child := range g.children[current] {
+			if !visited[child] {
+				visited[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	for _, mailbox := range g.mailboxes {
+		if !visited[mailbox.Identifier] {
+			order = append(order, mailbox.Identifier)
+		}
+	}
+
+	return order
+}
+
+// Metrics returns the org depth and sub-org size of every mailbox in time
+// linear in the size of the graph. Mailboxes caught in a reporting cycle are
+// not reachable from any root; they are measured from the point where the
+// cycle is entered so that the computation always terminates.
+func (g *Graph) Metrics() (depths map[string]int, subOrgSizes map[string]int) {
+	depths = make(map[string]int, len(g.mailboxes))
+	subOrgSizes = make(map[string]int, len(g.mailboxes))
+	parents := make(map[string]string, len(g.mailboxes))
+	order := make([]string, 0, len(g.mailboxes))
+
+	walk := func(start string, depth int) {
+		depths[start] = depth
+		order = append(order, start)
+		for i := len(order) - 1; i < len(order); i++ {
+			current := order[i]
+			for _, child := range g.children[current] {
+				if _, seen := depths[child]; seen {
+					continue
+				}
+				depths[child] = depths[current] + 1
+				parents[child] = current
+				order = append(order, child)
+			}
+		}
+	}
+
+	for _, root := range g.roots {
+		walk(root, 0)
+	}
+
+	for _, mailbox := range g.mailboxes {
+		if _, seen := depths[mailbox.Identifier]; !seen {
+			walk(mailbox.Identifier, len(g.Ancestors(mailbox.Identifier)))
+		}
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		identifier := order[i]
+		if parent, ok := parents[identifier]; ok {
+			subOrgSizes[parent] += subOrgSizes[identifier] + 1
+		}
+	}
+
+	for _, identifier := range order {
+		if _, ok := subOrgSizes[identifier]; !ok {
+			subOrgSizes[identifier] = 0
+		}
+	}
+
+	return depths, subOrgSizes
+}
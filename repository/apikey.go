@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"mailbox-api/db"
+	"mailbox-api/model"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, key model.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*model.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) (bool, error)
+	TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error
+}
+
+type apiKeyRepository struct {
+	db *db.DB
+}
+
+func NewAPIKeyRepository(db *db.DB) APIKeyRepository {
+	return &apiKeyRepository{db: db}
+}
+
+const apiKeyColumns = `
+		id,
+		name,
+		key_hash,
+		scopes,
+		mailbox_identifier,
+		created_by,
+		created_at,
+		expires_at,
+		last_used_at,
+		revoked_at`
+
+func scanAPIKey(row pgx.Row) (*model.APIKey, error) {
+	var key model.APIKey
+	var mailboxId sql.NullString
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.KeyHash,
+		&key.Scopes,
+		&mailboxId,
+		&key.CreatedBy,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.MailboxIdentifier = mailboxId.String
+
+	return &key, nil
+}
+
+func (r *apiKeyRepository) CreateAPIKey(ctx context.Context, key model.APIKey) error {
+	query := `
+	INSERT INTO api_keys (
+		id,
+		name,
+		key_hash,
+		scopes,
+		mailbox_identifier,
+		created_by,
+		expires_at
+	) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)`
+
+	_, err := r.db.Exec(ctx, query,
+		key.ID,
+		key.Name,
+		key.KeyHash,
+		key.Scopes,
+		key.MailboxIdentifier,
+		key.CreatedBy,
+		key.ExpiresAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	return nil
+}
+
+func (r *apiKeyRepository) GetAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	query := `
+	SELECT` + apiKeyColumns + `
+	FROM
+		api_keys
+	WHERE
+		id = $1`
+
+	key, err := scanAPIKey(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	return key, nil
+}
+
+func (r *apiKeyRepository) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	query := `
+	SELECT` + apiKeyColumns + `
+	FROM
+		api_keys
+	ORDER BY
+		created_at, id`
+
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []model.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating API key rows: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey reports false if the key does not exist or was already
+// revoked.
+func (r *apiKeyRepository) RevokeAPIKey(ctx context.Context, id string) (bool, error) {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = NOW()
+	WHERE id = $1 AND revoked_at IS NULL`
+
+	rows, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	return rows > 0, nil
+}
+
+func (r *apiKeyRepository) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = $2
+	WHERE id = $1`
+
+	if _, err := r.db.Exec(ctx, query, id, usedAt); err != nil {
+		return fmt.Errorf("failed to update API key last use: %w", err)
+	}
+
+	return nil
+}
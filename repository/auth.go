@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"mailbox-api/db"
+	"mailbox-api/model"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type AuthRepository interface {
+	GetCredential(ctx context.Context, username string) (*model.Credential, error)
+	CreateCredential(ctx context.Context, credential model.Credential) error
+	CreateRefreshToken(ctx context.Context, token model.RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (*model.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, tokenHash string) (bool, error)
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type authRepository struct {
+	db *db.DB
+}
+
+func NewAuthRepository(db *db.DB) AuthRepository {
+	return &authRepository{db: db}
+}
+
+func (r *authRepository) GetCredential(ctx context.Context, username string) (*model.Credential, error) {
+	query := `
+	SELECT
+		username,
+		password_hash,
+		role,
+		mailbox_identifier,
+		created_at
+	FROM
+		credentials
+	WHERE
+		username = $1`
+
+	var credential model.Credential
+	var mailboxId sql.NullString
+	err := r.db.QueryRow(ctx, query, username).Scan(
+		&credential.Username,
+		&credential.PasswordHash,
+		&credential.Role,
+		&mailboxId,
+		&credential.CreatedAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get credential: %w", err)
+	}
+
+	credential.MailboxIdentifier = mailboxId.String
+
+	return &credential, nil
+}
+
+func (r *authRepository) CreateCredential(ctx context.Context, credential model.Credential) error {
+	query := `
+	INSERT INTO credentials (
+		username,
+		password_hash,
+		role,
+		mailbox_identifier
+	) VALUES ($1, $2, $3, NULLIF($4, ''))`
+
+	_, err := r.db.Exec(ctx, query,
+		credential.Username,
+		credential.PasswordHash,
+		credential.Role,
+		credential.MailboxIdentifier,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create credential: %w", err)
+	}
+
+	return nil
+}
+
+func (r *authRepository) CreateRefreshToken(ctx context.Context, token model.RefreshToken) error {
+	query := `
+	INSERT INTO refresh_tokens (
+		token_hash,
+		username,
+		expires_at
+	) VALUES ($1, $2, $3)`
+
+	_, err := r.db.Exec(ctx, query, token.TokenHash, token.Username, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	return nil
+}
+
+func (r *authRepository) GetRefreshToken(ctx context.Context, tokenHash string) (*model.RefreshToken, error) {
+	query := `
+	SELECT
+		token_hash,
+		username,
+		expires_at,
+		revoked_at
+	FROM
+		refresh_tokens
+	WHERE
+		token_hash = $1`
+
+	var token model.RefreshToken
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(
+		&token.TokenHash,
+		&token.Username,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	return &token, nil
+}
+
+// RevokeRefreshToken marks the token as revoked. It reports false if the
+// token does not exist or was already revoked, so that concurrent refreshes
+// with the same token cannot both succeed.
+func (r *authRepository) RevokeRefreshToken(ctx context.Context, tokenHash string) (bool, error) {
+	query := `
+	UPDATE refresh_tokens
+	SET revoked_at = NOW()
+	WHERE token_hash = $1 AND revoked_at IS NULL`
+
+	rows, err := r.db.Exec(ctx, query, tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+
+	return rows > 0, nil
+}
+
+// RevokeAccessToken adds the token to the revocation list and drops entries
+// for tokens that have expired anyway.
+func (r *authRepository) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	query := `
+	INSERT INTO revoked_tokens (
+		jti,
+		expires_at
+	) VALUES ($1, $2)
+	ON CONFLICT (jti) DO NOTHING`
+
+	if _, err := r.db.Exec(ctx, query, jti, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+
+	if _, err := r.db.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (r *authRepository) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM revoked_tokens
+		WHERE jti = $1
+	)`
+
+	var revoked bool
+	if err := r.db.QueryRow(ctx, query, jti).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("failed to check revoked token: %w", err)
+	}
+
+	return revoked, nil
+}
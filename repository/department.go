@@ -14,9 +14,38 @@ import (
 type DepartmentRepository interface {
 	GetDepartments(ctx context.Context) ([]model.Department, error)
 	GetDepartmentByID(ctx context.Context, id int) (*model.Department, error)
-	CreateDepartment(ctx context.Context, department model.Department) error
+	CreateDepartment(ctx context.Context, department model.Department, members []string) (int, error)
+	UpdateDepartment(ctx context.Context, department model.Department) error
+	DeleteDepartment(ctx context.Context, id int) error
+	ImportDepartments(ctx context.Context, departments []model.Department) error
+	GetDepartmentSummaries(ctx context.Context) ([]model.DepartmentSummary, error)
 }
 
+// ErrMemberNotFound is returned by CreateDepartment when a member is not a
+// stored mailbox.
+var ErrMemberNotFound = errors.New("department member not found")
+
+// ErrDepartmentExists is returned by CreateDepartment when another department
+// already has the ID.
+var ErrDepartmentExists = errors.New("department already exists")
+
+// ErrDepartmentCycle is returned by UpdateDepartment when the new parent is
+// the department itself or below it.
+var ErrDepartmentCycle = errors.New("parent change would create a department cycle")
+
+// ErrDepartmentNotFound, ErrDepartmentHasMembers and
+// ErrDepartmentHasSubDepartments are returned by DeleteDepartment when the
+// department cannot be deleted.
+var (
+	ErrDepartmentNotFound          = errors.New("department not found")
+	ErrDepartmentHasMembers        = errors.New("department has members")
+	ErrDepartmentHasSubDepartments = errors.New("department has sub-departments")
+)
+
+// maxDepartmentIDAttempts bounds how often CreateDepartment picks a new ID
+// after concurrent creates took the one it picked.
+const maxDepartmentIDAttempts = 5
+
 type departmentRepository struct {
 	db *db.DB
 }
@@ -29,7 +58,9 @@ func (r *departmentRepository) GetDepartments(ctx context.Context) ([]model.Depa
 	query := `
 	SELECT 
 		department_id, 
-		department_name
+		department_name,
+		COALESCE(parent_department_id, 0),
+		cost_center
 	FROM 
 		departments
 	ORDER BY 
@@ -47,6 +78,8 @@ func (r *departmentRepository) GetDepartments(ctx context.Context) ([]model.Depa
 		err := rows.Scan(
 			&department.ID,
 			&department.Name,
+			&department.ParentID,
+			&department.CostCenter,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan department: %w", err)
@@ -65,7 +98,9 @@ func (r *departmentRepository) GetDepartmentByID(ctx context.Context, id int) (*
 	query := `
 	SELECT 
 		department_id, 
-		department_name
+		department_name,
+		COALESCE(parent_department_id, 0),
+		cost_center
 	FROM 
 		departments
 	WHERE 
@@ -75,6 +110,8 @@ func (r *departmentRepository) GetDepartmentByID(ctx context.Context, id int) (*
 	err := r.db.QueryRow(ctx, query, id).Scan(
 		&department.ID,
 		&department.Name,
+		&department.ParentID,
+		&department.CostCenter,
 	)
 
 	if err != nil {
@@ -87,21 +124,346 @@ func (r *departmentRepository) GetDepartmentByID(ctx context.Context, id int) (*
 	return &department, nil
 }
 
-func (r *departmentRepository) CreateDepartment(ctx context.Context, department model.Department) error {
+// CreateDepartment inserts the department and moves the members into it in
+// a single transaction, and returns its ID. A zero ID is replaced by one more
+// than the highest existing ID, picked again if a concurrent create takes it
+// first. Nothing is stored if a member does not exist.
+func (r *departmentRepository) CreateDepartment(ctx context.Context, department model.Department, members []string) (int, error) {
+	for attempt := 1; ; attempt++ {
+		id, err := r.createDepartment(ctx, department, members)
+		if errors.Is(err, ErrDepartmentExists) && department.ID == 0 && attempt < maxDepartmentIDAttempts {
+			continue
+		}
+		return id, err
+	}
+}
+
+func (r *departmentRepository) createDepartment(ctx context.Context, department model.Department, members []string) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
 	query := `
 	INSERT INTO departments (
 		department_id, 
-		department_name
-	) VALUES ($1, $2)`
+		department_name,
+		parent_department_id,
+		cost_center
+	) VALUES (
+		CASE WHEN $1 = 0 THEN (SELECT COALESCE(MAX(department_id), 0) + 1 FROM departments) ELSE $1 END,
+		$2,
+		NULLIF($3, 0),
+		$4
+	)
+	RETURNING department_id`
+
+	var id int
+	err = tx.QueryRow(ctx, query,
+		department.ID,
+		department.Name,
+		department.ParentID,
+		department.CostCenter,
+	).Scan(&id)
+
+	if isUniqueViolation(err) {
+		return 0, ErrDepartmentExists
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to create department: %w", err)
+	}
+
+	if len(members) > 0 {
+		move := `
+		UPDATE mailboxes
+		SET department_id = $1
+		WHERE mailbox_identifier = ANY($2)`
+
+		tag, err := tx.Exec(ctx, move, id, members)
+		if err != nil {
+			return 0, fmt.Errorf("failed to move department members: %w", err)
+		}
+		if tag.RowsAffected() != int64(len(members)) {
+			return 0, ErrMemberNotFound
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, nil
+}
+
+// UpdateDepartment stores the department. A new parent is checked inside
+// the transaction, after its chain of ancestors is locked, so that two
+// concurrent changes cannot close a cycle together; ErrDepartmentCycle is
+// returned if the department is among them.
+func (r *departmentRepository) UpdateDepartment(ctx context.Context, department model.Department) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current := `
+	SELECT COALESCE(parent_department_id, 0)
+	FROM departments
+	WHERE department_id = $1
+	FOR UPDATE`
+
+	var parentID int
+	err = tx.QueryRow(ctx, current, department.ID).Scan(&parentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock department %d: %w", department.ID, err)
+	}
+
+	if department.ParentID != 0 && department.ParentID != parentID {
+		cycle, err := lockDepartmentChain(ctx, tx, department.ID, department.ParentID)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrDepartmentCycle
+		}
+	}
+
+	query := `
+	UPDATE departments
+	SET
+		department_name = $2,
+		parent_department_id = NULLIF($3, 0),
+		cost_center = $4
+	WHERE department_id = $1`
 
-	_, err := r.db.Exec(ctx, query,
+	_, err = tx.Exec(ctx, query,
 		department.ID,
 		department.Name,
+		department.ParentID,
+		department.CostCenter,
 	)
+	if err != nil {
+		return fmt.Errorf("failed to update department: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// lockDepartmentChain locks the rows of the parent and all its ancestors and
+// then reports whether the department is among them, in which case moving it
+// below the parent would close a cycle. As with lockReportingLine, of two
+// changes that would only close a cycle together the second waits for the
+// first and then sees its parent, or a deadlock aborts one of them. The
+// depth bound stops the walk on a cycle stored before this check.
+func lockDepartmentChain(ctx context.Context, tx pgx.Tx, id int, parentID int) (bool, error) {
+	chain := `
+	WITH RECURSIVE chain (department_id, parent_department_id, depth) AS (
+		SELECT department_id, parent_department_id, 0
+		FROM departments
+		WHERE department_id = $1
+		UNION ALL
+		SELECT d.department_id, d.parent_department_id, c.depth + 1
+		FROM departments d
+		JOIN chain c ON d.department_id = c.parent_department_id
+		WHERE c.depth < 1000
+	)`
+
+	lock := chain + `
+	SELECT department_id
+	FROM departments
+	WHERE department_id IN (SELECT department_id FROM chain)
+	ORDER BY department_id
+	FOR UPDATE`
+
+	rows, err := tx.Query(ctx, lock, parentID)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock ancestors of department %d: %w", parentID, err)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to lock ancestors of department %d: %w", parentID, err)
+	}
 
+	// A new statement sees the parents that committed while waiting for the locks
+	query := chain + `
+	SELECT EXISTS (SELECT 1 FROM chain WHERE department_id = $2)`
+
+	var cycle bool
+	if err := tx.QueryRow(ctx, query, parentID, id).Scan(&cycle); err != nil {
+		return false, fmt.Errorf("failed to check ancestors of department %d: %w", parentID, err)
+	}
+
+	return cycle, nil
+}
+
+// DeleteDepartment deletes the department only if no mailbox belongs to it
+// and it has no sub-departments, and otherwise returns the error for the one
+// that keeps it. The department's row is locked first, which keeps
+// concurrent writes from adding a member or sub-department referencing it
+// until the delete commits.
+func (r *departmentRepository) DeleteDepartment(ctx context.Context, id int) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	lock := `
+	SELECT department_id
+	FROM departments
+	WHERE department_id = $1
+	FOR UPDATE`
+
+	err = tx.QueryRow(ctx, lock, id).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDepartmentNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock department %d: %w", id, err)
+	}
+
+	// A new statement sees the writes that committed while waiting for the lock
+	references := `
+	SELECT
+		EXISTS (SELECT 1 FROM mailboxes WHERE department_id = $1),
+		EXISTS (SELECT 1 FROM departments WHERE parent_department_id = $1)`
+
+	var hasMembers, hasSubDepartments bool
+	if err := tx.QueryRow(ctx, references, id).Scan(&hasMembers, &hasSubDepartments); err != nil {
+		return fmt.Errorf("failed to check department %d: %w", id, err)
+	}
+	if hasSubDepartments {
+		return ErrDepartmentHasSubDepartments
+	}
+	if hasMembers {
+		return ErrDepartmentHasMembers
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM departments WHERE department_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete department: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ImportDepartments inserts the departments in a single transaction, so
+// either all of them are stored or none. Parents must come before their
+// sub-departments.
+func (r *departmentRepository) ImportDepartments(ctx context.Context, departments []model.Department) error {
+	tx, err := r.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create department: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+	INSERT INTO departments (
+		department_id, 
+		department_name,
+		parent_department_id,
+		cost_center
+	) VALUES ($1, $2, NULLIF($3, 0), $4)`
+
+	for _, department := range departments {
+		_, err := tx.Exec(ctx, query,
+			department.ID,
+			department.Name,
+			department.ParentID,
+			department.CostCenter,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to import department %d: %w", department.ID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
+
+// departmentSummaryQuery counts only the active mailboxes; the ones that left
+// the organization are kept but no longer belong to a department's staff.
+const departmentSummaryQuery = `
+	SELECT
+		d.department_id,
+		d.department_name,
+		COALESCE(d.parent_department_id, 0),
+		d.cost_center,
+		COUNT(m.mailbox_identifier) AS headcount,
+		COUNT(m.mailbox_identifier) FILTER (
+			WHERE EXISTS (
+				SELECT 1 FROM mailboxes r WHERE r.manager_mailbox_identifier = m.mailbox_identifier AND r.active
+			)
+		) AS manager_count,
+		COALESCE(ROUND(AVG(m.org_depth), 2), 0)::float8 AS average_org_depth
+	FROM
+		departments d
+	LEFT JOIN
+		mailboxes m ON m.department_id = d.department_id AND m.active`
+
+func scanDepartmentSummary(row pgx.Row) (*model.DepartmentSummary, error) {
+	var summary model.DepartmentSummary
+	err := row.Scan(
+		&summary.ID,
+		&summary.Name,
+		&summary.ParentID,
+		&summary.CostCenter,
+		&summary.Headcount,
+		&summary.ManagerCount,
+		&summary.AverageOrgDepth,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+func (r *departmentRepository) GetDepartmentSummaries(ctx context.Context) ([]model.DepartmentSummary, error) {
+	query := departmentSummaryQuery + `
+	GROUP BY
+		d.department_id
+	ORDER BY
+		d.department_name`
+
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query department summaries: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := []model.DepartmentSummary{}
+	for rows.Next() {
+		summary, err := scanDepartmentSummary(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan department summary: %w", err)
+		}
+		summaries = append(summaries, *summary)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over department summaries: %w", err)
+	}
+
+	return summaries, nil
+}
+
+// isUniqueViolation reports whether a statement failed because it would
+// store a duplicate key.
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
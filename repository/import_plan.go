@@ -0,0 +1,338 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"mailbox-api/db"
+	"mailbox-api/model"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrPlanStale is returned by ApplyPlan when the stored mailboxes no longer
+// match the directory the plan was computed against.
+var ErrPlanStale = errors.New("directory changed since the import plan was created")
+
+type ImportPlanRepository interface {
+	CreatePlan(ctx context.Context, plan model.ImportPlan) error
+	GetPlan(ctx context.Context, id string) (*model.ImportPlan, error)
+	ListPlans(ctx context.Context) ([]model.ImportPlan, error)
+	ApplyPlan(ctx context.Context, plan model.ImportPlan) (bool, error)
+}
+
+type importPlanRepository struct {
+	db *db.DB
+}
+
+func NewImportPlanRepository(db *db.DB) ImportPlanRepository {
+	return &importPlanRepository{db: db}
+}
+
+func (r *importPlanRepository) CreatePlan(ctx context.Context, plan model.ImportPlan) error {
+	summary, err := json.Marshal(plan.Summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode plan summary: %w", err)
+	}
+	changes, err := json.Marshal(plan.Changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode plan changes: %w", err)
+	}
+
+	query := `
+	INSERT INTO import_plans (
+		id,
+		status,
+		summary,
+		changes,
+		directory_version,
+		created_by
+	) VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err = r.db.Exec(ctx, query,
+		plan.ID,
+		plan.Status,
+		summary,
+		changes,
+		plan.DirectoryVersion,
+		plan.CreatedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create import plan: %w", err)
+	}
+
+	return nil
+}
+
+func (r *importPlanRepository) GetPlan(ctx context.Context, id string) (*model.ImportPlan, error) {
+	query := `
+	SELECT
+		id,
+		status,
+		summary,
+		changes,
+		directory_version,
+		created_by,
+		created_at,
+		applied_at
+	FROM
+		import_plans
+	WHERE
+		id = $1`
+
+	var plan model.ImportPlan
+	var summary, changes []byte
+	err := r.db.QueryRow(ctx, query, id).Scan(
+		&plan.ID,
+		&plan.Status,
+		&summary,
+		&changes,
+		&plan.DirectoryVersion,
+		&plan.CreatedBy,
+		&plan.CreatedAt,
+		&plan.AppliedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get import plan: %w", err)
+	}
+
+	if err := json.Unmarshal(summary, &plan.Summary); err != nil {
+		return nil, fmt.Errorf("failed to decode plan summary: %w", err)
+	}
+	if err := json.Unmarshal(changes, &plan.Changes); err != nil {
+		return nil, fmt.Errorf("failed to decode plan changes: %w", err)
+	}
+
+	return &plan, nil
+}
+
+// ListPlans returns every plan, newest first, without its changes.
+func (r *importPlanRepository) ListPlans(ctx context.Context) ([]model.ImportPlan, error) {
+	query := `
+	SELECT
+		id,
+		status,
+		summary,
+		created_by,
+		created_at,
+		applied_at
+	FROM
+		import_plans
+	ORDER BY
+		created_at DESC, id`
+
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list import plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []model.ImportPlan{}
+	for rows.Next() {
+		var plan model.ImportPlan
+		var summary []byte
+		err := rows.Scan(
+			&plan.ID,
+			&plan.Status,
+			&summary,
+			&plan.CreatedBy,
+			&plan.CreatedAt,
+			&plan.AppliedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan import plan: %w", err)
+		}
+		if err := json.Unmarshal(summary, &plan.Summary); err != nil {
+			return nil, fmt.Errorf("failed to decode plan summary: %w", err)
+		}
+		plans = append(plans, plan)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating import plan rows: %w", err)
+	}
+
+	return plans, nil
+}
+
+// ApplyPlan makes the changes of a pending plan and marks it applied in a
+// single transaction, then refreshes the closure table and the org metrics
+// of every mailbox. Added managers must come before their reports. It
+// reports false, without changing anything, if the plan is not pending, and
+// returns ErrPlanStale if any mailbox was added, removed or changed since the
+// plan was computed. The roster the plan was computed from is complete and
+// free of cycles, so applied to the same directory it leaves no cycle.
+func (r *importPlanRepository) ApplyPlan(ctx context.Context, plan model.ImportPlan) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	claim := `
+	UPDATE import_plans
+	SET status = $2, applied_at = NOW()
+	WHERE id = $1 AND status = $3`
+
+	tag, err := tx.Exec(ctx, claim, plan.ID, model.PlanApplied, model.PlanPending)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark import plan applied: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if err := lockDirectory(ctx, tx, plan); err != nil {
+		return false, err
+	}
+
+	insert := `
+	INSERT INTO mailboxes (
+		mailbox_identifier,
+		user_full_name,
+		job_title,
+		department_id,
+		manager_mailbox_identifier,
+		org_depth,
+		sub_org_size,
+		active
+	) VALUES ($1, $2, $3, $4, NULLIF($5, ''), 0, 0, TRUE)`
+
+	update := `
+	UPDATE mailboxes
+	SET
+		user_full_name = $2,
+		job_title = $3,
+		department_id = $4,
+		manager_mailbox_identifier = NULLIF($5, ''),
+		active = TRUE
+	WHERE
+		mailbox_identifier = $1`
+
+	deactivate := `
+	UPDATE mailboxes
+	SET active = FALSE
+	WHERE mailbox_identifier = $1`
+
+	for _, change := range plan.Changes {
+		switch change.Action {
+		case model.ChangeAdd, model.ChangeUpdate, model.ChangeMove:
+			query := update
+			if change.Action == model.ChangeAdd {
+				query = insert
+			}
+			_, err = tx.Exec(ctx, query,
+				change.After.Identifier,
+				change.After.UserFullName,
+				change.After.JobTitle,
+				change.After.DepartmentID,
+				change.After.ManagerIdentifier,
+			)
+		case model.ChangeDeactivate:
+			_, err = tx.Exec(ctx, deactivate, change.Identifier)
+		default:
+			err = fmt.Errorf("unknown action %q", change.Action)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to %s mailbox %s: %w", change.Action, change.Identifier, err)
+		}
+	}
+
+	if err := rebuildClosure(ctx, tx); err != nil {
+		return false, err
+	}
+
+	if err := refreshOrgMetrics(ctx, tx); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+// lockDirectory keeps every mailbox from being added, removed or changed
+// until the plan is applied, and checks that the directory still has the
+// version the plan was computed against.
+func lockDirectory(ctx context.Context, tx pgx.Tx, plan model.ImportPlan) error {
+	if _, err := tx.Exec(ctx, `LOCK TABLE mailboxes IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("failed to lock mailboxes: %w", err)
+	}
+
+	query := `
+	SELECT
+		mailbox_identifier,
+		user_full_name,
+		job_title,
+		department_id,
+		COALESCE(manager_mailbox_identifier, ''),
+		active
+	FROM
+		mailboxes`
+
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read mailboxes: %w", err)
+	}
+	defer rows.Close()
+
+	mailboxes := []model.Mailbox{}
+	for rows.Next() {
+		var mailbox model.Mailbox
+		err := rows.Scan(
+			&mailbox.Identifier,
+			&mailbox.UserFullName,
+			&mailbox.JobTitle,
+			&mailbox.DepartmentID,
+			&mailbox.ManagerIdentifier,
+			&mailbox.Active,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scan mailbox: %w", err)
+		}
+		mailboxes = append(mailboxes, mailbox)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating mailbox rows: %w", err)
+	}
+
+	if DirectoryVersion(mailboxes) != plan.DirectoryVersion {
+		return ErrPlanStale
+	}
+
+	return nil
+}
+
+// DirectoryVersion fingerprints the fields a sync compares of every mailbox.
+// A plan records the version of the directory it was computed against.
+func DirectoryVersion(mailboxes []model.Mailbox) string {
+	sorted := make([]model.Mailbox, len(mailboxes))
+	copy(sorted, mailboxes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Identifier < sorted[j].Identifier
+	})
+
+	hash := sha256.New()
+	for _, mailbox := range sorted {
+		fmt.Fprintf(hash, "%q %q %q %d %q %t\n",
+			mailbox.Identifier,
+			mailbox.UserFullName,
+			mailbox.JobTitle,
+			mailbox.DepartmentID,
+			mailbox.ManagerIdentifier,
+			mailbox.Active,
+		)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -9,21 +9,34 @@ import (
 
 	"mailbox-api/db"
 	"mailbox-api/model"
+	"mailbox-api/orggraph"
 
 	"github.com/jackc/pgx/v4"
 )
 
 type MailboxRepository interface {
 	GetMailboxes(ctx context.Context, filter model.MailboxFilter) ([]model.Mailbox, int, error)
+	StreamMailboxes(ctx context.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error
 	GetMailboxByIdentifier(ctx context.Context, identifier string) (*model.Mailbox, error)
 	GetMailboxesByRole(ctx context.Context, role string) ([]model.Mailbox, error)
 	GetAllMailboxes(ctx context.Context) ([]model.Mailbox, error)
+	GetDirectReports(ctx context.Context, identifier string) ([]model.Mailbox, error)
+	GetAncestors(ctx context.Context, identifier string) ([]model.Mailbox, error)
+	IsInSubOrg(ctx context.Context, managerIdentifier string, identifier string) (bool, error)
 	CreateMailbox(ctx context.Context, mailbox model.Mailbox) error
+	UpdateMailbox(ctx context.Context, mailbox model.Mailbox) error
+	DeleteMailbox(ctx context.Context, identifier string) error
+	SetMailboxActive(ctx context.Context, identifier string, active bool) error
+	ImportMailboxes(ctx context.Context, mailboxes []model.Mailbox) error
 	UpdateOrgDepth(ctx context.Context, identifier string, depth int) error
 	UpdateSubOrgSize(ctx context.Context, identifier string, size int) error
 	CalculateOrgMetrics(ctx context.Context) error
 }
 
+// ErrReportingCycle is returned by UpdateMailbox when the new manager is
+// the mailbox itself or inside its sub-org.
+var ErrReportingCycle = errors.New("manager change would create a reporting cycle")
+
 type mailboxRepository struct {
 	db *db.DB
 }
@@ -32,7 +45,9 @@ func NewMailboxRepository(db *db.DB) MailboxRepository {
 	return &mailboxRepository{db: db}
 }
 
-func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.MailboxFilter) ([]model.Mailbox, int, error) {
+// mailboxQuery builds the query for the mailboxes matching the filter, in
+// the requested order and without pagination, and the matching count query.
+func mailboxQuery(filter model.MailboxFilter) (string, string, []interface{}) {
 	query := `
 	SELECT 
 		m.mailbox_identifier, 
@@ -42,7 +57,8 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 		d.department_name, 
 		m.manager_mailbox_identifier, 
 		m.org_depth, 
-		m.sub_org_size
+		m.sub_org_size,
+		m.active
 	FROM 
 		mailboxes m
 	JOIN 
@@ -74,9 +90,81 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 		paramIndex++
 	}
 
+	if filter.Identifier != "" {
+		identifierCondition := fmt.Sprintf(`
+		AND lower(m.mailbox_identifier) = lower($%d)`, paramIndex)
+		query += identifierCondition
+		countQuery += identifierCondition
+		params = append(params, filter.Identifier)
+		paramIndex++
+	}
+
+	if filter.SubOrgOf != "" {
+		subOrgCondition := fmt.Sprintf(`
+		AND m.mailbox_identifier IN (
+			SELECT descendant_identifier 
+			FROM mailbox_closure 
+			WHERE ancestor_identifier = $%d AND depth > 0
+		)`, paramIndex)
+		query += subOrgCondition
+		countQuery += subOrgCondition
+		params = append(params, filter.SubOrgOf)
+		paramIndex++
+	}
+
+	if filter.AncestorsOf != "" {
+		ancestorsCondition := fmt.Sprintf(`
+		AND m.mailbox_identifier IN (
+			SELECT ancestor_identifier 
+			FROM mailbox_closure 
+			WHERE descendant_identifier = $%d AND depth > 0
+		)`, paramIndex)
+		query += ancestorsCondition
+		countQuery += ancestorsCondition
+		params = append(params, filter.AncestorsOf)
+		paramIndex++
+	}
+
+	if filter.ReportsTo != "" {
+		reportsCondition := fmt.Sprintf(`
+		AND m.manager_mailbox_identifier = $%d`, paramIndex)
+		query += reportsCondition
+		countQuery += reportsCondition
+		params = append(params, filter.ReportsTo)
+		paramIndex++
+	}
+
+	if filter.PeersOf != "" {
+		peersCondition := fmt.Sprintf(`
+		AND m.mailbox_identifier <> $%d
+		AND m.manager_mailbox_identifier = (
+			SELECT manager_mailbox_identifier 
+			FROM mailboxes 
+			WHERE mailbox_identifier = $%d
+		)`, paramIndex, paramIndex)
+		query += peersCondition
+		countQuery += peersCondition
+		params = append(params, filter.PeersOf)
+		paramIndex++
+	}
+
 	if filter.Department != 0 {
 		departmentCondition := fmt.Sprintf(`
 		AND m.department_id = $%d`, paramIndex)
+		if filter.IncludeSubDepartments {
+			// UNION rather than UNION ALL stops the walk on a cycle
+			departmentCondition = fmt.Sprintf(`
+		AND m.department_id IN (
+			WITH RECURSIVE sub_departments AS (
+				SELECT department_id FROM departments WHERE department_id = $%d
+				UNION
+				SELECT d.department_id
+				FROM departments d
+				JOIN sub_departments s ON d.parent_department_id = s.department_id
+			)
+			SELECT department_id FROM sub_departments
+		)`, paramIndex)
+		}
 		query += departmentCondition
 		countQuery += departmentCondition
 		params = append(params, filter.Department)
@@ -128,6 +216,15 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 		paramIndex++
 	}
 
+	if filter.Active != nil {
+		activeCondition := fmt.Sprintf(`
+		AND m.active = $%d`, paramIndex)
+		query += activeCondition
+		countQuery += activeCondition
+		params = append(params, *filter.Active)
+		paramIndex++
+	}
+
 	if len(filter.SortBy) > 0 && len(filter.SortBy) == len(filter.SortDirections) {
 		query += " ORDER BY "
 		sorts := []string{}
@@ -166,15 +263,21 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 		query += " ORDER BY m.user_full_name ASC"
 	}
 
+	return query, countQuery, params
+}
+
+func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.MailboxFilter) ([]model.Mailbox, int, error) {
+	query, countQuery, params := mailboxQuery(filter)
+	countParams := params
+
 	if filter.Page > 0 && filter.PageSize > 0 {
 		offset := (filter.Page - 1) * filter.PageSize
-		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
 		params = append(params, filter.PageSize, offset)
-		paramIndex += 2
 	}
 
 	var totalCount int
-	err := r.db.QueryRow(ctx, countQuery, params[:len(params)-2]...).Scan(&totalCount)
+	err := r.db.QueryRow(ctx, countQuery, countParams...).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to count mailboxes: %w", err)
 	}
@@ -187,28 +290,10 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 
 	mailboxes := []model.Mailbox{}
 	for rows.Next() {
-		var mailbox model.Mailbox
-		var managerId sql.NullString // Use sql.NullString to handle NULL values
-		err := rows.Scan(
-			&mailbox.Identifier,
-			&mailbox.UserFullName,
-			&mailbox.JobTitle,
-			&mailbox.DepartmentID,
-			&mailbox.Department,
-			&managerId, // Scan into NullString
-			&mailbox.OrgDepth,
-			&mailbox.SubOrgSize,
-		)
+		mailbox, err := scanMailbox(rows)
 		if err != nil {
 			return nil, 0, fmt.Errorf("failed to scan mailbox: %w", err)
 		}
-
-		// Convert NullString to string
-		if managerId.Valid {
-			mailbox.ManagerIdentifier = managerId.String
-		} else {
-			mailbox.ManagerIdentifier = "" // Empty string for NULL
-		}
 		mailboxes = append(mailboxes, mailbox)
 	}
 
@@ -219,6 +304,59 @@ func (r *mailboxRepository) GetMailboxes(ctx context.Context, filter model.Mailb
 	return mailboxes, totalCount, nil
 }
 
+// StreamMailboxes calls fn with every mailbox matching the filter, in order,
+// as the rows are read; pagination is ignored. It stops at the first error
+// returned by fn.
+func (r *mailboxRepository) StreamMailboxes(ctx context.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	query, _, params := mailboxQuery(filter)
+
+	rows, err := r.db.Query(ctx, query, params...)
+	if err != nil {
+		return fmt.Errorf("failed to query mailboxes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		mailbox, err := scanMailbox(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan mailbox: %w", err)
+		}
+		if err := fn(mailbox); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over mailboxes: %w", err)
+	}
+
+	return nil
+}
+
+// scanMailbox reads a row of the mailbox query.
+func scanMailbox(row pgx.Row) (model.Mailbox, error) {
+	var mailbox model.Mailbox
+	var managerId sql.NullString // Use sql.NullString to handle NULL values
+	err := row.Scan(
+		&mailbox.Identifier,
+		&mailbox.UserFullName,
+		&mailbox.JobTitle,
+		&mailbox.DepartmentID,
+		&mailbox.Department,
+		&managerId, // Scan into NullString
+		&mailbox.OrgDepth,
+		&mailbox.SubOrgSize,
+		&mailbox.Active,
+	)
+	if err != nil {
+		return mailbox, err
+	}
+
+	mailbox.ManagerIdentifier = managerId.String
+
+	return mailbox, nil
+}
+
 func (r *mailboxRepository) GetMailboxByIdentifier(ctx context.Context, identifier string) (*model.Mailbox, error) {
 	query := `
 	SELECT 
@@ -229,7 +367,8 @@ func (r *mailboxRepository) GetMailboxByIdentifier(ctx context.Context, identifi
 		d.department_name, 
 		m.manager_mailbox_identifier, 
 		m.org_depth, 
-		m.sub_org_size
+		m.sub_org_size,
+		m.active
 	FROM 
 		mailboxes m
 	JOIN 
@@ -238,15 +377,17 @@ func (r *mailboxRepository) GetMailboxByIdentifier(ctx context.Context, identifi
 		m.mailbox_identifier = $1`
 
 	var mailbox model.Mailbox
+	var managerId sql.NullString
 	err := r.db.QueryRow(ctx, query, identifier).Scan(
 		&mailbox.Identifier,
 		&mailbox.UserFullName,
 		&mailbox.JobTitle,
 		&mailbox.DepartmentID,
 		&mailbox.Department,
-		&mailbox.ManagerIdentifier,
+		&managerId,
 		&mailbox.OrgDepth,
 		&mailbox.SubOrgSize,
+		&mailbox.Active,
 	)
 
 	if err != nil {
@@ -256,9 +397,143 @@ func (r *mailboxRepository) GetMailboxByIdentifier(ctx context.Context, identifi
 		return nil, fmt.Errorf("failed to get mailbox: %w", err)
 	}
 
+	mailbox.ManagerIdentifier = managerId.String
+
 	return &mailbox, nil
 }
 
+func (r *mailboxRepository) GetDirectReports(ctx context.Context, identifier string) ([]model.Mailbox, error) {
+	query := `
+	SELECT 
+		m.mailbox_identifier, 
+		m.user_full_name, 
+		m.job_title, 
+		m.department_id, 
+		d.department_name, 
+		m.manager_mailbox_identifier, 
+		m.org_depth, 
+		m.sub_org_size,
+		m.active
+	FROM 
+		mailboxes m
+	JOIN 
+		departments d ON m.department_id = d.department_id
+	WHERE 
+		m.manager_mailbox_identifier = $1
+	ORDER BY m.user_full_name`
+
+	rows, err := r.db.Query(ctx, query, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query direct reports: %w", err)
+	}
+	defer rows.Close()
+
+	mailboxes := []model.Mailbox{}
+	for rows.Next() {
+		var mailbox model.Mailbox
+		var managerId sql.NullString
+		err := rows.Scan(
+			&mailbox.Identifier,
+			&mailbox.UserFullName,
+			&mailbox.JobTitle,
+			&mailbox.DepartmentID,
+			&mailbox.Department,
+			&managerId,
+			&mailbox.OrgDepth,
+			&mailbox.SubOrgSize,
+			&mailbox.Active,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan mailbox: %w", err)
+		}
+		mailbox.ManagerIdentifier = managerId.String
+		mailboxes = append(mailboxes, mailbox)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over mailboxes: %w", err)
+	}
+
+	return mailboxes, nil
+}
+
+// GetAncestors returns the management chain above a mailbox, nearest manager
+// first.
+func (r *mailboxRepository) GetAncestors(ctx context.Context, identifier string) ([]model.Mailbox, error) {
+	query := `
+	SELECT 
+		m.mailbox_identifier, 
+		m.user_full_name, 
+		m.job_title, 
+		m.department_id, 
+		d.department_name, 
+		m.manager_mailbox_identifier, 
+		m.org_depth, 
+		m.sub_org_size,
+		m.active
+	FROM 
+		mailbox_closure c
+	JOIN 
+		mailboxes m ON m.mailbox_identifier = c.ancestor_identifier
+	JOIN 
+		departments d ON m.department_id = d.department_id
+	WHERE 
+		c.descendant_identifier = $1 AND c.depth > 0
+	ORDER BY c.depth`
+
+	rows, err := r.db.Query(ctx, query, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ancestors: %w", err)
+	}
+	defer rows.Close()
+
+	mailboxes := []model.Mailbox{}
+	for rows.Next() {
+		var mailbox model.Mailbox
+		var managerId sql.NullString
+		err := rows.Scan(
+			&mailbox.Identifier,
+			&mailbox.UserFullName,
+			&mailbox.JobTitle,
+			&mailbox.DepartmentID,
+			&mailbox.Department,
+			&managerId,
+			&mailbox.OrgDepth,
+			&mailbox.SubOrgSize,
+			&mailbox.Active,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan mailbox: %w", err)
+		}
+		mailbox.ManagerIdentifier = managerId.String
+		mailboxes = append(mailboxes, mailbox)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over mailboxes: %w", err)
+	}
+
+	return mailboxes, nil
+}
+
+// IsInSubOrg reports whether the mailbox reports, directly or indirectly, to
+// the manager.
+func (r *mailboxRepository) IsInSubOrg(ctx context.Context, managerIdentifier string, identifier string) (bool, error) {
+	query := `
+	SELECT EXISTS (
+		SELECT 1 
+		FROM mailbox_closure 
+		WHERE ancestor_identifier = $1 AND descendant_identifier = $2 AND depth > 0
+	)`
+
+	var exists bool
+	if err := r.db.QueryRow(ctx, query, managerIdentifier, identifier).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check sub-org membership: %w", err)
+	}
+
+	return exists, nil
+}
+
 func (r *mailboxRepository) GetMailboxesByRole(ctx context.Context, role string) ([]model.Mailbox, error) {
 	query := `
 	SELECT 
@@ -269,7 +544,8 @@ func (r *mailboxRepository) GetMailboxesByRole(ctx context.Context, role string)
 		d.department_name, 
 		m.manager_mailbox_identifier, 
 		m.org_depth, 
-		m.sub_org_size
+		m.sub_org_size,
+		m.active
 	FROM 
 		mailboxes m
 	JOIN 
@@ -296,6 +572,7 @@ func (r *mailboxRepository) GetMailboxesByRole(ctx context.Context, role string)
 			&managerId, // Scan into NullString
 			&mailbox.OrgDepth,
 			&mailbox.SubOrgSize,
+			&mailbox.Active,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan mailbox: %w", err)
@@ -327,7 +604,8 @@ func (r *mailboxRepository) GetAllMailboxes(ctx context.Context) ([]model.Mailbo
 		d.department_name, 
 		m.manager_mailbox_identifier, 
 		m.org_depth, 
-		m.sub_org_size
+		m.sub_org_size,
+		m.active
 	FROM 
 		mailboxes m
 	JOIN 
@@ -353,6 +631,7 @@ func (r *mailboxRepository) GetAllMailboxes(ctx context.Context) ([]model.Mailbo
 			&managerId, // Scan into NullString
 			&mailbox.OrgDepth,
 			&mailbox.SubOrgSize,
+			&mailbox.Active,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan mailbox: %w", err)
@@ -373,7 +652,21 @@ func (r *mailboxRepository) GetAllMailboxes(ctx context.Context) ([]model.Mailbo
 	return mailboxes, nil
 }
 
+// CreateMailbox inserts the mailbox below its manager and, in the same
+// transaction, sets its org depth and grows the sub-org size of every
+// ancestor. The OrgDepth and SubOrgSize fields of the argument are ignored.
 func (r *mailboxRepository) CreateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	depth, err := childDepth(ctx, tx, mailbox.ManagerIdentifier)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	INSERT INTO mailboxes (
 		mailbox_identifier, 
@@ -382,23 +675,459 @@ func (r *mailboxRepository) CreateMailbox(ctx context.Context, mailbox model.Mai
 		department_id, 
 		manager_mailbox_identifier, 
 		org_depth, 
-		sub_org_size
-	) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		sub_org_size,
+		active
+	) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, 0, $7)`
 
-	_, err := r.db.Exec(ctx, query,
+	_, err = tx.Exec(ctx, query,
 		mailbox.Identifier,
 		mailbox.UserFullName,
 		mailbox.JobTitle,
 		mailbox.DepartmentID,
 		mailbox.ManagerIdentifier,
-		mailbox.OrgDepth,
-		mailbox.SubOrgSize,
+		depth,
+		mailbox.Active,
 	)
-
 	if err != nil {
 		return fmt.Errorf("failed to create mailbox: %w", err)
 	}
 
+	if err := insertClosurePaths(ctx, tx, mailbox.Identifier, mailbox.ManagerIdentifier); err != nil {
+		return err
+	}
+
+	if err := adjustAncestorSubOrgSize(ctx, tx, mailbox.ManagerIdentifier, 1); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateMailbox updates the mailbox's attributes. When the manager changes,
+// the moved subtree's size is subtracted from the old ancestors, added to the
+// new ones, and the org depth of the whole subtree is shifted, all in the
+// same transaction as the update.
+func (r *mailboxRepository) UpdateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockOrgPosition(ctx, tx, mailbox.Identifier)
+	if err != nil {
+		return err
+	}
+
+	if current != nil && mailbox.ManagerIdentifier != "" && current.managerIdentifier != mailbox.ManagerIdentifier {
+		cycle, err := lockReportingLine(ctx, tx, mailbox.Identifier, mailbox.ManagerIdentifier)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrReportingCycle
+		}
+	}
+
+	query := `
+	UPDATE mailboxes 
+	SET 
+		user_full_name = $1, 
+		job_title = $2, 
+		department_id = $3, 
+		manager_mailbox_identifier = NULLIF($4, '')
+	WHERE mailbox_identifier = $5`
+
+	_, err = tx.Exec(ctx, query,
+		mailbox.UserFullName,
+		mailbox.JobTitle,
+		mailbox.DepartmentID,
+		mailbox.ManagerIdentifier,
+		mailbox.Identifier,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update mailbox: %w", err)
+	}
+
+	if current != nil && current.managerIdentifier != mailbox.ManagerIdentifier {
+		moved := current.subOrgSize + 1
+
+		if err := adjustAncestorSubOrgSize(ctx, tx, current.managerIdentifier, -moved); err != nil {
+			return err
+		}
+		if err := moveClosureSubtree(ctx, tx, mailbox.Identifier, mailbox.ManagerIdentifier); err != nil {
+			return err
+		}
+		if err := adjustAncestorSubOrgSize(ctx, tx, mailbox.ManagerIdentifier, moved); err != nil {
+			return err
+		}
+
+		depth, err := childDepth(ctx, tx, mailbox.ManagerIdentifier)
+		if err != nil {
+			return err
+		}
+		if err := shiftSubtreeDepth(ctx, tx, mailbox.Identifier, depth-current.orgDepth); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteMailbox removes the mailbox and shrinks the sub-org size of its
+// ancestors in the same transaction. Its closure rows are removed by the
+// cascading foreign keys.
+func (r *mailboxRepository) DeleteMailbox(ctx context.Context, identifier string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockOrgPosition(ctx, tx, identifier)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+
+	if err := adjustAncestorSubOrgSize(ctx, tx, current.managerIdentifier, -(current.subOrgSize + 1)); err != nil {
+		return err
+	}
+
+	query := `
+	DELETE FROM mailboxes 
+	WHERE mailbox_identifier = $1`
+
+	if _, err := tx.Exec(ctx, query, identifier); err != nil {
+		return fmt.Errorf("failed to delete mailbox: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// orgPosition is the part of a mailbox row that the incremental metric
+// updates need.
+type orgPosition struct {
+	managerIdentifier string
+	orgDepth          int
+	subOrgSize        int
+}
+
+// lockOrgPosition reads the mailbox's position in the hierarchy and locks its
+// row for the rest of the transaction. It returns nil if the mailbox does not
+// exist.
+func lockOrgPosition(ctx context.Context, tx pgx.Tx, identifier string) (*orgPosition, error) {
+	query := `
+	SELECT 
+		manager_mailbox_identifier, 
+		org_depth, 
+		sub_org_size
+	FROM 
+		mailboxes
+	WHERE 
+		mailbox_identifier = $1
+	FOR UPDATE`
+
+	var position orgPosition
+	var managerId sql.NullString
+	err := tx.QueryRow(ctx, query, identifier).Scan(&managerId, &position.orgDepth, &position.subOrgSize)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock mailbox %s: %w", identifier, err)
+	}
+
+	position.managerIdentifier = managerId.String
+
+	return &position, nil
+}
+
+// lockReportingLine locks the rows of the manager and all its ancestors and
+// then reports whether the mailbox is among them, in which case reporting to
+// the manager would close a cycle. Two moves can only close a cycle together
+// if each moves a mailbox above the other's new manager, so the second waits
+// for the first to commit and sees its paths in the closure table; a
+// deadlock between them aborts one instead.
+func lockReportingLine(ctx context.Context, tx pgx.Tx, identifier string, managerIdentifier string) (bool, error) {
+	lock := `
+	SELECT mailbox_identifier
+	FROM mailboxes
+	WHERE mailbox_identifier IN (
+		SELECT ancestor_identifier FROM mailbox_closure WHERE descendant_identifier = $1
+	)
+	ORDER BY mailbox_identifier
+	FOR UPDATE`
+
+	rows, err := tx.Query(ctx, lock, managerIdentifier)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock reporting line of %s: %w", managerIdentifier, err)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to lock reporting line of %s: %w", managerIdentifier, err)
+	}
+
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM mailbox_closure
+		WHERE ancestor_identifier = $1 AND descendant_identifier = $2
+	)`
+
+	var cycle bool
+	if err := tx.QueryRow(ctx, query, identifier, managerIdentifier).Scan(&cycle); err != nil {
+		return false, fmt.Errorf("failed to check reporting line of %s: %w", managerIdentifier, err)
+	}
+
+	return cycle, nil
+}
+
+// childDepth returns the org depth a direct report of the given manager has.
+// An empty or unknown manager makes the report a root at depth 0.
+func childDepth(ctx context.Context, tx pgx.Tx, managerIdentifier string) (int, error) {
+	if managerIdentifier == "" {
+		return 0, nil
+	}
+
+	var depth int
+	err := tx.QueryRow(ctx, `SELECT org_depth FROM mailboxes WHERE mailbox_identifier = $1`, managerIdentifier).Scan(&depth)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get org depth for %s: %w", managerIdentifier, err)
+	}
+
+	return depth + 1, nil
+}
+
+// adjustAncestorSubOrgSize adds delta to the sub-org size of the given
+// mailbox and every mailbox above it.
+func adjustAncestorSubOrgSize(ctx context.Context, tx pgx.Tx, identifier string, delta int) error {
+	if identifier == "" || delta == 0 {
+		return nil
+	}
+
+	query := `
+	UPDATE mailboxes 
+	SET sub_org_size = sub_org_size + $2 
+	WHERE mailbox_identifier IN (
+		SELECT ancestor_identifier 
+		FROM mailbox_closure 
+		WHERE descendant_identifier = $1
+	)`
+
+	if _, err := tx.Exec(ctx, query, identifier, delta); err != nil {
+		return fmt.Errorf("failed to update sub-org size above %s: %w", identifier, err)
+	}
+
+	return nil
+}
+
+// shiftSubtreeDepth adds delta to the org depth of the given mailbox and
+// every mailbox below it.
+func shiftSubtreeDepth(ctx context.Context, tx pgx.Tx, identifier string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+
+	query := `
+	UPDATE mailboxes 
+	SET org_depth = org_depth + $2 
+	WHERE mailbox_identifier IN (
+		SELECT descendant_identifier 
+		FROM mailbox_closure 
+		WHERE ancestor_identifier = $1
+	)`
+
+	if _, err := tx.Exec(ctx, query, identifier, delta); err != nil {
+		return fmt.Errorf("failed to update org depth below %s: %w", identifier, err)
+	}
+
+	return nil
+}
+
+// insertClosurePaths adds the closure rows for a new mailbox: itself at
+// depth 0 and one row for every ancestor of its manager.
+func insertClosurePaths(ctx context.Context, tx pgx.Tx, identifier string, managerIdentifier string) error {
+	query := `
+	INSERT INTO mailbox_closure (ancestor_identifier, descendant_identifier, depth)
+	SELECT $1, $1, 0
+	UNION ALL
+	SELECT ancestor_identifier, $1, depth + 1
+	FROM mailbox_closure
+	WHERE descendant_identifier = $2`
+
+	if _, err := tx.Exec(ctx, query, identifier, managerIdentifier); err != nil {
+		return fmt.Errorf("failed to insert hierarchy paths for %s: %w", identifier, err)
+	}
+
+	return nil
+}
+
+// moveClosureSubtree detaches the subtree rooted at identifier from its old
+// ancestors and attaches it below the new manager.
+func moveClosureSubtree(ctx context.Context, tx pgx.Tx, identifier string, managerIdentifier string) error {
+	deleteQuery := `
+	DELETE FROM mailbox_closure
+	WHERE descendant_identifier IN (
+		SELECT descendant_identifier FROM mailbox_closure WHERE ancestor_identifier = $1
+	)
+	AND ancestor_identifier NOT IN (
+		SELECT descendant_identifier FROM mailbox_closure WHERE ancestor_identifier = $1
+	)`
+
+	if _, err := tx.Exec(ctx, deleteQuery, identifier); err != nil {
+		return fmt.Errorf("failed to detach hierarchy paths for %s: %w", identifier, err)
+	}
+
+	if managerIdentifier == "" {
+		return nil
+	}
+
+	insertQuery := `
+	INSERT INTO mailbox_closure (ancestor_identifier, descendant_identifier, depth)
+	SELECT above.ancestor_identifier, below.descendant_identifier, above.depth + below.depth + 1
+	FROM mailbox_closure above
+	CROSS JOIN mailbox_closure below
+	WHERE above.descendant_identifier = $2 AND below.ancestor_identifier = $1`
+
+	if _, err := tx.Exec(ctx, insertQuery, identifier, managerIdentifier); err != nil {
+		return fmt.Errorf("failed to attach hierarchy paths for %s: %w", identifier, err)
+	}
+
+	return nil
+}
+
+// ImportMailboxes inserts the mailboxes in a single transaction, so either
+// all of them are stored or none. Managers must come before their reports.
+// The closure table and the org metrics of every mailbox are refreshed in the
+// same transaction; the OrgDepth and SubOrgSize fields are ignored.
+func (r *mailboxRepository) ImportMailboxes(ctx context.Context, mailboxes []model.Mailbox) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+	INSERT INTO mailboxes (
+		mailbox_identifier, 
+		user_full_name, 
+		job_title, 
+		department_id, 
+		manager_mailbox_identifier, 
+		org_depth, 
+		sub_org_size
+	) VALUES ($1, $2, $3, $4, NULLIF($5, ''), 0, 0)`
+
+	for _, mailbox := range mailboxes {
+		_, err := tx.Exec(ctx, query,
+			mailbox.Identifier,
+			mailbox.UserFullName,
+			mailbox.JobTitle,
+			mailbox.DepartmentID,
+			mailbox.ManagerIdentifier,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to import mailbox %s: %w", mailbox.Identifier, err)
+		}
+	}
+
+	if err := rebuildClosure(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := refreshOrgMetrics(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// refreshOrgMetrics derives the org depth and sub-org size of every mailbox
+// from the closure table, which must be up to date and free of cycles.
+func refreshOrgMetrics(ctx context.Context, tx pgx.Tx) error {
+	query := `
+	UPDATE mailboxes m
+	SET
+		org_depth = (
+			SELECT COUNT(*) FROM mailbox_closure c
+			WHERE c.descendant_identifier = m.mailbox_identifier AND c.depth > 0
+		),
+		sub_org_size = (
+			SELECT COUNT(*) FROM mailbox_closure c
+			WHERE c.ancestor_identifier = m.mailbox_identifier AND c.depth > 0
+		)`
+
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to refresh org metrics: %w", err)
+	}
+
+	return nil
+}
+
+// rebuildClosure regenerates the whole closure table from the manager
+// references. The depth bound stops the walk on a reporting cycle.
+func rebuildClosure(ctx context.Context, tx pgx.Tx) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM mailbox_closure`); err != nil {
+		return fmt.Errorf("failed to clear hierarchy paths: %w", err)
+	}
+
+	query := `
+	WITH RECURSIVE paths AS (
+		SELECT mailbox_identifier AS ancestor_identifier, mailbox_identifier AS descendant_identifier, 0 AS depth
+		FROM mailboxes
+		UNION ALL
+		SELECT p.ancestor_identifier, m.mailbox_identifier, p.depth + 1
+		FROM paths p
+		JOIN mailboxes m ON m.manager_mailbox_identifier = p.descendant_identifier
+		WHERE p.depth < (SELECT COUNT(*) FROM mailboxes)
+	)
+	INSERT INTO mailbox_closure (ancestor_identifier, descendant_identifier, depth)
+	SELECT ancestor_identifier, descendant_identifier, MIN(depth)
+	FROM paths
+	GROUP BY ancestor_identifier, descendant_identifier`
+
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to rebuild hierarchy paths: %w", err)
+	}
+
+	return nil
+}
+
+// SetMailboxActive deactivates the mailbox, or activates it again. A
+// deactivated mailbox keeps its place in the org.
+func (r *mailboxRepository) SetMailboxActive(ctx context.Context, identifier string, active bool) error {
+	query := `
+	UPDATE mailboxes
+	SET active = $1
+	WHERE mailbox_identifier = $2`
+
+	_, err := r.db.Exec(ctx, query, active, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to update active flag: %w", err)
+	}
+
 	return nil
 }
 
@@ -430,54 +1159,38 @@ func (r *mailboxRepository) UpdateSubOrgSize(ctx context.Context, identifier str
 	return nil
 }
 
+// CalculateOrgMetrics recomputes org depth and sub-org size for every mailbox
+// from scratch, rewrites the rows whose stored values differ and rebuilds the
+// closure table. Regular writes maintain all three incrementally; this is the
+// repair path.
 func (r *mailboxRepository) CalculateOrgMetrics(ctx context.Context) error {
 	mailboxes, err := r.GetAllMailboxes(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get all mailboxes: %w", err)
 	}
 
-	mailboxMap := make(map[string]*model.Mailbox)
-	for i := range mailboxes {
-		mailboxMap[mailboxes[i].Identifier] = &mailboxes[i]
-	}
+	depths, subOrgSizes := orggraph.New(mailboxes).Metrics()
 
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback(ctx)
-		}
-	}()
+	defer tx.Rollback(ctx)
 
-	for _, mailbox := range mailboxes {
-		depth := 0
-		current := mailbox.Identifier
-		visited := make(map[string]bool)
-
-		for current != "" && !visited[current] {
-			visited[current] = true
-			parent := mailboxMap[current].ManagerIdentifier
-			if parent == "" {
-				break
-			}
-			depth++
-			current = parent
-		}
-
-		_, err := tx.Exec(ctx, `UPDATE mailboxes SET org_depth = $1 WHERE mailbox_identifier = $2`, depth, mailbox.Identifier)
-		if err != nil {
-			return fmt.Errorf("failed to update org depth for %s: %w", mailbox.Identifier, err)
-		}
+	if err := rebuildClosure(ctx, tx); err != nil {
+		return err
 	}
 
 	for _, mailbox := range mailboxes {
-		size := calculateSubOrgSize(mailbox.Identifier, mailboxMap)
+		depth := depths[mailbox.Identifier]
+		size := subOrgSizes[mailbox.Identifier]
+		if mailbox.OrgDepth == depth && mailbox.SubOrgSize == size {
+			continue
+		}
 
-		_, err := tx.Exec(ctx, `UPDATE mailboxes SET sub_org_size = $1 WHERE mailbox_identifier = $2`, size, mailbox.Identifier)
+		_, err := tx.Exec(ctx, `UPDATE mailboxes SET org_depth = $1, sub_org_size = $2 WHERE mailbox_identifier = $3`, depth, size, mailbox.Identifier)
 		if err != nil {
-			return fmt.Errorf("failed to update sub-org size for %s: %w", mailbox.Identifier, err)
+			return fmt.Errorf("failed to update org metrics for %s: %w", mailbox.Identifier, err)
 		}
 	}
 
@@ -487,16 +1200,3 @@ func (r *mailboxRepository) CalculateOrgMetrics(ctx context.Context) error {
 
 	return nil
 }
-
-func calculateSubOrgSize(identifier string, mailboxMap map[string]*model.Mailbox) int {
-	size := 0
-
-	for _, mailbox := range mailboxMap {
-		if mailbox.ManagerIdentifier == identifier {
-			size++
-			size += calculateSubOrgSize(mailbox.Identifier, mailboxMap)
-		}
-	}
-
-	return size
-}
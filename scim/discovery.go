@@ -0,0 +1,213 @@
+package scim
+
+// Pagination of list responses: the page size used when the client sets no
+// count, and the largest it may ask for.
+const (
+	DefaultCount = 100
+	MaxResults   = 1000
+)
+
+type supported struct {
+	Supported bool `json:"supported"`
+}
+
+type bulkConfig struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type filterConfig struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type authenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+// ServiceProviderConfig describes the supported features to clients.
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 supported              `json:"patch"`
+	Bulk                  bulkConfig             `json:"bulk"`
+	Filter                filterConfig           `json:"filter"`
+	ChangePassword        supported              `json:"changePassword"`
+	Sort                  supported              `json:"sort"`
+	ETag                  supported              `json:"etag"`
+	AuthenticationSchemes []authenticationScheme `json:"authenticationSchemes"`
+	Meta                  *Meta                  `json:"meta"`
+}
+
+func NewServiceProviderConfig(baseURL string) ServiceProviderConfig {
+	return ServiceProviderConfig{
+		Schemas: []string{SchemaServiceProviderConfig},
+		Patch:   supported{Supported: true},
+		Filter:  filterConfig{Supported: true, MaxResults: MaxResults},
+		AuthenticationSchemes: []authenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer token",
+			Description: "An API key or an access token, sent as Authorization: Bearer <token>",
+			Primary:     true,
+		}},
+		Meta: &Meta{ResourceType: "ServiceProviderConfig", Location: baseURL + "/ServiceProviderConfig"},
+	}
+}
+
+type schemaExtension struct {
+	Schema   string `json:"schema"`
+	Required bool   `json:"required"`
+}
+
+type ResourceType struct {
+	Schemas          []string          `json:"schemas"`
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Endpoint         string            `json:"endpoint"`
+	Description      string            `json:"description"`
+	Schema           string            `json:"schema"`
+	SchemaExtensions []schemaExtension `json:"schemaExtensions,omitempty"`
+	Meta             *Meta             `json:"meta"`
+}
+
+func NewResourceTypes(baseURL string) []ResourceType {
+	return []ResourceType{
+		{
+			Schemas:          []string{SchemaResourceType},
+			ID:               "User",
+			Name:             "User",
+			Endpoint:         "/Users",
+			Description:      "Mailboxes",
+			Schema:           SchemaUser,
+			SchemaExtensions: []schemaExtension{{Schema: SchemaEnterpriseUser}},
+			Meta:             &Meta{ResourceType: "ResourceType", Location: baseURL + "/ResourceTypes/User"},
+		},
+		{
+			Schemas:     []string{SchemaResourceType},
+			ID:          "Group",
+			Name:        "Group",
+			Endpoint:    "/Groups",
+			Description: "Departments",
+			Schema:      SchemaGroup,
+			Meta:        &Meta{ResourceType: "ResourceType", Location: baseURL + "/ResourceTypes/Group"},
+		},
+	}
+}
+
+// Attribute describes an attribute of a schema.
+type Attribute struct {
+	Name           string      `json:"name"`
+	Type           string      `json:"type"`
+	MultiValued    bool        `json:"multiValued"`
+	Description    string      `json:"description,omitempty"`
+	Required       bool        `json:"required"`
+	CaseExact      bool        `json:"caseExact"`
+	Mutability     string      `json:"mutability"`
+	Returned       string      `json:"returned"`
+	Uniqueness     string      `json:"uniqueness"`
+	ReferenceTypes []string    `json:"referenceTypes,omitempty"`
+	SubAttributes  []Attribute `json:"subAttributes,omitempty"`
+}
+
+type Schema struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Attributes  []Attribute `json:"attributes"`
+	Meta        *Meta       `json:"meta"`
+}
+
+func attribute(name string, attrType string, mutability string, description string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        attrType,
+		Description: description,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  "none",
+	}
+}
+
+func complexAttribute(name string, multiValued bool, mutability string, description string, subAttributes ...Attribute) Attribute {
+	a := attribute(name, "complex", mutability, description)
+	a.MultiValued = multiValued
+	a.SubAttributes = subAttributes
+	return a
+}
+
+func reference(name string, mutability string, description string, referenceTypes ...string) Attribute {
+	a := attribute(name, "reference", mutability, description)
+	a.ReferenceTypes = referenceTypes
+	return a
+}
+
+func NewSchemas(baseURL string) []Schema {
+	userName := attribute("userName", "string", "immutable", "The mailbox identifier, an email address")
+	userName.Required = true
+	userName.Uniqueness = "server"
+
+	return []Schema{
+		{
+			Schemas:     []string{SchemaSchema},
+			ID:          SchemaUser,
+			Name:        "User",
+			Description: "A mailbox",
+			Attributes: []Attribute{
+				userName,
+				complexAttribute("name", false, "readWrite", "The full name",
+					attribute("formatted", "string", "readWrite", "The full name"),
+					attribute("givenName", "string", "readWrite", "All but the last word of the full name"),
+					attribute("familyName", "string", "readWrite", "The last word of the full name"),
+				),
+				attribute("displayName", "string", "readWrite", "The full name"),
+				attribute("title", "string", "readWrite", "The job title"),
+				complexAttribute("emails", true, "readOnly", "The mailbox identifier",
+					attribute("value", "string", "readOnly", ""),
+					attribute("type", "string", "readOnly", ""),
+					attribute("primary", "boolean", "readOnly", ""),
+				),
+				attribute("active", "boolean", "readWrite", "Whether the mailbox is active; leavers are deactivated"),
+				complexAttribute("groups", true, "readOnly", "The department",
+					attribute("value", "string", "readOnly", "The department ID"),
+					reference("$ref", "readOnly", "", "Group"),
+					attribute("display", "string", "readOnly", "The department name"),
+				),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + SchemaUser},
+		},
+		{
+			Schemas:     []string{SchemaSchema},
+			ID:          SchemaEnterpriseUser,
+			Name:        "EnterpriseUser",
+			Description: "The department and manager of a mailbox",
+			Attributes: []Attribute{
+				attribute("department", "string", "readWrite", "The department name, or the department ID"),
+				complexAttribute("manager", false, "readWrite", "The manager's mailbox",
+					attribute("value", "string", "readWrite", "The manager's mailbox identifier"),
+					reference("$ref", "readOnly", "", "User"),
+				),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + SchemaEnterpriseUser},
+		},
+		{
+			Schemas:     []string{SchemaSchema},
+			ID:          SchemaGroup,
+			Name:        "Group",
+			Description: "A department",
+			Attributes: []Attribute{
+				attribute("displayName", "string", "readWrite", "The department name"),
+				complexAttribute("members", true, "readWrite", "The mailboxes in the department",
+					attribute("value", "string", "immutable", "The mailbox identifier"),
+					reference("$ref", "immutable", "", "User"),
+					attribute("display", "string", "readOnly", "The full name"),
+					attribute("type", "string", "immutable", "Always User"),
+				),
+			},
+			Meta: &Meta{ResourceType: "Schema", Location: baseURL + "/Schemas/" + SchemaGroup},
+		},
+	}
+}
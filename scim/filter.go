@@ -0,0 +1,359 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Filter is a parsed filter expression (RFC 7644, section 3.4.2.2). Op is
+// "and", "or", "not", "pr", a comparison operator such as "eq", or "[]" for
+// a value path such as emails[type eq "work"], whose filter applies to the
+// elements of the attribute.
+type Filter struct {
+	Op       string
+	Path     Path
+	Value    interface{}
+	Children []*Filter
+}
+
+var comparisons = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// maxFilterDepth bounds the nesting of a filter.
+const maxFilterDepth = 32
+
+// ParseFilter parses a filter expression. Errors are invalidFilter errors.
+func ParseFilter(s string) (*Filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, invalidFilter("unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+func invalidFilter(format string, args ...interface{}) *Error {
+	return NewError(400, ErrInvalidFilter, "invalid filter: "+format, args...)
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, invalidFilter("unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(s[i:end+1]), &value); err != nil {
+				return nil, invalidFilter("invalid string %s", s[i:end+1])
+			}
+			tokens = append(tokens, token{text: value, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, token{text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// keyword reports whether the next token is the unquoted word, and consumes
+// it if so.
+func (p *filterParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) next() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	p.pos++
+	return p.tokens[p.pos-1], true
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.keyword(text) {
+		return invalidFilter("expected %q", text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr(depth int) (*Filter, error) {
+	if depth > maxFilterDepth {
+		return nil, invalidFilter("nested too deeply")
+	}
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "or", Children: []*Filter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd(depth int) (*Filter, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "and", Children: []*Filter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary(depth int) (*Filter, error) {
+	switch {
+	case p.keyword("not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &Filter{Op: "not", Children: []*Filter{inner}}, nil
+	case p.keyword("("):
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	default:
+		return p.parseAttributeExpression(depth)
+	}
+}
+
+func (p *filterParser) parseAttributeExpression(depth int) (*Filter, error) {
+	attribute, ok := p.next()
+	if !ok || attribute.quoted {
+		return nil, invalidFilter("expected an attribute")
+	}
+	path, err := ParsePath(attribute.text)
+	if err != nil || path.Filter != nil {
+		return nil, invalidFilter("invalid attribute %q", attribute.text)
+	}
+
+	if p.keyword("[") {
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &Filter{Op: "[]", Path: path, Children: []*Filter{inner}}, nil
+	}
+
+	if p.keyword("pr") {
+		return &Filter{Op: "pr", Path: path}, nil
+	}
+
+	op, ok := p.next()
+	if !ok || op.quoted || !comparisons[strings.ToLower(op.text)] {
+		return nil, invalidFilter("expected an operator after %s", attribute.text)
+	}
+
+	value, ok := p.next()
+	if !ok {
+		return nil, invalidFilter("expected a value after %s", op.text)
+	}
+	f := &Filter{Op: strings.ToLower(op.text), Path: path}
+	switch {
+	case value.quoted:
+		f.Value = value.text
+	case strings.EqualFold(value.text, "true"), strings.EqualFold(value.text, "false"):
+		f.Value = strings.EqualFold(value.text, "true")
+	case strings.EqualFold(value.text, "null"):
+		f.Value = nil
+	default:
+		number, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, invalidFilter("invalid value %q", value.text)
+		}
+		f.Value = number
+	}
+	return f, nil
+}
+
+// Match evaluates the filter against the JSON object of a resource. Strings
+// are compared case insensitively.
+func (f *Filter) Match(resource map[string]interface{}) bool {
+	switch f.Op {
+	case "and":
+		return f.Children[0].Match(resource) && f.Children[1].Match(resource)
+	case "or":
+		return f.Children[0].Match(resource) || f.Children[1].Match(resource)
+	case "not":
+		return !f.Children[0].Match(resource)
+	case "[]":
+		c := container(resource, f.Path.Schema, false)
+		if c == nil {
+			return false
+		}
+		key, _ := findKey(c, f.Path.Attr)
+		elements, _ := c[key].([]interface{})
+		for _, element := range elements {
+			if complex, ok := element.(map[string]interface{}); ok && f.Children[0].Match(complex) {
+				return true
+			}
+		}
+		return false
+	case "pr":
+		for _, value := range values(resource, f.Path) {
+			if s, ok := value.(string); !ok || s != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		eq := *f
+		eq.Op = "eq"
+		return !eq.Match(resource)
+	default:
+		for _, value := range values(resource, f.Path) {
+			if compareValue(value, f.Op, f.Value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func compareValue(value interface{}, op string, want interface{}) bool {
+	switch want := want.(type) {
+	case string:
+		got, ok := value.(string)
+		if !ok {
+			return false
+		}
+		got, want = strings.ToLower(got), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return got == want
+		case "co":
+			return strings.Contains(got, want)
+		case "sw":
+			return strings.HasPrefix(got, want)
+		case "ew":
+			return strings.HasSuffix(got, want)
+		default:
+			return ordered(strings.Compare(got, want), op)
+		}
+	case float64:
+		got, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case got < want:
+			return ordered(-1, op)
+		case got > want:
+			return ordered(1, op)
+		default:
+			return ordered(0, op)
+		}
+	case bool:
+		got, ok := value.(bool)
+		return ok && op == "eq" && got == want
+	default:
+		return op == "eq" && value == nil
+	}
+}
+
+func ordered(cmp int, op string) bool {
+	switch op {
+	case "eq":
+		return cmp == 0
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+// Equality returns the value the attribute must equal for the filter to
+// match: a string compared with eq at the top level or in a top-level and.
+// It lets a query be narrowed before the filter is evaluated.
+func (f *Filter) Equality(path string) (string, bool) {
+	want, err := ParsePath(path)
+	if err != nil {
+		return "", false
+	}
+	switch f.Op {
+	case "and":
+		for _, child := range f.Children {
+			if value, ok := child.Equality(path); ok {
+				return value, true
+			}
+		}
+	case "eq":
+		value, isString := f.Value.(string)
+		if isString && strings.EqualFold(f.Path.Schema, want.Schema) && strings.EqualFold(f.Path.Attr, want.Attr) && strings.EqualFold(f.Path.Sub, want.Sub) {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,253 @@
+package scim
+
+import (
+	"reflect"
+	"strings"
+)
+
+// PatchOp is a PATCH request (RFC 7644, section 3.5.2).
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// Apply applies the operations, in order, to the JSON object of a resource.
+// Operation names are case insensitive. A remove whose path names a
+// multi-valued attribute and that carries a value removes only the elements
+// with those values, as some providers send for group members.
+func (p PatchOp) Apply(resource map[string]interface{}) error {
+	if len(p.Operations) == 0 {
+		return NewError(400, ErrInvalidSyntax, "a PATCH request needs at least one operation")
+	}
+
+	for _, operation := range p.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return NewError(400, ErrInvalidSyntax, "unknown operation %q", operation.Op)
+		}
+
+		if operation.Path == "" {
+			if op == "remove" {
+				return NewError(400, ErrNoTarget, "remove needs a path")
+			}
+			attributes, ok := operation.Value.(map[string]interface{})
+			if !ok {
+				return NewError(400, ErrInvalidValue, "%s without a path needs an object value", operation.Op)
+			}
+			for name, value := range attributes {
+				path, err := ParsePath(name)
+				if err != nil {
+					return err
+				}
+				if err := applyOperation(resource, op, path, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		path, err := ParsePath(operation.Path)
+		if err != nil {
+			return err
+		}
+		if err := applyOperation(resource, op, path, operation.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOperation(resource map[string]interface{}, op string, path Path, value interface{}) error {
+	c := container(resource, path.Schema, op != "remove")
+	if c == nil {
+		return nil
+	}
+
+	// The path names a whole extension
+	if path.Attr == "" {
+		if op == "remove" {
+			delete(resource, schemaKey(resource, path.Schema))
+			return nil
+		}
+		attributes, ok := value.(map[string]interface{})
+		if !ok {
+			return NewError(400, ErrInvalidValue, "%s needs an object value", path.Schema)
+		}
+		for name, attributeValue := range attributes {
+			if err := applyOperation(resource, op, Path{Schema: path.Schema, Attr: name}, attributeValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	key, _ := findKey(c, path.Attr)
+
+	if path.Filter != nil {
+		return applyToElements(c, key, op, path, value)
+	}
+
+	if path.Sub != "" {
+		if _, isArray := c[key].([]interface{}); isArray {
+			return NewError(400, ErrInvalidPath, "%s.%s needs a value filter", path.Attr, path.Sub)
+		}
+		complex, ok := c[key].(map[string]interface{})
+		if !ok {
+			if op == "remove" {
+				return nil
+			}
+			complex = map[string]interface{}{}
+			c[key] = complex
+		}
+		sub, _ := findKey(complex, path.Sub)
+		if op == "remove" {
+			delete(complex, sub)
+		} else {
+			complex[sub] = value
+		}
+		return nil
+	}
+
+	existing, exists := c[key]
+	array, isArray := existing.([]interface{})
+
+	switch op {
+	case "remove":
+		if isArray && value != nil {
+			c[key] = without(array, asArray(value))
+		} else {
+			delete(c, key)
+		}
+	case "add":
+		switch {
+		case isArray || (!exists && isArrayValue(value)):
+			for _, element := range asArray(value) {
+				if !containsElement(array, element) {
+					array = append(array, element)
+				}
+			}
+			c[key] = array
+		default:
+			c[key] = merge(existing, value)
+		}
+	case "replace":
+		if isArray {
+			c[key] = asArray(value)
+		} else {
+			c[key] = merge(existing, value)
+		}
+	}
+	return nil
+}
+
+// applyToElements applies an operation to the elements of a multi-valued
+// attribute that match the path's value filter.
+func applyToElements(c map[string]interface{}, key string, op string, path Path, value interface{}) error {
+	array, _ := c[key].([]interface{})
+	kept := []interface{}{}
+	matched := false
+
+	for _, element := range array {
+		complex, ok := element.(map[string]interface{})
+		if !ok || !path.Filter.Match(complex) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+
+		switch {
+		case op == "remove" && path.Sub == "":
+			continue
+		case op == "remove":
+			sub, _ := findKey(complex, path.Sub)
+			delete(complex, sub)
+		case path.Sub == "":
+			complex = merge(complex, value).(map[string]interface{})
+		default:
+			sub, _ := findKey(complex, path.Sub)
+			complex[sub] = value
+		}
+		kept = append(kept, complex)
+	}
+
+	if !matched {
+		if op == "remove" {
+			return nil
+		}
+		return NewError(400, ErrNoTarget, "no value of %s matches the filter", path.Attr)
+	}
+	c[key] = kept
+	return nil
+}
+
+// merge sets the sub-attributes of a complex value that the new value names
+// and keeps the others. Other values are replaced.
+func merge(existing interface{}, value interface{}) interface{} {
+	current, ok := existing.(map[string]interface{})
+	update, isComplex := value.(map[string]interface{})
+	if !ok || !isComplex {
+		return value
+	}
+
+	merged := map[string]interface{}{}
+	for name, sub := range current {
+		merged[name] = sub
+	}
+	for name, sub := range update {
+		key, _ := findKey(merged, name)
+		merged[key] = sub
+	}
+	return merged
+}
+
+func isArrayValue(value interface{}) bool {
+	_, ok := value.([]interface{})
+	return ok
+}
+
+func asArray(value interface{}) []interface{} {
+	if array, ok := value.([]interface{}); ok {
+		return array
+	}
+	return []interface{}{value}
+}
+
+// sameElement compares elements of a multi-valued attribute by their value
+// sub-attribute if they have one.
+func sameElement(a interface{}, b interface{}) bool {
+	complexA, okA := a.(map[string]interface{})
+	complexB, okB := b.(map[string]interface{})
+	if okA && okB {
+		keyA, hasA := findKey(complexA, "value")
+		keyB, hasB := findKey(complexB, "value")
+		if hasA && hasB {
+			return reflect.DeepEqual(complexA[keyA], complexB[keyB])
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func containsElement(array []interface{}, element interface{}) bool {
+	for _, existing := range array {
+		if sameElement(existing, element) {
+			return true
+		}
+	}
+	return false
+}
+
+func without(array []interface{}, removed []interface{}) []interface{} {
+	kept := []interface{}{}
+	for _, element := range array {
+		if !containsElement(removed, element) {
+			kept = append(kept, element)
+		}
+	}
+	return kept
+}
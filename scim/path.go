@@ -0,0 +1,185 @@
+package scim
+
+import (
+	"strings"
+)
+
+// knownSchemas are the schemas whose URNs may prefix an attribute path.
+var knownSchemas = []string{SchemaUser, SchemaEnterpriseUser, SchemaGroup}
+
+// coreSchemas hold the attributes at the top level of a resource.
+var coreSchemas = []string{SchemaUser, SchemaGroup}
+
+// Path is an attribute path such as userName, name.givenName,
+// emails[type eq "work"].value or
+// urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager. Schema
+// is set for attributes of an extension, whose object holds them. An empty
+// Attr names the whole extension.
+type Path struct {
+	Schema string
+	Attr   string
+	Filter *Filter
+	Sub    string
+}
+
+// ParsePath parses an attribute path, with an optional value filter.
+func ParsePath(s string) (Path, error) {
+	path := Path{}
+	rest := strings.TrimSpace(s)
+
+	if strings.HasPrefix(strings.ToLower(rest), "urn:") {
+		schema := ""
+		for _, known := range knownSchemas {
+			if len(rest) >= len(known) && strings.EqualFold(rest[:len(known)], known) && (len(rest) == len(known) || rest[len(known)] == ':') {
+				schema = known
+			}
+		}
+		if schema == "" {
+			i := strings.LastIndex(rest, ":")
+			schema = rest[:i]
+		}
+
+		rest = strings.TrimPrefix(rest[len(schema):], ":")
+		if !isCoreSchema(schema) {
+			path.Schema = schema
+		}
+		if rest == "" {
+			if path.Schema == "" {
+				return Path{}, NewError(400, ErrInvalidPath, "invalid attribute path %q", s)
+			}
+			return path, nil
+		}
+	}
+
+	if i := strings.IndexByte(rest, '['); i >= 0 {
+		end := strings.LastIndexByte(rest, ']')
+		if end < i {
+			return Path{}, NewError(400, ErrInvalidPath, "invalid attribute path %q", s)
+		}
+		filter, err := ParseFilter(rest[i+1 : end])
+		if err != nil {
+			return Path{}, NewError(400, ErrInvalidPath, "invalid value filter in %q: %v", s, err)
+		}
+		path.Filter = filter
+
+		after := rest[end+1:]
+		if after != "" && !strings.HasPrefix(after, ".") {
+			return Path{}, NewError(400, ErrInvalidPath, "invalid attribute path %q", s)
+		}
+		rest = rest[:i] + after
+	}
+
+	attr, sub, hasSub := strings.Cut(rest, ".")
+	if !isAttributeName(attr) || (hasSub && !isAttributeName(sub)) {
+		return Path{}, NewError(400, ErrInvalidPath, "invalid attribute path %q", s)
+	}
+	path.Attr, path.Sub = attr, sub
+	return path, nil
+}
+
+func isCoreSchema(schema string) bool {
+	for _, core := range coreSchemas {
+		if strings.EqualFold(schema, core) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAttributeName reports whether s is an ATTRNAME of RFC 7644, or $ref.
+func isAttributeName(s string) bool {
+	if s == "$ref" {
+		return true
+	}
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// findKey returns the key of the object that names the attribute.
+// Attribute names are case insensitive.
+func findKey(m map[string]interface{}, name string) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return name, false
+}
+
+// schemaKey returns the key of the extension object of the schema.
+func schemaKey(resource map[string]interface{}, schema string) string {
+	key, _ := findKey(resource, schema)
+	return key
+}
+
+// container returns the object that holds the attributes of the schema:
+// the resource itself for the core schema, else the extension object,
+// created if create is set.
+func container(resource map[string]interface{}, schema string, create bool) map[string]interface{} {
+	if schema == "" {
+		return resource
+	}
+	key := schemaKey(resource, schema)
+	if extension, ok := resource[key].(map[string]interface{}); ok {
+		return extension
+	}
+	if !create {
+		return nil
+	}
+	extension := map[string]interface{}{}
+	resource[key] = extension
+	return extension
+}
+
+// values returns the values of the attribute the path names. The values of
+// a multi-valued attribute are its elements, or the value sub-attribute of
+// complex elements; a sub-attribute is read from every element.
+func values(resource map[string]interface{}, path Path) []interface{} {
+	c := container(resource, path.Schema, false)
+	if c == nil {
+		return nil
+	}
+	key, ok := findKey(c, path.Attr)
+	if !ok {
+		return nil
+	}
+
+	elements := []interface{}{c[key]}
+	if array, ok := c[key].([]interface{}); ok {
+		elements = array
+	}
+
+	out := []interface{}{}
+	for _, element := range elements {
+		complex, isComplex := element.(map[string]interface{})
+		switch {
+		case path.Sub != "" && isComplex:
+			if sub, ok := findKey(complex, path.Sub); ok {
+				out = append(out, complex[sub])
+			}
+		case path.Sub != "":
+		case isComplex:
+			if value, ok := findKey(complex, "value"); ok {
+				out = append(out, complex[value])
+			}
+		case element != nil:
+			out = append(out, element)
+		}
+	}
+	return out
+}
@@ -0,0 +1,360 @@
+// Package scim implements the parts of SCIM 2.0 (RFC 7643 and RFC 7644) that
+// identity providers use to provision the directory: the User and Group
+// resources, filters, PATCH operations and the discovery documents. Users
+// are mailboxes and groups are departments.
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"mailbox-api/model"
+)
+
+// Schema URNs.
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaEnterpriseUser        = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// ContentType is the media type of SCIM requests and responses.
+const ContentType = "application/scim+json"
+
+// Error types (RFC 7644, section 3.12).
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrTooMany       = "tooMany"
+	ErrUniqueness    = "uniqueness"
+	ErrMutability    = "mutability"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidPath   = "invalidPath"
+	ErrNoTarget      = "noTarget"
+	ErrInvalidValue  = "invalidValue"
+)
+
+// Error is a SCIM error response. It is also returned as an error by the
+// parsers of this package.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func NewError(status int, scimType string, format string, args ...interface{}) *Error {
+	return &Error{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+// StatusCode returns the HTTP status of the error.
+func (e *Error) StatusCode() int {
+	status, _ := strconv.Atoi(e.Status)
+	return status
+}
+
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Reference points to another resource, such as a group member or a
+// manager.
+type Reference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare ID some providers send, as in a PATCH
+// of the enterprise manager.
+func (r *Reference) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*r = Reference{Value: value}
+		return nil
+	}
+
+	type reference Reference
+	return json.Unmarshal(data, (*reference)(r))
+}
+
+// Boolean is a boolean that also accepts "true" and "false" as strings, as
+// some providers send them in PATCH operations.
+type Boolean bool
+
+func (b *Boolean) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*b = Boolean(parsed)
+		return nil
+	}
+	return json.Unmarshal(data, (*bool)(b))
+}
+
+type EnterpriseUser struct {
+	Department string     `json:"department,omitempty"`
+	Manager    *Reference `json:"manager,omitempty"`
+}
+
+// User is a mailbox. Its id and userName are the mailbox identifier.
+type User struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	Name        *Name           `json:"name,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Emails      []Email         `json:"emails,omitempty"`
+	Active      *Boolean        `json:"active,omitempty"`
+	Groups      []Reference     `json:"groups,omitempty"`
+	Enterprise  *EnterpriseUser `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        *Meta           `json:"meta,omitempty"`
+}
+
+// Group is a department. Its id is the department ID.
+type Group struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []Reference `json:"members,omitempty"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+func NewListResponse(totalResults int, startIndex int, resources []interface{}) ListResponse {
+	return ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: totalResults,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// NewUser returns the User resource of a mailbox. baseURL is the root of
+// the SCIM endpoints, used for the locations of the user and the resources
+// it references.
+func NewUser(mailbox model.Mailbox, baseURL string) User {
+	name := Name{Formatted: mailbox.UserFullName}
+	if words := strings.Fields(mailbox.UserFullName); len(words) > 1 {
+		name.GivenName = strings.Join(words[:len(words)-1], " ")
+		name.FamilyName = words[len(words)-1]
+	} else {
+		name.FamilyName = mailbox.UserFullName
+	}
+
+	active := Boolean(mailbox.Active)
+	groupID := strconv.Itoa(mailbox.DepartmentID)
+	user := User{
+		Schemas:     []string{SchemaUser, SchemaEnterpriseUser},
+		ID:          mailbox.Identifier,
+		UserName:    mailbox.Identifier,
+		Name:        &name,
+		DisplayName: mailbox.UserFullName,
+		Title:       mailbox.JobTitle,
+		Emails:      []Email{{Value: mailbox.Identifier, Type: "work", Primary: true}},
+		Active:      &active,
+		Groups:      []Reference{{Value: groupID, Ref: GroupLocation(baseURL, groupID), Display: mailbox.Department}},
+		Enterprise:  &EnterpriseUser{Department: mailbox.Department},
+		Meta:        &Meta{ResourceType: "User", Location: UserLocation(baseURL, mailbox.Identifier)},
+	}
+	if mailbox.ManagerIdentifier != "" {
+		user.Enterprise.Manager = &Reference{Value: mailbox.ManagerIdentifier, Ref: UserLocation(baseURL, mailbox.ManagerIdentifier)}
+	}
+	return user
+}
+
+// NewGroup returns the Group resource of a department with the given
+// members.
+func NewGroup(department model.Department, members []model.Mailbox, baseURL string) Group {
+	id := strconv.Itoa(department.ID)
+	group := Group{
+		Schemas:     []string{SchemaGroup},
+		ID:          id,
+		DisplayName: department.Name,
+		Meta:        &Meta{ResourceType: "Group", Location: GroupLocation(baseURL, id)},
+	}
+	for _, member := range members {
+		group.Members = append(group.Members, Reference{
+			Value:   member.Identifier,
+			Ref:     UserLocation(baseURL, member.Identifier),
+			Display: member.UserFullName,
+			Type:    "User",
+		})
+	}
+	return group
+}
+
+func UserLocation(baseURL string, id string) string {
+	return baseURL + "/Users/" + url.PathEscape(id)
+}
+
+func GroupLocation(baseURL string, id string) string {
+	return baseURL + "/Groups/" + url.PathEscape(id)
+}
+
+// ToMap returns the JSON object of a resource, the form filters and PATCH
+// operations work on.
+func ToMap(resource interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FromMap decodes a JSON object into a resource. Values of the wrong type
+// are reported as invalidValue errors.
+func FromMap(m map[string]interface{}, resource interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, resource); err != nil {
+		return NewError(400, ErrInvalidValue, "%v", err)
+	}
+	return nil
+}
+
+// Project keeps the attributes a client asked for, or drops those it
+// excluded, as with the attributes and excludedAttributes query parameters.
+// schemas, id and meta are always returned.
+func Project(resource map[string]interface{}, attributes []string, excluded []string) map[string]interface{} {
+	if len(attributes) > 0 {
+		out := map[string]interface{}{}
+		for _, always := range []string{"schemas", "id", "meta"} {
+			if value, ok := resource[always]; ok {
+				out[always] = value
+			}
+		}
+		for _, attribute := range attributes {
+			path, err := ParsePath(attribute)
+			if err != nil || path.Filter != nil {
+				continue
+			}
+			copyAttribute(resource, out, path)
+		}
+		return out
+	}
+
+	for _, attribute := range excluded {
+		path, err := ParsePath(attribute)
+		if err != nil || path.Filter != nil {
+			continue
+		}
+		switch attr := strings.ToLower(path.Attr); {
+		case path.Schema == "" && (attr == "schemas" || attr == "id" || attr == "meta"):
+		default:
+			remove(resource, path)
+		}
+	}
+	return resource
+}
+
+func copyAttribute(from map[string]interface{}, to map[string]interface{}, path Path) {
+	source := container(from, path.Schema, false)
+	if source == nil {
+		return
+	}
+	if path.Attr == "" {
+		to[schemaKey(from, path.Schema)] = source
+		return
+	}
+
+	key, ok := findKey(source, path.Attr)
+	if !ok {
+		return
+	}
+	target := container(to, path.Schema, true)
+	if path.Sub == "" {
+		target[key] = source[key]
+		return
+	}
+
+	complex, ok := source[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	sub, ok := findKey(complex, path.Sub)
+	if !ok {
+		return
+	}
+	copied, ok := target[key].(map[string]interface{})
+	if !ok {
+		copied = map[string]interface{}{}
+		target[key] = copied
+	}
+	copied[sub] = complex[sub]
+}
+
+func remove(resource map[string]interface{}, path Path) {
+	c := container(resource, path.Schema, false)
+	if c == nil {
+		return
+	}
+	if path.Attr == "" {
+		delete(resource, schemaKey(resource, path.Schema))
+		return
+	}
+	key, ok := findKey(c, path.Attr)
+	if !ok {
+		return
+	}
+	if path.Sub == "" {
+		delete(c, key)
+		return
+	}
+	if complex, ok := c[key].(map[string]interface{}); ok {
+		if sub, ok := findKey(complex, path.Sub); ok {
+			delete(complex, sub)
+		}
+	}
+}
@@ -18,7 +18,9 @@ echo "Creating database schema..."
 docker-compose exec -T postgres psql -U ${DB_USER} -d ${DB_NAME} -c "
 CREATE TABLE IF NOT EXISTS departments (
     department_id INT PRIMARY KEY,
-    department_name VARCHAR(100) NOT NULL
+    department_name VARCHAR(100) NOT NULL,
+    parent_department_id INT REFERENCES departments(department_id),
+    cost_center VARCHAR(50) NOT NULL DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS mailboxes (
@@ -29,13 +31,81 @@ CREATE TABLE IF NOT EXISTS mailboxes (
     manager_mailbox_identifier VARCHAR(100),
     org_depth INT NOT NULL DEFAULT 0,
     sub_org_size INT NOT NULL DEFAULT 0,
-    FOREIGN KEY (department_id) REFERENCES departments(department_id)
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    FOREIGN KEY (department_id) REFERENCES departments(department_id),
+    FOREIGN KEY (manager_mailbox_identifier) REFERENCES mailboxes(mailbox_identifier)
 );
 
+CREATE INDEX IF NOT EXISTS idx_departments_parent_id ON departments(parent_department_id);
 CREATE INDEX IF NOT EXISTS idx_mailboxes_department_id ON mailboxes(department_id);
 CREATE INDEX IF NOT EXISTS idx_mailboxes_manager_id ON mailboxes(manager_mailbox_identifier);
 CREATE INDEX IF NOT EXISTS idx_mailboxes_org_depth ON mailboxes(org_depth);
 CREATE INDEX IF NOT EXISTS idx_mailboxes_sub_org_size ON mailboxes(sub_org_size);
+CREATE INDEX IF NOT EXISTS idx_mailboxes_identifier_lower ON mailboxes(lower(mailbox_identifier));
+
+CREATE TABLE IF NOT EXISTS mailbox_closure (
+    ancestor_identifier VARCHAR(100) NOT NULL,
+    descendant_identifier VARCHAR(100) NOT NULL,
+    depth INT NOT NULL,
+    PRIMARY KEY (ancestor_identifier, descendant_identifier),
+    FOREIGN KEY (ancestor_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE,
+    FOREIGN KEY (descendant_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mailbox_closure_descendant ON mailbox_closure(descendant_identifier, depth);
+
+CREATE TABLE IF NOT EXISTS credentials (
+    username VARCHAR(100) PRIMARY KEY,
+    password_hash VARCHAR(100) NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    mailbox_identifier VARCHAR(100),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (mailbox_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    username VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (username) REFERENCES credentials(username) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens(username);
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(32) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    mailbox_identifier VARCHAR(100),
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY (mailbox_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS import_plans (
+    id VARCHAR(32) PRIMARY KEY,
+    status VARCHAR(20) NOT NULL,
+    summary JSONB NOT NULL,
+    changes JSONB NOT NULL,
+    directory_version VARCHAR(64) NOT NULL DEFAULT '',
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    applied_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_plans_created_at ON import_plans(created_at);
 "
 
 echo "Seeding departments..."
@@ -53,5 +123,6 @@ docker-compose exec -T postgres bash -c "cat /tmp/mailboxes.csv | tail -n +2 | w
 echo "Database setup completed successfully!"
 echo ""
 echo "NEXT STEPS:"
-echo "1. Run the application to calculate organization metrics:"
-echo "   go run main.go"
\ No newline at end of file
+echo "1. Run the application and calculate organization metrics and hierarchy paths:"
+echo "   go run main.go"
+echo "   curl -X POST -H \"Authorization: Bearer \$CEO_TOKEN\" http://localhost:8080/api/mailboxes/calculate-metrics"
\ No newline at end of file
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mailbox-api/authz"
+	"mailbox-api/model"
+	"mailbox-api/repository"
+)
+
+// APIKeyPrefix starts every API key, so keys are easy to recognise in logs
+// and secret scanners. A key reads mbx_<id>_<secret>.
+const APIKeyPrefix = "mbx_"
+
+// apiKeyTouchInterval limits how often a key's last-used timestamp is
+// written.
+const apiKeyTouchInterval = time.Minute
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+type APIKeyService interface {
+	// CreateAPIKey creates a key whose scopes must all be held by the creator.
+	CreateAPIKey(ctx context.Context, input model.APIKeyInput, creator authz.Grants, createdBy string) (*model.CreatedAPIKey, error)
+	ListAPIKeys(ctx context.Context) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	// AuthenticateAPIKey returns the key's record, or nil if the key is
+	// unknown, revoked or expired.
+	AuthenticateAPIKey(ctx context.Context, key string) (*model.APIKey, error)
+}
+
+type apiKeyService struct {
+	apiKeyRepo  repository.APIKeyRepository
+	mailboxRepo repository.MailboxRepository
+}
+
+func NewAPIKeyService(apiKeyRepo repository.APIKeyRepository, mailboxRepo repository.MailboxRepository) APIKeyService {
+	return &apiKeyService{
+		apiKeyRepo:  apiKeyRepo,
+		mailboxRepo: mailboxRepo,
+	}
+}
+
+func (s *apiKeyService) CreateAPIKey(ctx context.Context, input model.APIKeyInput, creator authz.Grants, createdBy string) (*model.CreatedAPIKey, error) {
+	key := model.APIKey{
+		Name:              strings.TrimSpace(input.Name),
+		Scopes:            []string{},
+		MailboxIdentifier: strings.TrimSpace(input.MailboxIdentifier),
+		CreatedBy:         createdBy,
+		ExpiresAt:         input.ExpiresAt,
+	}
+
+	if key.Name == "" {
+		return nil, newValidationError("name", "is required")
+	}
+	if len(input.Scopes) == 0 {
+		return nil, newValidationError("scopes", "at least one scope is required")
+	}
+
+	seen := map[string]bool{}
+	for _, scope := range input.Scopes {
+		scope = strings.TrimSpace(scope)
+		if !authz.IsKnown(authz.Permission(scope)) {
+			return nil, newValidationError("scopes", "unknown scope %s", scope)
+		}
+		if !creator.Can(authz.Permission(scope)) {
+			return nil, newValidationError("scopes", "cannot grant %s, which the caller does not hold", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			key.Scopes = append(key.Scopes, scope)
+		}
+	}
+
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return nil, newValidationError("expires_at", "must be in the future")
+	}
+
+	if key.MailboxIdentifier != "" {
+		mailbox, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, key.MailboxIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mailbox: %w", err)
+		}
+		if mailbox == nil {
+			return nil, newValidationError("mailbox_identifier", "mailbox %s does not exist", key.MailboxIdentifier)
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	key.ID = hex.EncodeToString(id)
+	fullKey := APIKeyPrefix + key.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.KeyHash = hashToken(fullKey)
+
+	if err := s.apiKeyRepo.CreateAPIKey(ctx, key); err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	created, err := s.apiKeyRepo.GetAPIKey(ctx, key.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	return &model.CreatedAPIKey{APIKey: *created, Key: fullKey}, nil
+}
+
+func (s *apiKeyService) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	keys, err := s.apiKeyRepo.ListAPIKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *apiKeyService) RevokeAPIKey(ctx context.Context, id string) error {
+	revoked, err := s.apiKeyRepo.RevokeAPIKey(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if !revoked {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *apiKeyService) AuthenticateAPIKey(ctx context.Context, key string) (*model.APIKey, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !strings.HasPrefix(key, APIKeyPrefix) || !ok {
+		return nil, nil
+	}
+
+	stored, err := s.apiKeyRepo.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	if stored == nil || subtle.ConstantTimeCompare([]byte(stored.KeyHash), []byte(hashToken(key))) != 1 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if stored.RevokedAt != nil || (stored.ExpiresAt != nil && now.After(*stored.ExpiresAt)) {
+		return nil, nil
+	}
+
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.apiKeyRepo.TouchAPIKey(ctx, stored.ID, now); err != nil {
+			return nil, fmt.Errorf("failed to record API key use: %w", err)
+		}
+		stored.LastUsedAt = &now
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mailbox-api/model"
+	"mailbox-api/repository"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// minBootstrapPasswordLength is the minimum length of the bootstrap
+// administrator's password.
+const minBootstrapPasswordLength = 12
+
+// weakPasswords are defaults from example configurations and other common
+// passwords that the bootstrap administrator may not use.
+var weakPasswords = []string{
+	"change-me-please",
+	"changemeplease",
+	"password1234",
+	"adminadminadmin",
+	"letmeinletmein",
+	"123456789012",
+	"qwertyuiopas",
+}
+
+var (
+	ErrInvalidCredentials  = errors.New("invalid username or password")
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrCredentialExists    = errors.New("credential already exists")
+)
+
+// AuthService manages stored credentials, refresh tokens and the access
+// token revocation list. Signing access tokens is left to the caller.
+type AuthService interface {
+	Authenticate(ctx context.Context, username string, password string) (*model.Credential, error)
+	CreateCredential(ctx context.Context, input model.CredentialInput) (*model.Credential, error)
+	EnsureCredential(ctx context.Context, input model.CredentialInput) error
+	IssueRefreshToken(ctx context.Context, username string) (string, error)
+	RotateRefreshToken(ctx context.Context, refreshToken string) (*model.Credential, string, error)
+	RevokeRefreshToken(ctx context.Context, refreshToken string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type authService struct {
+	authRepo        repository.AuthRepository
+	mailboxRepo     repository.MailboxRepository
+	refreshTokenTTL time.Duration
+}
+
+func NewAuthService(authRepo repository.AuthRepository, mailboxRepo repository.MailboxRepository, refreshTokenTTL time.Duration) AuthService {
+	return &authService{
+		authRepo:        authRepo,
+		mailboxRepo:     mailboxRepo,
+		refreshTokenTTL: refreshTokenTTL,
+	}
+}
+
+func (s *authService) Authenticate(ctx context.Context, username string, password string) (*model.Credential, error) {
+	credential, err := s.authRepo.GetCredential(ctx, strings.TrimSpace(username))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credential: %w", err)
+	}
+
+	if credential == nil {
+		// Compare against a dummy hash so that unknown usernames take as long
+		// as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return credential, nil
+}
+
+// CreateCredential validates the input and stores the credential with a
+// bcrypt hash of the password. The caller is responsible for checking that
+// the role exists.
+func (s *authService) CreateCredential(ctx context.Context, input model.CredentialInput) (*model.Credential, error) {
+	credential := model.Credential{
+		Username:          strings.TrimSpace(input.Username),
+		Role:              strings.TrimSpace(input.Role),
+		MailboxIdentifier: strings.TrimSpace(input.MailboxIdentifier),
+	}
+
+	if credential.Username == "" {
+		return nil, newValidationError("username", "is required")
+	}
+	if len(input.Password) < minPasswordLength {
+		return nil, newValidationError("password", "must be at least %d characters", minPasswordLength)
+	}
+	if credential.Role == "" {
+		return nil, newValidationError("role", "is required")
+	}
+
+	existing, err := s.authRepo.GetCredential(ctx, credential.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credential: %w", err)
+	}
+	if existing != nil {
+		return nil, ErrCredentialExists
+	}
+
+	if credential.MailboxIdentifier != "" {
+		mailbox, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, credential.MailboxIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mailbox: %w", err)
+		}
+		if mailbox == nil {
+			return nil, newValidationError("mailbox_identifier", "mailbox %s does not exist", credential.MailboxIdentifier)
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	credential.PasswordHash = string(hash)
+
+	if err := s.authRepo.CreateCredential(ctx, credential); err != nil {
+		return nil, fmt.Errorf("failed to create credential: %w", err)
+	}
+
+	return s.authRepo.GetCredential(ctx, credential.Username)
+}
+
+// EnsureCredential creates the credential unless one with the same username
+// already exists. It is used to bootstrap the first administrator, whose
+// password comes from the environment, so it must be at least
+// minBootstrapPasswordLength characters and neither a known default nor the
+// username.
+func (s *authService) EnsureCredential(ctx context.Context, input model.CredentialInput) error {
+	if len(input.Password) < minBootstrapPasswordLength {
+		return newValidationError("password", "must be at least %d characters", minBootstrapPasswordLength)
+	}
+	for _, weak := range append(weakPasswords, strings.TrimSpace(input.Username)) {
+		if strings.EqualFold(input.Password, weak) {
+			return newValidationError("password", "is a default or guessable password")
+		}
+	}
+
+	_, err := s.CreateCredential(ctx, input)
+	if errors.Is(err, ErrCredentialExists) {
+		return nil
+	}
+	return err
+}
+
+// IssueRefreshToken creates a random opaque refresh token for the user and
+// stores its hash.
+func (s *authService) IssueRefreshToken(ctx context.Context, username string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := s.authRepo.CreateRefreshToken(ctx, model.RefreshToken{
+		TokenHash: hashToken(refreshToken),
+		Username:  username,
+		ExpiresAt: time.Now().Add(s.refreshTokenTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return refreshToken, nil
+}
+
+// RotateRefreshToken revokes a valid refresh token and issues a new one for
+// the same user. Each refresh token can be used exactly once.
+func (s *authService) RotateRefreshToken(ctx context.Context, refreshToken string) (*model.Credential, string, error) {
+	tokenHash := hashToken(refreshToken)
+
+	stored, err := s.authRepo.GetRefreshToken(ctx, tokenHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get refresh token: %w", err)
+	}
+	if stored == nil || stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	revoked, err := s.authRepo.RevokeRefreshToken(ctx, tokenHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	if !revoked {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	credential, err := s.authRepo.GetCredential(ctx, stored.Username)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get credential: %w", err)
+	}
+	if credential == nil {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	newToken, err := s.IssueRefreshToken(ctx, credential.Username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return credential, newToken, nil
+}
+
+func (s *authService) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	if _, err := s.authRepo.RevokeRefreshToken(ctx, hashToken(refreshToken)); err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	return nil
+}
+
+func (s *authService) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := s.authRepo.RevokeAccessToken(ctx, jti, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke access token: %w", err)
+	}
+	return nil
+}
+
+func (s *authService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	revoked, err := s.authRepo.IsAccessTokenRevoked(ctx, jti)
+	if err != nil {
+		return false, fmt.Errorf("failed to check revocation list: %w", err)
+	}
+	return revoked, nil
+}
+
+// dummyPasswordHash is a bcrypt hash used to keep failed logins for unknown
+// users as slow as those for known ones.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
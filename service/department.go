@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"mailbox-api/model"
+	"mailbox-api/repository"
+)
+
+const maxCostCenterLength = 50
+
+type DepartmentService interface {
+	GetDepartments(ctx context.Context) ([]model.DepartmentSummary, error)
+	GetDepartment(ctx context.Context, id int) (*model.DepartmentSummary, error)
+	CreateDepartment(ctx context.Context, input model.DepartmentInput) (*model.DepartmentSummary, error)
+	PatchDepartment(ctx context.Context, id int, patch model.DepartmentPatch) (*model.DepartmentSummary, error)
+	DeleteDepartment(ctx context.Context, id int) error
+}
+
+type departmentService struct {
+	departmentRepo repository.DepartmentRepository
+}
+
+func NewDepartmentService(departmentRepo repository.DepartmentRepository) DepartmentService {
+	return &departmentService{
+		departmentRepo: departmentRepo,
+	}
+}
+
+// GetDepartments returns every department with its headcount rolled up
+// through the department tree.
+func (s *departmentService) GetDepartments(ctx context.Context) ([]model.DepartmentSummary, error) {
+	departments, err := s.departmentRepo.GetDepartmentSummaries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get departments: %w", err)
+	}
+
+	rollUpHeadcount(departments)
+
+	return departments, nil
+}
+
+func (s *departmentService) GetDepartment(ctx context.Context, id int) (*model.DepartmentSummary, error) {
+	departments, err := s.GetDepartments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range departments {
+		if departments[i].ID == id {
+			return &departments[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *departmentService) CreateDepartment(ctx context.Context, input model.DepartmentInput) (*model.DepartmentSummary, error) {
+	department := model.Department{
+		ID:         input.ID,
+		Name:       strings.TrimSpace(input.Name),
+		ParentID:   input.ParentID,
+		CostCenter: strings.TrimSpace(input.CostCenter),
+	}
+
+	if department.ID < 0 {
+		return nil, newValidationError("department_id", "must be positive")
+	}
+	if department.Name == "" {
+		return nil, newValidationError("department_name", "is required")
+	}
+	if len(department.CostCenter) > maxCostCenterLength {
+		return nil, newValidationError("cost_center", "must be at most %d characters", maxCostCenterLength)
+	}
+
+	if department.ID != 0 {
+		existing, err := s.departmentRepo.GetDepartmentByID(ctx, department.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get department: %w", err)
+		}
+		if existing != nil {
+			return nil, ErrDepartmentExists
+		}
+	}
+
+	if err := s.validateParent(ctx, department); err != nil {
+		return nil, err
+	}
+
+	members := []string{}
+	seen := map[string]bool{}
+	for _, member := range input.Members {
+		member = strings.TrimSpace(member)
+		if member != "" && !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+
+	id, err := s.departmentRepo.CreateDepartment(ctx, department, members)
+	if errors.Is(err, repository.ErrMemberNotFound) {
+		return nil, newValidationError("members", "every member must be an existing mailbox")
+	}
+	if errors.Is(err, repository.ErrDepartmentExists) {
+		return nil, ErrDepartmentExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create department: %w", err)
+	}
+
+	return s.GetDepartment(ctx, id)
+}
+
+func (s *departmentService) PatchDepartment(ctx context.Context, id int, patch model.DepartmentPatch) (*model.DepartmentSummary, error) {
+	existing, err := s.departmentRepo.GetDepartmentByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get department: %w", err)
+	}
+	if existing == nil {
+		return nil, ErrDepartmentNotFound
+	}
+
+	department := *existing
+	if patch.Name != nil {
+		department.Name = strings.TrimSpace(*patch.Name)
+	}
+	if patch.ParentID != nil {
+		department.ParentID = *patch.ParentID
+	}
+	if patch.CostCenter != nil {
+		department.CostCenter = strings.TrimSpace(*patch.CostCenter)
+	}
+
+	if department.Name == "" {
+		return nil, newValidationError("department_name", "is required")
+	}
+	if len(department.CostCenter) > maxCostCenterLength {
+		return nil, newValidationError("cost_center", "must be at most %d characters", maxCostCenterLength)
+	}
+	if department.ParentID != existing.ParentID {
+		if err := s.validateParent(ctx, department); err != nil {
+			return nil, err
+		}
+	}
+
+	// The check above gives the usual error early; the repository repeats it
+	// with the parent's ancestors locked, which catches concurrent changes
+	if err := s.departmentRepo.UpdateDepartment(ctx, department); err != nil {
+		if errors.Is(err, repository.ErrDepartmentCycle) {
+			return nil, newValidationError("parent_department_id", "department %d is below department %d, which would create a cycle", department.ParentID, department.ID)
+		}
+		return nil, fmt.Errorf("failed to update department: %w", err)
+	}
+
+	return s.GetDepartment(ctx, id)
+}
+
+// DeleteDepartment refuses to delete a department that still has members or
+// sub-departments.
+func (s *departmentService) DeleteDepartment(ctx context.Context, id int) error {
+	err := s.departmentRepo.DeleteDepartment(ctx, id)
+	switch {
+	case errors.Is(err, repository.ErrDepartmentNotFound):
+		return ErrDepartmentNotFound
+	case errors.Is(err, repository.ErrDepartmentHasMembers):
+		return ErrDepartmentHasMembers
+	case errors.Is(err, repository.ErrDepartmentHasSubDepartments):
+		return ErrDepartmentHasSubDepartments
+	case err != nil:
+		return fmt.Errorf("failed to delete department: %w", err)
+	}
+
+	return nil
+}
+
+// validateParent checks that the department's parent exists and that the
+// department is not among the parent's ancestors, which would make the tree
+// a cycle.
+func (s *departmentService) validateParent(ctx context.Context, department model.Department) error {
+	if department.ParentID == 0 {
+		return nil
+	}
+	if department.ParentID < 0 {
+		return newValidationError("parent_department_id", "must be positive")
+	}
+	if department.ParentID == department.ID {
+		return newValidationError("parent_department_id", "a department cannot be its own parent")
+	}
+
+	departments, err := s.departmentRepo.GetDepartments(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get departments: %w", err)
+	}
+
+	parents := make(map[int]int, len(departments))
+	for _, d := range departments {
+		parents[d.ID] = d.ParentID
+	}
+
+	if _, ok := parents[department.ParentID]; !ok {
+		return newValidationError("parent_department_id", "department %d does not exist", department.ParentID)
+	}
+
+	visited := map[int]bool{}
+	for id := department.ParentID; id != 0 && !visited[id]; id = parents[id] {
+		if id == department.ID {
+			return newValidationError("parent_department_id", "department %d is below department %d, which would create a cycle", department.ParentID, department.ID)
+		}
+		visited[id] = true
+	}
+
+	return nil
+}
+
+// rollUpHeadcount sets the total headcount of each department to its own
+// headcount plus that of all departments below it.
+func rollUpHeadcount(departments []model.DepartmentSummary) {
+	index := make(map[int]int, len(departments))
+	for i, department := range departments {
+		index[department.ID] = i
+	}
+
+	children := map[int][]int{}
+	for i, department := range departments {
+		if _, ok := index[department.ParentID]; ok && department.ParentID != department.ID {
+			children[department.ParentID] = append(children[department.ParentID], i)
+		}
+	}
+
+	var total func(i int, visiting map[int]bool) int
+	total = func(i int, visiting map[int]bool) int {
+		if visiting[i] {
+			return 0
+		}
+		visiting[i] = true
+		sum := departments[i].Headcount
+		for _, child := range children[departments[i].ID] {
+			sum += total(child, visiting)
+		}
+		return sum
+	}
+
+	for i := range departments {
+		departments[i].TotalHeadcount = total(i, map[int]bool{})
+	}
+}
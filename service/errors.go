@@ -0,0 +1,35 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMailboxNotFound   = errors.New("mailbox not found")
+	ErrMailboxExists     = errors.New("mailbox already exists")
+	ErrMailboxHasReports = errors.New("mailbox has direct reports")
+	ErrOutOfScope        = errors.New("mailbox is outside the caller's scope")
+
+	ErrDepartmentNotFound          = errors.New("department not found")
+	ErrDepartmentExists            = errors.New("department already exists")
+	ErrDepartmentHasMembers        = errors.New("department has members")
+	ErrDepartmentHasSubDepartments = errors.New("department has sub-departments")
+)
+
+// ValidationError reports a request field that failed validation.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+func newValidationError(field, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
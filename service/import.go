@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mailbox-api/model"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+	"mailbox-api/util"
+)
+
+var (
+	mailboxColumns    = []string{"mailbox_identifier", "user_full_name", "job_title", "department_id", "manager_mailbox_identifier"}
+	departmentColumns = []string{"department_id", "department_name"}
+)
+
+// importRow is an imported record and the row it was read from.
+type importRow[T any] struct {
+	row    int
+	record T
+}
+
+// importErrors collects the row errors of an import.
+type importErrors []model.ImportRowError
+
+func (e *importErrors) add(row int, identifier string, field string, format string, args ...interface{}) {
+	*e = append(*e, model.ImportRowError{
+		Row:        row,
+		Identifier: identifier,
+		Field:      field,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// parseImportCSV reads the CSV with its header and checks that the required
+// columns are present.
+func parseImportCSV(csvData string, columns []string) ([]map[string]string, error) {
+	records, err := util.ParseCSV(csvData)
+	if err != nil {
+		return nil, newValidationError("file", "%v", err)
+	}
+	if len(records) == 0 {
+		return nil, newValidationError("file", "no data rows found")
+	}
+
+	for _, column := range columns {
+		if _, ok := records[0][column]; !ok {
+			return nil, newValidationError("file", "missing column %s", column)
+		}
+	}
+
+	return records, nil
+}
+
+// ImportMailboxesFromCSV imports new mailboxes from a CSV in the layout of
+// data/mailboxes.csv.
+func (s *mailboxService) ImportMailboxesFromCSV(ctx context.Context, csvData string, dryRun bool) (*model.ImportResult, error) {
+	records, err := parseImportCSV(csvData, mailboxColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]importRow[model.Mailbox], 0, len(records))
+	errs := importErrors{}
+
+	for i, record := range records {
+		if r, ok := parseMailboxRecord(i+2, record, &errs); ok {
+			rows = append(rows, r)
+		}
+	}
+
+	return s.importMailboxes(ctx, len(records), rows, errs, dryRun)
+}
+
+// parseMailboxRecord converts a CSV record in the layout of
+// data/mailboxes.csv. A manager of "null" or "" marks the top of the org.
+func parseMailboxRecord(row int, record map[string]string, errs *importErrors) (importRow[model.Mailbox], bool) {
+	mailbox := model.Mailbox{
+		Identifier:        strings.TrimSpace(record["mailbox_identifier"]),
+		UserFullName:      strings.TrimSpace(record["user_full_name"]),
+		JobTitle:          strings.TrimSpace(record["job_title"]),
+		ManagerIdentifier: strings.TrimSpace(record["manager_mailbox_identifier"]),
+	}
+	if mailbox.ManagerIdentifier == "null" {
+		mailbox.ManagerIdentifier = ""
+	}
+
+	departmentID, err := strconv.Atoi(strings.TrimSpace(record["department_id"]))
+	if err != nil {
+		errs.add(row, mailbox.Identifier, "department_id", "%q is not a number", record["department_id"])
+		return importRow[model.Mailbox]{}, false
+	}
+	mailbox.DepartmentID = departmentID
+
+	return importRow[model.Mailbox]{row: row, record: mailbox}, true
+}
+
+// importMailboxes validates the parsed rows together and, unless there are
+// errors or this is a dry run, stores them in one transaction. Every row is
+// checked, so the result lists all problems of the file at once.
+func (s *mailboxService) importMailboxes(ctx context.Context, total int, rows []importRow[model.Mailbox], errs importErrors, dryRun bool) (*model.ImportResult, error) {
+	departments, err := departmentNames(ctx, s.departmentRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.mailboxRepo.GetAllMailboxes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all mailboxes: %w", err)
+	}
+	stored := make(map[string]bool, len(existing))
+	for _, mailbox := range existing {
+		stored[mailbox.Identifier] = true
+	}
+
+	imported := make(map[string]int, len(rows))
+	valid := []importRow[model.Mailbox]{}
+
+	for _, r := range rows {
+		before := len(errs)
+
+		if stored[r.record.Identifier] {
+			errs.add(r.row, r.record.Identifier, "mailbox_identifier", "mailbox already exists")
+		}
+		checkMailboxRow(r, imported, departments, &errs)
+
+		if len(errs) == before {
+			valid = append(valid, r)
+		}
+	}
+
+	// Check the reporting lines of the new mailboxes together with the
+	// stored ones
+	for _, r := range valid {
+		manager := r.record.ManagerIdentifier
+		if manager != "" && !stored[manager] && imported[manager] == 0 {
+			errs.add(r.row, r.record.Identifier, "manager_mailbox_identifier", "mailbox %s does not exist", manager)
+		}
+	}
+	checkCycles(append(append([]model.Mailbox{}, existing...), recordsOf(valid)...), imported, &errs)
+
+	result := &model.ImportResult{
+		DryRun: dryRun,
+		Rows:   total,
+		Errors: errs,
+	}
+	if len(errs) > 0 || dryRun {
+		return result, nil
+	}
+
+	// Store managers before their reports so every manager reference
+	// resolves at insert time
+	ordered := make([]model.Mailbox, 0, len(valid))
+	graph := orggraph.New(recordsOf(valid))
+	for _, identifier := range graph.TopologicalOrder() {
+		mailbox, _ := graph.Get(identifier)
+		ordered = append(ordered, *mailbox)
+	}
+
+	if err := s.mailboxRepo.ImportMailboxes(ctx, ordered); err != nil {
+		return nil, fmt.Errorf("failed to import mailboxes: %w", err)
+	}
+
+	result.Imported = len(ordered)
+	return result, nil
+}
+
+// departmentNames maps the ID of every department to its name.
+func departmentNames(ctx context.Context, departmentRepo repository.DepartmentRepository) (map[int]string, error) {
+	departments, err := departmentRepo.GetDepartments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get departments: %w", err)
+	}
+
+	names := make(map[int]string, len(departments))
+	for _, department := range departments {
+		names[department.ID] = department.Name
+	}
+	return names, nil
+}
+
+// checkMailboxRow checks the fields of a row on their own and against the
+// earlier rows of the file, and records the row in seen.
+func checkMailboxRow(r importRow[model.Mailbox], seen map[string]int, departments map[int]string, errs *importErrors) {
+	mailbox := r.record
+
+	switch {
+	case mailbox.Identifier == "":
+		errs.add(r.row, "", "mailbox_identifier", "is required")
+	case !strings.Contains(mailbox.Identifier, "@"):
+		errs.add(r.row, mailbox.Identifier, "mailbox_identifier", "must be an email address")
+	case seen[mailbox.Identifier] != 0:
+		errs.add(r.row, mailbox.Identifier, "mailbox_identifier", "duplicate of row %d", seen[mailbox.Identifier])
+	default:
+		seen[mailbox.Identifier] = r.row
+	}
+	if mailbox.UserFullName == "" {
+		errs.add(r.row, mailbox.Identifier, "user_full_name", "is required")
+	}
+	if mailbox.JobTitle == "" {
+		errs.add(r.row, mailbox.Identifier, "job_title", "is required")
+	}
+	if _, ok := departments[mailbox.DepartmentID]; !ok {
+		errs.add(r.row, mailbox.Identifier, "department_id", "department %d does not exist", mailbox.DepartmentID)
+	}
+	if mailbox.ManagerIdentifier != "" && mailbox.ManagerIdentifier == mailbox.Identifier {
+		errs.add(r.row, mailbox.Identifier, "manager_mailbox_identifier", "a mailbox cannot manage itself")
+	}
+}
+
+// checkCycles reports every reporting cycle among the mailboxes on the rows
+// of its members that come from the file.
+func checkCycles(mailboxes []model.Mailbox, rows map[string]int, errs *importErrors) {
+	for _, cycle := range orggraph.New(mailboxes).Cycles() {
+		path := strings.Join(append(cycle, cycle[0]), " -> ")
+		for _, identifier := range cycle {
+			if row := rows[identifier]; row != 0 {
+				errs.add(row, identifier, "manager_mailbox_identifier", "reporting cycle: %s", path)
+			}
+		}
+	}
+}
+
+// ImportDepartmentsFromCSV imports departments from a CSV in the layout of
+// data/departments.csv, optionally with parent_department_id and cost_center
+// columns.
+func (s *mailboxService) ImportDepartmentsFromCSV(ctx context.Context, csvData string, dryRun bool) (*model.ImportResult, error) {
+	records, err := parseImportCSV(csvData, departmentColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]importRow[model.Department], 0, len(records))
+	errs := importErrors{}
+
+	for i, record := range records {
+		row := i + 2
+		department := model.Department{
+			Name:       strings.TrimSpace(record["department_name"]),
+			CostCenter: strings.TrimSpace(record["cost_center"]),
+		}
+
+		id, err := strconv.Atoi(strings.TrimSpace(record["department_id"]))
+		if err != nil {
+			errs.add(row, record["department_id"], "department_id", "%q is not a number", record["department_id"])
+			continue
+		}
+		department.ID = id
+
+		if parent := strings.TrimSpace(record["parent_department_id"]); parent != "" && parent != "null" {
+			parentID, err := strconv.Atoi(parent)
+			if err != nil {
+				errs.add(row, strconv.Itoa(id), "parent_department_id", "%q is not a number", parent)
+				continue
+			}
+			department.ParentID = parentID
+		}
+
+		rows = append(rows, importRow[model.Department]{row: row, record: department})
+	}
+
+	return s.importDepartments(ctx, len(records), rows, errs, dryRun)
+}
+
+// importDepartments validates the parsed rows together and, unless there are
+// errors or this is a dry run, stores them in one transaction.
+func (s *mailboxService) importDepartments(ctx context.Context, total int, rows []importRow[model.Department], errs importErrors, dryRun bool) (*model.ImportResult, error) {
+	existing, err := s.departmentRepo.GetDepartments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get departments: %w", err)
+	}
+	stored := make(map[int]bool, len(existing))
+	for _, department := range existing {
+		stored[department.ID] = true
+	}
+
+	imported := make(map[int]int, len(rows))
+	parents := make(map[int]int, len(rows))
+	valid := []importRow[model.Department]{}
+
+	for _, r := range rows {
+		department := r.record
+		identifier := strconv.Itoa(department.ID)
+		before := len(errs)
+
+		switch {
+		case department.ID <= 0:
+			errs.add(r.row, identifier, "department_id", "must be positive")
+		case stored[department.ID]:
+			errs.add(r.row, identifier, "department_id", "department already exists")
+		case imported[department.ID] != 0:
+			errs.add(r.row, identifier, "department_id", "duplicate of row %d", imported[department.ID])
+		}
+		if department.Name == "" {
+			errs.add(r.row, identifier, "department_name", "is required")
+		}
+		if len(department.CostCenter) > maxCostCenterLength {
+			errs.add(r.row, identifier, "cost_center", "must be at most %d characters", maxCostCenterLength)
+		}
+		if department.ParentID < 0 {
+			errs.add(r.row, identifier, "parent_department_id", "must be positive")
+		}
+
+		if imported[department.ID] == 0 {
+			imported[department.ID] = r.row
+			parents[department.ID] = department.ParentID
+		}
+		if len(errs) == before {
+			valid = append(valid, r)
+		}
+	}
+
+	for _, r := range valid {
+		department := r.record
+		identifier := strconv.Itoa(department.ID)
+		if department.ParentID == 0 || stored[department.ParentID] {
+			continue
+		}
+		if imported[department.ParentID] == 0 {
+			errs.add(r.row, identifier, "parent_department_id", "department %d does not exist", department.ParentID)
+			continue
+		}
+
+		// Stored departments cannot have a new parent, so a cycle can only
+		// run through imported rows
+		visited := map[int]bool{}
+		for id := department.ParentID; id != 0 && !stored[id] && !visited[id]; id = parents[id] {
+			if id == department.ID {
+				errs.add(r.row, identifier, "parent_department_id", "would create a department cycle")
+				break
+			}
+			visited[id] = true
+		}
+	}
+
+	result := &model.ImportResult{
+		DryRun: dryRun,
+		Rows:   total,
+		Errors: errs,
+	}
+	if len(errs) > 0 || dryRun {
+		return result, nil
+	}
+
+	// Store parents before their sub-departments
+	ordered := make([]model.Department, 0, len(valid))
+	placed := make(map[int]bool, len(valid))
+	byID := make(map[int]model.Department, len(valid))
+	for _, r := range valid {
+		byID[r.record.ID] = r.record
+	}
+	var place func(department model.Department)
+	place = func(department model.Department) {
+		if placed[department.ID] {
+			return
+		}
+		placed[department.ID] = true
+		if parent, ok := byID[department.ParentID]; ok {
+			place(parent)
+		}
+		ordered = append(ordered, department)
+	}
+	for _, r := range valid {
+		place(r.record)
+	}
+
+	if err := s.departmentRepo.ImportDepartments(ctx, ordered); err != nil {
+		return nil, fmt.Errorf("failed to import departments: %w", err)
+	}
+
+	result.Imported = len(ordered)
+	return result, nil
+}
+
+func recordsOf[T any](rows []importRow[T]) []T {
+	records := make([]T, len(rows))
+	for i, r := range rows {
+		records[i] = r.record
+	}
+	return records
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"mailbox-api/model"
+)
+
+// mailboxRecord is a mailbox in a JSON import, with the field names of the
+// API. A missing, null or empty manager marks the top of the org. Reports
+// are only read by the tree import.
+type mailboxRecord struct {
+	Identifier        string            `json:"mailbox_identifier"`
+	UserFullName      string            `json:"user_full_name"`
+	JobTitle          string            `json:"job_title"`
+	DepartmentID      int               `json:"department_id"`
+	ManagerIdentifier *string           `json:"manager_mailbox_identifier"`
+	Reports           []json.RawMessage `json:"reports"`
+}
+
+func (r mailboxRecord) mailbox() model.Mailbox {
+	mailbox := model.Mailbox{
+		Identifier:   strings.TrimSpace(r.Identifier),
+		UserFullName: strings.TrimSpace(r.UserFullName),
+		JobTitle:     strings.TrimSpace(r.JobTitle),
+		DepartmentID: r.DepartmentID,
+	}
+	if r.ManagerIdentifier != nil {
+		mailbox.ManagerIdentifier = strings.TrimSpace(*r.ManagerIdentifier)
+	}
+	return mailbox
+}
+
+// decodeMailboxRecord decodes the record on a row. A value of the wrong type
+// is reported on its field.
+func decodeMailboxRecord(row int, data json.RawMessage, errs *importErrors) (mailboxRecord, bool) {
+	var record mailboxRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			// The other fields are still decoded
+			errs.add(row, strings.TrimSpace(record.Identifier), typeErr.Field, "must be a JSON %s, not %s", jsonType(typeErr.Type), typeErr.Value)
+		} else {
+			errs.add(row, "", "", "must be a JSON object")
+		}
+		return mailboxRecord{}, false
+	}
+	return record, true
+}
+
+// jsonType names the JSON type a field of mailboxRecord is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int:
+		return "number"
+	case reflect.Slice:
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+// flatRecord decodes the record of a flat import, where every mailbox names
+// its manager.
+func flatRecord(row int, data json.RawMessage, errs *importErrors) (importRow[model.Mailbox], bool) {
+	record, ok := decodeMailboxRecord(row, data, errs)
+	if !ok {
+		return importRow[model.Mailbox]{}, false
+	}
+
+	mailbox := record.mailbox()
+	if len(record.Reports) > 0 {
+		errs.add(row, mailbox.Identifier, "reports", "only allowed in a tree import")
+		return importRow[model.Mailbox]{}, false
+	}
+	return importRow[model.Mailbox]{row: row, record: mailbox}, true
+}
+
+// ImportMailboxesFromJSON imports new mailboxes from a JSON array of
+// mailboxes. The row of an error is the position of the mailbox in the
+// array, starting at 1.
+func (s *mailboxService) ImportMailboxesFromJSON(ctx context.Context, jsonData string, dryRun bool) (*model.ImportResult, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal([]byte(jsonData), &elements); err != nil {
+		return nil, newValidationError("file", "not a JSON array of mailboxes: %v", err)
+	}
+	if len(elements) == 0 {
+		return nil, newValidationError("file", "no mailboxes found")
+	}
+
+	rows := make([]importRow[model.Mailbox], 0, len(elements))
+	errs := importErrors{}
+
+	for i, element := range elements {
+		if r, ok := flatRecord(i+1, element, &errs); ok {
+			rows = append(rows, r)
+		}
+	}
+
+	return s.importMailboxes(ctx, len(elements), rows, errs, dryRun)
+}
+
+// ImportMailboxesFromNDJSON imports new mailboxes from newline-delimited
+// JSON, one mailbox per line. Blank lines are skipped, and the row of an
+// error is its line number, so a line that is not valid JSON only fails that
+// row.
+func (s *mailboxService) ImportMailboxesFromNDJSON(ctx context.Context, ndjsonData string, dryRun bool) (*model.ImportResult, error) {
+	rows := []importRow[model.Mailbox]{}
+	errs := importErrors{}
+	total := 0
+
+	for i, line := range strings.Split(ndjsonData, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		total++
+
+		if !json.Valid([]byte(line)) {
+			errs.add(i+1, "", "", "not valid JSON")
+			continue
+		}
+		if r, ok := flatRecord(i+1, json.RawMessage(line), &errs); ok {
+			rows = append(rows, r)
+		}
+	}
+	if total == 0 {
+		return nil, newValidationError("file", "no mailboxes found")
+	}
+
+	return s.importMailboxes(ctx, total, rows, errs, dryRun)
+}
+
+// ImportMailboxesFromTree imports new mailboxes from a nested org tree: a
+// node, or an array of nodes, whose reports array holds the nodes of its
+// direct reports. A report's manager is its parent node; a root node may
+// name a stored manager to attach the tree below it. The row of an error is
+// the position of the node in depth-first order, starting at 1.
+func (s *mailboxService) ImportMailboxesFromTree(ctx context.Context, jsonData string, dryRun bool) (*model.ImportResult, error) {
+	var roots []json.RawMessage
+	if strings.HasPrefix(strings.TrimSpace(jsonData), "[") {
+		if err := json.Unmarshal([]byte(jsonData), &roots); err != nil {
+			return nil, newValidationError("file", "not a JSON org tree: %v", err)
+		}
+	} else {
+		var root json.RawMessage
+		if err := json.Unmarshal([]byte(jsonData), &root); err != nil {
+			return nil, newValidationError("file", "not a JSON org tree: %v", err)
+		}
+		roots = []json.RawMessage{root}
+	}
+	if len(roots) == 0 {
+		return nil, newValidationError("file", "no mailboxes found")
+	}
+
+	rows := []importRow[model.Mailbox]{}
+	errs := importErrors{}
+	total := 0
+
+	var walk func(node json.RawMessage, parent *model.Mailbox)
+	walk = func(node json.RawMessage, parent *model.Mailbox) {
+		total++
+		row := total
+
+		// A node that cannot be decoded takes its reports with it
+		record, ok := decodeMailboxRecord(row, node, &errs)
+		if !ok {
+			return
+		}
+
+		mailbox := record.mailbox()
+		if parent != nil {
+			if mailbox.ManagerIdentifier != "" && mailbox.ManagerIdentifier != parent.Identifier {
+				errs.add(row, mailbox.Identifier, "manager_mailbox_identifier", "conflicts with the parent node %s", parent.Identifier)
+			}
+			mailbox.ManagerIdentifier = parent.Identifier
+		}
+		rows = append(rows, importRow[model.Mailbox]{row: row, record: mailbox})
+
+		for _, report := range record.Reports {
+			walk(report, &mailbox)
+		}
+	}
+	for _, root := range roots {
+		walk(root, nil)
+	}
+
+	return s.importMailboxes(ctx, total, rows, errs, dryRun)
+}
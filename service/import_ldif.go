@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"mailbox-api/ldif"
+	"mailbox-api/model"
+)
+
+// ImportMailboxesFromLDIF imports new mailboxes from the inetOrgPerson
+// entries of an LDIF file, such as one written by the LDIF export; other
+// entries are skipped. The manager DN is resolved to the mail address of the
+// entry it names in the file, or else read from a mail= RDN. The row of an
+// error is the line of the entry's dn.
+func (s *mailboxService) ImportMailboxesFromLDIF(ctx context.Context, ldifData string, dryRun bool) (*model.ImportResult, error) {
+	entries, err := ldif.Parse(strings.NewReader(ldifData))
+	if err != nil {
+		return nil, newValidationError("file", "%v", err)
+	}
+
+	people := []ldif.Entry{}
+	mail := map[string]string{}
+	for _, entry := range entries {
+		if !entry.HasObjectClass("inetOrgPerson") {
+			continue
+		}
+		people = append(people, entry)
+		if dn, err := ldif.NormalizeDN(entry.DN); err == nil {
+			mail[dn] = strings.TrimSpace(entry.First("mail"))
+		}
+	}
+	if len(people) == 0 {
+		return nil, newValidationError("file", "no inetOrgPerson entries found")
+	}
+
+	rows := make([]importRow[model.Mailbox], 0, len(people))
+	errs := importErrors{}
+
+	for _, entry := range people {
+		if r, ok := parseMailboxEntry(entry, mail, &errs); ok {
+			rows = append(rows, r)
+		}
+	}
+
+	return s.importMailboxes(ctx, len(people), rows, errs, dryRun)
+}
+
+// parseMailboxEntry converts an inetOrgPerson entry: mail is the identifier,
+// cn the full name, title the job title and departmentNumber the department.
+func parseMailboxEntry(entry ldif.Entry, mail map[string]string, errs *importErrors) (importRow[model.Mailbox], bool) {
+	row := entry.Line
+	mailbox := model.Mailbox{
+		Identifier:   strings.TrimSpace(entry.First("mail")),
+		UserFullName: strings.TrimSpace(entry.First("cn")),
+		JobTitle:     strings.TrimSpace(entry.First("title")),
+	}
+
+	departmentNumber := strings.TrimSpace(entry.First("departmentNumber"))
+	departmentID, err := strconv.Atoi(departmentNumber)
+	if err != nil {
+		errs.add(row, mailbox.Identifier, "department_id", "departmentNumber %q is not a number", departmentNumber)
+		return importRow[model.Mailbox]{}, false
+	}
+	mailbox.DepartmentID = departmentID
+
+	if manager := strings.TrimSpace(entry.First("manager")); manager != "" {
+		identifier, ok := managerIdentifier(manager, mail)
+		if !ok {
+			errs.add(row, mailbox.Identifier, "manager_mailbox_identifier", "manager %s is not a mailbox", manager)
+			return importRow[model.Mailbox]{}, false
+		}
+		mailbox.ManagerIdentifier = identifier
+	}
+
+	return importRow[model.Mailbox]{row: row, record: mailbox}, true
+}
+
+// managerIdentifier resolves a manager DN to a mailbox identifier.
+func managerIdentifier(dn string, mail map[string]string) (string, bool) {
+	normalized, err := ldif.NormalizeDN(dn)
+	if err != nil {
+		return "", false
+	}
+	if identifier, ok := mail[normalized]; ok && identifier != "" {
+		return identifier, true
+	}
+
+	rdns, _ := ldif.ParseDN(dn)
+	if len(rdns) > 0 && strings.EqualFold(rdns[0].Type, "mail") {
+		return rdns[0].Value, true
+	}
+	return "", false
+}
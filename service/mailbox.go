@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -13,11 +14,25 @@ import (
 type MailboxService interface {
 	GetMailboxes(ctx context.Context, filter model.MailboxFilter) (*model.MailboxResponse, error)
 	GetMailboxByIdentifier(ctx context.Context, identifier string) (*model.Mailbox, error)
+	CreateMailbox(ctx context.Context, input model.MailboxInput) (*model.Mailbox, error)
+	ReplaceMailbox(ctx context.Context, identifier string, input model.MailboxInput) (*model.Mailbox, error)
+	PatchMailbox(ctx context.Context, identifier string, patch model.MailboxPatch) (*model.Mailbox, error)
+	DeleteMailbox(ctx context.Context, identifier string) error
+	SetMailboxActive(ctx context.Context, identifier string, active bool) (*model.Mailbox, error)
 	CalculateOrgMetrics(ctx context.Context) error
-	GetMailboxesInSubOrg(ctx context.Context, role string, filter model.MailboxFilter) (*model.MailboxResponse, error)
+	GetMailboxByJobTitle(ctx context.Context, jobTitle string) (*model.Mailbox, error)
+	GetMailboxesInSubOrg(ctx context.Context, managerIdentifier string, filter model.MailboxFilter) (*model.MailboxResponse, error)
+	StreamMailboxes(ctx context.Context, subOrgOf string, filter model.MailboxFilter, fn func(model.Mailbox) error) error
+	GetReportingChain(ctx context.Context, identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error)
+	GetReports(ctx context.Context, identifier string, recursive bool, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error)
+	GetPeers(ctx context.Context, identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error)
 	IsMailboxInSubOrg(ctx context.Context, managerIdentifier string, mailboxIdentifier string) (bool, error)
-	ImportMailboxesFromCSV(ctx context.Context, csvData string) error
-	ImportDepartmentsFromCSV(ctx context.Context, csvData string) error
+	ImportMailboxesFromCSV(ctx context.Context, csvData string, dryRun bool) (*model.ImportResult, error)
+	ImportMailboxesFromJSON(ctx context.Context, jsonData string, dryRun bool) (*model.ImportResult, error)
+	ImportMailboxesFromNDJSON(ctx context.Context, ndjsonData string, dryRun bool) (*model.ImportResult, error)
+	ImportMailboxesFromTree(ctx context.Context, jsonData string, dryRun bool) (*model.ImportResult, error)
+	ImportMailboxesFromLDIF(ctx context.Context, ldifData string, dryRun bool) (*model.ImportResult, error)
+	ImportDepartmentsFromCSV(ctx context.Context, csvData string, dryRun bool) (*model.ImportResult, error)
 }
 
 type mailboxService struct {
@@ -71,233 +86,316 @@ func (s *mailboxService) GetMailboxByIdentifier(ctx context.Context, identifier
 	return mailbox, nil
 }
 
-func (s *mailboxService) GetMailboxesByRole(ctx context.Context, role string) ([]model.Mailbox, error) {
-	mailboxes, err := s.mailboxRepo.GetMailboxesByRole(ctx, role)
+func (s *mailboxService) CreateMailbox(ctx context.Context, input model.MailboxInput) (*model.Mailbox, error) {
+	mailbox := mailboxFromInput(input)
+	mailbox.Active = input.Active == nil || *input.Active
+
+	if mailbox.Identifier == "" {
+		return nil, newValidationError("mailbox_identifier", "is required")
+	}
+	if !strings.Contains(mailbox.Identifier, "@") {
+		return nil, newValidationError("mailbox_identifier", "must be an email address")
+	}
+
+	existing, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, mailbox.Identifier)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get mailboxes by role: %w", err)
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if existing != nil {
+		return nil, ErrMailboxExists
 	}
 
-	return mailboxes, nil
+	if err := s.validateMailbox(ctx, mailbox); err != nil {
+		return nil, err
+	}
+
+	if err := s.mailboxRepo.CreateMailbox(ctx, mailbox); err != nil {
+		return nil, fmt.Errorf("failed to create mailbox: %w", err)
+	}
+
+	return s.GetMailboxByIdentifier(ctx, mailbox.Identifier)
 }
 
-func (s *mailboxService) CalculateOrgMetrics(ctx context.Context) error {
-	if err := s.mailboxRepo.CalculateOrgMetrics(ctx); err != nil {
-		return fmt.Errorf("failed to calculate org metrics: %w", err)
+func (s *mailboxService) ReplaceMailbox(ctx context.Context, identifier string, input model.MailboxInput) (*model.Mailbox, error) {
+	if input.Identifier != "" && input.Identifier != identifier {
+		return nil, newValidationError("mailbox_identifier", "cannot be changed")
 	}
-	return nil
+	input.Identifier = identifier
+
+	return s.updateMailbox(ctx, mailboxFromInput(input))
 }
 
-func (s *mailboxService) GetMailboxesInSubOrg(ctx context.Context, role string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
-	mailboxesByRole, err := s.GetMailboxesByRole(ctx, role)
+func (s *mailboxService) PatchMailbox(ctx context.Context, identifier string, patch model.MailboxPatch) (*model.Mailbox, error) {
+	existing, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, identifier)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get manager: %w", err)
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if existing == nil {
+		return nil, ErrMailboxNotFound
 	}
 
-	if len(mailboxesByRole) == 0 {
-		return nil, fmt.Errorf("manager not found: %s", role)
+	mailbox := *existing
+	if patch.UserFullName != nil {
+		mailbox.UserFullName = strings.TrimSpace(*patch.UserFullName)
 	}
+	if patch.JobTitle != nil {
+		mailbox.JobTitle = strings.TrimSpace(*patch.JobTitle)
+	}
+	if patch.DepartmentID != nil {
+		mailbox.DepartmentID = *patch.DepartmentID
+	}
+	if patch.ManagerIdentifier != nil {
+		mailbox.ManagerIdentifier = strings.TrimSpace(*patch.ManagerIdentifier)
+	}
+
+	return s.updateMailbox(ctx, mailbox)
+}
 
-	allMailboxes, err := s.mailboxRepo.GetAllMailboxes(ctx)
+func (s *mailboxService) updateMailbox(ctx context.Context, mailbox model.Mailbox) (*model.Mailbox, error) {
+	existing, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, mailbox.Identifier)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get all mailboxes: %w", err)
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
 	}
-
-	mailboxMap := make(map[string]*model.Mailbox)
-	for i := range allMailboxes {
-		mailboxMap[allMailboxes[i].Identifier] = &allMailboxes[i]
+	if existing == nil {
+		return nil, ErrMailboxNotFound
 	}
 
-	subOrgMailboxes := []model.Mailbox{}
-	findSubOrg(mailboxesByRole[0].Identifier, mailboxMap, &subOrgMailboxes)
+	if err := s.validateMailbox(ctx, mailbox); err != nil {
+		return nil, err
+	}
 
-	filteredMailboxes := []model.Mailbox{}
-	for _, mailbox := range subOrgMailboxes {
-		if filter.SearchTerm != "" {
-			searchTerm := strings.ToLower(filter.SearchTerm)
-			if !strings.Contains(strings.ToLower(mailbox.UserFullName), searchTerm) &&
-				!strings.Contains(strings.ToLower(mailbox.JobTitle), searchTerm) &&
-				!strings.Contains(strings.ToLower(mailbox.Department), searchTerm) {
-				continue
-			}
+	if mailbox.ManagerIdentifier != "" && mailbox.ManagerIdentifier != existing.ManagerIdentifier {
+		inSubOrg, err := s.IsMailboxInSubOrg(ctx, mailbox.Identifier, mailbox.ManagerIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check reporting line: %w", err)
 		}
-
-		if filter.Department != 0 && mailbox.DepartmentID != filter.Department {
-			continue
+		if inSubOrg {
+			return nil, newValidationError("manager_mailbox_identifier", "would create a reporting cycle because %s reports to %s", mailbox.ManagerIdentifier, mailbox.Identifier)
 		}
+	}
 
-		if filter.OrgDepthExact != nil && mailbox.OrgDepth != *filter.OrgDepthExact {
-			continue
-		}
-		if filter.OrgDepthGt != nil && mailbox.OrgDepth <= *filter.OrgDepthGt {
-			continue
-		}
-		if filter.OrgDepthLt != nil && mailbox.OrgDepth >= *filter.OrgDepthLt {
-			continue
+	// The check above gives the usual error early; the repository repeats it
+	// with the reporting line locked, which catches concurrent moves
+	if err := s.mailboxRepo.UpdateMailbox(ctx, mailbox); err != nil {
+		if errors.Is(err, repository.ErrReportingCycle) {
+			return nil, newValidationError("manager_mailbox_identifier", "would create a reporting cycle because %s reports to %s", mailbox.ManagerIdentifier, mailbox.Identifier)
 		}
+		return nil, fmt.Errorf("failed to update mailbox: %w", err)
+	}
 
-		if filter.SubOrgSizeMin != nil && mailbox.SubOrgSize < *filter.SubOrgSizeMin {
-			continue
-		}
-		if filter.SubOrgSizeMax != nil && mailbox.SubOrgSize > *filter.SubOrgSizeMax {
-			continue
-		}
+	return s.GetMailboxByIdentifier(ctx, mailbox.Identifier)
+}
 
-		filteredMailboxes = append(filteredMailboxes, mailbox)
+func (s *mailboxService) DeleteMailbox(ctx context.Context, identifier string) error {
+	existing, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if existing == nil {
+		return ErrMailboxNotFound
 	}
 
-	if filter.PageSize <= 0 {
-		filter.PageSize = 10
+	reports, err := s.mailboxRepo.GetDirectReports(ctx, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to get direct reports: %w", err)
 	}
-	if filter.Page <= 0 {
-		filter.Page = 1
+	if len(reports) > 0 {
+		return ErrMailboxHasReports
 	}
 
-	totalCount := len(filteredMailboxes)
-	startIndex := (filter.Page - 1) * filter.PageSize
-	endIndex := startIndex + filter.PageSize
-	if endIndex > totalCount {
-		endIndex = totalCount
+	if err := s.mailboxRepo.DeleteMailbox(ctx, identifier); err != nil {
+		return fmt.Errorf("failed to delete mailbox: %w", err)
 	}
 
-	var pagedMailboxes []model.Mailbox
-	if startIndex < totalCount {
-		pagedMailboxes = filteredMailboxes[startIndex:endIndex]
-	} else {
-		pagedMailboxes = []model.Mailbox{}
-	}
+	return nil
+}
 
-	totalPages := (totalCount + filter.PageSize - 1) / filter.PageSize
-	pagination := &model.Pagination{
-		Page:       filter.Page,
-		PageSize:   filter.PageSize,
-		TotalItems: totalCount,
-		TotalPages: totalPages,
+// SetMailboxActive deactivates a mailbox, as for a leaver whose mailbox is
+// kept, or activates it again.
+func (s *mailboxService) SetMailboxActive(ctx context.Context, identifier string, active bool) (*model.Mailbox, error) {
+	existing, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if existing == nil {
+		return nil, ErrMailboxNotFound
 	}
 
-	var result interface{} = pagedMailboxes
-	if len(filter.Fields) > 0 {
-		result = dto.FilterMailboxFields(pagedMailboxes, filter.Fields)
+	if existing.Active != active {
+		if err := s.mailboxRepo.SetMailboxActive(ctx, identifier, active); err != nil {
+			return nil, fmt.Errorf("failed to set mailbox active: %w", err)
+		}
 	}
 
-	return dto.NewMailboxResponse(result, pagination), nil
+	return s.GetMailboxByIdentifier(ctx, identifier)
 }
 
-func (s *mailboxService) IsMailboxInSubOrg(ctx context.Context, managerIdentifier string, mailboxIdentifier string) (bool, error) {
-	if managerIdentifier == mailboxIdentifier {
-		return true, nil // Manager can see their own mailbox
+// validateMailbox checks the fields shared by create and update.
+func (s *mailboxService) validateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	if mailbox.UserFullName == "" {
+		return newValidationError("user_full_name", "is required")
+	}
+	if mailbox.JobTitle == "" {
+		return newValidationError("job_title", "is required")
 	}
 
-	allMailboxes, err := s.mailboxRepo.GetAllMailboxes(ctx)
+	department, err := s.departmentRepo.GetDepartmentByID(ctx, mailbox.DepartmentID)
 	if err != nil {
-		return false, fmt.Errorf("failed to get all mailboxes: %w", err)
+		return fmt.Errorf("failed to get department: %w", err)
 	}
-
-	mailboxMap := make(map[string]*model.Mailbox)
-	for i := range allMailboxes {
-		mailboxMap[allMailboxes[i].Identifier] = &allMailboxes[i]
+	if department == nil {
+		return newValidationError("department_id", "department %d does not exist", mailbox.DepartmentID)
 	}
 
-	subOrgMailboxIdentifiers := make(map[string]bool)
-	var subOrgMailboxes []model.Mailbox
-	findSubOrg(managerIdentifier, mailboxMap, &subOrgMailboxes)
+	if mailbox.ManagerIdentifier == "" {
+		return nil
+	}
+	if mailbox.ManagerIdentifier == mailbox.Identifier {
+		return newValidationError("manager_mailbox_identifier", "a mailbox cannot manage itself")
+	}
 
-	for _, mailbox := range subOrgMailboxes {
-		subOrgMailboxIdentifiers[mailbox.Identifier] = true
+	manager, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, mailbox.ManagerIdentifier)
+	if err != nil {
+		return fmt.Errorf("failed to get manager: %w", err)
+	}
+	if manager == nil {
+		return newValidationError("manager_mailbox_identifier", "mailbox %s does not exist", mailbox.ManagerIdentifier)
 	}
 
-	return subOrgMailboxIdentifiers[mailboxIdentifier], nil
+	return nil
 }
 
-func findSubOrg(managerID string, mailboxMap map[string]*model.Mailbox, result *[]model.Mailbox) {
-	for id, mailbox := range mailboxMap {
-		if mailbox.ManagerIdentifier == managerID {
-			*result = append(*result, *mailbox)
-			findSubOrg(id, mailboxMap, result)
-		}
+func mailboxFromInput(input model.MailboxInput) model.Mailbox {
+	return model.Mailbox{
+		Identifier:        strings.TrimSpace(input.Identifier),
+		UserFullName:      strings.TrimSpace(input.UserFullName),
+		JobTitle:          strings.TrimSpace(input.JobTitle),
+		DepartmentID:      input.DepartmentID,
+		ManagerIdentifier: strings.TrimSpace(input.ManagerIdentifier),
 	}
 }
 
-func (s *mailboxService) ImportMailboxesFromCSV(ctx context.Context, csvData string) error {
-	lines := strings.Split(csvData, "\n")
-	if len(lines) < 2 {
-		return fmt.Errorf("invalid CSV data: no data rows found")
+func (s *mailboxService) GetMailboxesByRole(ctx context.Context, role string) ([]model.Mailbox, error) {
+	mailboxes, err := s.mailboxRepo.GetMailboxesByRole(ctx, role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailboxes by role: %w", err)
 	}
 
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
-		}
+	return mailboxes, nil
+}
 
-		fields := strings.Split(line, ",")
-		if len(fields) < 5 {
-			return fmt.Errorf("invalid CSV line at row %d: expected 5 fields, got %d", i+1, len(fields))
-		}
+func (s *mailboxService) CalculateOrgMetrics(ctx context.Context) error {
+	if err := s.mailboxRepo.CalculateOrgMetrics(ctx); err != nil {
+		return fmt.Errorf("failed to calculate org metrics: %w", err)
+	}
+	return nil
+}
 
-		var departmentID int
-		_, err := fmt.Sscanf(fields[3], "%d", &departmentID)
-		if err != nil {
-			return fmt.Errorf("invalid department ID at row %d: %w", i+1, err)
-		}
+// GetMailboxByJobTitle returns the first mailbox whose job title matches, or
+// nil if there is none.
+func (s *mailboxService) GetMailboxByJobTitle(ctx context.Context, jobTitle string) (*model.Mailbox, error) {
+	mailboxes, err := s.GetMailboxesByRole(ctx, jobTitle)
+	if err != nil {
+		return nil, err
+	}
 
-		mailbox := model.Mailbox{
-			Identifier:        fields[0],
-			UserFullName:      fields[1],
-			JobTitle:          fields[2],
-			DepartmentID:      departmentID,
-			ManagerIdentifier: fields[4],
-			OrgDepth:          0,
-			SubOrgSize:        0,
-		}
+	if len(mailboxes) == 0 {
+		return nil, nil
+	}
 
-		if mailbox.ManagerIdentifier == "null" {
-			mailbox.ManagerIdentifier = ""
-		}
+	return &mailboxes[0], nil
+}
 
-		if err := s.mailboxRepo.CreateMailbox(ctx, mailbox); err != nil {
-			return fmt.Errorf("failed to create mailbox at row %d: %w", i+1, err)
-		}
+func (s *mailboxService) GetMailboxesInSubOrg(ctx context.Context, managerIdentifier string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+	filter.SubOrgOf = managerIdentifier
+
+	return s.GetMailboxes(ctx, filter)
+}
+
+// StreamMailboxes calls fn with every mailbox matching the filter as it is
+// read, ignoring pagination. A non-empty subOrgOf limits the mailboxes to
+// that mailbox's sub-org, as for callers scoped to their sub-org.
+func (s *mailboxService) StreamMailboxes(ctx context.Context, subOrgOf string, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	if subOrgOf != "" {
+		filter.SubOrgOf = subOrgOf
 	}
 
-	if err := s.CalculateOrgMetrics(ctx); err != nil {
-		return fmt.Errorf("failed to calculate org metrics: %w", err)
+	if err := s.mailboxRepo.StreamMailboxes(ctx, filter, fn); err != nil {
+		return fmt.Errorf("failed to stream mailboxes: %w", err)
 	}
 
 	return nil
 }
 
-func (s *mailboxService) ImportDepartmentsFromCSV(ctx context.Context, csvData string) error {
-	lines := strings.Split(csvData, "\n")
-	if len(lines) < 2 {
-		return fmt.Errorf("invalid CSV data: no data rows found")
+// GetReportingChain lists the managers above the mailbox, nearest first
+// unless the filter sorts otherwise. A non-empty subOrgOf limits the result
+// to that mailbox's sub-org, as for callers scoped to their sub-org.
+func (s *mailboxService) GetReportingChain(ctx context.Context, identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+	if err := s.requireMailbox(ctx, identifier); err != nil {
+		return nil, err
 	}
 
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
-		}
+	if len(filter.SortBy) == 0 {
+		filter.SortBy = []string{"org_depth"}
+		filter.SortDirections = []string{"desc"}
+	}
+	filter.AncestorsOf = identifier
+	filter.SubOrgOf = subOrgOf
 
-		fields := strings.Split(line, ",")
-		if len(fields) < 2 {
-			return fmt.Errorf("invalid CSV line at row %d: expected 2 fields, got %d", i+1, len(fields))
-		}
+	return s.GetMailboxes(ctx, filter)
+}
 
-		var departmentID int
-		_, err := fmt.Sscanf(fields[0], "%d", &departmentID)
-		if err != nil {
-			return fmt.Errorf("invalid department ID at row %d: %w", i+1, err)
-		}
+// GetReports lists the direct reports of the mailbox or, if recursive, its
+// whole sub-org. subOrgOf is applied as for GetReportingChain; the caller is
+// expected to have checked that the mailbox itself is within it.
+func (s *mailboxService) GetReports(ctx context.Context, identifier string, recursive bool, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+	if err := s.requireMailbox(ctx, identifier); err != nil {
+		return nil, err
+	}
 
-		department := model.Department{
-			ID:   departmentID,
-			Name: fields[1],
-		}
+	if recursive {
+		filter.SubOrgOf = identifier
+	} else {
+		filter.ReportsTo = identifier
+		filter.SubOrgOf = subOrgOf
+	}
 
-		if err := s.departmentRepo.CreateDepartment(ctx, department); err != nil {
-			return fmt.Errorf("failed to create department at row %d: %w", i+1, err)
-		}
+	return s.GetMailboxes(ctx, filter)
+}
+
+// GetPeers lists the other mailboxes with the same manager. Mailboxes
+// without a manager have no peers.
+func (s *mailboxService) GetPeers(ctx context.Context, identifier string, subOrgOf string, filter model.MailboxFilter) (*model.MailboxResponse, error) {
+	if err := s.requireMailbox(ctx, identifier); err != nil {
+		return nil, err
 	}
 
+	filter.PeersOf = identifier
+	filter.SubOrgOf = subOrgOf
+
+	return s.GetMailboxes(ctx, filter)
+}
+
+func (s *mailboxService) requireMailbox(ctx context.Context, identifier string) error {
+	mailbox, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, identifier)
+	if err != nil {
+		return fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if mailbox == nil {
+		return ErrMailboxNotFound
+	}
 	return nil
 }
+
+func (s *mailboxService) IsMailboxInSubOrg(ctx context.Context, managerIdentifier string, mailboxIdentifier string) (bool, error) {
+	if managerIdentifier == mailboxIdentifier {
+		return true, nil // Manager can see their own mailbox
+	}
+
+	inSubOrg, err := s.mailboxRepo.IsInSubOrg(ctx, managerIdentifier, mailboxIdentifier)
+	if err != nil {
+		return false, fmt.Errorf("failed to check sub-org membership: %w", err)
+	}
+
+	return inSubOrg, nil
+}
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"mailbox-api/dto"
+	"mailbox-api/model"
+	"mailbox-api/orgchart"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+)
+
+type OrgService interface {
+	CheckIntegrity(ctx context.Context) (*model.OrgIntegrityReport, error)
+	GetTree(ctx context.Context, scope string, identity string, root string, depth int, fields []string) (interface{}, error)
+	ExportTree(ctx context.Context, scope string, identity string, root string, depth int, options orgchart.ExportOptions) ([]byte, error)
+	LayoutTree(ctx context.Context, scope string, identity string, root string, depth int, options orgchart.LayoutOptions) (*orgchart.Layout, error)
+	GetRelationship(ctx context.Context, scope string, identity string, a string, b string) (*model.OrgRelationship, error)
+}
+
+type orgService struct {
+	mailboxRepo repository.MailboxRepository
+}
+
+func NewOrgService(mailboxRepo repository.MailboxRepository) OrgService {
+	return &orgService{
+		mailboxRepo: mailboxRepo,
+	}
+}
+
+// CheckIntegrity loads the whole directory and reports reporting cycles,
+// managers that do not exist, roots other than the top of the org, and
+// mailboxes whose stored metrics differ from the recomputed ones.
+func (s *orgService) CheckIntegrity(ctx context.Context) (*model.OrgIntegrityReport, error) {
+	mailboxes, err := s.mailboxRepo.GetAllMailboxes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all mailboxes: %w", err)
+	}
+
+	graph := orggraph.New(mailboxes)
+	depths, subOrgSizes := graph.Metrics()
+
+	report := &model.OrgIntegrityReport{
+		TotalMailboxes:   len(mailboxes),
+		Cycles:           graph.Cycles(),
+		DanglingManagers: []model.DanglingManager{},
+		OrphanedRoots:    []string{},
+		MetricMismatches: []model.OrgMetricMismatch{},
+	}
+
+	for _, mailbox := range graph.DanglingManagers() {
+		report.DanglingManagers = append(report.DanglingManagers, model.DanglingManager{
+			Identifier:        mailbox.Identifier,
+			ManagerIdentifier: mailbox.ManagerIdentifier,
+		})
+	}
+
+	// Every mailbox without a manager other than the top of the org is
+	// orphaned.
+	topRoot := topOfOrg(graph, subOrgSizes)
+	for _, root := range graph.Roots() {
+		mailbox, _ := graph.Get(root)
+		if mailbox.ManagerIdentifier == "" && root != topRoot {
+			report.OrphanedRoots = append(report.OrphanedRoots, root)
+		}
+	}
+
+	for _, mailbox := range mailboxes {
+		depth := depths[mailbox.Identifier]
+		size := subOrgSizes[mailbox.Identifier]
+		if mailbox.OrgDepth != depth || mailbox.SubOrgSize != size {
+			report.MetricMismatches = append(report.MetricMismatches, model.OrgMetricMismatch{
+				Identifier:         mailbox.Identifier,
+				StoredOrgDepth:     mailbox.OrgDepth,
+				ExpectedOrgDepth:   depth,
+				StoredSubOrgSize:   mailbox.SubOrgSize,
+				ExpectedSubOrgSize: size,
+			})
+		}
+	}
+
+	report.Healthy = len(report.Cycles) == 0 &&
+		len(report.DanglingManagers) == 0 &&
+		len(report.OrphanedRoots) == 0 &&
+		len(report.MetricMismatches) == 0
+
+	return report, nil
+}
+
+// GetTree returns the org chart below root as nested nodes, down to depth
+// levels (negative for no limit), projected onto fields if any are given.
+// Without a root the tree starts at the top of the org for callers who can
+// read everything and at the caller's own mailbox otherwise. Callers limited
+// to their own mailbox get only that mailbox.
+func (s *orgService) GetTree(ctx context.Context, scope string, identity string, root string, depth int, fields []string) (interface{}, error) {
+	tree, err := s.tree(ctx, scope, identity, root, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 {
+		return dto.FilterOrgTreeFields(tree, fields), nil
+	}
+
+	return tree, nil
+}
+
+// ExportTree renders the same tree as GetTree in one of the orgchart export
+// formats.
+func (s *orgService) ExportTree(ctx context.Context, scope string, identity string, root string, depth int, options orgchart.ExportOptions) ([]byte, error) {
+	if !orgchart.IsFormat(options.Format) {
+		return nil, newValidationError("format", "must be one of %s", strings.Join(orgchart.Formats, ", "))
+	}
+
+	tree, err := s.tree(ctx, scope, identity, root, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := orgchart.Export(&b, tree, options); err != nil {
+		return nil, fmt.Errorf("failed to export org chart: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// LayoutTree computes coordinates for drawing the same tree as GetTree. The
+// node sizes and spacings must be positive, finite numbers.
+func (s *orgService) LayoutTree(ctx context.Context, scope string, identity string, root string, depth int, options orgchart.LayoutOptions) (*orgchart.Layout, error) {
+	for _, size := range []struct {
+		field string
+		value float64
+	}{
+		{"node_width", options.NodeWidth},
+		{"node_height", options.NodeHeight},
+		{"sibling_spacing", options.SiblingSpacing},
+		{"level_spacing", options.LevelSpacing},
+	} {
+		if math.IsNaN(size.value) || math.IsInf(size.value, 0) || size.value <= 0 {
+			return nil, newValidationError(size.field, "must be a positive number")
+		}
+	}
+
+	switch {
+	case options.CollapseAbove < 0:
+		return nil, newValidationError("collapse_above", "must not be negative")
+	case options.Orientation != orgchart.OrientationVertical && options.Orientation != orgchart.OrientationHorizontal:
+		return nil, newValidationError("orientation", "must be %s or %s", orgchart.OrientationVertical, orgchart.OrientationHorizontal)
+	}
+
+	tree, err := s.tree(ctx, scope, identity, root, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	return orgchart.NewLayout(tree, options), nil
+}
+
+// tree reads only the root and its sub-org, rather than the whole
+// directory, and nests them.
+func (s *orgService) tree(ctx context.Context, scope string, identity string, root string, depth int) (*model.OrgTreeNode, error) {
+	if scope == model.ScopeNone {
+		return nil, ErrOutOfScope
+	}
+	if root == "" && scope != model.ScopeAll {
+		root = identity
+	}
+
+	if root == "" {
+		top, err := s.topOfOrgByMetrics(ctx)
+		if err != nil {
+			return nil, err
+		}
+		root = top
+	}
+
+	allowed, err := s.inScope(ctx, scope, identity, root)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrOutOfScope
+	}
+	if scope == model.ScopeSelf {
+		depth = 0
+	}
+
+	mailbox, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if mailbox == nil {
+		return nil, ErrMailboxNotFound
+	}
+
+	mailboxes := []model.Mailbox{*mailbox}
+	if depth != 0 {
+		filter := model.MailboxFilter{
+			SubOrgOf:       root,
+			SortBy:         []string{"mailbox_identifier"},
+			SortDirections: []string{"asc"},
+		}
+		err := s.mailboxRepo.StreamMailboxes(ctx, filter, func(mailbox model.Mailbox) error {
+			mailboxes = append(mailboxes, mailbox)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to stream mailboxes: %w", err)
+		}
+	}
+
+	tree, _ := orggraph.New(mailboxes).Tree(root, depth)
+	return tree, nil
+}
+
+// topOfOrgByMetrics returns the top-level mailbox with the largest stored
+// sub-org size, reading only the mailboxes at the top of the org.
+func (s *orgService) topOfOrgByMetrics(ctx context.Context) (string, error) {
+	topLevel := 0
+	filter := model.MailboxFilter{OrgDepthExact: &topLevel}
+
+	top := ""
+	topSize := 0
+	err := s.mailboxRepo.StreamMailboxes(ctx, filter, func(mailbox model.Mailbox) error {
+		if mailbox.ManagerIdentifier == "" && (top == "" || mailbox.SubOrgSize > topSize) {
+			top, topSize = mailbox.Identifier, mailbox.SubOrgSize
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to stream mailboxes: %w", err)
+	}
+	if top == "" {
+		return "", ErrMailboxNotFound
+	}
+
+	return top, nil
+}
+
+// GetRelationship finds the lowest common manager of two mailboxes and the
+// path between them from the management chains in the closure table, the
+// same data the sub-org checks use. Both mailboxes must be within the
+// caller's scope.
+func (s *orgService) GetRelationship(ctx context.Context, scope string, identity string, a string, b string) (*model.OrgRelationship, error) {
+	for _, identifier := range []string{a, b} {
+		allowed, err := s.inScope(ctx, scope, identity, identifier)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, ErrOutOfScope
+		}
+	}
+
+	chainA, err := s.chainFrom(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	chainB, err := s.chainFrom(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	relationship := &model.OrgRelationship{
+		A:    a,
+		B:    b,
+		Path: []model.Mailbox{},
+	}
+
+	// Each chain starts with the mailbox itself, so the first entry of B's
+	// chain that also appears in A's is the lowest common manager
+	positionInA := make(map[string]int, len(chainA))
+	for i, mailbox := range chainA {
+		positionInA[mailbox.Identifier] = i
+	}
+
+	for j, mailbox := range chainB {
+		i, ok := positionInA[mailbox.Identifier]
+		if !ok {
+			continue
+		}
+
+		common := mailbox
+		distance := i + j
+		relationship.LowestCommonManager = &common
+		relationship.Distance = &distance
+		relationship.AInSubOrgOfB = j == 0 && i > 0
+		relationship.BInSubOrgOfA = i == 0 && j > 0
+
+		relationship.Path = append(relationship.Path, chainA[:i+1]...)
+		for k := j - 1; k >= 0; k-- {
+			relationship.Path = append(relationship.Path, chainB[k])
+		}
+		break
+	}
+
+	return relationship, nil
+}
+
+// chainFrom returns the mailbox followed by its managers, nearest first.
+func (s *orgService) chainFrom(ctx context.Context, identifier string) ([]model.Mailbox, error) {
+	mailbox, err := s.mailboxRepo.GetMailboxByIdentifier(ctx, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox: %w", err)
+	}
+	if mailbox == nil {
+		return nil, ErrMailboxNotFound
+	}
+
+	ancestors, err := s.mailboxRepo.GetAncestors(ctx, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	return append([]model.Mailbox{*mailbox}, ancestors...), nil
+}
+
+// inScope reports whether a caller with the given scope can read the mailbox.
+func (s *orgService) inScope(ctx context.Context, scope string, identity string, identifier string) (bool, error) {
+	switch scope {
+	case model.ScopeAll:
+		return true, nil
+	case model.ScopeSubOrg:
+		if identifier == identity {
+			return true, nil
+		}
+		inSubOrg, err := s.mailboxRepo.IsInSubOrg(ctx, identity, identifier)
+		if err != nil {
+			return false, fmt.Errorf("failed to check sub-org membership: %w", err)
+		}
+		return inSubOrg, nil
+	case model.ScopeSelf:
+		return identifier == identity, nil
+	default:
+		return false, nil
+	}
+}
+
+// topOfOrg returns the mailbox without a manager that has the largest
+// sub-org, which is taken to be the top of the org.
+func topOfOrg(graph *orggraph.Graph, subOrgSizes map[string]int) string {
+	topRoot := ""
+	for _, root := range graph.Roots() {
+		mailbox, _ := graph.Get(root)
+		if mailbox.ManagerIdentifier != "" {
+			continue
+		}
+		if topRoot == "" || subOrgSizes[root] > subOrgSizes[topRoot] {
+			topRoot = root
+		}
+	}
+	return topRoot
+}
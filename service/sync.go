@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"mailbox-api/model"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+)
+
+var (
+	ErrPlanNotFound   = errors.New("import plan not found")
+	ErrPlanNotPending = errors.New("import plan is not pending")
+	ErrPlanStale      = errors.New("directory changed since the import plan was created")
+)
+
+// SyncService reconciles the directory with a full roster, such as a nightly
+// HR extract. Syncing computes a plan of the changes; the plan is stored for
+// review and applied later in one transaction.
+type SyncService interface {
+	SyncMailboxesFromCSV(ctx context.Context, csvData string, dryRun bool, createdBy string) (*model.ImportResult, error)
+	GetPlan(ctx context.Context, id string) (*model.ImportPlan, error)
+	ListPlans(ctx context.Context) ([]model.ImportPlan, error)
+	ApplyPlan(ctx context.Context, id string) (*model.ImportPlan, error)
+}
+
+type syncService struct {
+	mailboxRepo    repository.MailboxRepository
+	departmentRepo repository.DepartmentRepository
+	planRepo       repository.ImportPlanRepository
+}
+
+func NewSyncService(mailboxRepo repository.MailboxRepository, departmentRepo repository.DepartmentRepository, planRepo repository.ImportPlanRepository) SyncService {
+	return &syncService{
+		mailboxRepo:    mailboxRepo,
+		departmentRepo: departmentRepo,
+		planRepo:       planRepo,
+	}
+}
+
+// SyncMailboxesFromCSV compares the roster with the directory and plans to
+// add the mailboxes that are new, update or move the ones that changed, and
+// deactivate the active ones missing from the roster. The roster is complete,
+// so every manager must be in it. Unless this is a dry run or a row has
+// errors, the plan is stored as pending.
+func (s *syncService) SyncMailboxesFromCSV(ctx context.Context, csvData string, dryRun bool, createdBy string) (*model.ImportResult, error) {
+	records, err := parseImportCSV(csvData, mailboxColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	departments, err := departmentNames(ctx, s.departmentRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := importErrors{}
+	seen := make(map[string]int, len(records))
+	roster := []importRow[model.Mailbox]{}
+
+	for i, record := range records {
+		r, ok := parseMailboxRecord(i+2, record, &errs)
+		if !ok {
+			continue
+		}
+		before := len(errs)
+		checkMailboxRow(r, seen, departments, &errs)
+		if len(errs) == before {
+			r.record.Department = departments[r.record.DepartmentID]
+			r.record.Active = true
+			roster = append(roster, r)
+		}
+	}
+
+	for _, r := range roster {
+		manager := r.record.ManagerIdentifier
+		if manager != "" && seen[manager] == 0 {
+			errs.add(r.row, r.record.Identifier, "manager_mailbox_identifier", "mailbox %s is not in the file", manager)
+		}
+	}
+	checkCycles(recordsOf(roster), seen, &errs)
+
+	result := &model.ImportResult{
+		DryRun: dryRun,
+		Rows:   len(records),
+		Errors: errs,
+	}
+	if len(errs) > 0 {
+		return result, nil
+	}
+
+	existing, err := s.mailboxRepo.GetAllMailboxes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all mailboxes: %w", err)
+	}
+
+	plan := diffRoster(existing, recordsOf(roster))
+	plan.DirectoryVersion = repository.DirectoryVersion(existing)
+	plan.Status = model.PlanPending
+	plan.CreatedBy = createdBy
+	result.Plan = plan
+
+	if dryRun {
+		return result, nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate plan ID: %w", err)
+	}
+	plan.ID = hex.EncodeToString(id)
+
+	if err := s.planRepo.CreatePlan(ctx, *plan); err != nil {
+		return nil, fmt.Errorf("failed to create import plan: %w", err)
+	}
+
+	stored, err := s.planRepo.GetPlan(ctx, plan.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import plan: %w", err)
+	}
+	result.Plan = stored
+
+	return result, nil
+}
+
+// diffRoster plans the changes from the stored mailboxes to the roster.
+// Additions, updates and moves follow the reporting lines of the roster from
+// the top down, so added managers come before their reports; deactivations
+// come last.
+func diffRoster(existing []model.Mailbox, roster []model.Mailbox) *model.ImportPlan {
+	plan := &model.ImportPlan{Changes: []model.PlanChange{}}
+
+	stored := make(map[string]model.Mailbox, len(existing))
+	for _, mailbox := range existing {
+		stored[mailbox.Identifier] = mailbox
+	}
+
+	graph := orggraph.New(roster)
+	for _, identifier := range graph.TopologicalOrder() {
+		after, _ := graph.Get(identifier)
+
+		before, ok := stored[identifier]
+		if !ok {
+			plan.Changes = append(plan.Changes, model.PlanChange{
+				Action:     model.ChangeAdd,
+				Identifier: identifier,
+				After:      after,
+			})
+			plan.Summary.Add++
+			continue
+		}
+
+		fields := changedFields(before, *after)
+		if len(fields) == 0 {
+			plan.Summary.Unchanged++
+			continue
+		}
+
+		action := model.ChangeUpdate
+		for _, field := range fields {
+			if field == "manager_mailbox_identifier" {
+				action = model.ChangeMove
+			}
+		}
+		if action == model.ChangeMove {
+			plan.Summary.Move++
+		} else {
+			plan.Summary.Update++
+		}
+
+		plan.Changes = append(plan.Changes, model.PlanChange{
+			Action:     action,
+			Identifier: identifier,
+			Fields:     fields,
+			Before:     &before,
+			After:      after,
+		})
+	}
+
+	for _, mailbox := range existing {
+		if _, ok := graph.Get(mailbox.Identifier); ok || !mailbox.Active {
+			continue
+		}
+		before := mailbox
+		plan.Changes = append(plan.Changes, model.PlanChange{
+			Action:     model.ChangeDeactivate,
+			Identifier: mailbox.Identifier,
+			Fields:     []string{"active"},
+			Before:     &before,
+		})
+		plan.Summary.Deactivate++
+	}
+
+	return plan
+}
+
+// changedFields lists the fields a sync can change that differ between the
+// two mailboxes.
+func changedFields(before model.Mailbox, after model.Mailbox) []string {
+	fields := []string{}
+	if before.UserFullName != after.UserFullName {
+		fields = append(fields, "user_full_name")
+	}
+	if before.JobTitle != after.JobTitle {
+		fields = append(fields, "job_title")
+	}
+	if before.DepartmentID != after.DepartmentID {
+		fields = append(fields, "department_id")
+	}
+	if before.ManagerIdentifier != after.ManagerIdentifier {
+		fields = append(fields, "manager_mailbox_identifier")
+	}
+	if before.Active != after.Active {
+		fields = append(fields, "active")
+	}
+	return fields
+}
+
+func (s *syncService) GetPlan(ctx context.Context, id string) (*model.ImportPlan, error) {
+	plan, err := s.planRepo.GetPlan(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import plan: %w", err)
+	}
+	if plan == nil {
+		return nil, ErrPlanNotFound
+	}
+	return plan, nil
+}
+
+func (s *syncService) ListPlans(ctx context.Context) ([]model.ImportPlan, error) {
+	plans, err := s.planRepo.ListPlans(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list import plans: %w", err)
+	}
+	return plans, nil
+}
+
+// ApplyPlan applies a pending plan. A plan is refused as stale if any mailbox
+// was added, removed or changed since it was computed, including the ones it
+// leaves unchanged; sync again to get a new plan.
+func (s *syncService) ApplyPlan(ctx context.Context, id string) (*model.ImportPlan, error) {
+	plan, err := s.GetPlan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Status != model.PlanPending {
+		return nil, ErrPlanNotPending
+	}
+
+	// The repository checks the plan against the directory it locks, so a
+	// concurrent write cannot slip in between the check and the apply
+	applied, err := s.planRepo.ApplyPlan(ctx, *plan)
+	if errors.Is(err, repository.ErrPlanStale) {
+		return nil, ErrPlanStale
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply import plan: %w", err)
+	}
+	if !applied {
+		return nil, ErrPlanNotPending
+	}
+
+	return s.GetPlan(ctx, id)
+}
@@ -1,46 +1,61 @@
 package test
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"mailbox-api/api/middleware"
 	"mailbox-api/api/router"
+	"mailbox-api/authz"
 	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
 	"mailbox-api/logger"
+	"mailbox-api/model"
 	"mailbox-api/service"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
 )
 
-func setupTestRouter() (*gin.Engine, *config.Config) {
+func setupTestRouter() (*gin.Engine, *config.Config, *jwtkeys.KeySet) {
 	// Load config
 	cfg, _ := config.Load()
 
 	// For testing, override JWT secret
 	cfg.Auth.JWTSecret = "test-secret-key"
+	cfg.Auth.DevMode = true
+
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
 
 	// Create logger
 	log := logger.NewLogger()
 
 	// Create service
 	mailboxService := service.NewMailboxService(testMailboxRepo, testDepartmentRepo)
+	orgService := service.NewOrgService(testMailboxRepo)
 
 	// Create router
-	r := router.SetupRouter(cfg, log, mailboxService)
+	r := router.SetupRouter(cfg, log, authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: mailboxService,
+		Org:     orgService,
+	})
 
-	return r.GetEngine(), cfg
+	return r.GetEngine(), cfg, keys
 }
 
 func TestGetToken(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	router, _ := setupTestRouter()
+	router, _, _ := setupTestRouter()
 
 	// Test CEO token endpoint
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/api/token/ceo", nil)
+	req, _ := http.NewRequest("GET", "/api/token/ceo?mailbox=isabella.white@falafel.org", nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -53,7 +68,7 @@ func TestGetToken(t *testing.T) {
 
 	// Test CTO token endpoint
 	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/api/token/cto", nil)
+	req, _ = http.NewRequest("GET", "/api/token/cto?mailbox=david.brown@falafel.org", nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -64,14 +79,164 @@ func TestGetToken(t *testing.T) {
 	assert.NotEmpty(t, response["token"])
 }
 
+func TestGetManagerToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router, cfg, _ := setupTestRouter()
+
+	// Roles missing from the policy are rejected
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/token/janitor?mailbox=bob.smith@falafel.org", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/token/manager?mailbox=bob.smith@falafel.org", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	claims := &middleware.Claims{}
+	_, err = jwt.ParseWithClaims(response["token"], claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.Auth.JWTSecret), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, authz.RoleManager, claims.Role)
+	assert.Equal(t, "bob.smith@falafel.org", claims.Subject)
+}
+
+func TestGetMe(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router, cfg, keys := setupTestRouter()
+
+	// Without a token
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/me", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A CEO token that is not bound to a mailbox sees everything
+	ceoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ceoToken))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var identity model.Identity
+	err := json.Unmarshal(w.Body.Bytes(), &identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "ceo", identity.Role)
+	assert.Equal(t, model.ScopeAll, identity.Scope)
+	assert.Contains(t, identity.Permissions, string(authz.PermMetricsRecalculate))
+	assert.Nil(t, identity.Mailbox)
+}
+
+func TestTokenEndpointRequiresDevMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	cfg.Auth.DevMode = false
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), jwtkeys.NewHMAC(cfg.Auth.JWTSecret), router.Services{
+		Mailbox: service.NewMailboxService(testMailboxRepo, testDepartmentRepo),
+		Org:     service.NewOrgService(testMailboxRepo),
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/token/ceo?mailbox=isabella.white@falafel.org", nil)
+	r.GetEngine().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestBootstrapCredentialRejectsWeakPasswords tests that the bootstrap
+// administrator cannot be created with a short, default or guessable
+// password. The checks run before the credential store is used.
+func TestBootstrapCredentialRejectsWeakPasswords(t *testing.T) {
+	authService := service.NewAuthService(nil, nil, time.Hour)
+
+	for _, password := range []string{"", "short-pass", "change-me-please", "CHANGE-ME-PLEASE", "administrator@corp"} {
+		err := authService.EnsureCredential(context.Background(), model.CredentialInput{
+			Username: "administrator@corp",
+			Password: password,
+			Role:     string(authz.RoleAdmin),
+		})
+		var validationErr *service.ValidationError
+		if assert.ErrorAs(t, err, &validationErr, password) {
+			assert.Equal(t, "password", validationErr.Field)
+		}
+	}
+}
+
+func TestAuthMiddlewareValidatesClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router, cfg, _ := setupTestRouter()
+
+	sign := func(claims *middleware.Claims) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.Auth.JWTSecret))
+		return token
+	}
+
+	valid := func() *middleware.Claims {
+		return &middleware.Claims{
+			Role: authz.RoleCEO,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "test-jti",
+				Issuer:    cfg.Auth.Issuer,
+				Audience:  jwt.ClaimStrings{cfg.Auth.Audience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+	}
+
+	wrongIssuer := valid()
+	wrongIssuer.Issuer = "someone-else"
+
+	wrongAudience := valid()
+	wrongAudience.Audience = jwt.ClaimStrings{"another-api"}
+
+	missingID := valid()
+	missingID.ID = ""
+
+	tests := []struct {
+		name   string
+		claims *middleware.Claims
+		status int
+	}{
+		{"valid", valid(), http.StatusOK},
+		{"wrong issuer", wrongIssuer, http.StatusUnauthorized},
+		{"wrong audience", wrongAudience, http.StatusUnauthorized},
+		{"missing jti", missingID, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/me", nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sign(tt.claims)))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
 // These are currently disabled, should populate data before testing these.
 // func TestGetMailboxes(t *testing.T) {
 // 	gin.SetMode(gin.TestMode)
-// 	router, cfg := setupTestRouter()
+// 	router, cfg, keys := setupTestRouter()
 
 // 	// Generate CEO and CTO tokens
-// 	ceoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCEO)
-// 	ctoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCTO)
+// 	ceoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "ceo@example.com")
+// 	ctoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCTO, "cto@example.com")
 
 // 	// Test CEO access - should see all mailboxes
 // 	w := httptest.NewRecorder()
@@ -111,11 +276,11 @@ func TestGetToken(t *testing.T) {
 
 // func TestGetMailbox(t *testing.T) {
 // 	gin.SetMode(gin.TestMode)
-// 	router, cfg := setupTestRouter()
+// 	router, cfg, keys := setupTestRouter()
 
 // 	// Generate CEO and CTO tokens
-// 	ceoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCEO)
-// 	ctoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCTO)
+// 	ceoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "ceo@example.com")
+// 	ctoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCTO, "cto@example.com")
 
 // 	// Test CEO access to any mailbox
 // 	w := httptest.NewRecorder()
@@ -152,11 +317,11 @@ func TestGetToken(t *testing.T) {
 
 // func TestCalculateOrgMetrics(t *testing.T) {
 // 	gin.SetMode(gin.TestMode)
-// 	router, cfg := setupTestRouter()
+// 	router, cfg, keys := setupTestRouter()
 
 // 	// Generate CEO and CTO tokens
-// 	ceoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCEO)
-// 	ctoToken, _ := middleware.GenerateToken(cfg, middleware.RoleCTO)
+// 	ceoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "ceo@example.com")
+// 	ctoToken, _ := middleware.GenerateToken(cfg, keys, authz.RoleCTO, "cto@example.com")
 
 // 	// Test CEO access to calculate metrics
 // 	w := httptest.NewRecorder()
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAPIKeyRepo keeps API keys in memory so the key flow can be tested
+// without a database.
+type memoryAPIKeyRepo struct {
+	keys map[string]model.APIKey
+}
+
+func newMemoryAPIKeyRepo() *memoryAPIKeyRepo {
+	return &memoryAPIKeyRepo{keys: map[string]model.APIKey{}}
+}
+
+func (r *memoryAPIKeyRepo) CreateAPIKey(ctx context.Context, key model.APIKey) error {
+	key.CreatedAt = time.Now()
+	r.keys[key.ID] = key
+	return nil
+}
+
+func (r *memoryAPIKeyRepo) GetAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (r *memoryAPIKeyRepo) ListAPIKeys(ctx context.Context) ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *memoryAPIKeyRepo) RevokeAPIKey(ctx context.Context, id string) (bool, error) {
+	key, ok := r.keys[id]
+	if !ok || key.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	r.keys[id] = key
+	return true, nil
+}
+
+func (r *memoryAPIKeyRepo) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	key := r.keys[id]
+	key.LastUsedAt = &usedAt
+	r.keys[id] = key
+	return nil
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryAPIKeyRepo()
+	keyService := service.NewAPIKeyService(repo, testMailboxRepo)
+	hr := authz.DefaultPolicy().Grants(authz.RoleHR)
+
+	created, err := keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:   "directory sync",
+		Scopes: []string{"mailbox:read:all", "mailbox:read:all"},
+	}, hr, "hr")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mailbox:read:all"}, created.Scopes)
+	assert.Contains(t, created.Key, service.APIKeyPrefix+created.ID+"_")
+	assert.NotContains(t, repo.keys[created.ID].KeyHash, created.Key)
+
+	// Scopes the creator does not hold cannot be granted
+	_, err = keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:   "escalation",
+		Scopes: []string{"metrics:recalculate"},
+	}, hr, "hr")
+	var validationErr *service.ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	_, err = keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:   "unknown",
+		Scopes: []string{"mailbox:delete"},
+	}, hr, "hr")
+	assert.ErrorAs(t, err, &validationErr)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:      "expired",
+		Scopes:    []string{"mailbox:read:all"},
+		ExpiresAt: &past,
+	}, hr, "hr")
+	assert.ErrorAs(t, err, &validationErr)
+
+	// Authentication records the last use and rejects tampered keys
+	key, err := keyService.AuthenticateAPIKey(ctx, created.Key)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.NotNil(t, repo.keys[created.ID].LastUsedAt)
+
+	key, err = keyService.AuthenticateAPIKey(ctx, created.Key+"x")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	policy := authz.DefaultPolicy()
+	keyService := service.NewAPIKeyService(newMemoryAPIKeyRepo(), testMailboxRepo)
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), policy, keys, router.Services{
+		Mailbox: service.NewMailboxService(testMailboxRepo, testDepartmentRepo),
+		Org:     service.NewOrgService(testMailboxRepo),
+		APIKey:  keyService,
+	})
+
+	readOnly, err := keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:   "read-only directory",
+		Scopes: []string{string(authz.PermMailboxReadAll)},
+	}, policy.Grants(authz.RoleAdmin), "admin")
+	require.NoError(t, err)
+
+	serve := func(method string, path string, header string, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set(header, value)
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	// The key's scopes are the caller's permissions
+	w := serve("GET", "/api/me", middleware.APIKeyHeader, readOnly.Key)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var identity model.Identity
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, string(middleware.APIKeyRole), identity.Role)
+	assert.Equal(t, model.ScopeAll, identity.Scope)
+	assert.Equal(t, []string{string(authz.PermMailboxReadAll)}, identity.Permissions)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/me", "Authorization", "ApiKey "+readOnly.Key).Code)
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/api/mailboxes/calculate-metrics", middleware.APIKeyHeader, readOnly.Key).Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/api/api-keys", middleware.APIKeyHeader, readOnly.Key).Code)
+
+	// A key may manage keys if it was granted that scope
+	manager, err := keyService.CreateAPIKey(ctx, model.APIKeyInput{
+		Name:   "provisioning",
+		Scopes: []string{string(authz.PermAPIKeysManage)},
+	}, policy.Grants(authz.RoleAdmin), "admin")
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/api-keys", middleware.APIKeyHeader, manager.Key).Code)
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/api/api-keys/"+readOnly.ID, middleware.APIKeyHeader, manager.Key).Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/api/api-keys/"+readOnly.ID, middleware.APIKeyHeader, manager.Key).Code)
+
+	// Revoked and unknown keys are rejected
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/api/me", middleware.APIKeyHeader, readOnly.Key).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/api/me", middleware.APIKeyHeader, "mbx_unknown_secret").Code)
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mailbox-api/authz"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDefaultPolicy tests the built-in role to permission mapping
+func TestDefaultPolicy(t *testing.T) {
+	policy := authz.DefaultPolicy()
+
+	assert.True(t, policy.Can(authz.RoleCEO, authz.PermMetricsRecalculate))
+	assert.True(t, policy.Can(authz.RoleCTO, authz.PermMailboxReadSubOrg))
+	assert.False(t, policy.Can(authz.RoleCTO, authz.PermMailboxReadAll))
+	assert.False(t, policy.Can(authz.RoleAuditor, authz.PermMailboxWrite))
+	assert.True(t, policy.CanAny(authz.RoleSelf, authz.ReadPermissions...))
+
+	// admin holds the wildcard permission
+	assert.True(t, policy.Can(authz.RoleAdmin, authz.PermOrgIntegrity))
+
+	// Unknown roles hold nothing
+	assert.False(t, policy.HasRole("janitor"))
+	assert.False(t, policy.CanAny("janitor", authz.ReadPermissions...))
+}
+
+// TestLoadPolicy tests loading the mapping from a policy file
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(path, []byte(`{"roles": {"hr": ["mailbox:read:all", "mailbox:write"]}}`), 0o600)
+	assert.NoError(t, err)
+
+	policy, err := authz.LoadPolicy(path)
+	assert.NoError(t, err)
+	assert.True(t, policy.Can(authz.RoleHR, authz.PermMailboxWrite))
+	assert.False(t, policy.HasRole(authz.RoleCEO))
+	assert.Equal(t, []authz.Permission{authz.PermMailboxReadAll, authz.PermMailboxWrite}, policy.Permissions(authz.RoleHR))
+
+	// An empty path falls back to the built-in policy
+	policy, err = authz.LoadPolicy("")
+	assert.NoError(t, err)
+	assert.True(t, policy.HasRole(authz.RoleCEO))
+
+	// A file without roles is rejected
+	err = os.WriteFile(path, []byte(`{}`), 0o600)
+	assert.NoError(t, err)
+	_, err = authz.LoadPolicy(path)
+	assert.Error(t, err)
+
+	// So is a misspelt permission, while the wildcard is accepted
+	err = os.WriteFile(path, []byte(`{"roles": {"admin": ["*"], "hr": ["mailbox:read:all", "mailbox:wirte"]}}`), 0o600)
+	assert.NoError(t, err)
+	_, err = authz.LoadPolicy(path)
+	assert.ErrorContains(t, err, `"mailbox:wirte"`)
+
+	err = os.WriteFile(path, []byte(`{"roles": {"admin": ["*"]}}`), 0o600)
+	assert.NoError(t, err)
+	policy, err = authz.LoadPolicy(path)
+	assert.NoError(t, err)
+	assert.True(t, policy.Can(authz.RoleAdmin, authz.PermDirectoryImport))
+}
@@ -0,0 +1,294 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/repository"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryDepartmentRepo keeps departments in memory; members holds the
+// headcount of each department. If mailboxes is set, CreateDepartment moves
+// the members given to it there.
+type memoryDepartmentRepo struct {
+	departments map[int]model.Department
+	members     map[int]int
+	mailboxes   *memoryMailboxRepo
+}
+
+func newMemoryDepartmentRepo() *memoryDepartmentRepo {
+	return &memoryDepartmentRepo{
+		departments: map[int]model.Department{},
+		members:     map[int]int{},
+	}
+}
+
+func (r *memoryDepartmentRepo) GetDepartments(ctx context.Context) ([]model.Department, error) {
+	departments := []model.Department{}
+	for _, department := range r.departments {
+		departments = append(departments, department)
+	}
+	sort.Slice(departments, func(i, j int) bool { return departments[i].Name < departments[j].Name })
+	return departments, nil
+}
+
+func (r *memoryDepartmentRepo) GetDepartmentByID(ctx context.Context, id int) (*model.Department, error) {
+	department, ok := r.departments[id]
+	if !ok {
+		return nil, nil
+	}
+	return &department, nil
+}
+
+func (r *memoryDepartmentRepo) CreateDepartment(ctx context.Context, department model.Department, members []string) (int, error) {
+	moves := map[string]bool{}
+	for _, member := range members {
+		moves[member] = true
+	}
+	indexes := []int{}
+	if r.mailboxes != nil {
+		for i, mailbox := range r.mailboxes.mailboxes {
+			if moves[mailbox.Identifier] {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	if len(indexes) != len(members) {
+		return 0, repository.ErrMemberNotFound
+	}
+
+	if department.ID == 0 {
+		for id := range r.departments {
+			if id > department.ID {
+				department.ID = id
+			}
+		}
+		department.ID++
+	}
+	if _, ok := r.departments[department.ID]; ok {
+		return 0, repository.ErrDepartmentExists
+	}
+	r.departments[department.ID] = department
+	for _, i := range indexes {
+		r.mailboxes.mailboxes[i].DepartmentID = department.ID
+	}
+	return department.ID, nil
+}
+
+func (r *memoryDepartmentRepo) UpdateDepartment(ctx context.Context, department model.Department) error {
+	r.departments[department.ID] = department
+	return nil
+}
+
+func (r *memoryDepartmentRepo) DeleteDepartment(ctx context.Context, id int) error {
+	if _, ok := r.departments[id]; !ok {
+		return repository.ErrDepartmentNotFound
+	}
+	for _, department := range r.departments {
+		if department.ParentID == id {
+			return repository.ErrDepartmentHasSubDepartments
+		}
+	}
+	if r.members[id] > 0 {
+		return repository.ErrDepartmentHasMembers
+	}
+	delete(r.departments, id)
+	return nil
+}
+
+func (r *memoryDepartmentRepo) ImportDepartments(ctx context.Context, departments []model.Department) error {
+	for _, department := range departments {
+		r.departments[department.ID] = department
+	}
+	return nil
+}
+
+func (r *memoryDepartmentRepo) GetDepartmentSummaries(ctx context.Context) ([]model.DepartmentSummary, error) {
+	departments, _ := r.GetDepartments(ctx)
+	summaries := []model.DepartmentSummary{}
+	for _, department := range departments {
+		summaries = append(summaries, model.DepartmentSummary{Department: department, Headcount: r.members[department.ID]})
+	}
+	return summaries, nil
+}
+
+func TestDepartmentService(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryDepartmentRepo()
+	departmentService := service.NewDepartmentService(repo)
+
+	engineering, err := departmentService.CreateDepartment(ctx, model.DepartmentInput{ID: 2, Name: " Engineering "})
+	require.NoError(t, err)
+	assert.Equal(t, "Engineering", engineering.Name)
+
+	// A missing ID picks the next free one
+	marketing, err := departmentService.CreateDepartment(ctx, model.DepartmentInput{Name: "Marketing"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, marketing.ID)
+
+	_, err = departmentService.CreateDepartment(ctx, model.DepartmentInput{ID: 2, Name: "Duplicate"})
+	assert.ErrorIs(t, err, service.ErrDepartmentExists)
+
+	var validationErr *service.ValidationError
+	_, err = departmentService.CreateDepartment(ctx, model.DepartmentInput{Name: "  "})
+	assert.ErrorAs(t, err, &validationErr)
+
+	name := "Platform Engineering"
+	renamed, err := departmentService.PatchDepartment(ctx, 2, model.DepartmentPatch{Name: &name})
+	require.NoError(t, err)
+	assert.Equal(t, name, renamed.Name)
+
+	_, err = departmentService.PatchDepartment(ctx, 99, model.DepartmentPatch{Name: &name})
+	assert.ErrorIs(t, err, service.ErrDepartmentNotFound)
+
+	// Departments with members cannot be deleted
+	repo.members[2] = 4
+	assert.ErrorIs(t, departmentService.DeleteDepartment(ctx, 2), service.ErrDepartmentHasMembers)
+	assert.NoError(t, departmentService.DeleteDepartment(ctx, 3))
+	assert.ErrorIs(t, departmentService.DeleteDepartment(ctx, 3), service.ErrDepartmentNotFound)
+}
+
+func TestDepartmentHierarchy(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryDepartmentRepo()
+	departmentService := service.NewDepartmentService(repo)
+
+	_, err := departmentService.CreateDepartment(ctx, model.DepartmentInput{ID: 1, Name: "Technology", CostCenter: " CC-100 "})
+	require.NoError(t, err)
+	_, err = departmentService.CreateDepartment(ctx, model.DepartmentInput{ID: 2, Name: "Engineering", ParentID: 1})
+	require.NoError(t, err)
+	_, err = departmentService.CreateDepartment(ctx, model.DepartmentInput{ID: 3, Name: "Platform Team", ParentID: 2})
+	require.NoError(t, err)
+
+	var validationErr *service.ValidationError
+	_, err = departmentService.CreateDepartment(ctx, model.DepartmentInput{Name: "Orphans", ParentID: 99})
+	assert.ErrorAs(t, err, &validationErr)
+
+	// Moving a department below one of its own descendants is a cycle
+	parent := 3
+	_, err = departmentService.PatchDepartment(ctx, 1, model.DepartmentPatch{ParentID: &parent})
+	assert.ErrorAs(t, err, &validationErr)
+	parent = 1
+	_, err = departmentService.PatchDepartment(ctx, 1, model.DepartmentPatch{ParentID: &parent})
+	assert.ErrorAs(t, err, &validationErr)
+
+	repo.members[1] = 1
+	repo.members[2] = 2
+	repo.members[3] = 5
+
+	technology, err := departmentService.GetDepartment(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "CC-100", technology.CostCenter)
+	assert.Equal(t, 1, technology.Headcount)
+	assert.Equal(t, 8, technology.TotalHeadcount)
+
+	engineering, err := departmentService.GetDepartment(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, engineering.ParentID)
+	assert.Equal(t, 7, engineering.TotalHeadcount)
+
+	// Detaching a team moves its headcount out of the division
+	parent = 0
+	_, err = departmentService.PatchDepartment(ctx, 3, model.DepartmentPatch{ParentID: &parent})
+	require.NoError(t, err)
+	technology, err = departmentService.GetDepartment(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, technology.TotalHeadcount)
+
+	repo.members[2] = 0
+	assert.ErrorIs(t, departmentService.DeleteDepartment(ctx, 1), service.ErrDepartmentHasSubDepartments)
+	assert.NoError(t, departmentService.DeleteDepartment(ctx, 2))
+}
+
+// staleDepartmentRepo lists the departments as they were before a
+// concurrent parent change committed, while its writes see the current
+// tree, as the repository's transaction does.
+type staleDepartmentRepo struct {
+	*memoryDepartmentRepo
+	stale []model.Department
+}
+
+func (r *staleDepartmentRepo) GetDepartments(ctx context.Context) ([]model.Department, error) {
+	return r.stale, nil
+}
+
+func (r *staleDepartmentRepo) UpdateDepartment(ctx context.Context, department model.Department) error {
+	for id := department.ParentID; id != 0; id = r.departments[id].ParentID {
+		if id == department.ID {
+			return repository.ErrDepartmentCycle
+		}
+	}
+	return r.memoryDepartmentRepo.UpdateDepartment(ctx, department)
+}
+
+// TestDepartmentParentCycleInTransaction tests that a cycle the repository
+// detects inside its transaction is reported like the service's own check
+func TestDepartmentParentCycleInTransaction(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryDepartmentRepo()
+	repo.CreateDepartment(ctx, model.Department{ID: 1, Name: "Technology"}, nil)
+	repo.CreateDepartment(ctx, model.Department{ID: 2, Name: "Engineering"}, nil)
+	stale, _ := repo.GetDepartments(ctx)
+
+	// Engineering moved below Technology after the service read the tree
+	repo.UpdateDepartment(ctx, model.Department{ID: 2, Name: "Engineering", ParentID: 1})
+
+	departmentService := service.NewDepartmentService(&staleDepartmentRepo{repo, stale})
+	parent := 2
+	_, err := departmentService.PatchDepartment(ctx, 1, model.DepartmentPatch{ParentID: &parent})
+
+	var validationErr *service.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "parent_department_id", validationErr.Field)
+	assert.Equal(t, 0, repo.departments[1].ParentID)
+}
+
+func TestDepartmentRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	repo := newMemoryDepartmentRepo()
+	repo.CreateDepartment(context.Background(), model.Department{ID: 1, Name: "Executive"}, nil)
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox:    service.NewMailboxService(testMailboxRepo, repo),
+		Org:        service.NewOrgService(testMailboxRepo),
+		Department: service.NewDepartmentService(repo),
+	})
+
+	serve := func(role authz.Role, method string, path string, body string) int {
+		token, _ := middleware.GenerateToken(cfg, keys, role, "")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(authz.RoleAuditor, "GET", "/api/departments", ""))
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleSelf, "GET", "/api/departments", ""))
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleAuditor, "POST", "/api/departments", `{"department_name": "Legal"}`))
+	assert.Equal(t, http.StatusCreated, serve(authz.RoleHR, "POST", "/api/departments", `{"department_name": "Legal"}`))
+	assert.Equal(t, http.StatusBadRequest, serve(authz.RoleHR, "GET", "/api/departments/legal", ""))
+	assert.Equal(t, http.StatusOK, serve(authz.RoleHR, "PATCH", "/api/departments/2", `{"department_name": "Legal & Compliance"}`))
+	assert.Equal(t, http.StatusNoContent, serve(authz.RoleHR, "DELETE", "/api/departments/2", ""))
+	assert.Equal(t, http.StatusNotFound, serve(authz.RoleHR, "GET", "/api/departments/2", ""))
+}
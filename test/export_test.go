@@ -0,0 +1,211 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	direxport "mailbox-api/export"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/repository"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var exportMailboxes = []model.Mailbox{
+	{Identifier: "ceo@example.com", UserFullName: "Ceo", JobTitle: "CEO", DepartmentID: 1},
+	{Identifier: "sales@example.com", UserFullName: "Doe, Jane", JobTitle: "Director, Sales", DepartmentID: 2, ManagerIdentifier: "ceo@example.com", Active: true},
+}
+
+func writeMailboxes(t *testing.T, format string, fields []string, mailboxes []model.Mailbox) string {
+	var b bytes.Buffer
+	w, err := direxport.NewMailboxWriter(&b, format, direxport.Options{Fields: fields})
+	require.NoError(t, err)
+	for _, mailbox := range mailboxes {
+		require.NoError(t, w.Write(mailbox))
+	}
+	require.NoError(t, w.Close())
+	return b.String()
+}
+
+// TestExportWriters tests the CSV, JSON and NDJSON output
+func TestExportWriters(t *testing.T) {
+	csvOut := writeMailboxes(t, direxport.FormatCSV, nil, exportMailboxes)
+	assert.Equal(t, "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n"+
+		"ceo@example.com,Ceo,CEO,1,null\n"+
+		"sales@example.com,\"Doe, Jane\",\"Director, Sales\",2,ceo@example.com\n", csvOut)
+
+	// The CSV layout can be read back by the importer
+	mailboxes, departments := importFixture()
+	mailboxes.mailboxes = nil
+	result, err := service.NewMailboxService(mailboxes, departments).ImportMailboxesFromCSV(context.Background(), csvOut, true)
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+
+	csvOut = writeMailboxes(t, direxport.FormatCSV, []string{"job_title", "unknown", "active"}, exportMailboxes)
+	assert.Equal(t, "job_title,active\nCEO,false\n\"Director, Sales\",true\n", csvOut)
+
+	var decoded []model.Mailbox
+	require.NoError(t, json.Unmarshal([]byte(writeMailboxes(t, direxport.FormatJSON, nil, exportMailboxes)), &decoded))
+	assert.Equal(t, exportMailboxes, decoded)
+
+	var empty []model.Mailbox
+	require.NoError(t, json.Unmarshal([]byte(writeMailboxes(t, direxport.FormatJSON, nil, nil)), &empty))
+	assert.Empty(t, empty)
+
+	lines := strings.Split(strings.TrimSpace(writeMailboxes(t, direxport.FormatNDJSON, []string{"mailbox_identifier"}, exportMailboxes)), "\n")
+	assert.Equal(t, []string{`{"mailbox_identifier":"ceo@example.com"}`, `{"mailbox_identifier":"sales@example.com"}`}, lines)
+
+	var b bytes.Buffer
+	w, err := direxport.NewDepartmentWriter(&b, direxport.FormatCSV, direxport.Options{})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(model.Department{ID: 1, Name: "Executive"}))
+	require.NoError(t, w.Write(model.Department{ID: 3, Name: "Sales, EMEA", ParentID: 1, CostCenter: "CC-3"}))
+	require.NoError(t, w.Close())
+	assert.Equal(t, "department_id,department_name,parent_department_id,cost_center\n1,Executive,,\n3,\"Sales, EMEA\",1,CC-3\n", b.String())
+
+	_, err = direxport.NewMailboxWriter(&b, "xml", direxport.Options{})
+	assert.Error(t, err)
+}
+
+// TestNegotiate tests picking an export format from an Accept header
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, direxport.FormatCSV, direxport.Negotiate("text/csv"))
+	assert.Equal(t, direxport.FormatNDJSON, direxport.Negotiate("application/x-ndjson"))
+	assert.Equal(t, direxport.FormatNDJSON, direxport.Negotiate("text/csv;q=0.5, application/x-ndjson"))
+	assert.Equal(t, direxport.FormatCSV, direxport.Negotiate("text/csv, application/json"))
+	assert.Equal(t, direxport.FormatJSON, direxport.Negotiate("text/csv;q=0, application/json"))
+	assert.Equal(t, "", direxport.Negotiate("*/*"))
+	assert.Equal(t, "", direxport.Negotiate(""))
+}
+
+// TestExportRoutes tests the export endpoints and content negotiation on the
+// mailbox list
+func TestExportRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	repo := &memoryMailboxRepo{mailboxes: sampleOrg()}
+	departments := newMemoryDepartmentRepo()
+	departments.departments[1] = model.Department{ID: 1, Name: "Executive"}
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox:    service.NewMailboxService(repo, departments),
+		Org:        service.NewOrgService(repo),
+		Department: service.NewDepartmentService(departments),
+	})
+
+	get := func(role authz.Role, subject string, path string, accept string) *httptest.ResponseRecorder {
+		token, _ := middleware.GenerateToken(cfg, keys, role, subject)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(authz.RoleCEO, "", "/api/export/mailboxes", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "mailboxes.csv")
+	assert.Len(t, strings.Split(strings.TrimSpace(w.Body.String()), "\n"), 8)
+
+	// Sub-org callers only export their sub-org
+	w = get(authz.RoleManager, "cto@example.com", "/api/export/mailboxes?format=json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var mailboxes []model.Mailbox
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &mailboxes))
+	identifiers := []string{}
+	for _, mailbox := range mailboxes {
+		identifiers = append(identifiers, mailbox.Identifier)
+	}
+	assert.ElementsMatch(t, []string{"dev1@example.com", "dev2@example.com", "intern@example.com"}, identifiers)
+
+	// The Accept header selects the format on the list endpoint
+	w = get(authz.RoleCEO, "", "/api/mailboxes?fields=mailbox_identifier", "application/x-ndjson")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Len(t, strings.Split(strings.TrimSpace(w.Body.String()), "\n"), 7)
+
+	w = get(authz.RoleCEO, "", "/api/mailboxes", "application/json")
+	var response model.MailboxResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotNil(t, response.Pagination)
+
+	w = get(authz.RoleSelf, "dev2@example.com", "/api/mailboxes", "text/csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n"+
+		"dev2@example.com,,,0,cto@example.com\n", w.Body.String())
+
+	w = get(authz.RoleCEO, "", "/api/export/mailboxes?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get(authz.RoleCEO, "", "/api/export/departments", "application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var exported []model.Department
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+	assert.Equal(t, []model.Department{{ID: 1, Name: "Executive"}}, exported)
+}
+
+// failingStreamRepo fails every streamed read before the first mailbox.
+type failingStreamRepo struct {
+	*memoryMailboxRepo
+}
+
+func (r *failingStreamRepo) StreamMailboxes(ctx context.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	return fmt.Errorf("connection refused")
+}
+
+// TestExportHeaders tests that the export headers are only sent with the
+// export itself, and not with an error response
+func TestExportHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+
+	serve := func(repo repository.MailboxRepository, path string) *httptest.ResponseRecorder {
+		departments := newMemoryDepartmentRepo()
+		r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+			Mailbox: service.NewMailboxService(repo, departments),
+			Org:     service.NewOrgService(repo),
+		})
+		token, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(&failingStreamRepo{&memoryMailboxRepo{mailboxes: sampleOrg()}}, "/api/export/mailboxes?format=ldif")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+	assert.Contains(t, w.Body.String(), "Failed to export mailboxes")
+
+	// An empty export still has its headers
+	w = serve(&memoryMailboxRepo{}, "/api/export/mailboxes?format=ndjson")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "mailboxes.ndjson")
+	assert.Empty(t, w.Body.String())
+}
@@ -0,0 +1,326 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func importFixture() (*memoryMailboxRepo, *memoryDepartmentRepo) {
+	departments := newMemoryDepartmentRepo()
+	departments.departments[1] = model.Department{ID: 1, Name: "Executive"}
+	departments.departments[2] = model.Department{ID: 2, Name: "Sales"}
+
+	mailboxes := &memoryMailboxRepo{mailboxes: []model.Mailbox{
+		{Identifier: "ceo@example.com", DepartmentID: 1},
+	}}
+	departments.mailboxes = mailboxes
+	return mailboxes, departments
+}
+
+// TestImportMailboxes tests CSV validation, dry runs and the all-or-nothing
+// import
+func TestImportMailboxes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("imports quoted fields in manager order", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		csvData := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+			"rep@example.com,Rep,Account Executive,2,sales@example.com\n" +
+			"sales@example.com,\"Doe, Jane\",\"Director, Sales\",2,ceo@example.com\n"
+
+		result, err := mailboxService.ImportMailboxesFromCSV(ctx, csvData, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Errors)
+		assert.Equal(t, 2, result.Rows)
+		assert.Equal(t, 2, result.Imported)
+
+		require.Len(t, mailboxes.mailboxes, 3)
+		assert.Equal(t, "sales@example.com", mailboxes.mailboxes[1].Identifier)
+		assert.Equal(t, "Director, Sales", mailboxes.mailboxes[1].JobTitle)
+		assert.Equal(t, "Doe, Jane", mailboxes.mailboxes[1].UserFullName)
+		assert.Equal(t, "rep@example.com", mailboxes.mailboxes[2].Identifier)
+	})
+
+	t.Run("dry run does not write", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		csvData := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+			"sales@example.com,Jane,Director,2,ceo@example.com\n"
+
+		result, err := mailboxService.ImportMailboxesFromCSV(ctx, csvData, true)
+		require.NoError(t, err)
+		assert.True(t, result.DryRun)
+		assert.Empty(t, result.Errors)
+		assert.Equal(t, 0, result.Imported)
+		assert.Len(t, mailboxes.mailboxes, 1)
+	})
+
+	t.Run("reports every invalid row and writes nothing", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		csvData := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+			"ok@example.com,Ok,Rep,2,ceo@example.com\n" +
+			"ceo@example.com,Again,CEO,1,null\n" +
+			"noat,Bad,Rep,2,ceo@example.com\n" +
+			"nodept@example.com,Bad,Rep,9,ceo@example.com\n" +
+			"orphan@example.com,Bad,Rep,2,ghost@example.com\n" +
+			"a@example.com,A,Rep,2,b@example.com\n" +
+			"b@example.com,B,Rep,2,a@example.com\n" +
+			"nan@example.com,Bad,Rep,x,ceo@example.com\n"
+
+		result, err := mailboxService.ImportMailboxesFromCSV(ctx, csvData, false)
+		require.NoError(t, err)
+		assert.Equal(t, 0, result.Imported)
+		assert.Len(t, mailboxes.mailboxes, 1)
+
+		rows := map[int]string{}
+		for _, rowErr := range result.Errors {
+			rows[rowErr.Row] = rowErr.Field
+		}
+		assert.Equal(t, map[int]string{
+			3: "mailbox_identifier",
+			4: "mailbox_identifier",
+			5: "department_id",
+			6: "manager_mailbox_identifier",
+			7: "manager_mailbox_identifier",
+			8: "manager_mailbox_identifier",
+			9: "department_id",
+		}, rows)
+	})
+
+	t.Run("rejects files without the required columns", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		_, err := mailboxService.ImportMailboxesFromCSV(ctx, "mailbox_identifier\nx@example.com\n", false)
+		var validationErr *service.ValidationError
+		assert.ErrorAs(t, err, &validationErr)
+	})
+}
+
+// TestImportMailboxFormats tests the JSON, NDJSON and tree imports
+func TestImportMailboxFormats(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("json array", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		jsonData := `[
+			{"mailbox_identifier": "rep@example.com", "user_full_name": "Rep", "job_title": "Account Executive", "department_id": 2, "manager_mailbox_identifier": "sales@example.com"},
+			{"mailbox_identifier": "sales@example.com", "user_full_name": "Doe, Jane", "job_title": "Director", "department_id": 2, "manager_mailbox_identifier": "ceo@example.com"}
+		]`
+
+		result, err := mailboxService.ImportMailboxesFromJSON(ctx, jsonData, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Errors)
+		assert.Equal(t, 2, result.Imported)
+		require.Len(t, mailboxes.mailboxes, 3)
+		assert.Equal(t, "sales@example.com", mailboxes.mailboxes[1].Identifier)
+
+		_, err = mailboxService.ImportMailboxesFromJSON(ctx, `{"mailbox_identifier": "x@example.com"}`, false)
+		var validationErr *service.ValidationError
+		assert.ErrorAs(t, err, &validationErr)
+	})
+
+	t.Run("ndjson reports errors by line", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		ndjsonData := `{"mailbox_identifier": "ok@example.com", "user_full_name": "Ok", "job_title": "Rep", "department_id": 2, "manager_mailbox_identifier": "ceo@example.com"}
+
+{"mailbox_identifier": "top@example.com", "user_full_name": "Top", "job_title": "Chair", "department_id": 1, "manager_mailbox_identifier": null}
+{"mailbox_identifier": "nan@example.com", "user_full_name": "Bad", "job_title": "Rep", "department_id": "2"}
+{"mailbox_identifier": "broken@example.com",
+{"mailbox_identifier": "nested@example.com", "user_full_name": "Bad", "job_title": "Rep", "department_id": 2, "reports": [{}]}
+`
+
+		result, err := mailboxService.ImportMailboxesFromNDJSON(ctx, ndjsonData, true)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Rows)
+
+		rows := map[int]string{}
+		for _, rowErr := range result.Errors {
+			rows[rowErr.Row] = rowErr.Field
+		}
+		assert.Equal(t, map[int]string{4: "department_id", 5: "", 6: "reports"}, rows)
+		assert.Equal(t, "nan@example.com", result.Errors[0].Identifier)
+	})
+
+	t.Run("tree sets managers from the nesting", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		tree := `{
+			"mailbox_identifier": "sales@example.com", "user_full_name": "Jane", "job_title": "Director", "department_id": 2,
+			"manager_mailbox_identifier": "ceo@example.com",
+			"reports": [
+				{"mailbox_identifier": "lead@example.com", "user_full_name": "Lead", "job_title": "Team Lead", "department_id": 2, "reports": [
+					{"mailbox_identifier": "rep@example.com", "user_full_name": "Rep", "job_title": "Rep", "department_id": 2}
+				]},
+				{"mailbox_identifier": "sdr@example.com", "user_full_name": "Sdr", "job_title": "Rep", "department_id": 2}
+			]
+		}`
+
+		result, err := mailboxService.ImportMailboxesFromTree(ctx, tree, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Errors)
+		assert.Equal(t, 4, result.Imported)
+
+		managers := map[string]string{}
+		for _, mailbox := range mailboxes.mailboxes {
+			managers[mailbox.Identifier] = mailbox.ManagerIdentifier
+		}
+		assert.Equal(t, "ceo@example.com", managers["sales@example.com"])
+		assert.Equal(t, "sales@example.com", managers["lead@example.com"])
+		assert.Equal(t, "lead@example.com", managers["rep@example.com"])
+		assert.Equal(t, "sales@example.com", managers["sdr@example.com"])
+	})
+
+	t.Run("tree reports nodes in depth-first order", func(t *testing.T) {
+		mailboxes, departments := importFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		tree := `[
+			{"mailbox_identifier": "a@example.com", "user_full_name": "A", "job_title": "Head", "department_id": 2, "reports": [
+				{"mailbox_identifier": "b@example.com", "user_full_name": "B", "job_title": "Rep", "department_id": 9},
+				{"mailbox_identifier": "c@example.com", "user_full_name": "C", "job_title": "Rep", "department_id": 2, "manager_mailbox_identifier": "ceo@example.com"}
+			]},
+			{"mailbox_identifier": "a@example.com", "user_full_name": "A", "job_title": "Head", "department_id": 2}
+		]`
+
+		result, err := mailboxService.ImportMailboxesFromTree(ctx, tree, false)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Rows)
+		assert.Len(t, mailboxes.mailboxes, 1)
+
+		rows := map[int]string{}
+		for _, rowErr := range result.Errors {
+			rows[rowErr.Row] = rowErr.Field
+		}
+		assert.Equal(t, map[int]string{2: "department_id", 3: "manager_mailbox_identifier", 4: "mailbox_identifier"}, rows)
+	})
+}
+
+// TestImportDepartments tests department imports with parents and cycles
+func TestImportDepartments(t *testing.T) {
+	ctx := context.Background()
+
+	mailboxes, departments := importFixture()
+	mailboxService := service.NewMailboxService(mailboxes, departments)
+
+	csvData := "department_id,department_name,parent_department_id,cost_center\n" +
+		"11,Inside Sales,10,CC-11\n" +
+		"10,\"Sales, EMEA\",2,CC-10\n" +
+		"20,Loop A,21,\n" +
+		"21,Loop B,20,\n"
+
+	result, err := mailboxService.ImportDepartmentsFromCSV(ctx, csvData, false)
+	require.NoError(t, err)
+	assert.Len(t, result.Errors, 2)
+	assert.Len(t, departments.departments, 2)
+
+	csvData = "department_id,department_name,parent_department_id,cost_center\n" +
+		"11,Inside Sales,10,CC-11\n" +
+		"10,\"Sales, EMEA\",2,CC-10\n"
+
+	result, err = mailboxService.ImportDepartmentsFromCSV(ctx, csvData, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, 2, result.Imported)
+	assert.Equal(t, "Sales, EMEA", departments.departments[10].Name)
+	assert.Equal(t, 10, departments.departments[11].ParentID)
+}
+
+// TestImportRoutes tests the multipart upload and the permission check
+func TestImportRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	mailboxes, departments := importFixture()
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(mailboxes, departments),
+		Org:     service.NewOrgService(mailboxes),
+	})
+
+	upload := func(role authz.Role, path string, csvData string) (int, model.ImportResult) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("file", "mailboxes.csv")
+		part.Write([]byte(csvData))
+		writer.Close()
+
+		token, _ := middleware.GenerateToken(cfg, keys, role, "")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+
+		var result model.ImportResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	valid := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+		"sales@example.com,Jane,\"Director, Sales\",2,ceo@example.com\n"
+	invalid := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+		"sales@example.com,Jane,Director,9,ceo@example.com\n"
+
+	code, _ := upload(authz.RoleManager, "/api/import/mailboxes", valid)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, result := upload(authz.RoleCEO, "/api/import/mailboxes?dry_run=true", valid)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.DryRun)
+	assert.Len(t, mailboxes.mailboxes, 1)
+
+	code, _ = upload(authz.RoleCEO, "/api/import/mailboxes?dry_run=maybe", valid)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, result = upload(authz.RoleCEO, "/api/import/mailboxes", invalid)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, 2, result.Errors[0].Row)
+
+	code, result = upload(authz.RoleHR, "/api/import/mailboxes", valid)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, result.Imported)
+	assert.Len(t, mailboxes.mailboxes, 2)
+
+	code, result = upload(authz.RoleCEO, "/api/import/mailboxes?format=ndjson",
+		`{"mailbox_identifier": "rep@example.com", "user_full_name": "Rep", "job_title": "Rep", "department_id": 2, "manager_mailbox_identifier": "sales@example.com"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, result.Imported)
+
+	code, _ = upload(authz.RoleCEO, "/api/import/mailboxes?format=xml", valid)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = upload(authz.RoleCEO, "/api/import/departments", "nothing")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRSAKey(t *testing.T, dir string, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0600))
+}
+
+func writeECKey(t *testing.T, dir string, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0600))
+}
+
+func setupKeyedRouter(keys *jwtkeys.KeySet) (*gin.Engine, *config.Config) {
+	cfg, _ := config.Load()
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(testMailboxRepo, testDepartmentRepo),
+		Org:     service.NewOrgService(testMailboxRepo),
+	})
+
+	return r.GetEngine(), cfg
+}
+
+func TestKeyRotation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "2024-01")
+
+	keys, err := jwtkeys.Load(dir, "")
+	require.NoError(t, err)
+	engine, cfg := setupKeyedRouter(keys)
+
+	me := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	oldToken, err := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, me(oldToken))
+
+	// A newer key takes over signing; tokens signed with the old key stay valid
+	writeECKey(t, dir, "2024-02")
+	require.NoError(t, keys.Reload())
+	assert.Equal(t, "2024-02", keys.Active().ID)
+	assert.Equal(t, jwtkeys.AlgorithmES256, keys.Active().Algorithm)
+
+	newToken, err := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, me(newToken))
+	assert.Equal(t, http.StatusOK, me(oldToken))
+
+	// Removing the old key retires it
+	require.NoError(t, os.Remove(filepath.Join(dir, "2024-01.pem")))
+	require.NoError(t, keys.Reload())
+	assert.Equal(t, http.StatusUnauthorized, me(oldToken))
+	assert.Equal(t, http.StatusOK, me(newToken))
+}
+
+func TestJWKS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "rsa-key")
+	writeECKey(t, dir, "ec-key")
+
+	keys, err := jwtkeys.Load(dir, "rsa-key")
+	require.NoError(t, err)
+	assert.Equal(t, "rsa-key", keys.Active().ID)
+
+	engine, _ := setupKeyedRouter(keys)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	engine.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var jwks jwtkeys.JWKS
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 2)
+
+	assert.Equal(t, "ec-key", jwks.Keys[0].KeyID)
+	assert.Equal(t, "EC", jwks.Keys[0].KeyType)
+	assert.Equal(t, "P-256", jwks.Keys[0].Curve)
+	assert.Equal(t, "ES256", jwks.Keys[0].Algorithm)
+
+	assert.Equal(t, "rsa-key", jwks.Keys[1].KeyID)
+	assert.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+	assert.Equal(t, "RS256", jwks.Keys[1].Algorithm)
+
+	// A shared secret is never published
+	assert.Empty(t, jwtkeys.NewHMAC("secret").JWKS().Keys)
+}
+
+func TestRejectsAlgorithmMismatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "rsa-key")
+
+	keys, err := jwtkeys.Load(dir, "")
+	require.NoError(t, err)
+	engine, cfg := setupKeyedRouter(keys)
+
+	// An HS256 token that names the RSA key must not be verified with it
+	claims := &middleware.Claims{
+		Role: authz.RoleAdmin,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       "forged",
+			Issuer:   cfg.Auth.Issuer,
+			Audience: jwt.ClaimStrings{cfg.Auth.Audience},
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "rsa-key"
+	signed, err := token.SignedString([]byte("guessed-secret"))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", signed))
+	engine.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,340 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"mailbox-api/authz"
+	"mailbox-api/ldap"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ber encodes an element from its identifier and content. The client side
+// of the tests encodes and decodes by hand, so it checks the wire format
+// independently of the server's codec.
+func ber(identifier byte, content ...[]byte) []byte {
+	var body []byte
+	for _, part := range content {
+		body = append(body, part...)
+	}
+	out := []byte{identifier}
+	switch n := len(body); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	}
+	return append(out, body...)
+}
+
+func berString(identifier byte, s string) []byte {
+	return ber(identifier, []byte(s))
+}
+
+func berInt(identifier byte, n int) []byte {
+	if n < 0x80 {
+		return ber(identifier, []byte{byte(n)})
+	}
+	return ber(identifier, []byte{byte(n >> 8), byte(n)})
+}
+
+type berElement struct {
+	identifier byte
+	content    []byte
+}
+
+func berElements(data []byte) []berElement {
+	elements := []berElement{}
+	for len(data) > 0 {
+		identifier, length, header := data[0], int(data[1]), 2
+		if length&0x80 != 0 {
+			n := length & 0x7f
+			length = 0
+			for _, b := range data[2 : 2+n] {
+				length = length<<8 | int(b)
+			}
+			header += n
+		}
+		elements = append(elements, berElement{identifier: identifier, content: data[header : header+length]})
+		data = data[header+length:]
+	}
+	return elements
+}
+
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// ldapClient speaks just enough LDAP to exercise the server.
+type ldapClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+func dialLDAP(t *testing.T, addr string) *ldapClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &ldapClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *ldapClient) send(op []byte) {
+	c.id++
+	_, err := c.conn.Write(ber(0x30, berInt(0x02, c.id), op))
+	require.NoError(c.t, err)
+}
+
+// receive returns the protocol operation of the next response.
+func (c *ldapClient) receive() berElement {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.r, header)
+	require.NoError(c.t, err)
+	length := int(header[1])
+	if length&0x80 != 0 {
+		lengthBytes := make([]byte, length&0x7f)
+		_, err := io.ReadFull(c.r, lengthBytes)
+		require.NoError(c.t, err)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	content := make([]byte, length)
+	_, err = io.ReadFull(c.r, content)
+	require.NoError(c.t, err)
+
+	message := berElements(content)
+	require.Len(c.t, message, 2)
+	assert.Equal(c.t, []byte{byte(c.id)}, message[0].content)
+	return message[1]
+}
+
+func resultCode(op berElement) int {
+	return int(berElements(op.content)[0].content[0])
+}
+
+func (c *ldapClient) bind(name string, password string) int {
+	c.send(ber(0x60, berInt(0x02, 3), berString(0x04, name), berString(0x80, password)))
+	op := c.receive()
+	require.Equal(c.t, byte(0x61), op.identifier)
+	return resultCode(op)
+}
+
+func (c *ldapClient) search(base string, scope int, sizeLimit int, filter []byte, attributes ...string) ([]ldapEntry, int) {
+	var attributeList [][]byte
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, berString(0x04, attribute))
+	}
+	c.send(ber(0x63,
+		berString(0x04, base),
+		berInt(0x0a, scope),
+		berInt(0x0a, 0),
+		berInt(0x02, sizeLimit),
+		berInt(0x02, 0),
+		ber(0x01, []byte{0}),
+		filter,
+		ber(0x30, attributeList...),
+	))
+
+	entries := []ldapEntry{}
+	for {
+		op := c.receive()
+		if op.identifier == 0x65 {
+			return entries, resultCode(op)
+		}
+		require.Equal(c.t, byte(0x64), op.identifier)
+
+		parts := berElements(op.content)
+		entry := ldapEntry{dn: string(parts[0].content), attributes: map[string][]string{}}
+		for _, attribute := range berElements(parts[1].content) {
+			typeAndValues := berElements(attribute.content)
+			values := []string{}
+			for _, value := range berElements(typeAndValues[1].content) {
+				values = append(values, string(value.content))
+			}
+			entry.attributes[string(typeAndValues[0].content)] = values
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func mails(entries []ldapEntry) []string {
+	out := []string{}
+	for _, entry := range entries {
+		out = append(out, entry.attributes["mail"]...)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// TestLDAPServer tests binding with API keys and searching within the scope
+// of the bound key
+func TestLDAPServer(t *testing.T) {
+	ctx := context.Background()
+	repo := &memoryMailboxRepo{mailboxes: sampleOrg()}
+	repo.mailboxes[3].UserFullName = "Jane Doe"
+	repo.mailboxes[3].DepartmentID = 2
+
+	keyService := service.NewAPIKeyService(newMemoryAPIKeyRepo(), repo)
+	admin := authz.DefaultPolicy().Grants(authz.RoleAdmin)
+	newKey := func(scope string, identifier string) string {
+		created, err := keyService.CreateAPIKey(ctx, model.APIKeyInput{Name: scope, Scopes: []string{scope}, MailboxIdentifier: identifier}, admin, "admin")
+		require.NoError(t, err)
+		return created.Key
+	}
+	allKey := newKey("mailbox:read:all", "")
+	subOrgKey := newKey("mailbox:read:suborg", "cto@example.com")
+	selfKey := newKey("mailbox:read:self", "dev2@example.com")
+
+	server := ldap.NewServer("dc=example,dc=com", authz.DefaultPolicy(), ldap.Services{
+		Mailbox: service.NewMailboxService(repo, newMemoryDepartmentRepo()),
+		APIKey:  keyService,
+	}, logger.NewLogger())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	everything := berString(0x87, "objectClass")
+	people := "ou=people,dc=example,dc=com"
+
+	t.Run("anonymous binds read only the root DSE", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		entries, code := client.search("", 0, 0, everything)
+		assert.Equal(t, 0, code)
+		require.Len(t, entries, 1)
+		assert.Equal(t, []string{"dc=example,dc=com"}, entries[0].attributes["namingContexts"])
+
+		_, code = client.search(people, 2, 0, everything)
+		assert.Equal(t, 50, code)
+	})
+
+	t.Run("rejects invalid binds", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		assert.Equal(t, 49, client.bind("", service.APIKeyPrefix+"unknown"))
+		assert.Equal(t, 53, client.bind("cn=admin,dc=example,dc=com", ""))
+		assert.Equal(t, 49, client.bind("admin", "password"))
+	})
+
+	t.Run("searches the whole directory", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		require.Equal(t, 0, client.bind("", allKey))
+
+		entries, code := client.search("dc=example,dc=com", 2, 0, everything)
+		assert.Equal(t, 0, code)
+		assert.Len(t, entries, 8)
+
+		entries, code = client.search(people, 1, 0, ber(0xa3, berString(0x04, "objectClass"), berString(0x04, "inetOrgPerson")))
+		assert.Equal(t, 0, code)
+		assert.Len(t, entries, 7)
+
+		entries, code = client.search(people, 2, 2, everything)
+		assert.Equal(t, 4, code)
+		assert.Len(t, entries, 2)
+
+		_, code = client.search("ou=groups,dc=example,dc=com", 2, 0, everything)
+		assert.Equal(t, 32, code)
+		_, code = client.search("not a dn", 2, 0, everything)
+		assert.Equal(t, 34, code)
+	})
+
+	t.Run("evaluates filters and selects attributes", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		require.Equal(t, 0, client.bind("", allKey))
+
+		devs := ber(0xa4, berString(0x04, "mail"), ber(0x30, berString(0x80, "dev")))
+		entries, _ := client.search(people, 2, 0, devs, "mail")
+		assert.Equal(t, []string{"dev1@example.com", "dev2@example.com"}, mails(entries))
+		for _, entry := range entries {
+			assert.Len(t, entry.attributes, 1)
+		}
+
+		jane := ber(0xa0,
+			ber(0xa4, berString(0x04, "cn"), ber(0x30, berString(0x81, "jane"))),
+			ber(0xa3, berString(0x04, "departmentNumber"), berString(0x04, "2")),
+		)
+		entries, _ = client.search(people, 2, 0, jane)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "mail=dev1@example.com,ou=people,dc=example,dc=com", entries[0].dn)
+		assert.Equal(t, []string{"Doe"}, entries[0].attributes["sn"])
+
+		intern := ber(0xa3, berString(0x04, "mail"), berString(0x04, "intern@example.com"))
+		entries, _ = client.search(people, 2, 0, intern)
+		require.Len(t, entries, 1)
+		assert.Equal(t, []string{"mail=dev1@example.com,ou=people,dc=example,dc=com"}, entries[0].attributes["manager"])
+
+		// mail is matched ignoring case, as the filter compares it
+		entries, _ = client.search(people, 2, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "INTERN@Example.com")))
+		assert.Equal(t, []string{"intern@example.com"}, mails(entries))
+
+		notDevs := ber(0xa2, devs)
+		entries, _ = client.search(people, 1, 0, notDevs)
+		assert.Len(t, entries, 5)
+	})
+
+	t.Run("limits searches to the sub-org", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		require.Equal(t, 0, client.bind("", subOrgKey))
+
+		entries, code := client.search(people, 1, 0, everything)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, []string{"dev1@example.com", "dev2@example.com", "intern@example.com"}, mails(entries))
+
+		entries, code = client.search("mail=intern@example.com,"+people, 0, 0, everything)
+		assert.Equal(t, 0, code)
+		assert.Len(t, entries, 1)
+
+		_, code = client.search("mail=cmo@example.com,"+people, 0, 0, everything)
+		assert.Equal(t, 32, code)
+
+		entries, _ = client.search(people, 1, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "marketing@example.com")))
+		assert.Empty(t, entries)
+		entries, _ = client.search(people, 1, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "Marketing@example.com")))
+		assert.Empty(t, entries)
+
+		// Looking up the caller's own mailbox finds it
+		entries, _ = client.search(people, 1, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "CTO@example.com")))
+		assert.Equal(t, []string{"cto@example.com"}, mails(entries))
+	})
+
+	t.Run("limits searches to the own mailbox", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		require.Equal(t, 0, client.bind("", selfKey))
+
+		entries, _ := client.search(people, 2, 0, everything)
+		assert.Equal(t, []string{"dev2@example.com"}, mails(entries))
+
+		entries, _ = client.search(people, 2, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "Dev2@example.com")))
+		assert.Equal(t, []string{"dev2@example.com"}, mails(entries))
+		entries, _ = client.search(people, 2, 0, ber(0xa3, berString(0x04, "mail"), berString(0x04, "dev1@example.com")))
+		assert.Empty(t, entries)
+	})
+
+	t.Run("rejects updates", func(t *testing.T) {
+		client := dialLDAP(t, addr)
+		require.Equal(t, 0, client.bind("", allKey))
+
+		client.send(berString(0x4a, "mail=dev1@example.com,"+people))
+		op := client.receive()
+		assert.Equal(t, byte(0x6b), op.identifier)
+		assert.Equal(t, 53, resultCode(op))
+		assert.Len(t, repo.mailboxes, 7)
+	})
+}
@@ -0,0 +1,262 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	direxport "mailbox-api/export"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/ldif"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLDIFEntries tests encoding, folding and parsing entries
+func TestLDIFEntries(t *testing.T) {
+	entry := ldif.Entry{DN: "mail=jose@example.com,ou=people,dc=example,dc=com"}
+	entry.Add("objectClass", "top", "inetOrgPerson")
+	entry.Add("cn", "José Núñez")
+	entry.Add("description", strings.Repeat("long ", 30))
+	entry.Add("title", ":colon", "")
+
+	var b bytes.Buffer
+	require.NoError(t, ldif.WriteEntry(&b, entry))
+	out := b.String()
+	assert.Contains(t, out, "cn:: Sm9zw6kgTsO6w7Fleg==\n")
+	assert.Contains(t, out, "title:: OmNvbG9u\n")
+	for _, line := range strings.Split(out, "\n") {
+		assert.LessOrEqual(t, len(line), 76)
+	}
+
+	entries, err := ldif.Parse(strings.NewReader(ldif.Header + "\n# a comment\n  continued\n" + out + "dn: ou=people,dc=example,dc=com\r\nchangetype: add\r\nou: people\r\n"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, entry.DN, entries[0].DN)
+	assert.Equal(t, 5, entries[0].Line)
+	assert.Equal(t, "José Núñez", entries[0].First("CN"))
+	assert.Equal(t, strings.Repeat("long ", 30), entries[0].First("description"))
+	assert.True(t, entries[0].HasObjectClass("inetorgperson"))
+	assert.Equal(t, []string{"people"}, entries[1].Get("ou"))
+
+	for _, invalid := range []string{
+		"dn: cn=a\nchangetype: delete\n",
+		"dn: cn=a\njpegPhoto:< file:///photo.jpg\n",
+		"cn: a\n",
+		"dn: cn=a\ncn:: !!!\n",
+	} {
+		_, err := ldif.Parse(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestLDIFDistinguishedNames tests escaping and parsing DNs
+func TestLDIFDistinguishedNames(t *testing.T) {
+	assert.Equal(t, `Doe\, Jane \+ co`, ldif.EscapeValue("Doe, Jane + co"))
+	assert.Equal(t, `\#1\ `, ldif.EscapeValue("#1 "))
+
+	rdns, err := ldif.ParseDN(`ou=Sales\, EMEA , OU = people,dc=example,dc=com`)
+	require.NoError(t, err)
+	assert.Equal(t, []ldif.RDN{{Type: "ou", Value: "Sales, EMEA"}, {Type: "OU", Value: "people"}, {Type: "dc", Value: "example"}, {Type: "dc", Value: "com"}}, rdns)
+
+	rdns, err = ldif.ParseDN(`cn=Jos\C3\A9\ ,dc=com`)
+	require.NoError(t, err)
+	assert.Equal(t, "José ", rdns[0].Value)
+
+	normalized, err := ldif.NormalizeDN("Mail=Ada@Example.com, OU=People,dc=example")
+	require.NoError(t, err)
+	assert.Equal(t, "mail=ada@example.com,ou=people,dc=example", normalized)
+
+	for _, invalid := range []string{"cn", "cn=a+sn=b", "=a", `cn=a\`} {
+		_, err := ldif.ParseDN(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestLDIFExport tests the inetOrgPerson and organizationalUnit entries
+func TestLDIFExport(t *testing.T) {
+	var b bytes.Buffer
+	w, err := direxport.NewMailboxWriter(&b, direxport.FormatLDIF, direxport.Options{BaseDN: "dc=falafel,dc=org", Fields: []string{"job_title"}})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(model.Mailbox{Identifier: "ceo@falafel.org", UserFullName: "Ada Byron Lovelace", JobTitle: "CEO", DepartmentID: 1, Department: "Executive"}))
+	require.NoError(t, w.Write(model.Mailbox{Identifier: "cto@falafel.org", UserFullName: "Grace", JobTitle: "CTO", DepartmentID: 2, ManagerIdentifier: "ceo@falafel.org"}))
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, `version: 1
+
+dn: ou=people,dc=falafel,dc=org
+objectClass: top
+objectClass: organizationalUnit
+ou: people
+
+dn: mail=ceo@falafel.org,ou=people,dc=falafel,dc=org
+objectClass: top
+objectClass: person
+objectClass: organizationalPerson
+objectClass: inetOrgPerson
+mail: ceo@falafel.org
+cn: Ada Byron Lovelace
+givenName: Ada Byron
+sn: Lovelace
+title: CEO
+departmentNumber: 1
+ou: Executive
+
+dn: mail=cto@falafel.org,ou=people,dc=falafel,dc=org
+objectClass: top
+objectClass: person
+objectClass: organizationalPerson
+objectClass: inetOrgPerson
+mail: cto@falafel.org
+cn: Grace
+sn: Grace
+title: CTO
+departmentNumber: 2
+manager: mail=ceo@falafel.org,ou=people,dc=falafel,dc=org
+
+`, b.String())
+
+	b.Reset()
+	d, err := direxport.NewDepartmentWriter(&b, direxport.FormatLDIF, direxport.Options{BaseDN: "dc=falafel,dc=org"})
+	require.NoError(t, err)
+	require.NoError(t, d.Write(model.Department{ID: 3, Name: "Sales, EMEA", ParentID: 2, CostCenter: "CC-3"}))
+	require.NoError(t, d.Write(model.Department{ID: 2, Name: "Sales"}))
+	require.NoError(t, d.Close())
+
+	entries, err := ldif.Parse(&b)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "ou=departments,dc=falafel,dc=org", entries[0].DN)
+	assert.Equal(t, "ou=Sales,ou=departments,dc=falafel,dc=org", entries[1].DN)
+	assert.Equal(t, `ou=Sales\, EMEA,ou=Sales,ou=departments,dc=falafel,dc=org`, entries[2].DN)
+	assert.Equal(t, "3", entries[2].First("businessCategory"))
+	assert.Equal(t, "CC-3", entries[2].First("description"))
+}
+
+// TestLDIFImport tests importing inetOrgPerson entries and resolving manager
+// DNs
+func TestLDIFImport(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("round trip through the export", func(t *testing.T) {
+		var b bytes.Buffer
+		w, _ := direxport.NewMailboxWriter(&b, direxport.FormatLDIF, direxport.Options{BaseDN: "dc=example,dc=com"})
+		w.Write(model.Mailbox{Identifier: "sales@example.com", UserFullName: "Doe, Jane", JobTitle: "Director", DepartmentID: 2, ManagerIdentifier: "ceo@example.com"})
+		w.Write(model.Mailbox{Identifier: "rep@example.com", UserFullName: "Rep", JobTitle: "Rep", DepartmentID: 2, ManagerIdentifier: "sales@example.com"})
+		w.Close()
+
+		mailboxes, departments := importFixture()
+		result, err := service.NewMailboxService(mailboxes, departments).ImportMailboxesFromLDIF(ctx, b.String(), false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Errors)
+		assert.Equal(t, 2, result.Imported)
+		require.Len(t, mailboxes.mailboxes, 3)
+		assert.Equal(t, "Doe, Jane", mailboxes.mailboxes[1].UserFullName)
+		assert.Equal(t, "ceo@example.com", mailboxes.mailboxes[1].ManagerIdentifier)
+		assert.Equal(t, "sales@example.com", mailboxes.mailboxes[2].ManagerIdentifier)
+	})
+
+	t.Run("resolves managers named by other attributes", func(t *testing.T) {
+		ldifData := `version: 1
+
+dn: cn=Jane Doe,ou=staff,dc=legacy
+objectClass: inetOrgPerson
+mail: sales@example.com
+cn: Jane Doe
+title: Director
+departmentNumber: 2
+manager: mail=ceo@example.com,ou=people,dc=example,dc=com
+
+dn: cn=Rep,ou=staff,dc=legacy
+objectClass: inetOrgPerson
+mail: rep@example.com
+cn: Rep
+title: Rep
+departmentNumber: 2
+manager: CN=Jane Doe, OU=staff, DC=legacy
+
+dn: cn=Bad,ou=staff,dc=legacy
+objectClass: inetOrgPerson
+mail: bad@example.com
+cn: Bad
+title: Rep
+departmentNumber: two
+manager: cn=Nobody,ou=staff,dc=legacy
+
+dn: cn=Orphan,ou=staff,dc=legacy
+objectClass: inetOrgPerson
+mail: orphan@example.com
+cn: Orphan
+title: Rep
+departmentNumber: 2
+manager: cn=Nobody,ou=staff,dc=legacy
+
+dn: ou=staff,dc=legacy
+objectClass: organizationalUnit
+ou: staff
+`
+
+		mailboxes, departments := importFixture()
+		result, err := service.NewMailboxService(mailboxes, departments).ImportMailboxesFromLDIF(ctx, ldifData, true)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Rows)
+
+		rows := map[int]string{}
+		for _, rowErr := range result.Errors {
+			rows[rowErr.Row] = rowErr.Field
+		}
+		assert.Equal(t, map[int]string{19: "department_id", 27: "manager_mailbox_identifier"}, rows)
+
+		_, err = service.NewMailboxService(mailboxes, departments).ImportMailboxesFromLDIF(ctx, "dn: ou=staff\nou: staff\n", true)
+		var validationErr *service.ValidationError
+		assert.ErrorAs(t, err, &validationErr)
+	})
+}
+
+// TestLDIFRoutes tests the LDIF export and import formats
+func TestLDIFRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	cfg.LDAP.BaseDN = "dc=falafel,dc=org"
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	repo := &memoryMailboxRepo{mailboxes: sampleOrg()}
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(repo, newMemoryDepartmentRepo()),
+		Org:     service.NewOrgService(repo),
+	})
+
+	token, _ := middleware.GenerateToken(cfg, keys, authz.RoleCEO, "")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/export/mailboxes", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Accept", "text/x-ldif")
+	r.GetEngine().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/x-ldif; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "mailboxes.ldif")
+
+	entries, err := ldif.Parse(w.Body)
+	require.NoError(t, err)
+	assert.Len(t, entries, 8)
+	managers := map[string]string{}
+	for _, entry := range entries {
+		managers[entry.First("mail")] = entry.First("manager")
+	}
+	assert.Equal(t, "mail=cto@example.com,ou=people,dc=falafel,dc=org", managers["dev1@example.com"])
+}
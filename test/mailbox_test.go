@@ -0,0 +1,285 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mailboxFixture returns sampleOrg with names, titles and departments, for
+// tests that write mailboxes.
+func mailboxFixture() (*memoryMailboxRepo, *memoryDepartmentRepo) {
+	departments := newMemoryDepartmentRepo()
+	departments.departments[1] = model.Department{ID: 1, Name: "Executive"}
+	departments.departments[2] = model.Department{ID: 2, Name: "Engineering"}
+
+	mailboxes := sampleOrg()
+	for i := range mailboxes {
+		mailboxes[i].UserFullName = strings.Split(mailboxes[i].Identifier, "@")[0]
+		mailboxes[i].JobTitle = "Staff"
+		mailboxes[i].DepartmentID = 1
+		mailboxes[i].Department = "Executive"
+		mailboxes[i].Active = true
+	}
+	departments.mailboxes = &memoryMailboxRepo{mailboxes: mailboxes}
+	return departments.mailboxes, departments
+}
+
+// mailboxServer serves the routes over the memory repositories and returns
+// a function that sends a request as the role and identity.
+func mailboxServer(mailboxes repository.MailboxRepository, departments *memoryDepartmentRepo) func(role authz.Role, identity string, method string, path string, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox:    service.NewMailboxService(mailboxes, departments),
+		Org:        service.NewOrgService(mailboxes),
+		Department: service.NewDepartmentService(departments),
+	})
+
+	return func(role authz.Role, identity string, method string, path string, body string) *httptest.ResponseRecorder {
+		token, _ := middleware.GenerateToken(cfg, keys, role, identity)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+}
+
+// TestMailboxWriteScope tests that callers scoped to a sub-org can only
+// create and move mailboxes inside it
+func TestMailboxWriteScope(t *testing.T) {
+	mailboxes, departments := mailboxFixture()
+	serve := mailboxServer(mailboxes, departments)
+
+	cto := func(method string, path string, body string) int {
+		return serve(authz.RoleCTO, "cto@example.com", method, path, body).Code
+	}
+	manager := func(identifier string) string {
+		mailbox, _ := mailboxes.GetMailboxByIdentifier(context.Background(), identifier)
+		require.NotNil(t, mailbox)
+		return mailbox.ManagerIdentifier
+	}
+
+	joiner := `{"mailbox_identifier": "dev3@example.com", "user_full_name": "Dev Three", "job_title": "Engineer", "department_id": 2%s}`
+
+	// A new mailbox must report to the caller or into their sub-org
+	assert.Equal(t, http.StatusForbidden, cto("POST", "/api/mailboxes", fmt.Sprintf(joiner, "")))
+	assert.Equal(t, http.StatusForbidden, cto("POST", "/api/mailboxes", fmt.Sprintf(joiner, `, "manager_mailbox_identifier": ""`)))
+	assert.Equal(t, http.StatusForbidden, cto("POST", "/api/mailboxes", fmt.Sprintf(joiner, `, "manager_mailbox_identifier": "cmo@example.com"`)))
+	assert.Equal(t, http.StatusCreated, cto("POST", "/api/mailboxes", fmt.Sprintf(joiner, `, "manager_mailbox_identifier": "dev1@example.com"`)))
+
+	// Reports cannot be cut out of the sub-org by clearing their manager
+	assert.Equal(t, http.StatusForbidden, cto("PUT", "/api/mailboxes/dev2@example.com", `{"user_full_name": "Dev Two", "job_title": "Engineer", "department_id": 2}`))
+	assert.Equal(t, http.StatusForbidden, cto("PATCH", "/api/mailboxes/dev2@example.com", `{"manager_mailbox_identifier": ""}`))
+	assert.Equal(t, http.StatusForbidden, cto("PATCH", "/api/mailboxes/dev2@example.com", `{"manager_mailbox_identifier": "cmo@example.com"}`))
+	assert.Equal(t, "cto@example.com", manager("dev2@example.com"))
+
+	// Changes that leave the manager alone or keep it inside the sub-org
+	// are allowed
+	assert.Equal(t, http.StatusOK, cto("PATCH", "/api/mailboxes/dev2@example.com", `{"job_title": "Senior Engineer"}`))
+	assert.Equal(t, http.StatusOK, cto("PATCH", "/api/mailboxes/dev2@example.com", `{"manager_mailbox_identifier": "dev1@example.com"}`))
+	assert.Equal(t, http.StatusOK, cto("PUT", "/api/mailboxes/dev2@example.com", `{"user_full_name": "Dev Two", "job_title": "Engineer", "department_id": 2, "manager_mailbox_identifier": "cto@example.com"}`))
+
+	// Callers who can read everything may still make a mailbox top-level
+	assert.Equal(t, http.StatusOK, serve(authz.RoleCEO, "ceo@example.com", "PATCH", "/api/mailboxes/dev2@example.com", `{"manager_mailbox_identifier": ""}`).Code)
+	assert.Equal(t, "", manager("dev2@example.com"))
+}
+
+// staleMailboxRepo answers sub-org checks as if a concurrent move had not
+// committed yet, while its writes see the current hierarchy, as the
+// repository's transaction does.
+type staleMailboxRepo struct {
+	*memoryMailboxRepo
+}
+
+func (r *staleMailboxRepo) IsInSubOrg(ctx context.Context, managerIdentifier string, identifier string) (bool, error) {
+	return false, nil
+}
+
+func (r *staleMailboxRepo) UpdateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	if orggraph.New(r.mailboxes).IsInSubOrg(mailbox.Identifier, mailbox.ManagerIdentifier) {
+		return repository.ErrReportingCycle
+	}
+	return r.memoryMailboxRepo.UpdateMailbox(ctx, mailbox)
+}
+
+// TestMailboxMoveCycleInTransaction tests that a cycle the repository
+// detects inside its transaction is reported like the service's own check
+func TestMailboxMoveCycleInTransaction(t *testing.T) {
+	mailboxes, departments := mailboxFixture()
+	mailboxService := service.NewMailboxService(&staleMailboxRepo{mailboxes}, departments)
+
+	manager := "intern@example.com"
+	_, err := mailboxService.PatchMailbox(context.Background(), "cto@example.com", model.MailboxPatch{ManagerIdentifier: &manager})
+
+	var validationErr *service.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "manager_mailbox_identifier", validationErr.Field)
+}
+
+// TestMailboxServiceWrites tests the checks of create, replace, patch and
+// delete against the memory repository
+func TestMailboxServiceWrites(t *testing.T) {
+	ctx := context.Background()
+	validationField := func(t *testing.T, err error) string {
+		var validationErr *service.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		return validationErr.Field
+	}
+
+	t.Run("create", func(t *testing.T) {
+		mailboxes, departments := mailboxFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+		input := func(identifier string, departmentID int, manager string) model.MailboxInput {
+			return model.MailboxInput{Identifier: identifier, UserFullName: "Dev Three", JobTitle: "Engineer", DepartmentID: departmentID, ManagerIdentifier: manager}
+		}
+
+		_, err := mailboxService.CreateMailbox(ctx, input("dev1@example.com", 2, "cto@example.com"))
+		assert.ErrorIs(t, err, service.ErrMailboxExists)
+
+		_, err = mailboxService.CreateMailbox(ctx, input("dev3@example.com", 9, "cto@example.com"))
+		assert.Equal(t, "department_id", validationField(t, err))
+
+		_, err = mailboxService.CreateMailbox(ctx, input("dev3@example.com", 2, "nobody@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		_, err = mailboxService.CreateMailbox(ctx, input("dev3@example.com", 2, "dev3@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		_, err = mailboxService.CreateMailbox(ctx, input("dev3", 2, "cto@example.com"))
+		assert.Equal(t, "mailbox_identifier", validationField(t, err))
+		assert.Len(t, mailboxes.mailboxes, 7)
+
+		created, err := mailboxService.CreateMailbox(ctx, input(" dev3@example.com ", 2, "cto@example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, "dev3@example.com", created.Identifier)
+		assert.True(t, created.Active)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		mailboxes, departments := mailboxFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+		input := func(departmentID int, manager string) model.MailboxInput {
+			return model.MailboxInput{UserFullName: "Dev One", JobTitle: "Lead", DepartmentID: departmentID, ManagerIdentifier: manager}
+		}
+
+		_, err := mailboxService.ReplaceMailbox(ctx, "nobody@example.com", input(2, "cto@example.com"))
+		assert.ErrorIs(t, err, service.ErrMailboxNotFound)
+
+		_, err = mailboxService.ReplaceMailbox(ctx, "dev1@example.com", input(9, "cto@example.com"))
+		assert.Equal(t, "department_id", validationField(t, err))
+
+		_, err = mailboxService.ReplaceMailbox(ctx, "dev1@example.com", input(2, "nobody@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		_, err = mailboxService.ReplaceMailbox(ctx, "dev1@example.com", input(2, "dev1@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		renamed := input(2, "cto@example.com")
+		renamed.Identifier = "other@example.com"
+		_, err = mailboxService.ReplaceMailbox(ctx, "dev1@example.com", renamed)
+		assert.Equal(t, "mailbox_identifier", validationField(t, err))
+
+		replaced, err := mailboxService.ReplaceMailbox(ctx, "dev1@example.com", input(2, "cmo@example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, "Lead", replaced.JobTitle)
+		assert.Equal(t, "cmo@example.com", replaced.ManagerIdentifier)
+	})
+
+	t.Run("patch", func(t *testing.T) {
+		mailboxes, departments := mailboxFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+		manager := func(identifier string) model.MailboxPatch {
+			return model.MailboxPatch{ManagerIdentifier: &identifier}
+		}
+		department := func(id int) model.MailboxPatch {
+			return model.MailboxPatch{DepartmentID: &id}
+		}
+
+		_, err := mailboxService.PatchMailbox(ctx, "nobody@example.com", department(2))
+		assert.ErrorIs(t, err, service.ErrMailboxNotFound)
+
+		_, err = mailboxService.PatchMailbox(ctx, "dev1@example.com", department(9))
+		assert.Equal(t, "department_id", validationField(t, err))
+
+		_, err = mailboxService.PatchMailbox(ctx, "dev1@example.com", manager("nobody@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		_, err = mailboxService.PatchMailbox(ctx, "dev1@example.com", manager("dev1@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		_, err = mailboxService.PatchMailbox(ctx, "cto@example.com", manager("intern@example.com"))
+		assert.Equal(t, "manager_mailbox_identifier", validationField(t, err))
+
+		patched, err := mailboxService.PatchMailbox(ctx, "dev1@example.com", department(2))
+		require.NoError(t, err)
+		assert.Equal(t, 2, patched.DepartmentID)
+		assert.Equal(t, "Staff", patched.JobTitle)
+		assert.Equal(t, "cto@example.com", patched.ManagerIdentifier)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		mailboxes, departments := mailboxFixture()
+		mailboxService := service.NewMailboxService(mailboxes, departments)
+
+		assert.ErrorIs(t, mailboxService.DeleteMailbox(ctx, "nobody@example.com"), service.ErrMailboxNotFound)
+		assert.ErrorIs(t, mailboxService.DeleteMailbox(ctx, "dev1@example.com"), service.ErrMailboxHasReports)
+		assert.Len(t, mailboxes.mailboxes, 7)
+
+		require.NoError(t, mailboxService.DeleteMailbox(ctx, "intern@example.com"))
+		require.NoError(t, mailboxService.DeleteMailbox(ctx, "dev1@example.com"))
+		assert.Len(t, mailboxes.mailboxes, 5)
+	})
+}
+
+// TestMailboxWriteErrors tests the status codes the mailbox write routes map
+// errors to
+func TestMailboxWriteErrors(t *testing.T) {
+	mailboxes, departments := mailboxFixture()
+	serve := mailboxServer(mailboxes, departments)
+
+	ceo := func(method string, path string, body string) int {
+		return serve(authz.RoleCEO, "ceo@example.com", method, path, body).Code
+	}
+
+	// 400 for bodies that do not parse and fields that fail validation
+	assert.Equal(t, http.StatusBadRequest, ceo("POST", "/api/mailboxes", `{"mailbox_identifier": 5}`))
+	assert.Equal(t, http.StatusBadRequest, ceo("POST", "/api/mailboxes", `{"mailbox_identifier": "dev3@example.com", "user_full_name": "Dev Three", "job_title": "Engineer", "department_id": 9}`))
+	assert.Equal(t, http.StatusBadRequest, ceo("PATCH", "/api/mailboxes/dev1@example.com", `{"manager_mailbox_identifier": "dev1@example.com"}`))
+
+	// 403 for callers without write access or writing outside their sub-org
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleAuditor, "ceo@example.com", "PATCH", "/api/mailboxes/dev1@example.com", `{"job_title": "Lead"}`).Code)
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleCTO, "cto@example.com", "DELETE", "/api/mailboxes/marketing@example.com", "").Code)
+
+	// 404 for mailboxes that do not exist
+	assert.Equal(t, http.StatusNotFound, ceo("PATCH", "/api/mailboxes/nobody@example.com", `{"job_title": "Lead"}`))
+	assert.Equal(t, http.StatusNotFound, ceo("PUT", "/api/mailboxes/nobody@example.com", `{"user_full_name": "Nobody", "job_title": "Lead", "department_id": 1}`))
+	assert.Equal(t, http.StatusNotFound, ceo("DELETE", "/api/mailboxes/nobody@example.com", ""))
+
+	// 409 for duplicates and for deleting a manager
+	assert.Equal(t, http.StatusConflict, ceo("POST", "/api/mailboxes", `{"mailbox_identifier": "dev1@example.com", "user_full_name": "Dev One", "job_title": "Engineer", "department_id": 2, "manager_mailbox_identifier": "cto@example.com"}`))
+	assert.Equal(t, http.StatusConflict, ceo("DELETE", "/api/mailboxes/dev1@example.com", ""))
+
+	assert.Equal(t, http.StatusNoContent, ceo("DELETE", "/api/mailboxes/intern@example.com", ""))
+}
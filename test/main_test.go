@@ -7,12 +7,10 @@ import (
 	"os"
 	"testing"
 
-	"mailbox-api/config"
 	"mailbox-api/db"
 	"mailbox-api/repository"
 
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/joho/godotenv"
 )
 
 var (
@@ -21,26 +19,17 @@ var (
 	testDepartmentRepo repository.DepartmentRepository
 )
 
-// TestMain is currently disabled to allow other tests to run
-// To re-enable integration tests, remove the "Skip" line and fix the DB setup issues
+// TestMain sets up the integration test database when TEST_DATABASE_URL
+// names one. Its tables are dropped and recreated, so it must be a database
+// used only by the tests. Without it, the tests that need a database skip.
 func TestMain(m *testing.M) {
-	// Temporarily skip integration tests
-	// Remove this line when integration tests are ready
-	log.Println("Skipping integration tests that require database setup")
-	os.Exit(m.Run())
-
-	// The code below will run when integration tests are re-enabled
-
-	// Load test environment
-	if err := godotenv.Load("../.env.test"); err != nil {
-		// If .env.test doesn't exist, try regular .env
-		if err := godotenv.Load("../.env"); err != nil {
-			log.Println("Warning: No .env file found for testing")
-		}
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		log.Println("TEST_DATABASE_URL is not set, skipping integration tests")
+		os.Exit(m.Run())
 	}
 
-	// Set up test database connection
-	if err := setupTestDB(); err != nil {
+	if err := setupTestDB(url); err != nil {
 		log.Fatalf("Failed to set up test database: %v", err)
 	}
 
@@ -48,11 +37,6 @@ func TestMain(m *testing.M) {
 	testMailboxRepo = repository.NewMailboxRepository(testDB)
 	testDepartmentRepo = repository.NewDepartmentRepository(testDB)
 
-	// Seed test data
-	if err := seedTestData(); err != nil {
-		log.Fatalf("Failed to seed test data: %v", err)
-	}
-
 	// Run tests
 	code := m.Run()
 
@@ -62,56 +46,27 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-// NOTE: The functions below need fixing before integration tests can be re-enabled
-
-func setupTestDB() error {
-	cfg, err := config.Load()
-	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
-	}
-
-	// Override database name for testing
-	if os.Getenv("DB_NAME") == "" || os.Getenv("DB_NAME") == "mailbox" {
-		os.Setenv("DB_NAME", "mailbox_test")
-		cfg.Database.DBName = "mailbox_test"
-	}
-
-	// Connect to PostgreSQL server (without database)
-	connectionString := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s sslmode=%s",
-		cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.Password, cfg.Database.SSLMode,
-	)
-
+func setupTestDB(url string) error {
 	ctx := context.Background()
-	conn, err := pgxpool.Connect(ctx, connectionString)
-	if err != nil {
-		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
-	}
-	defer conn.Close()
-
-	// Drop test database if it exists
-	_, err = conn.Exec(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s", cfg.Database.DBName))
+	pool, err := pgxpool.Connect(ctx, url)
 	if err != nil {
-		return fmt.Errorf("failed to drop test database: %w", err)
-	}
-
-	// Create test database
-	_, err = conn.Exec(ctx, fmt.Sprintf("CREATE DATABASE %s", cfg.Database.DBName))
-	if err != nil {
-		return fmt.Errorf("failed to create test database: %w", err)
+		return fmt.Errorf("failed to connect to test database: %w", err)
 	}
+	testDB = &db.DB{Pool: pool}
 
-	// Connect to test database
-	testDB, err = db.NewConnection(cfg.Database)
+	// Start from empty tables
+	_, err = testDB.Exec(ctx, `DROP TABLE IF EXISTS import_plans, mailbox_closure, mailboxes, departments CASCADE`)
 	if err != nil {
-		return fmt.Errorf("failed to connect to test database: %w", err)
+		return fmt.Errorf("failed to drop tables: %w", err)
 	}
 
-	// Create tables without the foreign key constraint initially
+	// Create tables
 	schema := `
 	CREATE TABLE IF NOT EXISTS departments (
 		department_id INT PRIMARY KEY,
-		department_name VARCHAR(100) NOT NULL
+		department_name VARCHAR(100) NOT NULL,
+		parent_department_id INT REFERENCES departments(department_id),
+		cost_center VARCHAR(50) NOT NULL DEFAULT ''
 	);
 
 	CREATE TABLE IF NOT EXISTS mailboxes (
@@ -122,12 +77,36 @@ func setupTestDB() error {
 		manager_mailbox_identifier VARCHAR(100) NULL,
 		org_depth INT NOT NULL DEFAULT 0,
 		sub_org_size INT NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
 		FOREIGN KEY (department_id) REFERENCES departments(department_id)
 	);
 
 	CREATE INDEX idx_mailboxes_department_id ON mailboxes(department_id);
 	CREATE INDEX idx_mailboxes_org_depth ON mailboxes(org_depth);
 	CREATE INDEX idx_mailboxes_sub_org_size ON mailboxes(sub_org_size);
+	CREATE INDEX idx_mailboxes_identifier_lower ON mailboxes(lower(mailbox_identifier));
+
+	CREATE TABLE IF NOT EXISTS mailbox_closure (
+		ancestor_identifier VARCHAR(100) NOT NULL,
+		descendant_identifier VARCHAR(100) NOT NULL,
+		depth INT NOT NULL,
+		PRIMARY KEY (ancestor_identifier, descendant_identifier),
+		FOREIGN KEY (ancestor_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE,
+		FOREIGN KEY (descendant_identifier) REFERENCES mailboxes(mailbox_identifier) ON DELETE CASCADE
+	);
+
+	CREATE INDEX idx_mailbox_closure_descendant ON mailbox_closure(descendant_identifier, depth);
+
+	CREATE TABLE IF NOT EXISTS import_plans (
+		id VARCHAR(32) PRIMARY KEY,
+		status VARCHAR(20) NOT NULL,
+		summary JSONB NOT NULL,
+		changes JSONB NOT NULL,
+		directory_version VARCHAR(64) NOT NULL DEFAULT '',
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		applied_at TIMESTAMPTZ
+	);
 	`
 
 	_, err = testDB.Exec(ctx, schema)
@@ -138,12 +117,6 @@ func setupTestDB() error {
 	return nil
 }
 
-func seedTestData() error {
-	// Implementation needs fixing before this can be enabled
-	// This is where the integration test is failing
-	return nil
-}
-
 func cleanupTestDB() {
 	if testDB != nil {
 		testDB.Close()
@@ -0,0 +1,163 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/oidc"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuer = "https://idp.example.com"
+
+// setupProvider writes a provider key and a JWKS file with its public part,
+// and returns a verifier reading that file.
+func setupProvider(t *testing.T, mapping oidc.ClaimMapping) (*oidc.Verifier, *jwtkeys.KeySet) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "idp-key")
+
+	providerKeys, err := jwtkeys.Load(dir, "")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(providerKeys.JWKS())
+	require.NoError(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, data, 0600))
+
+	verifier, err := oidc.NewVerifier(context.Background(), testIssuer, "mailbox-api", "", jwksFile, mapping)
+	require.NoError(t, err)
+
+	return verifier, providerKeys
+}
+
+func signExternal(t *testing.T, keys *jwtkeys.KeySet, claims jwt.MapClaims) string {
+	key := keys.Active()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.SigningKey())
+	require.NoError(t, err)
+	return signed
+}
+
+func externalClaims(extra jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": "mailbox-api",
+		"sub": "00u1a2b3c4",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestOIDCClaimMapping(t *testing.T) {
+	roles, err := oidc.ParseRoleMappings("Directory-Admins=admin, People-Ops=hr")
+	require.NoError(t, err)
+
+	verifier, providerKeys := setupProvider(t, oidc.ClaimMapping{
+		MailboxClaim: "email",
+		GroupsClaim:  "realm_access.roles",
+		Roles:        roles,
+	})
+
+	// Mapping order decides between several matching groups
+	identity, err := verifier.Verify(context.Background(), signExternal(t, providerKeys, externalClaims(jwt.MapClaims{
+		"email":        "Alice.Jones@Falafel.org",
+		"jti":          "external-jti",
+		"realm_access": map[string]interface{}{"roles": []string{"People-Ops", "Directory-Admins"}},
+	})))
+	require.NoError(t, err)
+	assert.Equal(t, authz.RoleAdmin, identity.Role)
+	assert.Equal(t, "alice.jones@falafel.org", identity.MailboxIdentifier)
+	assert.Equal(t, "external-jti", identity.ID)
+
+	// No matching group and no default role
+	_, err = verifier.Verify(context.Background(), signExternal(t, providerKeys, externalClaims(jwt.MapClaims{
+		"realm_access": map[string]interface{}{"roles": []string{"Engineering"}},
+	})))
+	assert.ErrorIs(t, err, oidc.ErrNoRole)
+
+	// Wrong audience
+	_, err = verifier.Verify(context.Background(), signExternal(t, providerKeys, externalClaims(jwt.MapClaims{
+		"aud":          "another-api",
+		"realm_access": map[string]interface{}{"roles": []string{"People-Ops"}},
+	})))
+	assert.Error(t, err)
+
+	// Tokens without an audience are rejected too
+	claims := externalClaims(jwt.MapClaims{"realm_access": map[string]interface{}{"roles": []string{"People-Ops"}}})
+	delete(claims, "aud")
+	_, err = verifier.Verify(context.Background(), signExternal(t, providerKeys, claims))
+	assert.Error(t, err)
+
+	// The audience is required
+	_, err = oidc.NewVerifier(context.Background(), testIssuer, "", "", filepath.Join(t.TempDir(), "jwks.json"), oidc.ClaimMapping{})
+	assert.ErrorContains(t, err, "audience")
+
+	_, err = oidc.ParseRoleMappings("People-Ops")
+	assert.Error(t, err)
+}
+
+func TestOIDCTokensInMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	verifier, providerKeys := setupProvider(t, oidc.ClaimMapping{
+		GroupsClaim: "groups",
+		DefaultRole: authz.RoleAuditor,
+	})
+
+	cfg, _ := config.Load()
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), jwtkeys.NewHMAC(cfg.Auth.JWTSecret), router.Services{
+		Mailbox: service.NewMailboxService(testMailboxRepo, testDepartmentRepo),
+		Org:     service.NewOrgService(testMailboxRepo),
+		OIDC:    verifier,
+	})
+
+	me := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	w := me(signExternal(t, providerKeys, externalClaims(nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var identity model.Identity
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, string(authz.RoleAuditor), identity.Role)
+	assert.Equal(t, model.ScopeAll, identity.Scope)
+
+	// A token that claims the provider as issuer but is signed with another key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, externalClaims(nil))
+	forged.Header["kid"] = "idp-key"
+	signed, err := forged.SignedString(otherKey)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, me(signed).Code)
+}
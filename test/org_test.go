@@ -0,0 +1,376 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/orgchart"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryMailboxRepo serves a set of mailboxes. The read methods used by the
+// org, hierarchy and export endpoints, the single-mailbox writes and
+// ImportMailboxes are implemented, and GetMailboxes and StreamMailboxes only
+// apply the hierarchy filters; the other methods panic. Writes do not
+// resolve department names.
+type memoryMailboxRepo struct {
+	repository.MailboxRepository
+	mailboxes []model.Mailbox
+}
+
+func (r *memoryMailboxRepo) GetAllMailboxes(ctx context.Context) ([]model.Mailbox, error) {
+	return r.mailboxes, nil
+}
+
+func (r *memoryMailboxRepo) GetMailboxByIdentifier(ctx context.Context, identifier string) (*model.Mailbox, error) {
+	for _, mailbox := range r.mailboxes {
+		if mailbox.Identifier == identifier {
+			return &mailbox, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryMailboxRepo) GetMailboxes(ctx context.Context, filter model.MailboxFilter) ([]model.Mailbox, int, error) {
+	graph := orggraph.New(r.mailboxes)
+	self, _ := graph.Get(filter.PeersOf)
+
+	matches := []model.Mailbox{}
+	for _, mailbox := range r.mailboxes {
+		switch {
+		case filter.Identifier != "" && !strings.EqualFold(mailbox.Identifier, filter.Identifier):
+		case filter.SubOrgOf != "" && !graph.IsInSubOrg(filter.SubOrgOf, mailbox.Identifier):
+		case filter.AncestorsOf != "" && !graph.IsInSubOrg(mailbox.Identifier, filter.AncestorsOf):
+		case filter.ReportsTo != "" && mailbox.ManagerIdentifier != filter.ReportsTo:
+		case filter.PeersOf != "" && (self == nil || mailbox.Identifier == self.Identifier || mailbox.ManagerIdentifier != self.ManagerIdentifier):
+		default:
+			matches = append(matches, mailbox)
+		}
+	}
+
+	start := (filter.Page - 1) * filter.PageSize
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + filter.PageSize
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	return matches[start:end], len(matches), nil
+}
+
+func (r *memoryMailboxRepo) StreamMailboxes(ctx context.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	filter.Page, filter.PageSize = 1, len(r.mailboxes)
+	mailboxes, _, _ := r.GetMailboxes(ctx, filter)
+	for _, mailbox := range mailboxes {
+		if err := fn(mailbox); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryMailboxRepo) IsInSubOrg(ctx context.Context, managerIdentifier string, identifier string) (bool, error) {
+	return orggraph.New(r.mailboxes).IsInSubOrg(managerIdentifier, identifier), nil
+}
+
+func (r *memoryMailboxRepo) GetAncestors(ctx context.Context, identifier string) ([]model.Mailbox, error) {
+	graph := orggraph.New(r.mailboxes)
+	ancestors := []model.Mailbox{}
+	for _, ancestor := range graph.Ancestors(identifier) {
+		mailbox, _ := graph.Get(ancestor)
+		ancestors = append(ancestors, *mailbox)
+	}
+	return ancestors, nil
+}
+
+func (r *memoryMailboxRepo) CreateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	r.mailboxes = append(r.mailboxes, mailbox)
+	return nil
+}
+
+func (r *memoryMailboxRepo) UpdateMailbox(ctx context.Context, mailbox model.Mailbox) error {
+	for i := range r.mailboxes {
+		if r.mailboxes[i].Identifier == mailbox.Identifier {
+			mailbox.Active = r.mailboxes[i].Active
+			r.mailboxes[i] = mailbox
+		}
+	}
+	return nil
+}
+
+func (r *memoryMailboxRepo) DeleteMailbox(ctx context.Context, identifier string) error {
+	kept := []model.Mailbox{}
+	for _, mailbox := range r.mailboxes {
+		if mailbox.Identifier != identifier {
+			kept = append(kept, mailbox)
+		}
+	}
+	r.mailboxes = kept
+	return nil
+}
+
+func (r *memoryMailboxRepo) GetDirectReports(ctx context.Context, identifier string) ([]model.Mailbox, error) {
+	reports := []model.Mailbox{}
+	for _, mailbox := range r.mailboxes {
+		if mailbox.ManagerIdentifier == identifier {
+			reports = append(reports, mailbox)
+		}
+	}
+	return reports, nil
+}
+
+func (r *memoryMailboxRepo) SetMailboxActive(ctx context.Context, identifier string, active bool) error {
+	for i := range r.mailboxes {
+		if r.mailboxes[i].Identifier == identifier {
+			r.mailboxes[i].Active = active
+		}
+	}
+	return nil
+}
+
+func (r *memoryMailboxRepo) ImportMailboxes(ctx context.Context, mailboxes []model.Mailbox) error {
+	r.mailboxes = append(r.mailboxes, mailboxes...)
+	return nil
+}
+
+func reportIdentifiers(node *model.OrgTreeNode) []string {
+	identifiers := []string{}
+	for _, report := range node.Reports {
+		identifiers = append(identifiers, report.Identifier)
+	}
+	return identifiers
+}
+
+// subtreeOnlyRepo refuses to read the whole directory, so trees must be
+// built from the sub-org they show.
+type subtreeOnlyRepo struct {
+	*memoryMailboxRepo
+}
+
+func (r *subtreeOnlyRepo) GetAllMailboxes(ctx context.Context) ([]model.Mailbox, error) {
+	return nil, fmt.Errorf("the whole directory was read")
+}
+
+func TestOrgTree(t *testing.T) {
+	ctx := context.Background()
+	orgService := service.NewOrgService(&subtreeOnlyRepo{&memoryMailboxRepo{mailboxes: sampleOrg()}})
+
+	// Callers who can read everything start at the top of the org
+	result, err := orgService.GetTree(ctx, model.ScopeAll, "", "", -1, nil)
+	require.NoError(t, err)
+	tree := result.(*model.OrgTreeNode)
+	assert.Equal(t, "ceo@example.com", tree.Identifier)
+	assert.Equal(t, []string{"cto@example.com", "cmo@example.com"}, reportIdentifiers(tree))
+	assert.Equal(t, []string{"intern@example.com"}, reportIdentifiers(tree.Reports[0].Reports[0]))
+
+	result, err = orgService.GetTree(ctx, model.ScopeAll, "", "cto@example.com", 1, nil)
+	require.NoError(t, err)
+	tree = result.(*model.OrgTreeNode)
+	assert.Equal(t, []string{"dev1@example.com", "dev2@example.com"}, reportIdentifiers(tree))
+	assert.Empty(t, tree.Reports[0].Reports)
+
+	// Sub-org callers default to their own mailbox and cannot look outside it
+	result, err = orgService.GetTree(ctx, model.ScopeSubOrg, "cto@example.com", "", -1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "cto@example.com", result.(*model.OrgTreeNode).Identifier)
+
+	_, err = orgService.GetTree(ctx, model.ScopeSubOrg, "cto@example.com", "dev1@example.com", -1, nil)
+	assert.NoError(t, err)
+	_, err = orgService.GetTree(ctx, model.ScopeSubOrg, "cto@example.com", "cmo@example.com", -1, nil)
+	assert.ErrorIs(t, err, service.ErrOutOfScope)
+
+	result, err = orgService.GetTree(ctx, model.ScopeSelf, "dev1@example.com", "", -1, nil)
+	require.NoError(t, err)
+	assert.Empty(t, result.(*model.OrgTreeNode).Reports)
+
+	_, err = orgService.GetTree(ctx, model.ScopeAll, "", "nobody@example.com", -1, nil)
+	assert.ErrorIs(t, err, service.ErrMailboxNotFound)
+
+	// Projected nodes keep only the requested fields and their reports
+	result, err = orgService.GetTree(ctx, model.ScopeAll, "", "cmo@example.com", -1, []string{"mailbox_identifier"})
+	require.NoError(t, err)
+	projected := result.(map[string]interface{})
+	assert.Len(t, projected, 2)
+	reports := projected["reports"].([]map[string]interface{})
+	assert.Equal(t, "marketing@example.com", reports[0]["mailbox_identifier"])
+}
+
+func TestOrgRelationship(t *testing.T) {
+	ctx := context.Background()
+	mailboxes := append(sampleOrg(), model.Mailbox{Identifier: "contractor@example.com"})
+	orgService := service.NewOrgService(&memoryMailboxRepo{mailboxes: mailboxes})
+
+	pathOf := func(relationship *model.OrgRelationship) []string {
+		identifiers := []string{}
+		for _, mailbox := range relationship.Path {
+			identifiers = append(identifiers, mailbox.Identifier)
+		}
+		return identifiers
+	}
+
+	relationship, err := orgService.GetRelationship(ctx, model.ScopeAll, "", "intern@example.com", "marketing@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "ceo@example.com", relationship.LowestCommonManager.Identifier)
+	assert.Equal(t, []string{"intern@example.com", "dev1@example.com", "cto@example.com", "ceo@example.com", "cmo@example.com", "marketing@example.com"}, pathOf(relationship))
+	assert.Equal(t, 5, *relationship.Distance)
+	assert.False(t, relationship.AInSubOrgOfB)
+	assert.False(t, relationship.BInSubOrgOfA)
+
+	relationship, err = orgService.GetRelationship(ctx, model.ScopeAll, "", "cto@example.com", "intern@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cto@example.com", relationship.LowestCommonManager.Identifier)
+	assert.Equal(t, 2, *relationship.Distance)
+	assert.True(t, relationship.BInSubOrgOfA)
+
+	relationship, err = orgService.GetRelationship(ctx, model.ScopeAll, "", "dev2@example.com", "dev2@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, *relationship.Distance)
+	assert.False(t, relationship.AInSubOrgOfB)
+
+	// Mailboxes in separate trees are not connected
+	relationship, err = orgService.GetRelationship(ctx, model.ScopeAll, "", "contractor@example.com", "ceo@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, relationship.LowestCommonManager)
+	assert.Nil(t, relationship.Distance)
+	assert.Empty(t, relationship.Path)
+
+	_, err = orgService.GetRelationship(ctx, model.ScopeSubOrg, "cto@example.com", "dev1@example.com", "marketing@example.com")
+	assert.ErrorIs(t, err, service.ErrOutOfScope)
+	_, err = orgService.GetRelationship(ctx, model.ScopeAll, "", "dev1@example.com", "nobody@example.com")
+	assert.ErrorIs(t, err, service.ErrMailboxNotFound)
+}
+
+func TestOrgTreeRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	repo := &memoryMailboxRepo{mailboxes: sampleOrg()}
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(repo, nil),
+		Org:     service.NewOrgService(repo),
+	})
+
+	serve := func(role authz.Role, subject string, path string) *httptest.ResponseRecorder {
+		token, _ := middleware.GenerateToken(cfg, keys, role, subject)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(authz.RoleManager, "cto@example.com", "/api/org/tree?depth=1&fields=mailbox_identifier")
+	require.Equal(t, http.StatusOK, w.Code)
+	var tree map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tree))
+	assert.Equal(t, "cto@example.com", tree["mailbox_identifier"])
+	assert.Len(t, tree["reports"], 2)
+
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleManager, "cto@example.com", "/api/org/tree?root=ceo@example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(authz.RoleCEO, "", "/api/org/tree?depth=-1").Code)
+	assert.Equal(t, http.StatusNotFound, serve(authz.RoleCEO, "", "/api/org/tree?root=nobody@example.com").Code)
+
+	w = serve(authz.RoleManager, "cto@example.com", "/api/org/export?format=mermaid")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "n0 --> n1")
+	assert.Equal(t, http.StatusForbidden, serve(authz.RoleManager, "cto@example.com", "/api/org/export?root=cmo@example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(authz.RoleCEO, "", "/api/org/export?format=png").Code)
+
+	w = serve(authz.RoleCEO, "", "/api/org/layout?orientation=horizontal&node_width=100")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var layout orgchart.Layout
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &layout))
+	assert.Len(t, layout.Nodes, 7)
+	w = serve(authz.RoleCEO, "", "/api/org/layout?format=svg")
+	assert.Equal(t, "image/svg+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	for _, query := range []string{"node_width=0", "node_height=-60", "sibling_spacing=NaN", "level_spacing=Inf", "node_width=-Inf", "sibling_spacing=0"} {
+		assert.Equal(t, http.StatusBadRequest, serve(authz.RoleCEO, "", "/api/org/layout?"+query).Code, query)
+	}
+	assert.Equal(t, http.StatusBadRequest, serve(authz.RoleCEO, "", "/api/org/layout?orientation=diagonal").Code)
+
+	assert.Equal(t, http.StatusOK, serve(authz.RoleManager, "cto@example.com", "/api/org/relationship?a=dev1@example.com&b=intern@example.com").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(authz.RoleCEO, "", "/api/org/relationship?a=dev1@example.com").Code)
+}
+
+func TestMailboxHierarchyRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	repo := &memoryMailboxRepo{mailboxes: sampleOrg()}
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(repo, nil),
+		Org:     service.NewOrgService(repo),
+	})
+
+	list := func(role authz.Role, subject string, path string) (int, []string, model.Pagination) {
+		token, _ := middleware.GenerateToken(cfg, keys, role, subject)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+
+		var response struct {
+			Data       []model.Mailbox  `json:"data"`
+			Pagination model.Pagination `json:"pagination"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+
+		identifiers := []string{}
+		for _, mailbox := range response.Data {
+			identifiers = append(identifiers, mailbox.Identifier)
+		}
+		return w.Code, identifiers, response.Pagination
+	}
+
+	code, identifiers, _ := list(authz.RoleCEO, "", "/api/mailboxes/intern@example.com/chain")
+	assert.Equal(t, http.StatusOK, code)
+	assert.ElementsMatch(t, []string{"dev1@example.com", "cto@example.com", "ceo@example.com"}, identifiers)
+
+	_, identifiers, _ = list(authz.RoleCEO, "", "/api/mailboxes/cto@example.com/reports")
+	assert.ElementsMatch(t, []string{"dev1@example.com", "dev2@example.com"}, identifiers)
+
+	_, identifiers, pagination := list(authz.RoleCEO, "", "/api/mailboxes/cto@example.com/reports?recursive=true&page_size=2")
+	assert.Len(t, identifiers, 2)
+	assert.Equal(t, 3, pagination.TotalItems)
+
+	_, identifiers, _ = list(authz.RoleCEO, "", "/api/mailboxes/dev1@example.com/peers")
+	assert.Equal(t, []string{"dev2@example.com"}, identifiers)
+
+	// Sub-org callers only see the part of the chain inside their sub-org
+	code, identifiers, _ = list(authz.RoleManager, "cto@example.com", "/api/mailboxes/intern@example.com/chain")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"dev1@example.com"}, identifiers)
+
+	code, _, _ = list(authz.RoleManager, "cto@example.com", "/api/mailboxes/cmo@example.com/reports")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _, _ = list(authz.RoleCEO, "", "/api/mailboxes/nobody@example.com/peers")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _, _ = list(authz.RoleCEO, "", "/api/mailboxes/cto@example.com/reports?recursive=maybe")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"mailbox-api/model"
+	"mailbox-api/orgchart"
+	"mailbox-api/orggraph"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func labelledOrg() *model.OrgTreeNode {
+	tree, _ := orggraph.New([]model.Mailbox{
+		{Identifier: "ceo@example.com", UserFullName: "Ada \"The Boss\" Lovelace", JobTitle: "CEO", DepartmentID: 1, Department: "Executive"},
+		{Identifier: "cto@example.com", UserFullName: "Grace Hopper", JobTitle: "CTO", DepartmentID: 2, Department: "Engineering", ManagerIdentifier: "ceo@example.com"},
+		{Identifier: "dev@example.com", UserFullName: "Linus Torvalds", JobTitle: "Engineer", DepartmentID: 2, Department: "Engineering", ManagerIdentifier: "cto@example.com"},
+	}).Tree("ceo@example.com", -1)
+	return tree
+}
+
+func export(t *testing.T, format string, cluster bool) string {
+	var b bytes.Buffer
+	require.NoError(t, orgchart.Export(&b, labelledOrg(), orgchart.ExportOptions{Format: format, ClusterByDepartment: cluster}))
+	return b.String()
+}
+
+func TestExportDOT(t *testing.T) {
+	dot := export(t, orgchart.FormatDOT, false)
+	assert.True(t, strings.HasPrefix(dot, "digraph org {"))
+	assert.Contains(t, dot, `"ceo@example.com" [label="Ada \"The Boss\" Lovelace\nCEO\nExecutive"];`)
+	assert.Contains(t, dot, `"cto@example.com" -> "dev@example.com";`)
+
+	clustered := export(t, orgchart.FormatDOT, true)
+	assert.Contains(t, clustered, `subgraph "cluster_2" {`)
+	assert.Contains(t, clustered, `label="Engineering";`)
+}
+
+func TestExportMermaid(t *testing.T) {
+	mermaid := export(t, orgchart.FormatMermaid, true)
+	assert.True(t, strings.HasPrefix(mermaid, "flowchart TB\n"))
+	assert.Contains(t, mermaid, `n0["Ada #quot;The Boss#quot; Lovelace<br/>CEO<br/>Executive"]`)
+	assert.Contains(t, mermaid, `subgraph d2["Engineering"]`)
+	assert.Contains(t, mermaid, "n1 --> n2")
+}
+
+func TestExportGraphML(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		graphML := export(t, orgchart.FormatGraphML, cluster)
+
+		var doc struct {
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+			} `xml:"graph>edge"`
+		}
+		require.NoError(t, xml.Unmarshal([]byte(graphML), &doc))
+		assert.Len(t, doc.Edges, 2)
+		assert.Equal(t, "ceo@example.com", doc.Edges[0].Source)
+		assert.Contains(t, graphML, `<data key="title">Engineer</data>`)
+	}
+
+	var b bytes.Buffer
+	assert.Error(t, orgchart.Export(&b, labelledOrg(), orgchart.ExportOptions{Format: "svg"}))
+}
+
+func TestLayout(t *testing.T) {
+	tree, _ := orggraph.New(sampleOrg()).Tree("ceo@example.com", -1)
+	options := orgchart.DefaultLayoutOptions()
+	layout := orgchart.NewLayout(tree, options)
+
+	require.Len(t, layout.Nodes, 7)
+	require.Len(t, layout.Edges, 6)
+
+	nodes := map[string]orgchart.LayoutNode{}
+	byDepth := map[int][]orgchart.LayoutNode{}
+	for _, node := range layout.Nodes {
+		nodes[node.Identifier] = node
+		byDepth[node.Depth] = append(byDepth[node.Depth], node)
+	}
+
+	// Nodes on the same level keep at least the sibling spacing
+	for _, level := range byDepth {
+		for i := 1; i < len(level); i++ {
+			assert.GreaterOrEqual(t, level[i].X-level[i-1].X, options.NodeWidth+options.SiblingSpacing)
+		}
+	}
+
+	// Managers are centred over their first and last report
+	cto := nodes["cto@example.com"]
+	assert.Equal(t, (nodes["dev1@example.com"].X+nodes["dev2@example.com"].X)/2, cto.X)
+	assert.Equal(t, nodes["intern@example.com"].X, nodes["dev1@example.com"].X)
+	assert.Equal(t, options.NodeHeight/2, nodes["ceo@example.com"].Y)
+	assert.Equal(t, cto.Y+options.NodeHeight+options.LevelSpacing, nodes["dev1@example.com"].Y)
+
+	assert.Equal(t, 3*options.NodeWidth+2*options.SiblingSpacing, layout.Width)
+	assert.Equal(t, layout.Width, nodes["ceo@example.com"].SubtreeWidth)
+	assert.Equal(t, 4*options.NodeHeight+3*options.LevelSpacing, layout.Height)
+
+	edge := layout.Edges[0]
+	assert.Equal(t, orgchart.Point{X: nodes["ceo@example.com"].X, Y: options.NodeHeight}, edge.Points[0])
+	assert.Equal(t, nodes[edge.Target].Y-options.NodeHeight/2, edge.Points[len(edge.Points)-1].Y)
+
+	// Collapsed managers are drawn as leaves and count what they hide
+	tree, _ = orggraph.New(append(sampleOrg(), model.Mailbox{Identifier: "dev3@example.com", ManagerIdentifier: "cto@example.com"})).Tree("ceo@example.com", -1)
+	options.CollapseAbove = 2
+	options.Orientation = orgchart.OrientationHorizontal
+	layout = orgchart.NewLayout(tree, options)
+	assert.Len(t, layout.Nodes, 4)
+	for _, node := range layout.Nodes {
+		if node.Identifier == "cto@example.com" {
+			assert.True(t, node.Collapsed)
+			assert.Equal(t, 4, node.HiddenReports)
+			assert.Equal(t, options.NodeWidth+options.LevelSpacing+options.NodeWidth/2, node.X)
+		}
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, orgchart.WriteSVG(&b, layout))
+	assert.True(t, strings.HasPrefix(b.String(), `<svg xmlns="http://www.w3.org/2000/svg"`))
+	assert.Equal(t, 4, strings.Count(b.String(), "<rect"))
+	assert.Contains(t, b.String(), "+4 more")
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"mailbox-api/model"
+	"mailbox-api/orggraph"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleOrg() []model.Mailbox {
+	return []model.Mailbox{
+		{Identifier: "ceo@example.com"},
+		{Identifier: "cto@example.com", ManagerIdentifier: "ceo@example.com"},
+		{Identifier: "cmo@example.com", ManagerIdentifier: "ceo@example.com"},
+		{Identifier: "dev1@example.com", ManagerIdentifier: "cto@example.com"},
+		{Identifier: "dev2@example.com", ManagerIdentifier: "cto@example.com"},
+		{Identifier: "intern@example.com", ManagerIdentifier: "dev1@example.com"},
+		{Identifier: "marketing@example.com", ManagerIdentifier: "cmo@example.com"},
+	}
+}
+
+// TestOrgGraphSubtree tests subtree listing and membership checks
+func TestOrgGraphSubtree(t *testing.T) {
+	graph := orggraph.New(sampleOrg())
+
+	identifiers := []string{}
+	for _, mailbox := range graph.Subtree("cto@example.com") {
+		identifiers = append(identifiers, mailbox.Identifier)
+	}
+	assert.Equal(t, []string{"dev1@example.com", "dev2@example.com", "intern@example.com"}, identifiers)
+
+	assert.Empty(t, graph.Subtree("intern@example.com"))
+	assert.Equal(t, []string{"dev1@example.com", "cto@example.com", "ceo@example.com"}, graph.Ancestors("intern@example.com"))
+
+	assert.True(t, graph.IsInSubOrg("cto@example.com", "intern@example.com"))
+	assert.True(t, graph.IsInSubOrg("ceo@example.com", "marketing@example.com"))
+	assert.False(t, graph.IsInSubOrg("cto@example.com", "marketing@example.com"))
+	assert.False(t, graph.IsInSubOrg("cto@example.com", "cto@example.com"))
+}
+
+// TestOrgGraphMetrics tests depth and sub-org size calculation
+func TestOrgGraphMetrics(t *testing.T) {
+	depths, sizes := orggraph.New(sampleOrg()).Metrics()
+
+	assert.Equal(t, 0, depths["ceo@example.com"])
+	assert.Equal(t, 1, depths["cto@example.com"])
+	assert.Equal(t, 3, depths["intern@example.com"])
+
+	assert.Equal(t, 6, sizes["ceo@example.com"])
+	assert.Equal(t, 3, sizes["cto@example.com"])
+	assert.Equal(t, 1, sizes["cmo@example.com"])
+	assert.Equal(t, 0, sizes["intern@example.com"])
+}
+
+// TestOrgGraphCycle tests that a reporting cycle does not hang traversal
+func TestOrgGraphCycle(t *testing.T) {
+	graph := orggraph.New([]model.Mailbox{
+		{Identifier: "a@example.com", ManagerIdentifier: "b@example.com"},
+		{Identifier: "b@example.com", ManagerIdentifier: "a@example.com"},
+		{Identifier: "c@example.com", ManagerIdentifier: "missing@example.com"},
+	})
+
+	assert.Equal(t, []string{"c@example.com"}, graph.Roots())
+	assert.Len(t, graph.Subtree("a@example.com"), 1)
+	assert.Equal(t, []string{"b@example.com"}, graph.Ancestors("a@example.com"))
+
+	depths, sizes := graph.Metrics()
+	assert.Len(t, depths, 3)
+	assert.Len(t, sizes, 3)
+}
+
+// TestOrgGraphLargeOrg tests metrics on a 50k-mailbox hierarchy
+func TestOrgGraphLargeOrg(t *testing.T) {
+	const n = 50000
+	mailboxes := make([]model.Mailbox, n)
+	for i := range mailboxes {
+		mailboxes[i].Identifier = fmt.Sprintf("m%d@example.com", i)
+		if i > 0 {
+			mailboxes[i].ManagerIdentifier = fmt.Sprintf("m%d@example.com", (i-1)/2)
+		}
+	}
+
+	depths, sizes := orggraph.New(mailboxes).Metrics()
+	assert.Equal(t, n-1, sizes["m0@example.com"])
+	assert.Equal(t, 15, depths[fmt.Sprintf("m%d@example.com", n-1)])
+}
+
+// TestOrgGraphIntegrity tests cycle, dangling manager and ordering checks
+func TestOrgGraphIntegrity(t *testing.T) {
+	graph := orggraph.New([]model.Mailbox{
+		{Identifier: "dev@example.com", ManagerIdentifier: "cto@example.com"},
+		{Identifier: "cto@example.com", ManagerIdentifier: "ceo@example.com"},
+		{Identifier: "ceo@example.com"},
+		{Identifier: "a@example.com", ManagerIdentifier: "b@example.com"},
+		{Identifier: "b@example.com", ManagerIdentifier: "c@example.com"},
+		{Identifier: "c@example.com", ManagerIdentifier: "a@example.com"},
+		{Identifier: "d@example.com", ManagerIdentifier: "a@example.com"},
+		{Identifier: "lost@example.com", ManagerIdentifier: "gone@example.com"},
+	})
+
+	assert.Equal(t, [][]string{{"a@example.com", "b@example.com", "c@example.com"}}, graph.Cycles())
+
+	dangling := graph.DanglingManagers()
+	assert.Len(t, dangling, 1)
+	assert.Equal(t, "lost@example.com", dangling[0].Identifier)
+
+	order := graph.TopologicalOrder()
+	assert.Len(t, order, 8)
+	assert.Equal(t, []string{"ceo@example.com", "lost@example.com", "cto@example.com", "dev@example.com"}, order[:4])
+}
@@ -0,0 +1,416 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"mailbox-api/model"
+	"mailbox-api/orggraph"
+	"mailbox-api/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireDB skips tests that need the integration test database, which
+// TestMain only sets up when integration tests are enabled.
+func requireDB(t *testing.T) {
+	if testDB == nil {
+		t.Skip("requires the integration test database")
+	}
+}
+
+// resetHierarchy replaces the stored mailboxes, which all join department
+// 1, with the given ones.
+func resetHierarchy(t *testing.T, mailboxes []model.Mailbox) {
+	ctx := context.Background()
+	_, err := testDB.Pool.Exec(ctx, `TRUNCATE import_plans, mailbox_closure, mailboxes, departments CASCADE`)
+	require.NoError(t, err)
+	_, err = testDB.Pool.Exec(ctx, `INSERT INTO departments (department_id, department_name) VALUES (1, 'Executive')`)
+	require.NoError(t, err)
+
+	for i := range mailboxes {
+		mailboxes[i].UserFullName = mailboxes[i].Identifier
+		mailboxes[i].JobTitle = "Staff"
+		mailboxes[i].DepartmentID = 1
+	}
+	require.NoError(t, testMailboxRepo.ImportMailboxes(ctx, mailboxes))
+}
+
+// TestConcurrentMovesCannotCreateCycle tests two moves that would only
+// close a cycle together: each is valid on its own
+func TestConcurrentMovesCannotCreateCycle(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		resetHierarchy(t, []model.Mailbox{
+			{Identifier: "root@example.com"},
+			{Identifier: "a@example.com", ManagerIdentifier: "root@example.com"},
+			{Identifier: "b@example.com", ManagerIdentifier: "root@example.com"},
+			{Identifier: "a-report@example.com", ManagerIdentifier: "a@example.com"},
+			{Identifier: "b-report@example.com", ManagerIdentifier: "b@example.com"},
+		})
+
+		moves := []model.Mailbox{
+			{Identifier: "a@example.com", ManagerIdentifier: "b-report@example.com"},
+			{Identifier: "b@example.com", ManagerIdentifier: "a-report@example.com"},
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(moves))
+		for i, move := range moves {
+			wg.Add(1)
+			go func(i int, move model.Mailbox) {
+				defer wg.Done()
+				move.UserFullName, move.JobTitle, move.DepartmentID = move.Identifier, "Staff", 1
+				errs[i] = testMailboxRepo.UpdateMailbox(ctx, move)
+			}(i, move)
+		}
+		wg.Wait()
+
+		// One of them is refused, or aborted as a deadlock
+		assert.False(t, errs[0] == nil && errs[1] == nil, "both moves committed")
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, repository.ErrReportingCycle) {
+				assert.ErrorContains(t, err, "deadlock")
+			}
+		}
+
+		var cyclic bool
+		err := testDB.Pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM mailbox_closure
+			WHERE ancestor_identifier = descendant_identifier AND depth > 0
+		)`).Scan(&cyclic)
+		require.NoError(t, err)
+		assert.False(t, cyclic)
+	}
+}
+
+// TestApplyPlanChecksDirectory tests that the plan repository refuses a plan
+// once any mailbox was added or changed after it was computed, including the
+// ones the plan leaves unchanged, and applies nothing
+func TestApplyPlanChecksDirectory(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+	plans := repository.NewImportPlanRepository(testDB)
+
+	// newPlan plans to move a below b, which the plan leaves unchanged
+	newPlan := func(id string) model.ImportPlan {
+		resetHierarchy(t, []model.Mailbox{
+			{Identifier: "root@example.com"},
+			{Identifier: "a@example.com", ManagerIdentifier: "root@example.com"},
+			{Identifier: "b@example.com", ManagerIdentifier: "root@example.com"},
+		})
+		all, err := testMailboxRepo.GetAllMailboxes(ctx)
+		require.NoError(t, err)
+
+		var before model.Mailbox
+		for _, mailbox := range all {
+			if mailbox.Identifier == "a@example.com" {
+				before = mailbox
+			}
+		}
+		after := before
+		after.ManagerIdentifier = "b@example.com"
+
+		plan := model.ImportPlan{
+			ID:               id,
+			Status:           model.PlanPending,
+			CreatedBy:        "hr@example.com",
+			DirectoryVersion: repository.DirectoryVersion(all),
+			Changes: []model.PlanChange{
+				{Action: model.ChangeMove, Identifier: before.Identifier, Fields: []string{"manager_mailbox_identifier"}, Before: &before, After: &after},
+			},
+		}
+		require.NoError(t, plans.CreatePlan(ctx, plan))
+		return plan
+	}
+
+	assertNotApplied := func(plan model.ImportPlan) {
+		_, err := plans.ApplyPlan(ctx, plan)
+		assert.ErrorIs(t, err, repository.ErrPlanStale)
+
+		stored, err := plans.GetPlan(ctx, plan.ID)
+		require.NoError(t, err)
+		assert.Equal(t, model.PlanPending, stored.Status)
+		a, err := testMailboxRepo.GetMailboxByIdentifier(ctx, "a@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "root@example.com", a.ManagerIdentifier)
+	}
+
+	t.Run("an unchanged mailbox moved", func(t *testing.T) {
+		plan := newPlan("moved")
+		moveMailbox(t, "b@example.com", "a@example.com")
+		assertNotApplied(plan)
+	})
+
+	t.Run("a mailbox was added", func(t *testing.T) {
+		plan := newPlan("added")
+		joiner := model.Mailbox{Identifier: "c@example.com", UserFullName: "c", JobTitle: "Staff", DepartmentID: 1, ManagerIdentifier: "a@example.com", Active: true}
+		require.NoError(t, testMailboxRepo.CreateMailbox(ctx, joiner))
+		assertNotApplied(plan)
+	})
+
+	t.Run("the directory is unchanged", func(t *testing.T) {
+		plan := newPlan("current")
+		applied, err := plans.ApplyPlan(ctx, plan)
+		require.NoError(t, err)
+		assert.True(t, applied)
+
+		a, err := testMailboxRepo.GetMailboxByIdentifier(ctx, "a@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "b@example.com", a.ManagerIdentifier)
+		assert.Equal(t, 2, a.OrgDepth)
+	})
+}
+
+// moveMailbox gives the stored mailbox a new manager.
+func moveMailbox(t *testing.T, identifier string, manager string) {
+	ctx := context.Background()
+	mailbox, err := testMailboxRepo.GetMailboxByIdentifier(ctx, identifier)
+	require.NoError(t, err)
+	require.NotNil(t, mailbox)
+	mailbox.ManagerIdentifier = manager
+	require.NoError(t, testMailboxRepo.UpdateMailbox(ctx, *mailbox))
+}
+
+// assertMetricsMatchGraph checks the stored org depth and sub-org size of
+// every mailbox against the metrics recomputed from the reporting lines.
+func assertMetricsMatchGraph(t *testing.T, step string) {
+	all, err := testMailboxRepo.GetAllMailboxes(context.Background())
+	require.NoError(t, err)
+
+	depths, subOrgSizes := orggraph.New(all).Metrics()
+	for _, mailbox := range all {
+		assert.Equal(t, depths[mailbox.Identifier], mailbox.OrgDepth, "%s: org_depth of %s", step, mailbox.Identifier)
+		assert.Equal(t, subOrgSizes[mailbox.Identifier], mailbox.SubOrgSize, "%s: sub_org_size of %s", step, mailbox.Identifier)
+	}
+}
+
+// TestIncrementalOrgMetrics tests that creates, moves and deletes keep the
+// org depth and sub-org size of every mailbox as a full recount would
+func TestIncrementalOrgMetrics(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+	resetHierarchy(t, sampleOrg())
+	assertMetricsMatchGraph(t, "import")
+
+	joiner := model.Mailbox{Identifier: "dev3@example.com", UserFullName: "dev3", JobTitle: "Staff", DepartmentID: 1, ManagerIdentifier: "intern@example.com", Active: true}
+	require.NoError(t, testMailboxRepo.CreateMailbox(ctx, joiner))
+	assertMetricsMatchGraph(t, "create below a leaf")
+
+	// Moving a subtree deeper, shallower, to the top and back
+	moveMailbox(t, "cto@example.com", "marketing@example.com")
+	assertMetricsMatchGraph(t, "move subtree deeper")
+	moveMailbox(t, "dev1@example.com", "ceo@example.com")
+	assertMetricsMatchGraph(t, "move subtree shallower")
+	moveMailbox(t, "dev1@example.com", "")
+	assertMetricsMatchGraph(t, "move subtree to the top")
+	moveMailbox(t, "dev1@example.com", "dev2@example.com")
+	assertMetricsMatchGraph(t, "move subtree below a sibling")
+
+	// Deleting leaves shrinks every ancestor
+	require.NoError(t, testMailboxRepo.DeleteMailbox(ctx, "dev3@example.com"))
+	assertMetricsMatchGraph(t, "delete deep leaf")
+	require.NoError(t, testMailboxRepo.DeleteMailbox(ctx, "intern@example.com"))
+	assertMetricsMatchGraph(t, "delete leaf")
+	moveMailbox(t, "dev1@example.com", "ceo@example.com")
+	require.NoError(t, testMailboxRepo.DeleteMailbox(ctx, "dev1@example.com"))
+	assertMetricsMatchGraph(t, "delete after moving out")
+
+	// A full recount agrees with the incremental updates
+	require.NoError(t, testMailboxRepo.CalculateOrgMetrics(ctx))
+	assertMetricsMatchGraph(t, "recount")
+}
+
+// closurePath is a row of the closure table.
+type closurePath struct {
+	ancestor   string
+	descendant string
+	depth      int
+}
+
+// assertClosureMatchesGraph checks the closure table against the paths of
+// the reporting lines: one row per mailbox and ancestor, and a self row.
+func assertClosureMatchesGraph(t *testing.T, step string) {
+	ctx := context.Background()
+	all, err := testMailboxRepo.GetAllMailboxes(ctx)
+	require.NoError(t, err)
+
+	graph := orggraph.New(all)
+	expected := []closurePath{}
+	for _, mailbox := range all {
+		expected = append(expected, closurePath{mailbox.Identifier, mailbox.Identifier, 0})
+		for i, ancestor := range graph.Ancestors(mailbox.Identifier) {
+			expected = append(expected, closurePath{ancestor, mailbox.Identifier, i + 1})
+		}
+	}
+
+	rows, err := testDB.Pool.Query(ctx, `SELECT ancestor_identifier, descendant_identifier, depth FROM mailbox_closure`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	stored := []closurePath{}
+	for rows.Next() {
+		var path closurePath
+		require.NoError(t, rows.Scan(&path.ancestor, &path.descendant, &path.depth))
+		stored = append(stored, path)
+	}
+	require.NoError(t, rows.Err())
+
+	assert.ElementsMatch(t, expected, stored, step)
+}
+
+// TestClosureMaintenance tests the closure paths that creates insert, that
+// moves rewrite for the whole subtree, that deletes cascade away and that a
+// rebuild restores
+func TestClosureMaintenance(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+	resetHierarchy(t, sampleOrg())
+	assertClosureMatchesGraph(t, "import")
+
+	joiner := model.Mailbox{Identifier: "dev3@example.com", UserFullName: "dev3", JobTitle: "Staff", DepartmentID: 1, ManagerIdentifier: "intern@example.com", Active: true}
+	require.NoError(t, testMailboxRepo.CreateMailbox(ctx, joiner))
+	assertClosureMatchesGraph(t, "insert paths below a leaf")
+
+	top := model.Mailbox{Identifier: "board@example.com", UserFullName: "board", JobTitle: "Staff", DepartmentID: 1, Active: true}
+	require.NoError(t, testMailboxRepo.CreateMailbox(ctx, top))
+	assertClosureMatchesGraph(t, "insert a top-level mailbox")
+
+	moveMailbox(t, "cto@example.com", "marketing@example.com")
+	assertClosureMatchesGraph(t, "move subtree")
+	moveMailbox(t, "dev1@example.com", "")
+	assertClosureMatchesGraph(t, "move subtree to the top")
+	moveMailbox(t, "ceo@example.com", "board@example.com")
+	assertClosureMatchesGraph(t, "move the top of the org")
+
+	require.NoError(t, testMailboxRepo.DeleteMailbox(ctx, "dev3@example.com"))
+	assertClosureMatchesGraph(t, "delete cascades")
+
+	// A rebuild restores a damaged table
+	_, err := testDB.Pool.Exec(ctx, `DELETE FROM mailbox_closure WHERE depth > 1`)
+	require.NoError(t, err)
+	_, err = testDB.Pool.Exec(ctx, `INSERT INTO mailbox_closure VALUES ('marketing@example.com', 'ceo@example.com', 7)`)
+	require.NoError(t, err)
+	require.NoError(t, testMailboxRepo.CalculateOrgMetrics(ctx))
+	assertClosureMatchesGraph(t, "rebuild")
+}
+
+// TestDepartmentSummariesCountActiveMailboxes tests that the headcount,
+// manager count and average org depth of a department leave out the
+// mailboxes that were deactivated
+func TestDepartmentSummariesCountActiveMailboxes(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+
+	resetHierarchy(t, []model.Mailbox{
+		{Identifier: "root@example.com"},
+		{Identifier: "a@example.com", ManagerIdentifier: "root@example.com"},
+		{Identifier: "leaver@example.com", ManagerIdentifier: "a@example.com"},
+	})
+	_, err := testDB.Pool.Exec(ctx, `UPDATE mailboxes SET active = FALSE WHERE mailbox_identifier = 'leaver@example.com'`)
+	require.NoError(t, err)
+
+	summaries, err := testDepartmentRepo.GetDepartmentSummaries(ctx)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+
+	assert.Equal(t, 2, summaries[0].Headcount)
+	assert.Equal(t, 1, summaries[0].ManagerCount)
+	assert.Equal(t, 0.5, summaries[0].AverageOrgDepth)
+}
+
+// TestConcurrentDepartmentCreates tests that departments created at the same
+// time without an ID each get their own, and that a taken ID is reported as
+// such
+func TestConcurrentDepartmentCreates(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+	resetHierarchy(t, []model.Mailbox{{Identifier: "root@example.com"}})
+
+	const creates = 4
+	var wg sync.WaitGroup
+	ids := make([]int, creates)
+	errs := make([]error, creates)
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = testDepartmentRepo.CreateDepartment(ctx, model.Department{Name: "Team"}, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for i := range ids {
+		require.NoError(t, errs[i])
+		assert.False(t, seen[ids[i]], "department %d created twice", ids[i])
+		seen[ids[i]] = true
+	}
+
+	_, err := testDepartmentRepo.CreateDepartment(ctx, model.Department{ID: 1, Name: "Duplicate"}, nil)
+	assert.ErrorIs(t, err, repository.ErrDepartmentExists)
+}
+
+// TestDeleteDepartmentReasons tests that a refused delete reports what keeps
+// the department
+func TestDeleteDepartmentReasons(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+	resetHierarchy(t, []model.Mailbox{{Identifier: "root@example.com"}})
+
+	_, err := testDepartmentRepo.CreateDepartment(ctx, model.Department{ID: 2, Name: "Engineering", ParentID: 1}, nil)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, testDepartmentRepo.DeleteDepartment(ctx, 1), repository.ErrDepartmentHasSubDepartments)
+	assert.NoError(t, testDepartmentRepo.DeleteDepartment(ctx, 2))
+	assert.ErrorIs(t, testDepartmentRepo.DeleteDepartment(ctx, 2), repository.ErrDepartmentNotFound)
+	assert.ErrorIs(t, testDepartmentRepo.DeleteDepartment(ctx, 1), repository.ErrDepartmentHasMembers)
+}
+
+// TestConcurrentParentChangesCannotCreateCycle tests two parent changes that
+// would only close a department cycle together: each is valid on its own
+func TestConcurrentParentChangesCannotCreateCycle(t *testing.T) {
+	requireDB(t)
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		resetHierarchy(t, []model.Mailbox{{Identifier: "root@example.com"}})
+		for _, department := range []model.Department{
+			{ID: 2, Name: "A", ParentID: 1},
+			{ID: 3, Name: "B", ParentID: 1},
+		} {
+			_, err := testDepartmentRepo.CreateDepartment(ctx, department, nil)
+			require.NoError(t, err)
+		}
+
+		changes := []model.Department{
+			{ID: 2, Name: "A", ParentID: 3},
+			{ID: 3, Name: "B", ParentID: 2},
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(changes))
+		for i, change := range changes {
+			wg.Add(1)
+			go func(i int, change model.Department) {
+				defer wg.Done()
+				errs[i] = testDepartmentRepo.UpdateDepartment(ctx, change)
+			}(i, change)
+		}
+		wg.Wait()
+
+		// One of them is refused, or aborted as a deadlock
+		assert.False(t, errs[0] == nil && errs[1] == nil, "both changes committed")
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, repository.ErrDepartmentCycle) {
+				assert.ErrorContains(t, err, "deadlock")
+			}
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/scim"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scimUser(t *testing.T, mailbox model.Mailbox) map[string]interface{} {
+	resource, err := scim.ToMap(scim.NewUser(mailbox, "https://example.com/scim/v2"))
+	require.NoError(t, err)
+	return resource
+}
+
+// TestSCIMFilter tests filter parsing and evaluation against resources
+func TestSCIMFilter(t *testing.T) {
+	user := scimUser(t, model.Mailbox{
+		Identifier:        "jane@example.com",
+		UserFullName:      "Jane Doe",
+		JobTitle:          "Engineer",
+		Department:        "Engineering",
+		DepartmentID:      3,
+		ManagerIdentifier: "cto@example.com",
+		Active:            true,
+	})
+
+	matches := map[string]bool{
+		`userName eq "JANE@example.com"`:              true,
+		`userName ne "jane@example.com"`:              false,
+		`name.familyName sw "Do" and title co "gine"`: true,
+		`active eq false or displayName ew "doe"`:     true,
+		`not (active eq true)`:                        false,
+		`emails[type eq "work" and value co "jane"]`:  true,
+		`emails.value eq "jane@example.com"`:          true,
+		`groups eq "3"`:                               true,
+		`title pr`:                                    true,
+		`externalId pr`:                               false,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "jane@example.com"`:                     true,
+		`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager.value eq "cto@example.com"`: true,
+		`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department eq "Sales"`:              false,
+	}
+	for expression, want := range matches {
+		filter, err := scim.ParseFilter(expression)
+		require.NoError(t, err, expression)
+		assert.Equal(t, want, filter.Match(user), expression)
+	}
+
+	filter, err := scim.ParseFilter(`active eq true and userName eq "jane@example.com"`)
+	require.NoError(t, err)
+	identifier, ok := filter.Equality("userName")
+	assert.True(t, ok)
+	assert.Equal(t, "jane@example.com", identifier)
+
+	// An or cannot narrow the query
+	filter, err = scim.ParseFilter(`userName eq "jane@example.com" or active eq true`)
+	require.NoError(t, err)
+	_, ok = filter.Equality("userName")
+	assert.False(t, ok)
+
+	for _, expression := range []string{`userName eq`, `userName foo "x"`, `(userName eq "x"`, `userName eq "x`, `"x" eq userName`} {
+		_, err := scim.ParseFilter(expression)
+		var scimErr *scim.Error
+		require.ErrorAs(t, err, &scimErr, expression)
+		assert.Equal(t, scim.ErrInvalidFilter, scimErr.ScimType, expression)
+	}
+}
+
+// TestSCIMPatch tests PATCH operations as identity providers send them
+func TestSCIMPatch(t *testing.T) {
+	apply := func(t *testing.T, resource map[string]interface{}, body string) error {
+		var patch scim.PatchOp
+		require.NoError(t, json.Unmarshal([]byte(body), &patch))
+		return patch.Apply(resource)
+	}
+
+	t.Run("replaces attributes with and without paths", func(t *testing.T) {
+		user := scimUser(t, model.Mailbox{Identifier: "jane@example.com", UserFullName: "Jane Doe", JobTitle: "Engineer", Active: true})
+
+		require.NoError(t, apply(t, user, `{"Operations": [
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "replace", "value": {"title": "Staff Engineer", "displayName": "Jane Roe"}},
+			{"op": "add", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager", "value": "cto@example.com"},
+			{"op": "replace", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "Platform"}
+		]}`))
+
+		var patched scim.User
+		require.NoError(t, scim.FromMap(user, &patched))
+		assert.False(t, bool(*patched.Active))
+		assert.Equal(t, "Staff Engineer", patched.Title)
+		assert.Equal(t, "Jane Roe", patched.DisplayName)
+		assert.Equal(t, "cto@example.com", patched.Enterprise.Manager.Value)
+		assert.Equal(t, "Platform", patched.Enterprise.Department)
+
+		require.NoError(t, apply(t, user, `{"Operations": [{"op": "remove", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager"}]}`))
+		patched = scim.User{}
+		require.NoError(t, scim.FromMap(user, &patched))
+		assert.Nil(t, patched.Enterprise.Manager)
+	})
+
+	t.Run("adds and removes group members", func(t *testing.T) {
+		group, err := scim.ToMap(scim.NewGroup(model.Department{ID: 2, Name: "Sales"}, []model.Mailbox{{Identifier: "a@example.com"}, {Identifier: "b@example.com"}}, ""))
+		require.NoError(t, err)
+
+		require.NoError(t, apply(t, group, `{"Operations": [
+			{"op": "add", "path": "members", "value": [{"value": "b@example.com"}, {"value": "c@example.com"}]},
+			{"op": "remove", "path": "members", "value": [{"value": "a@example.com"}]},
+			{"op": "remove", "path": "members[value eq \"missing@example.com\"]"}
+		]}`))
+
+		var patched scim.Group
+		require.NoError(t, scim.FromMap(group, &patched))
+		members := []string{}
+		for _, member := range patched.Members {
+			members = append(members, member.Value)
+		}
+		assert.Equal(t, []string{"b@example.com", "c@example.com"}, members)
+	})
+
+	t.Run("rejects invalid operations", func(t *testing.T) {
+		user := scimUser(t, model.Mailbox{Identifier: "jane@example.com"})
+
+		var scimErr *scim.Error
+		require.ErrorAs(t, apply(t, user, `{"Operations": [{"op": "move", "path": "title"}]}`), &scimErr)
+		assert.Equal(t, scim.ErrInvalidSyntax, scimErr.ScimType)
+		require.ErrorAs(t, apply(t, user, `{"Operations": [{"op": "replace", "path": "emails[type eq \"home\"].value", "value": "x"}]}`), &scimErr)
+		assert.Equal(t, scim.ErrNoTarget, scimErr.ScimType)
+		require.ErrorAs(t, apply(t, user, `{"Operations": [{"op": "remove"}]}`), &scimErr)
+		assert.Equal(t, scim.ErrNoTarget, scimErr.ScimType)
+	})
+}
+
+// TestSCIMRoutes tests provisioning joiners, movers and leavers through the
+// SCIM endpoints
+func TestSCIMRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	mailboxes, departments := importFixture()
+	mailboxes.mailboxes[0].UserFullName = "Chief Executive"
+	mailboxes.mailboxes[0].JobTitle = "CEO"
+	mailboxes.mailboxes[0].Active = true
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox:    service.NewMailboxService(mailboxes, departments),
+		Org:        service.NewOrgService(mailboxes),
+		Department: service.NewDepartmentService(departments),
+	})
+
+	serve := func(role authz.Role, method string, path string, body string) (int, map[string]interface{}) {
+		token, _ := middleware.GenerateToken(cfg, keys, role, "")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", scim.ContentType)
+		r.GetEngine().ServeHTTP(w, req)
+
+		// The memory repository does not resolve department names on writes
+		for i := range mailboxes.mailboxes {
+			mailboxes.mailboxes[i].Department = departments.departments[mailboxes.mailboxes[i].DepartmentID].Name
+		}
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	mailbox := func(identifier string) model.Mailbox {
+		for _, mailbox := range mailboxes.mailboxes {
+			if mailbox.Identifier == identifier {
+				return mailbox
+			}
+		}
+		return model.Mailbox{}
+	}
+
+	t.Run("describes the service provider", func(t *testing.T) {
+		code, config := serve(authz.RoleSelf, "GET", "/scim/v2/ServiceProviderConfig", "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, true, config["patch"].(map[string]interface{})["supported"])
+		assert.Equal(t, float64(scim.MaxResults), config["filter"].(map[string]interface{})["maxResults"])
+
+		code, resourceTypes := serve(authz.RoleSelf, "GET", "/scim/v2/ResourceTypes", "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(2), resourceTypes["totalResults"])
+
+		code, _ = serve(authz.RoleSelf, "GET", "/scim/v2/Schemas/"+scim.SchemaEnterpriseUser, "")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("creates users with a department name and manager", func(t *testing.T) {
+		code, user := serve(authz.RoleHR, "POST", "/scim/v2/Users", `{
+			"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+			"userName": "rep@example.com",
+			"name": {"givenName": "Sam", "familyName": "Rep"},
+			"title": "Account Executive",
+			"active": true,
+			"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "sales", "manager": {"value": "ceo@example.com"}}
+		}`)
+		require.Equal(t, http.StatusCreated, code, user)
+		assert.Equal(t, "rep@example.com", user["id"])
+
+		created := mailbox("rep@example.com")
+		assert.Equal(t, "Sam Rep", created.UserFullName)
+		assert.Equal(t, 2, created.DepartmentID)
+		assert.Equal(t, "ceo@example.com", created.ManagerIdentifier)
+		assert.True(t, created.Active)
+
+		code, failure := serve(authz.RoleHR, "POST", "/scim/v2/Users", `{"userName": "rep@example.com", "displayName": "Rep", "title": "AE", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Sales"}}`)
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, scim.ErrUniqueness, failure["scimType"])
+
+		code, failure = serve(authz.RoleHR, "POST", "/scim/v2/Users", `{"userName": "new@example.com", "displayName": "New", "title": "AE", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Legal"}}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, scim.ErrInvalidValue, failure["scimType"])
+
+		code, _ = serve(authz.RoleAuditor, "POST", "/scim/v2/Users", `{"userName": "new@example.com", "displayName": "New", "title": "AE", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Sales"}}`)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("lists users with filters and pagination", func(t *testing.T) {
+		code, list := serve(authz.RoleAuditor, "GET", `/scim/v2/Users?filter=userName+eq+"REP@example.com"`, "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(1), list["totalResults"])
+
+		code, list = serve(authz.RoleAuditor, "GET", "/scim/v2/Users?startIndex=2&count=1&attributes=userName", "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(2), list["totalResults"])
+		assert.Equal(t, float64(2), list["startIndex"])
+		resources := list["Resources"].([]interface{})
+		require.Len(t, resources, 1)
+		assert.NotContains(t, resources[0], "title")
+		assert.Contains(t, resources[0], "userName")
+
+		code, failure := serve(authz.RoleAuditor, "GET", `/scim/v2/Users?filter=userName+eq`, "")
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, scim.ErrInvalidFilter, failure["scimType"])
+
+		code, _ = serve(authz.RoleAuditor, "GET", "/scim/v2/Users/missing@example.com", "")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("patches movers and leavers", func(t *testing.T) {
+		code, user := serve(authz.RoleHR, "PATCH", "/scim/v2/Users/rep@example.com", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [
+				{"op": "Replace", "path": "title", "value": "Sales Manager"},
+				{"op": "Replace", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "Executive"}
+			]
+		}`)
+		require.Equal(t, http.StatusOK, code, user)
+		assert.Equal(t, "Sales Manager", mailbox("rep@example.com").JobTitle)
+		assert.Equal(t, 1, mailbox("rep@example.com").DepartmentID)
+
+		code, _ = serve(authz.RoleHR, "PATCH", "/scim/v2/Users/rep@example.com", `{"Operations": [{"op": "replace", "path": "active", "value": "False"}]}`)
+		require.Equal(t, http.StatusOK, code)
+		assert.False(t, mailbox("rep@example.com").Active)
+
+		code, failure := serve(authz.RoleHR, "PATCH", "/scim/v2/Users/rep@example.com", `{"Operations": [{"op": "replace", "path": "userName", "value": "other@example.com"}]}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, scim.ErrMutability, failure["scimType"])
+
+		code, _ = serve(authz.RoleHR, "DELETE", "/scim/v2/Users/ceo@example.com", "")
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("moves group members between departments", func(t *testing.T) {
+		code, group := serve(authz.RoleAuditor, "GET", "/scim/v2/Groups/1", "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "Executive", group["displayName"])
+		assert.Len(t, group["members"], 2)
+
+		code, _ = serve(authz.RoleAuditor, "PATCH", "/scim/v2/Groups/2", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "rep@example.com"}]}]}`)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, group = serve(authz.RoleHR, "PATCH", "/scim/v2/Groups/2", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "rep@example.com"}]}]}`)
+		require.Equal(t, http.StatusOK, code, group)
+		assert.Equal(t, 2, mailbox("rep@example.com").DepartmentID)
+
+		// Members leave a department only by joining another
+		code, failure := serve(authz.RoleHR, "PATCH", "/scim/v2/Groups/2", `{"Operations": [{"op": "remove", "path": "members[value eq \"rep@example.com\"]"}]}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, scim.ErrMutability, failure["scimType"])
+
+		code, group = serve(authz.RoleHR, "POST", "/scim/v2/Groups", `{"displayName": "Legal", "members": [{"value": "rep@example.com"}]}`)
+		require.Equal(t, http.StatusCreated, code, group)
+		assert.Equal(t, "3", group["id"])
+		assert.Equal(t, 3, mailbox("rep@example.com").DepartmentID)
+
+		code, list := serve(authz.RoleHR, "GET", `/scim/v2/Groups?filter=displayName+eq+"legal"&excludedAttributes=members`, "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(1), list["totalResults"])
+		assert.NotContains(t, list["Resources"].([]interface{})[0], "members")
+	})
+
+	t.Run("accepts API keys as bearer tokens", func(t *testing.T) {
+		apiKeys := service.NewAPIKeyService(newMemoryAPIKeyRepo(), mailboxes)
+		keyRouter := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+			Mailbox:    service.NewMailboxService(mailboxes, departments),
+			Org:        service.NewOrgService(mailboxes),
+			Department: service.NewDepartmentService(departments),
+			APIKey:     apiKeys,
+		})
+
+		created, err := apiKeys.CreateAPIKey(context.Background(), model.APIKeyInput{Name: "idp", Scopes: []string{"mailbox:read:all"}}, authz.DefaultPolicy().Grants(authz.RoleAdmin), "admin")
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/scim/v2/Users/ceo@example.com", nil)
+		req.Header.Set("Authorization", "Bearer "+created.Key)
+		keyRouter.GetEngine().ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, scim.ContentType, w.Header().Get("Content-Type"))
+	})
+}
+
+// TestSCIMWriteScope tests that callers scoped to a sub-org cannot provision
+// users outside it, including by leaving out the manager
+func TestSCIMWriteScope(t *testing.T) {
+	mailboxes, departments := mailboxFixture()
+	serve := mailboxServer(mailboxes, departments)
+
+	cto := func(method string, path string, body string) int {
+		return serve(authz.RoleCTO, "cto@example.com", method, path, body).Code
+	}
+
+	joiner := `{"userName": "dev3@example.com", "displayName": "Dev Three", "title": "Engineer",
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Engineering"%s}}`
+	assert.Equal(t, http.StatusForbidden, cto("POST", "/scim/v2/Users", fmt.Sprintf(joiner, "")))
+	assert.Equal(t, http.StatusForbidden, cto("POST", "/scim/v2/Users", fmt.Sprintf(joiner, `, "manager": "cmo@example.com"`)))
+	assert.Equal(t, http.StatusCreated, cto("POST", "/scim/v2/Users", fmt.Sprintf(joiner, `, "manager": "dev1@example.com"`)))
+
+	assert.Equal(t, http.StatusForbidden, cto("PUT", "/scim/v2/Users/dev2@example.com", `{"userName": "dev2@example.com", "displayName": "Dev Two", "title": "Engineer",
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Executive"}}`))
+	assert.Equal(t, http.StatusForbidden, cto("PATCH", "/scim/v2/Users/dev2@example.com", `{"Operations": [{"op": "remove", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager"}]}`))
+	assert.Equal(t, http.StatusOK, cto("PATCH", "/scim/v2/Users/dev2@example.com", `{"Operations": [{"op": "replace", "path": "title", "value": "Senior Engineer"}]}`))
+
+	dev2, _ := mailboxes.GetMailboxByIdentifier(context.Background(), "dev2@example.com")
+	assert.Equal(t, "cto@example.com", dev2.ManagerIdentifier)
+	assert.Equal(t, "Senior Engineer", dev2.JobTitle)
+}
+
+// streamCountingRepo counts the mailboxes streamed from it.
+type streamCountingRepo struct {
+	*memoryMailboxRepo
+	streamed int
+}
+
+func (r *streamCountingRepo) StreamMailboxes(ctx context.Context, filter model.MailboxFilter, fn func(model.Mailbox) error) error {
+	return r.memoryMailboxRepo.StreamMailboxes(ctx, filter, func(mailbox model.Mailbox) error {
+		r.streamed++
+		return fn(mailbox)
+	})
+}
+
+// TestSCIMWritesAllOrNothing tests that a user or group is written whole or
+// not at all, and that user name lookups ignore case without reading the
+// whole directory
+func TestSCIMWritesAllOrNothing(t *testing.T) {
+	mailboxes, departments := mailboxFixture()
+	counting := &streamCountingRepo{memoryMailboxRepo: mailboxes}
+	serve := mailboxServer(counting, departments)
+
+	hr := func(method string, path string, body string) *httptest.ResponseRecorder {
+		return serve(authz.RoleHR, "hr@example.com", method, path, body)
+	}
+
+	// A group with a member that is not a user is not created, and no
+	// member is moved
+	w := hr("POST", "/scim/v2/Groups", `{"displayName": "Legal", "members": [{"value": "dev1@example.com"}, {"value": "missing@example.com"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	assert.Len(t, departments.departments, 2)
+	dev1, _ := mailboxes.GetMailboxByIdentifier(context.Background(), "dev1@example.com")
+	assert.Equal(t, 1, dev1.DepartmentID)
+
+	w = hr("POST", "/scim/v2/Groups", `{"displayName": "Legal", "members": [{"value": "dev1@example.com"}, {"value": "dev1@example.com"}, {"value": "dev2@example.com"}]}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	dev1, _ = mailboxes.GetMailboxByIdentifier(context.Background(), "dev1@example.com")
+	dev2, _ := mailboxes.GetMailboxByIdentifier(context.Background(), "dev2@example.com")
+	assert.Equal(t, 3, dev1.DepartmentID)
+	assert.Equal(t, 3, dev2.DepartmentID)
+
+	// A user sent inactive is created inactive
+	w = hr("POST", "/scim/v2/Users", `{"userName": "starter@example.com", "displayName": "Starter", "title": "Engineer", "active": false,
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"department": "Engineering", "manager": {"value": "cto@example.com"}}}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	starter, _ := mailboxes.GetMailboxByIdentifier(context.Background(), "starter@example.com")
+	require.NotNil(t, starter)
+	assert.False(t, starter.Active)
+
+	// Lookups read only the mailbox asked for, whatever its case
+	counting.streamed = 0
+	w = hr("GET", `/scim/v2/Users?filter=userName+eq+"DEV2@Example.com"`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"totalResults":1`)
+	assert.Equal(t, 1, counting.streamed)
+
+	counting.streamed = 0
+	w = hr("GET", `/scim/v2/Users?filter=userName+eq+"nobody@example.com"`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"totalResults":0`)
+	assert.Equal(t, 0, counting.streamed)
+
+	// Callers scoped to a sub-org find themselves and their reports only
+	w = serve(authz.RoleCTO, "cto@example.com", "GET", `/scim/v2/Users?filter=userName+eq+"CTO@example.com"`, "")
+	assert.Contains(t, w.Body.String(), `"totalResults":1`)
+	w = serve(authz.RoleCTO, "cto@example.com", "GET", `/scim/v2/Users?filter=userName+eq+"cmo@example.com"`, "")
+	assert.Contains(t, w.Body.String(), `"totalResults":0`)
+}
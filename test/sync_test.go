@@ -0,0 +1,302 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mailbox-api/api/middleware"
+	"mailbox-api/api/router"
+	"mailbox-api/authz"
+	"mailbox-api/config"
+	"mailbox-api/jwtkeys"
+	"mailbox-api/logger"
+	"mailbox-api/model"
+	"mailbox-api/repository"
+	"mailbox-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryImportPlanRepo keeps plans in memory and applies them to the
+// mailboxes of a memoryMailboxRepo, checking the directory version first as
+// the repository does.
+type memoryImportPlanRepo struct {
+	plans     map[string]model.ImportPlan
+	mailboxes *memoryMailboxRepo
+}
+
+func (r *memoryImportPlanRepo) CreatePlan(ctx context.Context, plan model.ImportPlan) error {
+	plan.CreatedAt = time.Now()
+	r.plans[plan.ID] = plan
+	return nil
+}
+
+func (r *memoryImportPlanRepo) GetPlan(ctx context.Context, id string) (*model.ImportPlan, error) {
+	plan, ok := r.plans[id]
+	if !ok {
+		return nil, nil
+	}
+	return &plan, nil
+}
+
+func (r *memoryImportPlanRepo) ListPlans(ctx context.Context) ([]model.ImportPlan, error) {
+	plans := []model.ImportPlan{}
+	for _, plan := range r.plans {
+		plan.Changes = nil
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+func (r *memoryImportPlanRepo) ApplyPlan(ctx context.Context, plan model.ImportPlan) (bool, error) {
+	if r.plans[plan.ID].Status != model.PlanPending {
+		return false, nil
+	}
+
+	if repository.DirectoryVersion(r.mailboxes.mailboxes) != plan.DirectoryVersion {
+		return false, repository.ErrPlanStale
+	}
+
+	for _, change := range plan.Changes {
+		switch change.Action {
+		case model.ChangeAdd:
+			r.mailboxes.mailboxes = append(r.mailboxes.mailboxes, *change.After)
+		default:
+			for i, mailbox := range r.mailboxes.mailboxes {
+				if mailbox.Identifier != change.Identifier {
+					continue
+				}
+				if change.Action == model.ChangeDeactivate {
+					r.mailboxes.mailboxes[i].Active = false
+				} else {
+					r.mailboxes.mailboxes[i] = *change.After
+				}
+			}
+		}
+	}
+
+	appliedAt := time.Now()
+	plan.Status = model.PlanApplied
+	plan.AppliedAt = &appliedAt
+	r.plans[plan.ID] = plan
+	return true, nil
+}
+
+func syncFixture() (*memoryMailboxRepo, *memoryDepartmentRepo, *memoryImportPlanRepo) {
+	mailboxes, departments := importFixture()
+	mailboxes.mailboxes = []model.Mailbox{
+		{Identifier: "ceo@example.com", UserFullName: "Ceo", JobTitle: "CEO", DepartmentID: 1, Active: true},
+		{Identifier: "cto@example.com", UserFullName: "Cto", JobTitle: "CTO", DepartmentID: 1, ManagerIdentifier: "ceo@example.com", Active: true},
+		{Identifier: "dev@example.com", UserFullName: "Dev", JobTitle: "Developer", DepartmentID: 1, ManagerIdentifier: "cto@example.com", Active: true},
+		{Identifier: "gone@example.com", UserFullName: "Gone", JobTitle: "Rep", DepartmentID: 2, ManagerIdentifier: "ceo@example.com", Active: true},
+	}
+	return mailboxes, departments, &memoryImportPlanRepo{plans: map[string]model.ImportPlan{}, mailboxes: mailboxes}
+}
+
+const syncRoster = "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+	"dev@example.com,Dev,Developer,1,lead@example.com\n" +
+	"lead@example.com,Lead,Team Lead,1,cto@example.com\n" +
+	"cto@example.com,Cto,\"CTO, Platform\",1,ceo@example.com\n" +
+	"ceo@example.com,Ceo,CEO,1,null\n"
+
+// TestSyncPlan tests the diff between a roster and the directory and
+// applying the resulting plan
+func TestSyncPlan(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("plans and applies changes", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, syncRoster, false, "hr@example.com")
+		require.NoError(t, err)
+		require.Empty(t, result.Errors)
+		require.NotNil(t, result.Plan)
+
+		plan := result.Plan
+		assert.Equal(t, model.PlanPending, plan.Status)
+		assert.Equal(t, "hr@example.com", plan.CreatedBy)
+		assert.Equal(t, model.PlanSummary{Add: 1, Update: 1, Move: 1, Deactivate: 1, Unchanged: 1}, plan.Summary)
+
+		actions := []string{}
+		for _, change := range plan.Changes {
+			actions = append(actions, change.Action+" "+change.Identifier)
+		}
+		assert.Equal(t, []string{
+			"update cto@example.com",
+			"add lead@example.com",
+			"move dev@example.com",
+			"deactivate gone@example.com",
+		}, actions)
+		assert.Equal(t, []string{"job_title"}, plan.Changes[0].Fields)
+
+		// Nothing is written until the plan is applied
+		assert.Len(t, mailboxes.mailboxes, 4)
+
+		applied, err := syncService.ApplyPlan(ctx, plan.ID)
+		require.NoError(t, err)
+		assert.Equal(t, model.PlanApplied, applied.Status)
+		assert.NotNil(t, applied.AppliedAt)
+
+		byID := map[string]model.Mailbox{}
+		for _, mailbox := range mailboxes.mailboxes {
+			byID[mailbox.Identifier] = mailbox
+		}
+		assert.Equal(t, "lead@example.com", byID["dev@example.com"].ManagerIdentifier)
+		assert.Equal(t, "CTO, Platform", byID["cto@example.com"].JobTitle)
+		assert.True(t, byID["lead@example.com"].Active)
+		assert.False(t, byID["gone@example.com"].Active)
+
+		_, err = syncService.ApplyPlan(ctx, plan.ID)
+		assert.ErrorIs(t, err, service.ErrPlanNotPending)
+
+		// Syncing the same roster again finds nothing to do
+		result, err = syncService.SyncMailboxesFromCSV(ctx, syncRoster, true, "hr@example.com")
+		require.NoError(t, err)
+		assert.Empty(t, result.Plan.Changes)
+		assert.Equal(t, 4, result.Plan.Summary.Unchanged)
+	})
+
+	t.Run("refuses stale plans", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, syncRoster, false, "hr@example.com")
+		require.NoError(t, err)
+
+		mailboxes.mailboxes[1].JobTitle = "Chief Technology Officer"
+
+		_, err = syncService.ApplyPlan(ctx, result.Plan.ID)
+		assert.ErrorIs(t, err, service.ErrPlanStale)
+		assert.Equal(t, model.PlanPending, plans.plans[result.Plan.ID].Status)
+	})
+
+	t.Run("refuses plans after an unchanged mailbox moved", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, syncRoster, false, "hr@example.com")
+		require.NoError(t, err)
+
+		// The plan leaves the CEO as is; putting it below the developer
+		// would close a cycle once the plan is applied
+		mailboxes.mailboxes[0].ManagerIdentifier = "dev@example.com"
+
+		_, err = syncService.ApplyPlan(ctx, result.Plan.ID)
+		assert.ErrorIs(t, err, service.ErrPlanStale)
+	})
+
+	t.Run("refuses plans after a mailbox was added", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, syncRoster, false, "hr@example.com")
+		require.NoError(t, err)
+
+		mailboxes.mailboxes = append(mailboxes.mailboxes, model.Mailbox{Identifier: "new@example.com", UserFullName: "New", JobTitle: "Rep", DepartmentID: 2, ManagerIdentifier: "gone@example.com", Active: true})
+
+		_, err = syncService.ApplyPlan(ctx, result.Plan.ID)
+		assert.ErrorIs(t, err, service.ErrPlanStale)
+		assert.Equal(t, model.PlanPending, plans.plans[result.Plan.ID].Status)
+	})
+
+	t.Run("dry run does not store the plan", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, syncRoster, true, "hr@example.com")
+		require.NoError(t, err)
+		assert.Empty(t, result.Plan.ID)
+		assert.Empty(t, plans.plans)
+	})
+
+	t.Run("requires every manager in the roster", func(t *testing.T) {
+		mailboxes, departments, plans := syncFixture()
+		syncService := service.NewSyncService(mailboxes, departments, plans)
+
+		roster := "mailbox_identifier,user_full_name,job_title,department_id,manager_mailbox_identifier\n" +
+			"dev@example.com,Dev,Developer,1,cto@example.com\n"
+
+		result, err := syncService.SyncMailboxesFromCSV(ctx, roster, false, "hr@example.com")
+		require.NoError(t, err)
+		require.Len(t, result.Errors, 1)
+		assert.Equal(t, 2, result.Errors[0].Row)
+		assert.Nil(t, result.Plan)
+		assert.Empty(t, plans.plans)
+
+		_, err = syncService.ApplyPlan(ctx, "missing")
+		assert.ErrorIs(t, err, service.ErrPlanNotFound)
+	})
+}
+
+// TestSyncRoutes tests reviewing and applying a plan over HTTP
+func TestSyncRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg, _ := config.Load()
+	keys := jwtkeys.NewHMAC(cfg.Auth.JWTSecret)
+	mailboxes, departments, plans := syncFixture()
+
+	r := router.SetupRouter(cfg, logger.NewLogger(), authz.DefaultPolicy(), keys, router.Services{
+		Mailbox: service.NewMailboxService(mailboxes, departments),
+		Org:     service.NewOrgService(mailboxes),
+		Sync:    service.NewSyncService(mailboxes, departments, plans),
+	})
+
+	token, _ := middleware.GenerateToken(cfg, keys, authz.RoleHR, "")
+	request := func(method string, path string, body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+		if body == nil {
+			body = &bytes.Buffer{}
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.GetEngine().ServeHTTP(w, req)
+		return w
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", "roster.csv")
+	part.Write([]byte(syncRoster))
+	writer.Close()
+
+	w := request("POST", "/api/import/mailboxes/sync", &body, writer.FormDataContentType())
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result model.ImportResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.NotNil(t, result.Plan)
+	id := result.Plan.ID
+
+	w = request("GET", "/api/import/plans/"+id, nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var plan model.ImportPlan
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	assert.Len(t, plan.Changes, 4)
+
+	w = request("GET", "/api/import/plans", nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request("POST", "/api/import/plans/"+id+"/apply", nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request("POST", "/api/import/plans/"+id+"/apply", nil, "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request("GET", "/api/import/plans/unknown", nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}